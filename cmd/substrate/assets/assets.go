@@ -6,10 +6,9 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
-
-	"github.com/SimpleFinance/substrate/cmd/substrate/assets/binaries"
-	"github.com/SimpleFinance/substrate/cmd/substrate/assets/zoneconfig"
 )
 
 // SubstrateAssets represents a temporary on-disk copy of the Substrate assets, including Terraform binaries and configuration.
@@ -17,10 +16,47 @@ type SubstrateAssets struct {
 	tempDir  string
 	sigChan  chan os.Signal
 	doneChan chan bool
+
+	// interruptHooks run (most recently added first) if we're interrupted, before the temp directory is removed
+	interruptHooks []func()
+	hooksLock      sync.Mutex
 }
 
 // ExtractSubstrateAssets extracts all our assets to a temp directory and exposes access to them via helper methods.
 func ExtractSubstrateAssets() (*SubstrateAssets, error) {
+	result, err := NewSubstrateAssets()
+	if err != nil {
+		return nil, err
+	}
+
+	// dump out all the files, cleaning up if we fail part way through
+	err = extractAllAssetsInto(result.tempDir)
+	if err != nil {
+		result.Cleanup()
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ExtractZoneConfig extracts just the zone configuration to a temp directory,
+// without the Terraform binaries (e.g., for tests that run a fake Terraform)
+func ExtractZoneConfig() (*SubstrateAssets, error) {
+	result, err := NewSubstrateAssets()
+	if err != nil {
+		return nil, err
+	}
+	err = extractAssetsInto(result.tempDir, "zone/")
+	if err != nil {
+		result.Cleanup()
+		return nil, err
+	}
+	return result, nil
+}
+
+// NewSubstrateAssets creates an empty temp directory for assets, for callers
+// that fill it in themselves (e.g., tests that don't need the real Terraform)
+func NewSubstrateAssets() (*SubstrateAssets, error) {
 	result := &SubstrateAssets{}
 
 	// create a temporary directory for binaries and config
@@ -37,56 +73,35 @@ func ExtractSubstrateAssets() (*SubstrateAssets, error) {
 	go func() {
 		select {
 		case <-result.sigChan:
+			result.runInterruptHooks()
 			result.Cleanup()
 			os.Exit(1)
 		case <-result.doneChan:
 		}
 	}()
 
-	// dump out all the files, cleaning up if we fail part way through
-	err = extractAllAssetsInto(result.tempDir)
-	if err != nil {
-		result.Cleanup()
-		return nil, err
-	}
-
 	return result, nil
 }
 
-// extractAllAssetsInto reads the uses the code generated by go-bindata to
-// iterate through all the assets and write them into the destination directory
+// extractAllAssetsInto writes all the embedded assets into the destination directory
 func extractAllAssetsInto(destDir string) error {
-	for _, assetName := range binaries.AssetNames() {
-		info, err := binaries.AssetInfo(assetName)
-		if err != nil {
-			return err
-		}
-		outPath := filepath.Join(destDir, "bin", info.Name())
-
-		buf, err := binaries.Asset(assetName)
-		if err != nil {
-			return err
-		}
-
-		err = os.MkdirAll(filepath.Dir(outPath), 0700)
-		if err != nil {
-			return err
-		}
+	return extractAssetsInto(destDir, "")
+}
 
-		err = ioutil.WriteFile(outPath, buf, info.Mode())
-		if err != nil {
-			return err
-		}
+// extractAssetsInto writes the embedded assets whose paths start with prefix
+// into the destination directory
+func extractAssetsInto(destDir string, prefix string) error {
+	embedded, err := embeddedAssets()
+	if err != nil {
+		return err
 	}
-
-	for _, assetName := range zoneconfig.AssetNames() {
-		info, err := zoneconfig.AssetInfo(assetName)
-		if err != nil {
-			return err
+	for _, asset := range embedded {
+		if !strings.HasPrefix(asset.Path, prefix) {
+			continue
 		}
-		outPath := filepath.Join(destDir, info.Name())
+		outPath := filepath.Join(destDir, filepath.FromSlash(asset.Path))
 
-		buf, err := zoneconfig.Asset(assetName)
+		buf, err := asset.load()
 		if err != nil {
 			return err
 		}
@@ -96,7 +111,7 @@ func extractAllAssetsInto(destDir string) error {
 			return err
 		}
 
-		err = ioutil.WriteFile(outPath, buf, info.Mode())
+		err = ioutil.WriteFile(outPath, buf, asset.Info.Mode())
 		if err != nil {
 			return err
 		}
@@ -104,6 +119,23 @@ func extractAllAssetsInto(destDir string) error {
 	return nil
 }
 
+// OnInterrupt registers a function to run if we're interrupted (e.g., by
+// Control-C) before the temporary directory is cleaned up, so that anything
+// important in it can be saved first
+func (a *SubstrateAssets) OnInterrupt(hook func()) {
+	a.hooksLock.Lock()
+	defer a.hooksLock.Unlock()
+	a.interruptHooks = append(a.interruptHooks, hook)
+}
+
+func (a *SubstrateAssets) runInterruptHooks() {
+	a.hooksLock.Lock()
+	defer a.hooksLock.Unlock()
+	for i := len(a.interruptHooks) - 1; i >= 0; i-- {
+		a.interruptHooks[i]()
+	}
+}
+
 // Cleanup cleans up the temporary directory and cancels pending signal handlers
 func (a *SubstrateAssets) Cleanup() {
 	// reset the signal handler so we stop catching signals
@@ -0,0 +1,179 @@
+package assets
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// ListInput contains the input parameters for listing the embedded assets
+type ListInput struct{}
+
+// List prints the path (relative to an extracted copy), size, mode and SHA256
+// of every embedded asset
+func List(params *ListInput) error {
+	embedded, err := embeddedAssets()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "PATH\tSIZE\tMODE\tSHA256\n")
+	for _, asset := range embedded {
+		sum, err := asset.sha256Sum()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", asset.Path, asset.Info.Size(), asset.Info.Mode(), sum)
+	}
+	return w.Flush()
+}
+
+// VerifyInput contains the input parameters for verifying the embedded assets
+type VerifyInput struct {
+	// Keyring is the path to an ASCII armored PGP public keyring containing
+	// the key Substrate releases are signed with
+	Keyring string
+
+	// SkipSignature checks the embedded files against the checksum manifest
+	// without checking who signed it (e.g., for unsigned development builds)
+	SkipSignature bool
+}
+
+// Verify checks the signature on the checksum manifest generated when this
+// binary was built, then checks every embedded asset against it
+func Verify(params *VerifyInput) error {
+	sums, signature, err := embeddedChecksums()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case params.SkipSignature:
+		fmt.Printf("Warning: not checking the signature on the checksum manifest\n")
+	case signature == nil:
+		return fmt.Errorf("the checksum manifest in this build is not signed (is it a development build?), use --skip-signature to check the assets against it anyway")
+	case params.Keyring == "":
+		return fmt.Errorf("--keyring is required to check the signature on the checksum manifest (or use --skip-signature)")
+	default:
+		err = checkChecksumsSignature(sums, signature, params.Keyring)
+		if err != nil {
+			return err
+		}
+	}
+
+	expected, err := parseChecksums(sums)
+	if err != nil {
+		return err
+	}
+	embedded, err := embeddedAssets()
+	if err != nil {
+		return err
+	}
+
+	failures := 0
+	for _, asset := range embedded {
+		sum, err := asset.sha256Sum()
+		if err != nil {
+			return err
+		}
+		expectedSum, listed := expected[asset.Path]
+		delete(expected, asset.Path)
+		switch {
+		case !listed:
+			fmt.Printf("%s: FAILED (not in the checksum manifest)\n", asset.Path)
+			failures++
+		case expectedSum != sum:
+			fmt.Printf("%s: FAILED (SHA256 is %s, expected %s)\n", asset.Path, sum, expectedSum)
+			failures++
+		default:
+			fmt.Printf("%s: OK\n", asset.Path)
+		}
+	}
+	for path := range expected {
+		fmt.Printf("%s: FAILED (missing from this build)\n", path)
+		failures++
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d embedded assets did not match the checksum manifest", failures)
+	}
+	fmt.Printf("all %d embedded assets match the checksum manifest\n", len(embedded))
+	return nil
+}
+
+// checkChecksumsSignature checks the detached signature on the checksum
+// manifest against the keyring and prints who signed it
+func checkChecksumsSignature(sums []byte, signature []byte, keyringPath string) error {
+	keyringFile, err := os.Open(keyringPath)
+	if err != nil {
+		return fmt.Errorf("error reading keyring: %v", err)
+	}
+	defer keyringFile.Close()
+	keyring, err := openpgp.ReadArmoredKeyRing(keyringFile)
+	if err != nil {
+		return fmt.Errorf("error reading keyring %s: %v", keyringPath, err)
+	}
+
+	signer, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(sums), bytes.NewReader(signature))
+	if err != nil {
+		return fmt.Errorf("bad signature on the checksum manifest: %v", err)
+	}
+	for name := range signer.Identities {
+		fmt.Printf("checksum manifest signed by %s (key %X)\n", name, signer.PrimaryKey.Fingerprint)
+		return nil
+	}
+	fmt.Printf("checksum manifest signed by key %X\n", signer.PrimaryKey.Fingerprint)
+	return nil
+}
+
+// ExtractInput contains the input parameters for extracting the embedded assets
+type ExtractInput struct {
+	// Directory to extract into (created if needed, but must be empty)
+	Directory string
+}
+
+// Extract writes the embedded assets (plus the checksum manifest, so it can be
+// checked with `shasum -c`) to a directory, laid out the same way as the
+// workspace Substrate runs Terraform in. The parts of the zone config
+// generated from a zone spec are rendered separately (see zone.ExtractAssets).
+func Extract(params *ExtractInput) error {
+	dir, err := filepath.Abs(params.Directory)
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	err = extractAllAssetsInto(dir)
+	if err != nil {
+		return err
+	}
+
+	sums, signature, err := embeddedChecksums()
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, ChecksumsFile), sums, 0600)
+	}
+	if err == nil && signature != nil {
+		err = ioutil.WriteFile(filepath.Join(dir, ChecksumsSignatureFile), signature, 0600)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: not writing %s: %v\n", ChecksumsFile, err)
+	}
+
+	fmt.Printf("extracted the Substrate assets to %s\n", dir)
+	return nil
+}
@@ -0,0 +1,123 @@
+package assets
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/assets/binaries"
+	"github.com/SimpleFinance/substrate/cmd/substrate/assets/checksums"
+	"github.com/SimpleFinance/substrate/cmd/substrate/assets/zoneconfig"
+)
+
+// names of the build time checksum manifest and its detached signature (both
+// embedded via go-bindata, see the Makefile)
+const (
+	ChecksumsFile          = "SHA256SUMS"
+	ChecksumsSignatureFile = "SHA256SUMS.asc"
+)
+
+// embeddedAsset is a single file from one of the go-bindata bundles
+type embeddedAsset struct {
+	// Path is where the asset is extracted to, relative to the extraction
+	// root (e.g., "bin/terraform" or "zone/main.tf")
+	Path string
+	Info os.FileInfo
+	load func() ([]byte, error)
+}
+
+// embeddedAssets lists every embedded binary and zone config file, sorted by path
+func embeddedAssets() ([]embeddedAsset, error) {
+	result := []embeddedAsset{}
+	for _, assetName := range binaries.AssetNames() {
+		name := assetName
+		info, err := binaries.AssetInfo(name)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, embeddedAsset{
+			Path: "bin/" + info.Name(),
+			Info: info,
+			load: func() ([]byte, error) { return binaries.Asset(name) },
+		})
+	}
+	for _, assetName := range zoneconfig.AssetNames() {
+		name := assetName
+		info, err := zoneconfig.AssetInfo(name)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, embeddedAsset{
+			Path: filepath.ToSlash(filepath.Clean(info.Name())),
+			Info: info,
+			load: func() ([]byte, error) { return zoneconfig.Asset(name) },
+		})
+	}
+	sort.Sort(byPath(result))
+	return result, nil
+}
+
+type byPath []embeddedAsset
+
+func (s byPath) Len() int           { return len(s) }
+func (s byPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+
+// sha256Sum hashes the contents of the asset
+func (a *embeddedAsset) sha256Sum() (string, error) {
+	buf, err := a.load()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// embeddedChecksums returns the checksum manifest generated when this binary
+// was built, and its signature (nil if the build wasn't signed)
+func embeddedChecksums() ([]byte, []byte, error) {
+	sums, err := checksums.Asset(ChecksumsFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("this build of Substrate has no embedded checksum manifest")
+	}
+	signature, err := checksums.Asset(ChecksumsSignatureFile)
+	if err != nil {
+		signature = nil
+	}
+	return sums, signature, nil
+}
+
+// parseChecksums parses a checksum manifest in the format written by
+// `shasum -a 256` into a map from path to hex SHA256
+func parseChecksums(sums []byte) (map[string]string, error) {
+	result := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid line %d in %s: %q", lineNumber, ChecksumsFile, line)
+		}
+
+		// shasum marks files hashed in binary mode with a "*"
+		path := strings.TrimPrefix(strings.TrimLeft(fields[1], " "), "*")
+		path = filepath.ToSlash(filepath.Clean(path))
+		if _, exists := result[path]; exists {
+			return nil, fmt.Errorf("%s lists %s more than once", ChecksumsFile, path)
+		}
+		result[path] = strings.ToLower(fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -6,6 +6,8 @@ import (
 
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 
+	"github.com/SimpleFinance/substrate/cmd/substrate/assets"
+	"github.com/SimpleFinance/substrate/cmd/substrate/runs"
 	"github.com/SimpleFinance/substrate/cmd/substrate/util"
 	"github.com/SimpleFinance/substrate/cmd/substrate/wipe"
 	"github.com/SimpleFinance/substrate/cmd/substrate/zone"
@@ -72,8 +74,163 @@ var (
 
 	createManifestOut = createCommand.Flag(
 		"manifest",
-		"output path for new zone manifest file",
+		"output path (or s3:// URL) for new zone manifest file",
 	).Default(defaultManifest).String()
+
+	createEncrypt = createCommand.Flag(
+		"encrypt",
+		"encrypt the zone manifest (including the Terraform state) at rest",
+	).Bool()
+
+	createManifestKey = createCommand.Flag(
+		"manifest-key",
+		"key used to encrypt the manifest (e.g., \"keyfile:/path/to/key\" or \"passphrase\"). Defaults to $SUBSTRATE_MANIFEST_KEY or ~/.substrate/manifest.key.",
+	).PlaceHolder("KEY").Envar("SUBSTRATE_MANIFEST_KEY").String()
+
+	createOverlay = createCommand.Flag(
+		"overlay",
+		"directory of extra Terraform config (.tf files and modules) to add to the zone, recorded in the manifest",
+	).PlaceHolder("DIR").ExistingDir()
+
+	createSpec = createCommand.Flag(
+		"spec",
+		"YAML zone spec describing the zone's instance types and counts, availability zones and ingress CIDR blocks, recorded in the manifest",
+	).PlaceHolder("FILE").ExistingFile()
+
+	createResume = createCommand.Flag(
+		"resume",
+		"pick up a create that failed part way, reusing the partial manifest or checkpoint it left behind",
+	).Bool()
+
+	createSkipPreflight = createCommand.Flag(
+		"skip-preflight",
+		"don't run the preflight checks (see `substrate zone preflight`) before creating the zone",
+	).Bool()
+
+	createVPCLimit = createCommand.Flag(
+		"vpc-limit",
+		"the account's limit on VPCs per region, if it has been raised from the default of 5",
+	).PlaceHolder("N").Int()
+
+	createSSHPublicKey = createCommand.Flag(
+		"ssh-public-key",
+		"use this SSH public key for the zone's instances instead of generating a key pair for the zone",
+	).PlaceHolder("FILE").ExistingFile()
+
+	createSSHKeyAgent = createCommand.Flag(
+		"ssh-key-agent",
+		"load the zone's generated SSH private key into ssh-agent instead of saving it alongside the manifest",
+	).Bool()
+)
+
+// `substrate zone clone` command and options
+var (
+	cloneCommand = zoneCommand.Command("clone", "create a new zone with the same configuration as an existing one")
+
+	cloneFrom = cloneCommand.Flag(
+		"from",
+		"path (or s3:// URL) to the manifest of the zone to clone",
+	).PlaceHolder("MANIFEST").Required().String()
+
+	cloneZoneIndex = ZoneIndex(cloneCommand.Flag(
+		"zone-index",
+		"numeric index of the new zone within the environment (0-15), must not be in use",
+	).PlaceHolder("M").Required())
+
+	cloneAvailabilityZone = cloneCommand.Flag(
+		"aws-availability-zone",
+		"AWS availability zone in which to create the new zone. Defaults to the cloned zone's.",
+	).PlaceHolder("AZ").String()
+
+	cloneManifestOut = cloneCommand.Flag(
+		"manifest",
+		"output path (or s3:// URL) for new zone manifest file",
+	).Default(defaultManifest).String()
+
+	cloneEncrypt = cloneCommand.Flag(
+		"encrypt",
+		"encrypt the new zone manifest with --manifest-key (an encrypted manifest is otherwise cloned with the key it was read with)",
+	).Bool()
+
+	cloneManifestKey = cloneCommand.Flag(
+		"manifest-key",
+		"key used to encrypt the manifest (e.g., \"keyfile:/path/to/key\" or \"passphrase\"). Defaults to $SUBSTRATE_MANIFEST_KEY or ~/.substrate/manifest.key.",
+	).PlaceHolder("KEY").Envar("SUBSTRATE_MANIFEST_KEY").String()
+
+	cloneResume = cloneCommand.Flag(
+		"resume",
+		"pick up a clone that failed part way (see `zone create --resume`)",
+	).Bool()
+
+	cloneSkipPreflight = cloneCommand.Flag(
+		"skip-preflight",
+		"don't run the preflight checks (see `substrate zone preflight`) before creating the zone",
+	).Bool()
+
+	cloneVPCLimit = cloneCommand.Flag(
+		"vpc-limit",
+		"the account's limit on VPCs per region, if it has been raised from the default of 5",
+	).PlaceHolder("N").Int()
+
+	cloneSSHPublicKey = cloneCommand.Flag(
+		"ssh-public-key",
+		"use this SSH public key for the new zone's instances instead of generating a key pair for the zone",
+	).PlaceHolder("FILE").ExistingFile()
+
+	cloneSSHKeyAgent = cloneCommand.Flag(
+		"ssh-key-agent",
+		"load the new zone's generated SSH private key into ssh-agent instead of saving it alongside the manifest",
+	).Bool()
+)
+
+// `substrate zone preflight` command and options
+var (
+	preflightCommand = zoneCommand.Command("preflight", "check that a zone can be created (credentials, limits, AZ, SSH key and subnet), without changing anything")
+
+	preflightEnvironmentName = EnvironmentName(preflightCommand.Flag(
+		"environment",
+		"Environment name. Defaults to \"$(whoami)-dev\".",
+	).PlaceHolder("ENV").Envar("SUBSTRATE_ENVIRONMENT").Default(defaultEnvironment))
+
+	preflightEnvironmentDomain = EnvironmentDomain(preflightCommand.Flag(
+		"environment-domain",
+		"Environment domain name.",
+	).PlaceHolder("ENV").Envar("SUBSTRATE_ENVIRONMENT_DOMAIN").Required())
+
+	preflightEnvironmentIndex = EnvironmentIndex(preflightCommand.Flag(
+		"environment-index",
+		"Numeric index of the environment (0-127). Defaults to 127.",
+	).PlaceHolder("N").Envar("SUBSTRATE_ENVIRONMENT_INDEX").Default("127"))
+
+	preflightZoneIndex = ZoneIndex(preflightCommand.Flag(
+		"zone-index",
+		"numeric index of zone within the environment (0-15). Defaults to 0.",
+	).PlaceHolder("M").Envar("SUBSTRATE_ZONE_INDEX").Default("0"))
+
+	preflightAvailabilityZone = preflightCommand.Flag(
+		"aws-availability-zone",
+		"AWS availability zone in which to create the zone. Defaults to \"us-west-2a\".",
+	).PlaceHolder("AZ").Default("us-west-2a").String()
+
+	preflightAWSAccountID = preflightCommand.Flag(
+		"aws-account-id",
+		"AWS account ID (e.g., \"123456789012\"). Defaults to $AWS_ACCOUNT_ID.",
+	).PlaceHolder("ID").Envar("AWS_ACCOUNT_ID").Required().String()
+
+	preflightVPCLimit = preflightCommand.Flag(
+		"vpc-limit",
+		"the account's limit on VPCs per region, if it has been raised from the default of 5",
+	).PlaceHolder("N").Int()
+
+	preflightSSHPublicKey = preflightCommand.Flag(
+		"ssh-public-key",
+		"SSH public key the zone would use (see `zone create --ssh-public-key`)",
+	).PlaceHolder("FILE").String()
+
+	preflightSpec = preflightCommand.Flag(
+		"spec",
+		"YAML zone spec the zone would be created with (see `zone create --spec`)",
+	).PlaceHolder("FILE").ExistingFile()
 )
 
 var (
@@ -82,18 +239,299 @@ var (
 		"unsafe",
 		"force an in-place upgrade even when it may not be safe",
 	).Bool()
+	updateOverlay = updateCommand.Flag(
+		"overlay",
+		"switch the zone to a different Terraform overlay directory (see `zone create --overlay`)",
+	).PlaceHolder("DIR").ExistingDir()
+	updateSpec = updateCommand.Flag(
+		"spec",
+		"replace the zone spec with the one in this YAML file (see `zone create --spec`)",
+	).PlaceHolder("FILE").ExistingFile()
 	updateManifestPath = updateCommand.Flag(
 		"manifest",
-		"path to zone manifest (will be overwritten with updated manifest)",
-	).Default(defaultManifest).ExistingFile()
+		"path (or s3:// URL) to zone manifest (will be overwritten with updated manifest)",
+	).Default(defaultManifest).String()
+	updateCheck = updateCommand.Flag(
+		"check",
+		"only explain whether the zone can be upgraded in place to this version, and which upgrade steps would run",
+	).Bool()
+	updateRolling = updateCommand.Flag(
+		"rolling",
+		"replace workers a batch at a time, draining each one first and waiting for its replacement to become a Ready node",
+	).Bool()
+	updateRollingBatchSize = updateCommand.Flag(
+		"rolling-batch-size",
+		"how many workers to replace at a time with --rolling",
+	).PlaceHolder("N").Default("1").Int()
+	updateRollingTimeout = updateCommand.Flag(
+		"rolling-timeout",
+		"how long to wait for each worker to drain, and for its replacement to become Ready, with --rolling",
+	).Default("15m").Duration()
+)
+
+var (
+	planCommand      = zoneCommand.Command("plan", "plan an update to a zone and summarize the changes (exits 0 if there are no changes, 2 if there are changes, 1 on error)")
+	planManifestPath = planCommand.Flag(
+		"manifest",
+		"path (or s3:// URL) to zone manifest",
+	).Default(defaultManifest).String()
+	planOut = planCommand.Flag(
+		"out",
+		"path to write the plan file to (apply it later with `substrate zone apply --plan`)",
+	).PlaceHolder("FILE").Required().String()
+	planJSON = planCommand.Flag(
+		"json",
+		"print the change summary as JSON",
+	).Bool()
+)
+
+// exit codes for `substrate zone plan`, so CI can tell "no changes" from "changes"
+// (kingpin already exits with 1 on errors)
+const (
+	planExitNoChanges = 0
+	planExitChanges   = 2
+)
+
+var (
+	driftCommand      = zoneCommand.Command("drift", "compare a zone's live resources with its manifest (exits 0 if nothing has drifted, 2 if something has, 1 on error)")
+	driftManifestPath = driftCommand.Flag(
+		"manifest",
+		"path (or s3:// URL) to zone manifest (will not be modified)",
+	).Default(defaultManifest).String()
+	driftJSON = driftCommand.Flag(
+		"json",
+		"print the drift report as JSON",
+	).Bool()
+)
+
+// exit codes for `substrate zone drift`, so CI can alert on drift
+const (
+	driftExitNoDrift = 0
+	driftExitDrift   = 2
+)
+
+var (
+	outputsCommand      = zoneCommand.Command("outputs", "print a zone's Terraform outputs (e.g., worker_dns or director_ip)")
+	outputsManifestPath = outputsCommand.Flag(
+		"manifest",
+		"path (or s3:// URL) to zone manifest",
+	).Default(defaultManifest).String()
+	outputsJSON = outputsCommand.Flag(
+		"json",
+		"print the outputs as JSON (in the same format as `terraform output -json`)",
+	).Bool()
+	outputsName = outputsCommand.Arg(
+		"name",
+		"only print this output",
+	).String()
+)
+
+var (
+	dnsCheckCommand      = zoneCommand.Command("dns-check", "check that a zone's subdomain is delegated to the Substrate nameservers by every nameserver of its parent zone (exits 0 if the delegation is consistent, 2 if it isn't, 1 on error)")
+	dnsCheckManifestPath = dnsCheckCommand.Flag(
+		"manifest",
+		"path (or s3:// URL) to the manifest of the zone to check",
+	).Default(defaultManifest).String()
+	dnsCheckEnvironmentDomain = dnsCheckCommand.Flag(
+		"environment-domain",
+		"check a proposed zone in this environment domain instead of an existing zone's manifest",
+	).PlaceHolder("ENV").String()
+	dnsCheckZoneIndex = ZoneIndex(dnsCheckCommand.Flag(
+		"zone-index",
+		"numeric index of the proposed zone within the environment (0-15). Defaults to 0.",
+	).PlaceHolder("M").Default("0"))
+	dnsCheckWait = dnsCheckCommand.Flag(
+		"wait",
+		"keep checking until the delegation is consistent (or --timeout passes)",
+	).Bool()
+	dnsCheckTimeout = dnsCheckCommand.Flag(
+		"timeout",
+		"how long to --wait for",
+	).Default("30m").Duration()
+	dnsCheckResolver = dnsCheckCommand.Flag(
+		"resolver",
+		"IP of the recursive nameserver used to find the parent zone (defaults to the first nameserver in /etc/resolv.conf)",
+	).PlaceHolder("IP").String()
+	dnsCheckJSON = dnsCheckCommand.Flag(
+		"json",
+		"print the report as JSON",
+	).Bool()
+)
+
+// exit codes for `substrate zone dns-check`
+const (
+	dnsCheckExitConsistent   = 0
+	dnsCheckExitInconsistent = 2
+)
+
+var (
+	applyCommand      = zoneCommand.Command("apply", "apply a plan file written by `substrate zone plan`")
+	applyManifestPath = applyCommand.Flag(
+		"manifest",
+		"path (or s3:// URL) to zone manifest (will be overwritten with updated manifest)",
+	).Default(defaultManifest).String()
+	applyPlanPath = applyCommand.Flag(
+		"plan",
+		"path to the plan file to apply",
+	).PlaceHolder("FILE").Required().ExistingFile()
 )
 
 var (
 	destroyCommand      = zoneCommand.Command("destroy", "destroy a zone")
 	destroyManifestPath = destroyCommand.Flag(
 		"manifest",
-		"path to zone manifest (will be deleted when the zone is destroyed)",
-	).Default(defaultManifest).ExistingFile()
+		"path (or s3:// URL) to zone manifest (will be deleted when the zone is destroyed)",
+	).Default(defaultManifest).String()
+)
+
+// `substrate zone replace` command and options
+var (
+	replaceCommand = zoneCommand.Command("replace", "replace a zone with a new one (e.g., for a major upgrade), switching DNS over once it's healthy")
+
+	replaceManifestPath = replaceCommand.Flag(
+		"manifest",
+		"path (or s3:// URL) to the manifest of the zone to replace",
+	).Default(defaultManifest).String()
+
+	replaceNewManifestPath = replaceCommand.Flag(
+		"new-manifest",
+		"output path (or s3:// URL) for the new zone's manifest file (required unless resuming)",
+	).PlaceHolder("MANIFEST").String()
+
+	replaceZoneIndex = replaceCommand.Flag(
+		"zone-index",
+		"numeric index of the new zone within the environment (0-15). Defaults to the first one not in use.",
+	).PlaceHolder("M").Default("-1").Int()
+
+	replaceAvailabilityZone = replaceCommand.Flag(
+		"aws-availability-zone",
+		"AWS availability zone in which to create the new zone. Defaults to the old zone's.",
+	).PlaceHolder("AZ").String()
+
+	replaceActivationName = replaceCommand.Flag(
+		"activation-name",
+		"the CNAME record that sends traffic to the active zone. Defaults to *.<environment domain>.",
+	).PlaceHolder("NAME").String()
+
+	replaceActivationPool = replaceCommand.Flag(
+		"activation-pool",
+		"the worker pool the activation CNAME points at",
+	).PlaceHolder("POOL").Default("worker").String()
+
+	replaceGracePeriod = replaceCommand.Flag(
+		"grace-period",
+		"how long to keep the old zone around after switching DNS to the new one",
+	).Default("24h").Duration()
+
+	replaceHealthTimeout = replaceCommand.Flag(
+		"health-timeout",
+		"how long to wait for the new zone's nodes to become Ready",
+	).Default("30m").Duration()
+
+	replaceResume = replaceCommand.Flag(
+		"resume",
+		"pick up a replacement that stopped part way (or is waiting out the grace period)",
+	).Bool()
+
+	replaceDestroyOldZone = replaceCommand.Flag(
+		"destroy-old-zone",
+		"destroy the old zone once the grace period is over",
+	).Bool()
+
+	replaceEncrypt = replaceCommand.Flag(
+		"encrypt",
+		"encrypt the new zone manifest with --manifest-key (an encrypted manifest is otherwise replaced with one encrypted with the same key)",
+	).Bool()
+
+	replaceManifestKey = replaceCommand.Flag(
+		"manifest-key",
+		"key used to encrypt the manifest (e.g., \"keyfile:/path/to/key\" or \"passphrase\"). Defaults to $SUBSTRATE_MANIFEST_KEY or ~/.substrate/manifest.key.",
+	).PlaceHolder("KEY").Envar("SUBSTRATE_MANIFEST_KEY").String()
+
+	replaceSkipPreflight = replaceCommand.Flag(
+		"skip-preflight",
+		"don't run the preflight checks (see `substrate zone preflight`) before creating the new zone",
+	).Bool()
+
+	replaceVPCLimit = replaceCommand.Flag(
+		"vpc-limit",
+		"the account's limit on VPCs per region, if it has been raised from the default of 5",
+	).PlaceHolder("N").Int()
+
+	replaceSSHKeyAgent = replaceCommand.Flag(
+		"ssh-key-agent",
+		"load the new zone's generated SSH private key into ssh-agent instead of saving it alongside the manifest",
+	).Bool()
+)
+
+var (
+	rotateSSHKeyCommand      = zoneCommand.Command("rotate-ssh-key", "replace a zone's admin SSH key on its key pair and running instances")
+	rotateSSHKeyManifestPath = rotateSSHKeyCommand.Flag(
+		"manifest",
+		"path (or s3:// URL) to zone manifest (will be overwritten with updated manifest)",
+	).Default(defaultManifest).String()
+	rotateSSHKeyPublicKey = rotateSSHKeyCommand.Flag(
+		"ssh-public-key",
+		"switch to this SSH public key instead of generating a new key pair",
+	).PlaceHolder("FILE").ExistingFile()
+	rotateSSHKeyAgent = rotateSSHKeyCommand.Flag(
+		"ssh-key-agent",
+		"load the new generated SSH private key into ssh-agent instead of saving it alongside the manifest",
+	).Bool()
+)
+
+var (
+	migrateManifestCommand = zoneCommand.Command(
+		"migrate-manifest",
+		"upgrade a zone manifest to the current manifest schema version",
+	)
+	migrateManifestPath = migrateManifestCommand.Flag(
+		"manifest",
+		"path (or s3:// URL) to zone manifest (will be rewritten, the original is kept as a backup)",
+	).Default(defaultManifest).String()
+)
+
+var (
+	rekeyCommand      = zoneCommand.Command("rekey", "re-encrypt a zone manifest with a new key")
+	rekeyManifestPath = rekeyCommand.Flag(
+		"manifest",
+		"path (or s3:// URL) to zone manifest",
+	).Default(defaultManifest).String()
+	rekeyNewKey = rekeyCommand.Flag(
+		"new-key",
+		"key to encrypt the manifest with from now on (e.g., \"keyfile:/path/to/new.key\" or \"passphrase\")",
+	).PlaceHolder("KEY").String()
+	rekeyGenerateKey = rekeyCommand.Flag(
+		"generate-key",
+		"generate a new key file (at the --new-key path) before re-encrypting",
+	).Bool()
+	rekeyDecrypt = rekeyCommand.Flag(
+		"decrypt",
+		"store the manifest in plaintext instead of re-encrypting it",
+	).Bool()
+)
+
+var (
+	historyCommand      = zoneCommand.Command("history", "list the recorded snapshots of a zone manifest")
+	historyManifestPath = historyCommand.Flag(
+		"manifest",
+		"path (or s3:// URL) to zone manifest",
+	).Default(defaultManifest).String()
+)
+
+var (
+	rollbackCommand = zoneCommand.Command(
+		"rollback",
+		"restore the Terraform state from a zone manifest snapshot and re-plan against it",
+	)
+	rollbackManifestPath = rollbackCommand.Flag(
+		"manifest",
+		"path (or s3:// URL) to zone manifest (will be overwritten with the restored manifest)",
+	).Default(defaultManifest).String()
+	rollbackTo = rollbackCommand.Flag(
+		"to",
+		"number of the snapshot to restore (see `substrate zone history`)",
+	).PlaceHolder("N").Required().Int()
 )
 
 var (
@@ -111,21 +549,80 @@ var (
 	).PlaceHolder("ENV").Envar("SUBSTRATE_ENVIRONMENT").Default(defaultEnvironment))
 )
 
+var (
+	runsCommand = app.Command("runs", "commands for browsing the transcripts of past create/update/destroy runs")
+
+	runsListCommand = runsCommand.Command("list", "list recorded runs")
+
+	runsShowCommand = runsCommand.Command("show", "show the details of a recorded run")
+	runsShowID      = runsShowCommand.Arg(
+		"id",
+		"ID of the run (see `substrate runs list`)",
+	).Required().String()
+	runsShowJSON = runsShowCommand.Flag(
+		"json",
+		"print the run metadata as JSON",
+	).Bool()
+)
+
+var (
+	assetsCommand = app.Command("assets", "commands for inspecting the Terraform binaries and zone configuration embedded in this build")
+
+	assetsListCommand = assetsCommand.Command("list", "list the embedded assets with their sizes, modes and SHA256 hashes")
+
+	assetsVerifyCommand = assetsCommand.Command("verify", "check the embedded assets against the signed checksum manifest generated when this build was made")
+	assetsVerifyKeyring = assetsVerifyCommand.Flag(
+		"keyring",
+		"ASCII armored PGP public keyring with the key Substrate releases are signed with",
+	).PlaceHolder("FILE").ExistingFile()
+	assetsVerifySkipSignature = assetsVerifyCommand.Flag(
+		"skip-signature",
+		"check the assets against the checksum manifest without checking its signature",
+	).Bool()
+
+	assetsExtractCommand   = assetsCommand.Command("extract", "extract the embedded assets into a Terraform workspace, rendering the zone config generated from a zone spec")
+	assetsExtractDirectory = assetsExtractCommand.Arg(
+		"dir",
+		"directory to extract into (must be empty or not exist yet)",
+	).Required().String()
+	assetsExtractManifestPath = assetsExtractCommand.Flag(
+		"manifest",
+		"path (or s3:// URL) to the zone manifest to render the config for",
+	).String()
+	assetsExtractSpec = assetsExtractCommand.Flag(
+		"spec",
+		"YAML zone spec to render the config from, if there's no --manifest (defaults to the spec of a zone created without one)",
+	).PlaceHolder("FILE").ExistingFile()
+	assetsExtractEnvironmentIndex = EnvironmentIndex(assetsExtractCommand.Flag(
+		"environment-index",
+		"numeric index of the environment to render --spec for (0-127). Defaults to 127.",
+	).PlaceHolder("N").Default("127"))
+	assetsExtractZoneIndex = ZoneIndex(assetsExtractCommand.Flag(
+		"zone-index",
+		"numeric index of the zone to render --spec for (0-15). Defaults to 0.",
+	).PlaceHolder("M").Default("0"))
+	assetsExtractAvailabilityZone = assetsExtractCommand.Flag(
+		"aws-availability-zone",
+		"AWS availability zone of the zone to render --spec for. Defaults to \"us-west-2a\".",
+	).PlaceHolder("AZ").Default("us-west-2a").String()
+)
+
 var (
 	sshCommand      = zoneCommand.Command("ssh", "ssh to an instance in a zone")
 	sshManifestPath = sshCommand.Flag(
 		"manifest",
-		"path to zone manifest",
-	).Default(defaultManifest).ExistingFile()
+		"path (or s3:// URL) to zone manifest",
+	).Default(defaultManifest).String()
 	sshHost = sshCommand.Flag(
 		"host",
-		"hostname or IP to which you'd like to connect",
+		"hostname or IP to which you'd like to connect (a worker pool name, or e.g. \"worker-0\" for one of its instances)",
 	).Default("director").HintOptions(
 		"border",
 		"director",
 		"border-0",
 		"director-0",
 		"worker",
+		"worker-0",
 	).String()
 	sshArgs = sshCommand.Arg(
 		"args",
@@ -153,8 +650,8 @@ var (
 
 	manifestPath = tunnelCommand.Flag(
 		"manifest",
-		"path to zone manifest",
-	).Default(defaultManifest).ExistingFile()
+		"path (or s3:// URL) to zone manifest",
+	).Default(defaultManifest).String()
 
 	jumpHostUser = tunnelCommand.Flag(
 		"jump-host-user",
@@ -166,8 +663,8 @@ var (
 	logsCommand      = zoneCommand.Command("logs", "tail the cluster level logs for a zone")
 	logsManifestPath = logsCommand.Flag(
 		"manifest",
-		"path to zone manifest",
-	).Default(defaultManifest).ExistingFile()
+		"path (or s3:// URL) to zone manifest",
+	).Default(defaultManifest).String()
 )
 
 func main() {
@@ -183,22 +680,141 @@ func main() {
 			AWSAvailabilityZone: *createAvailabilityZone,
 			AWSAccountID:        *createAWSAccountID,
 			OutputManifestPath:  *createManifestOut,
+			Encrypt:             *createEncrypt,
+			ManifestKey:         *createManifestKey,
+			Resume:              *createResume,
+			Overlay:             *createOverlay,
+			Spec:                *createSpec,
+			SkipPreflight:       *createSkipPreflight,
+			VPCLimit:            *createVPCLimit,
+			SSHPublicKey:        *createSSHPublicKey,
+			SSHKeyAgent:         *createSSHKeyAgent,
 		})
 		app.FatalIfError(err, "create")
+	case cloneCommand.FullCommand():
+		err := zone.Clone(&zone.CloneInput{
+			Version:             version,
+			Prompt:              *prompt,
+			SourceManifestPath:  *cloneFrom,
+			OutputManifestPath:  *cloneManifestOut,
+			ZoneIndex:           *cloneZoneIndex,
+			AWSAvailabilityZone: *cloneAvailabilityZone,
+			Encrypt:             *cloneEncrypt,
+			ManifestKey:         *cloneManifestKey,
+			Resume:              *cloneResume,
+			SkipPreflight:       *cloneSkipPreflight,
+			VPCLimit:            *cloneVPCLimit,
+			SSHPublicKey:        *cloneSSHPublicKey,
+			SSHKeyAgent:         *cloneSSHKeyAgent,
+		})
+		app.FatalIfError(err, "clone")
+	case preflightCommand.FullCommand():
+		err := zone.Preflight(&zone.PreflightInput{
+			EnvironmentName:     *preflightEnvironmentName,
+			EnvironmentDomain:   *preflightEnvironmentDomain,
+			EnvironmentIndex:    *preflightEnvironmentIndex,
+			ZoneIndex:           *preflightZoneIndex,
+			AWSAvailabilityZone: *preflightAvailabilityZone,
+			AWSAccountID:        *preflightAWSAccountID,
+			VPCLimit:            *preflightVPCLimit,
+			SSHPublicKey:        *preflightSSHPublicKey,
+			Spec:                *preflightSpec,
+		})
+		app.FatalIfError(err, "preflight")
 	case updateCommand.FullCommand():
 		err := zone.Update(&zone.UpdateInput{
-			Prompt:        *prompt,
-			Version:       version,
-			UnsafeUpgrade: *updateUnsafeUpgrade,
-			ManifestPath:  *updateManifestPath,
+			Prompt:           *prompt,
+			Version:          version,
+			UnsafeUpgrade:    *updateUnsafeUpgrade,
+			Overlay:          *updateOverlay,
+			Spec:             *updateSpec,
+			ManifestPath:     *updateManifestPath,
+			Check:            *updateCheck,
+			Rolling:          *updateRolling,
+			RollingBatchSize: *updateRollingBatchSize,
+			RollingTimeout:   *updateRollingTimeout,
 		})
 		app.FatalIfError(err, "update")
+	case planCommand.FullCommand():
+		summary, err := zone.Plan(&zone.PlanInput{
+			Version:      version,
+			ManifestPath: *planManifestPath,
+			PlanPath:     *planOut,
+			JSON:         *planJSON,
+		})
+		app.FatalIfError(err, "plan")
+		if summary.Changes {
+			os.Exit(planExitChanges)
+		}
+		os.Exit(planExitNoChanges)
+	case driftCommand.FullCommand():
+		report, err := zone.Drift(&zone.DriftInput{
+			ManifestPath: *driftManifestPath,
+			JSON:         *driftJSON,
+		})
+		app.FatalIfError(err, "drift")
+		if report.Drifted {
+			os.Exit(driftExitDrift)
+		}
+		os.Exit(driftExitNoDrift)
+	case outputsCommand.FullCommand():
+		err := zone.Outputs(&zone.OutputsInput{
+			ManifestPath: *outputsManifestPath,
+			Name:         *outputsName,
+			JSON:         *outputsJSON,
+		})
+		app.FatalIfError(err, "outputs")
+	case dnsCheckCommand.FullCommand():
+		report, err := zone.DNSCheck(&zone.DNSCheckInput{
+			ManifestPath:        *dnsCheckManifestPath,
+			EnvironmentDomain:   *dnsCheckEnvironmentDomain,
+			ZoneIndex:           *dnsCheckZoneIndex,
+			Wait:                *dnsCheckWait,
+			Timeout:             *dnsCheckTimeout,
+			JSON:                *dnsCheckJSON,
+			RecursiveNameserver: *dnsCheckResolver,
+		})
+		app.FatalIfError(err, "dns-check")
+		if !report.Consistent {
+			os.Exit(dnsCheckExitInconsistent)
+		}
+		os.Exit(dnsCheckExitConsistent)
+	case applyCommand.FullCommand():
+		err := zone.Apply(&zone.ApplyInput{
+			Version:      version,
+			Prompt:       *prompt,
+			ManifestPath: *applyManifestPath,
+			PlanPath:     *applyPlanPath,
+		})
+		app.FatalIfError(err, "apply")
 	case destroyCommand.FullCommand():
 		err := zone.Destroy(&zone.DestroyInput{
+			Version:      version,
 			Prompt:       *prompt,
 			ManifestPath: *destroyManifestPath,
 		})
 		app.FatalIfError(err, "destroy")
+	case replaceCommand.FullCommand():
+		err := zone.Replace(&zone.ReplaceInput{
+			Version:             version,
+			Prompt:              *prompt,
+			ManifestPath:        *replaceManifestPath,
+			NewManifestPath:     *replaceNewManifestPath,
+			ZoneIndex:           *replaceZoneIndex,
+			AWSAvailabilityZone: *replaceAvailabilityZone,
+			ActivationName:      *replaceActivationName,
+			ActivationPool:      *replaceActivationPool,
+			GracePeriod:         *replaceGracePeriod,
+			HealthTimeout:       *replaceHealthTimeout,
+			Resume:              *replaceResume,
+			DestroyOldZone:      *replaceDestroyOldZone,
+			Encrypt:             *replaceEncrypt,
+			ManifestKey:         *replaceManifestKey,
+			SkipPreflight:       *replaceSkipPreflight,
+			VPCLimit:            *replaceVPCLimit,
+			SSHKeyAgent:         *replaceSSHKeyAgent,
+		})
+		app.FatalIfError(err, "replace")
 	case sshCommand.FullCommand():
 		err := zone.SSH(&zone.SSHInput{
 			ManifestPath: *sshManifestPath,
@@ -206,6 +822,43 @@ func main() {
 			Args:         *sshArgs,
 		})
 		app.FatalIfError(err, "ssh")
+	case rotateSSHKeyCommand.FullCommand():
+		err := zone.RotateSSHKey(&zone.RotateSSHKeyInput{
+			Version:      version,
+			Prompt:       *prompt,
+			ManifestPath: *rotateSSHKeyManifestPath,
+			SSHPublicKey: *rotateSSHKeyPublicKey,
+			SSHKeyAgent:  *rotateSSHKeyAgent,
+		})
+		app.FatalIfError(err, "rotate-ssh-key")
+	case migrateManifestCommand.FullCommand():
+		err := zone.MigrateManifest(&zone.MigrateManifestInput{
+			Prompt:       *prompt,
+			ManifestPath: *migrateManifestPath,
+		})
+		app.FatalIfError(err, "migrate-manifest")
+	case rekeyCommand.FullCommand():
+		err := zone.Rekey(&zone.RekeyInput{
+			Prompt:       *prompt,
+			ManifestPath: *rekeyManifestPath,
+			NewKey:       *rekeyNewKey,
+			GenerateKey:  *rekeyGenerateKey,
+			Decrypt:      *rekeyDecrypt,
+		})
+		app.FatalIfError(err, "rekey")
+	case historyCommand.FullCommand():
+		err := zone.History(&zone.HistoryInput{
+			ManifestPath: *historyManifestPath,
+		})
+		app.FatalIfError(err, "history")
+	case rollbackCommand.FullCommand():
+		err := zone.Rollback(&zone.RollbackInput{
+			Version:      version,
+			Prompt:       *prompt,
+			ManifestPath: *rollbackManifestPath,
+			To:           *rollbackTo,
+		})
+		app.FatalIfError(err, "rollback")
 	case wipeCommand.FullCommand():
 		err := wipe.Wipe(&wipe.Input{
 			Prompt:          *prompt,
@@ -213,6 +866,37 @@ func main() {
 			EnvironmentName: *wipeEnvironmentName,
 		})
 		app.FatalIfError(err, "wipe")
+	case runsListCommand.FullCommand():
+		err := runs.List(&runs.ListInput{
+			Directory: runs.DefaultDirectory,
+		})
+		app.FatalIfError(err, "runs list")
+	case runsShowCommand.FullCommand():
+		err := runs.Show(&runs.ShowInput{
+			Directory: runs.DefaultDirectory,
+			ID:        *runsShowID,
+			JSON:      *runsShowJSON,
+		})
+		app.FatalIfError(err, "runs show")
+	case assetsListCommand.FullCommand():
+		err := assets.List(&assets.ListInput{})
+		app.FatalIfError(err, "assets list")
+	case assetsVerifyCommand.FullCommand():
+		err := assets.Verify(&assets.VerifyInput{
+			Keyring:       *assetsVerifyKeyring,
+			SkipSignature: *assetsVerifySkipSignature,
+		})
+		app.FatalIfError(err, "assets verify")
+	case assetsExtractCommand.FullCommand():
+		err := zone.ExtractAssets(&zone.ExtractAssetsInput{
+			Directory:           *assetsExtractDirectory,
+			ManifestPath:        *assetsExtractManifestPath,
+			Spec:                *assetsExtractSpec,
+			EnvironmentIndex:    *assetsExtractEnvironmentIndex,
+			ZoneIndex:           *assetsExtractZoneIndex,
+			AWSAvailabilityZone: *assetsExtractAvailabilityZone,
+		})
+		app.FatalIfError(err, "assets extract")
 	case tunnelCommand.FullCommand():
 		err := zone.MakeTunnel(&zone.TunnelInput{
 			Rip:          *rip,
@@ -0,0 +1,111 @@
+package runs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// ListInput contains the input parameters for listing runs
+type ListInput struct {
+	Directory string
+}
+
+// List prints a table of every recorded run, oldest first
+func List(params *ListInput) error {
+	runs, err := ListRuns(params.Directory)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		fmt.Printf("no runs recorded in %s\n", params.Directory)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tSTARTED\tZONE\tCOMMAND\tOPERATOR\tDURATION\tSTATUS\n")
+	for _, run := range runs {
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			run.ID,
+			run.Started.Local().Format(time.RFC3339),
+			run.ZoneName,
+			run.Command,
+			run.Operator,
+			run.Duration()/time.Second*time.Second,
+			run.Status())
+	}
+	return w.Flush()
+}
+
+// ShowInput contains the input parameters for showing a run
+type ShowInput struct {
+	Directory string
+	ID        string
+
+	// JSON prints the raw run metadata
+	JSON bool
+}
+
+// Show prints the details of a run: who ran it, how long each phase took,
+// and where to find its output, plans and state
+func Show(params *ShowInput) error {
+	run, err := ReadRun(params.Directory, params.ID)
+	if err != nil {
+		return err
+	}
+
+	if params.JSON {
+		runJSON, err := json.MarshalIndent(run, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(runJSON))
+		return nil
+	}
+
+	fmt.Printf("run:       %s\n", run.ID)
+	fmt.Printf("command:   substrate zone %s\n", run.Command)
+	fmt.Printf("zone:      %s (%s)\n", run.ZoneName, run.ManifestPath)
+	fmt.Printf("version:   Substrate %s\n", run.SubstrateVersion)
+	fmt.Printf("operator:  %s@%s\n", run.Operator, run.Hostname)
+	fmt.Printf("started:   %s\n", run.Started.Local().Format(time.RFC3339))
+	fmt.Printf("duration:  %s\n", run.Duration()/time.Second*time.Second)
+	fmt.Printf("status:    %s\n", run.Status())
+	if run.Error != "" {
+		fmt.Printf("error:     %s\n", run.Error)
+	}
+
+	fmt.Printf("\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "PHASE\tSTARTED\tDURATION\tEXIT\n")
+	for _, phase := range run.Phases {
+		fmt.Fprintf(
+			w,
+			"terraform %s\t%s\t%s\t%d\n",
+			phase.Name,
+			phase.Started.Local().Format("15:04:05"),
+			phase.Duration()/time.Second*time.Second,
+			phase.ExitStatus)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	runDirectory := filepath.Join(params.Directory, run.ID)
+	files, err := ioutil.ReadDir(runDirectory)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nfiles in %s:\n", runDirectory)
+	for _, file := range files {
+		fmt.Printf("  %-20s %d bytes\n", file.Name(), file.Size())
+	}
+	return nil
+}
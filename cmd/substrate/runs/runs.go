@@ -0,0 +1,251 @@
+package runs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/util"
+)
+
+// DefaultDirectory is where the transcripts of Substrate runs are kept
+var DefaultDirectory = os.ExpandEnv("$HOME/.substrate/runs")
+
+// names of the files in each run directory
+const (
+	MetadataFile = "run.json"
+	StdoutFile   = "stdout.log"
+	StderrFile   = "stderr.log"
+)
+
+// Phase is a single step of a run, e.g. `terraform plan`
+type Phase struct {
+	Name       string    `json:"name"`
+	Args       []string  `json:"args,omitempty"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	ExitStatus int       `json:"exit_status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Duration is how long the phase took
+func (p *Phase) Duration() time.Duration {
+	return p.Finished.Sub(p.Started)
+}
+
+// Metadata describes a run. It's saved as run.json in the run directory and
+// rewritten after every phase, so a run that never finished still has a
+// record of how far it got.
+type Metadata struct {
+	ID               string    `json:"id"`
+	Command          string    `json:"command"`
+	ZoneName         string    `json:"zone_name"`
+	ManifestPath     string    `json:"manifest_path"`
+	SubstrateVersion string    `json:"substrate_version"`
+	Operator         string    `json:"operator"`
+	Hostname         string    `json:"hostname"`
+	Started          time.Time `json:"started"`
+	Finished         time.Time `json:"finished,omitempty"`
+
+	// ExitStatus is 0 if the run succeeded, or else the exit status of the
+	// phase that failed (1 if the run failed outside of any phase)
+	ExitStatus int     `json:"exit_status"`
+	Error      string  `json:"error,omitempty"`
+	Phases     []Phase `json:"phases"`
+}
+
+// IsFinished returns whether the run got as far as recording its result
+func (m *Metadata) IsFinished() bool {
+	return !m.Finished.IsZero()
+}
+
+// Status summarizes the result of the run
+func (m *Metadata) Status() string {
+	switch {
+	case !m.IsFinished():
+		return "unfinished"
+	case m.Error != "":
+		return fmt.Sprintf("failed (exit %d)", m.ExitStatus)
+	default:
+		return "ok"
+	}
+}
+
+// Duration is how long the run took (so far, if it never finished)
+func (m *Metadata) Duration() time.Duration {
+	if !m.IsFinished() {
+		if len(m.Phases) == 0 {
+			return 0
+		}
+		return m.Phases[len(m.Phases)-1].Finished.Sub(m.Started)
+	}
+	return m.Finished.Sub(m.Started)
+}
+
+// Run is an in-progress run transcript
+type Run struct {
+	Metadata
+	directory string
+	lock      sync.Mutex
+}
+
+// Start creates a new run directory under directory (normally DefaultDirectory)
+func Start(directory string, command string, zoneName string, manifestPath string, version string) (*Run, error) {
+	started := time.Now().UTC()
+	hostname, _ := os.Hostname()
+
+	// e.g. "20170102T150405Z-zone00-example-com-update"
+	id := fmt.Sprintf(
+		"%s-%s-%s",
+		started.Format("20060102T150405Z"),
+		strings.Replace(zoneName, ".", "-", -1),
+		strings.Fields(command)[0])
+
+	r := &Run{
+		Metadata: Metadata{
+			ID:               id,
+			Command:          command,
+			ZoneName:         zoneName,
+			ManifestPath:     manifestPath,
+			SubstrateVersion: version,
+			Operator:         util.CurrentUser(),
+			Hostname:         hostname,
+			Started:          started,
+			Phases:           []Phase{},
+		},
+		directory: filepath.Join(directory, id),
+	}
+
+	// transcripts hold Terraform state, so keep them private
+	err := os.MkdirAll(r.directory, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating run directory: %v", err)
+	}
+	err = r.writeMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Path returns the path to a file in the run directory
+func (r *Run) Path(name string) string {
+	return filepath.Join(r.directory, name)
+}
+
+// WriteFile saves a file in the run directory
+func (r *Run) WriteFile(name string, data []byte) error {
+	return ioutil.WriteFile(r.Path(name), data, 0600)
+}
+
+// appendFile appends to a file in the run directory
+func (r *Run) appendFile(name string, data []byte) error {
+	f, err := os.OpenFile(r.Path(name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// RecordPhase saves the output and timing of a finished phase
+func (r *Run) RecordPhase(phase Phase, stdout []byte, stderr []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.appendFile(StdoutFile, stdout)
+	if err != nil {
+		return err
+	}
+	err = r.appendFile(StderrFile, stderr)
+	if err != nil {
+		return err
+	}
+	r.Phases = append(r.Phases, phase)
+	return r.writeMetadata()
+}
+
+// Finish records the result of the run
+func (r *Run) Finish(runErr error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.Finished = time.Now().UTC()
+	r.ExitStatus = 0
+	r.Error = ""
+	if runErr != nil {
+		r.Error = runErr.Error()
+		r.ExitStatus = 1
+		for _, phase := range r.Phases {
+			if phase.ExitStatus > 0 {
+				r.ExitStatus = phase.ExitStatus
+			}
+		}
+	}
+	return r.writeMetadata()
+}
+
+func (r *Run) writeMetadata() error {
+	metadataJSON, err := json.MarshalIndent(&r.Metadata, "", "    ")
+	if err != nil {
+		return err
+	}
+	return r.WriteFile(MetadataFile, metadataJSON)
+}
+
+// ReadRun reads the metadata of a run
+func ReadRun(directory string, id string) (*Metadata, error) {
+	metadataJSON, err := ioutil.ReadFile(filepath.Join(directory, id, MetadataFile))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no run %q in %s", id, directory)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var metadata Metadata
+	err = json.Unmarshal(metadataJSON, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing run %q: %v", id, err)
+	}
+	return &metadata, nil
+}
+
+// ListRuns reads the metadata of every run, oldest first
+func ListRuns(directory string) ([]*Metadata, error) {
+	entries, err := ioutil.ReadDir(directory)
+	if os.IsNotExist(err) {
+		return []*Metadata{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := []*Metadata{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		metadata, err := ReadRun(directory, entry.Name())
+		if err != nil {
+			// skip anything that isn't a run
+			continue
+		}
+		result = append(result, metadata)
+	}
+	sort.Sort(byStarted(result))
+	return result, nil
+}
+
+type byStarted []*Metadata
+
+func (s byStarted) Len() int           { return len(s) }
+func (s byStarted) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStarted) Less(i, j int) bool { return s[i].Started.Before(s[j].Started) }
@@ -3,7 +3,9 @@ package util
 import (
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -59,3 +61,96 @@ func FindFirstSuffixWithWorkingDNS(domain string) (string, []string, error) {
 	}
 	return "", []string{}, fmt.Errorf("no suffix of %q found w/working DNS", domain)
 }
+
+// WaitForNS polls `server` until the NS records for `target` are exactly `expected`, or until the timeout passes.
+func WaitForNS(target string, server string, expected []string, timeout time.Duration) error {
+	want := normalizeNameservers(expected)
+	deadline := time.Now().Add(timeout)
+	for {
+		actual, err := LookupNSUsingServer(target, server)
+		if err == nil && StringSlicesEqual(want, normalizeNameservers(actual)) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("timed out after %v waiting for %s to delegate %s: %v", timeout, server, target, err)
+			}
+			return fmt.Errorf(
+				"timed out after %v waiting for %s to delegate %s (it returned [%s])",
+				timeout,
+				server,
+				target,
+				strings.Join(actual, ", "))
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// normalizeNameservers lower cases and sorts nameserver names, stripping trailing dots, so they can be compared
+func normalizeNameservers(nameservers []string) []string {
+	result := make([]string, len(nameservers))
+	for i, ns := range nameservers {
+		result[i] = strings.ToLower(strings.TrimSuffix(ns, "."))
+	}
+	sort.Strings(result)
+	return result
+}
+
+// SameNameservers tests whether two lists of nameservers have the same names, ignoring order, case and trailing dots
+func SameNameservers(a []string, b []string) bool {
+	return StringSlicesEqual(normalizeNameservers(a), normalizeNameservers(b))
+}
+
+// DNSResolver sends single DNS queries to a nameserver. It's an interface so
+// DNS checks can be pointed at a local DNS server for testing.
+type DNSResolver interface {
+	// Query asks the nameserver at IP address `server` for the `qtype`
+	// records of `name`, asking it to recurse if `recursive` is set
+	Query(server string, name string, qtype uint16, recursive bool) (*dns.Msg, error)
+}
+
+// DNSClientResolver is a DNSResolver that sends real DNS queries (over UDP,
+// retrying over TCP if the reply is truncated)
+type DNSClientResolver struct {
+	// Port is the port nameservers listen on (defaults to 53)
+	Port string
+
+	// Timeout for each query (defaults to the miekg/dns default)
+	Timeout time.Duration
+}
+
+// Query implements DNSResolver
+func (r *DNSClientResolver) Query(server string, name string, qtype uint16, recursive bool) (*dns.Msg, error) {
+	port := r.Port
+	if port == "" {
+		port = "53"
+	}
+	address := net.JoinHostPort(server, port)
+
+	message := dns.Msg{}
+	message.SetQuestion(dns.Fqdn(name), qtype)
+	message.RecursionDesired = recursive
+
+	client := dns.Client{Timeout: r.Timeout}
+	reply, _, err := client.Exchange(&message, address)
+	if err == nil && reply.Truncated {
+		client.Net = "tcp"
+		reply, _, err = client.Exchange(&message, address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying %s for %s %s: %v", address, name, dns.TypeToString[qtype], err)
+	}
+	return reply, nil
+}
+
+// DefaultRecursiveNameserver returns the first nameserver from /etc/resolv.conf
+func DefaultRecursiveNameserver() (string, error) {
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("error reading /etc/resolv.conf: %v", err)
+	}
+	if len(config.Servers) == 0 {
+		return "", fmt.Errorf("no nameservers in /etc/resolv.conf")
+	}
+	return config.Servers[0], nil
+}
@@ -3,6 +3,7 @@ package util
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/route53"
@@ -23,11 +24,37 @@ func convertToSortedStringArray(input []*string) []string {
 func GetOrCreateSubstrateReusableDelegationSet(svc *route53.Route53) ([]string, string, error) {
 
 	// first, we look for an existing Delegation Set that matches our name, returning the nameservers if we find it
+	nsArray, dsID, found, err := FindSubstrateReusableDelegationSet(svc)
+	if err != nil || found {
+		return nsArray, dsID, err
+	}
+
+	// if we didn't find it, we'll make one
+
+	// generate a random caller reference that starts with our chosen prefix
+	callerReference := SubstrateDelegationSetNamePrefix + RandomHex(8)
+
+	// create the new delegation set
+	resp, err := svc.CreateReusableDelegationSet(&route53.CreateReusableDelegationSetInput{
+		CallerReference: aws.String(callerReference),
+	})
+	if err != nil {
+		return []string{}, "", fmt.Errorf("error creating a Route53 Reusable Delegation Set: %v", err)
+	}
+
+	// return the nameserver entries and ID of the new delegation set
+	nsArray = convertToSortedStringArray(resp.DelegationSet.NameServers)
+	dsID = strings.TrimPrefix(*resp.DelegationSet.Id, "/delegationset/")
+	return nsArray, dsID, nil
+}
+
+// FindSubstrateReusableDelegationSet looks up the Route53 Reusable Delegation Set called "substrate" without creating it. Returns its nameserver names, its ID, a boolean indicating whether one was found, or an error if something bad happens.
+func FindSubstrateReusableDelegationSet(svc *route53.Route53) ([]string, string, bool, error) {
 	var params route53.ListReusableDelegationSetsInput
 	for {
 		resp, err := svc.ListReusableDelegationSets(&params)
 		if err != nil {
-			return []string{}, "", fmt.Errorf("error looking for the right Route53 Reusable Delegation Set: %v", err)
+			return []string{}, "", false, fmt.Errorf("error looking for the right Route53 Reusable Delegation Set: %v", err)
 		}
 
 		// if one of the Delegation Sets in this page matches our name, return its nameservers
@@ -35,36 +62,29 @@ func GetOrCreateSubstrateReusableDelegationSet(svc *route53.Route53) ([]string,
 			if strings.HasPrefix(*ds.CallerReference, SubstrateDelegationSetNamePrefix) {
 				nsArray := convertToSortedStringArray(ds.NameServers)
 				dsID := strings.TrimPrefix(*ds.Id, "/delegationset/")
-				return nsArray, dsID, nil
+				return nsArray, dsID, true, nil
 			}
 		}
 
 		// if there are no more pages, we haven't found what we're looking for
 		if !*resp.IsTruncated {
-			break
+			return []string{}, "", false, nil
 		}
 
 		// otherwise move on to the next page
 		params.Marker = resp.NextMarker
 	}
+}
 
-	// if we didn't find it, we'll make one
-
-	// generate a random caller reference that starts with our chosen prefix
-	callerReference := SubstrateDelegationSetNamePrefix + RandomHex(8)
-
-	// create the new delegation set
-	resp, err := svc.CreateReusableDelegationSet(&route53.CreateReusableDelegationSetInput{
-		CallerReference: aws.String(callerReference),
+// GetReusableDelegationSet looks up the nameserver names for an existing Route53 Reusable Delegation Set by ID.
+func GetReusableDelegationSet(svc *route53.Route53, delegationSetID string) ([]string, error) {
+	resp, err := svc.GetReusableDelegationSet(&route53.GetReusableDelegationSetInput{
+		Id: aws.String(delegationSetID),
 	})
 	if err != nil {
-		return []string{}, "", fmt.Errorf("error creating a Route53 Reusable Delegation Set: %v", err)
+		return []string{}, fmt.Errorf("error looking up Route53 Reusable Delegation Set %s: %v", delegationSetID, err)
 	}
-
-	// return the nameserver entries and ID of the new delegation set
-	nsArray := convertToSortedStringArray(resp.DelegationSet.NameServers)
-	dsID := strings.TrimPrefix(*resp.DelegationSet.Id, "/delegationset/")
-	return nsArray, dsID, nil
+	return convertToSortedStringArray(resp.DelegationSet.NameServers), nil
 }
 
 // FindHostedZoneID finds the Route53 Hosted Zone ID for any zone hosting the specified domain. Returns the Hosted Zone ID, a boolean indicating whether one was found, or an error if something bad happens.
@@ -86,3 +106,169 @@ func FindHostedZoneID(svc *route53.Route53, domain string) (string, bool, error)
 
 	return "", false, nil
 }
+
+// GetHostedZoneNameservers looks up the nameservers Route53 serves a Hosted Zone from.
+func GetHostedZoneNameservers(svc *route53.Route53, hostedZoneID string) ([]string, error) {
+	resp, err := svc.GetHostedZone(&route53.GetHostedZoneInput{
+		Id: aws.String(hostedZoneID),
+	})
+	if err != nil {
+		return []string{}, fmt.Errorf("error looking up Route53 Hosted Zone %s: %v", hostedZoneID, err)
+	}
+	if resp.DelegationSet == nil {
+		return []string{}, nil
+	}
+	return convertToSortedStringArray(resp.DelegationSet.NameServers), nil
+}
+
+// UpsertNSRecords creates (or replaces) the NS record set for `name` in a Hosted Zone, pointing it at `nameservers`. It returns the ID of the Route53 change.
+func UpsertNSRecords(svc *route53.Route53, hostedZoneID string, name string, nameservers []string, ttl int64) (string, error) {
+	records := []*route53.ResourceRecord{}
+	for _, ns := range nameservers {
+		records = append(records, &route53.ResourceRecord{Value: aws.String(ns)})
+	}
+	resp, err := svc.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(hostedZoneID),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String(fmt.Sprintf("Substrate delegation for %s", name)),
+			Changes: []*route53.Change{
+				{
+					Action: aws.String("UPSERT"),
+					ResourceRecordSet: &route53.ResourceRecordSet{
+						Name:            aws.String(name),
+						Type:            aws.String("NS"),
+						TTL:             aws.Int64(ttl),
+						ResourceRecords: records,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating NS records for %s in Route53 Hosted Zone %s: %v", name, hostedZoneID, err)
+	}
+	return *resp.ChangeInfo.Id, nil
+}
+
+// GetNSRecords looks up the NS record set for `name` in a Hosted Zone. Returns the nameservers, a boolean indicating whether the record set exists, or an error if something bad happens.
+func GetNSRecords(svc *route53.Route53, hostedZoneID string, name string) ([]string, bool, error) {
+	recordSet, err := findNSRecordSet(svc, hostedZoneID, name)
+	if err != nil || recordSet == nil {
+		return []string{}, false, err
+	}
+	nameservers := []string{}
+	for _, record := range recordSet.ResourceRecords {
+		nameservers = append(nameservers, strings.TrimSuffix(*record.Value, "."))
+	}
+	return nameservers, true, nil
+}
+
+// DeleteNSRecords deletes the NS record set for `name` from a Hosted Zone. It returns the ID of the Route53 change, or "" if there was no record set to delete.
+func DeleteNSRecords(svc *route53.Route53, hostedZoneID string, name string) (string, error) {
+	recordSet, err := findNSRecordSet(svc, hostedZoneID, name)
+	if err != nil || recordSet == nil {
+		return "", err
+	}
+
+	// Route53 only deletes a record set that exactly matches the existing one
+	resp, err := svc.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(hostedZoneID),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String(fmt.Sprintf("remove Substrate delegation for %s", name)),
+			Changes: []*route53.Change{
+				{
+					Action:            aws.String("DELETE"),
+					ResourceRecordSet: recordSet,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error deleting NS records for %s from Route53 Hosted Zone %s: %v", name, hostedZoneID, err)
+	}
+	return *resp.ChangeInfo.Id, nil
+}
+
+// findNSRecordSet returns the NS record set for `name` in a Hosted Zone, or nil if there isn't one.
+func findNSRecordSet(svc *route53.Route53, hostedZoneID string, name string) (*route53.ResourceRecordSet, error) {
+	return findRecordSet(svc, hostedZoneID, name, "NS")
+}
+
+// findRecordSet returns the record set of a type for `name` in a Hosted Zone, or nil if there isn't one.
+func findRecordSet(svc *route53.Route53, hostedZoneID string, name string, recordType string) (*route53.ResourceRecordSet, error) {
+	resp, err := svc.ListResourceRecordSets(&route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(hostedZoneID),
+		StartRecordName: aws.String(name),
+		StartRecordType: aws.String(recordType),
+		MaxItems:        aws.String("1"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error looking up %s records for %s in Route53 Hosted Zone %s: %v", recordType, name, hostedZoneID, err)
+	}
+	for _, recordSet := range resp.ResourceRecordSets {
+		if normalizeRecordName(*recordSet.Name) == normalizeRecordName(name) && *recordSet.Type == recordType {
+			return recordSet, nil
+		}
+	}
+	return nil, nil
+}
+
+// normalizeRecordName strips the trailing dot from a record name, and turns
+// the escaped "*" Route53 returns for wildcard records back into a "*"
+func normalizeRecordName(name string) string {
+	return strings.Replace(strings.TrimSuffix(name, "."), "\\052", "*", -1)
+}
+
+// UpsertCNAMERecord creates (or replaces) the CNAME record for `name` in a Hosted Zone, pointing it at `target`. It returns the ID of the Route53 change.
+func UpsertCNAMERecord(svc *route53.Route53, hostedZoneID string, name string, target string, ttl int64) (string, error) {
+	resp, err := svc.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(hostedZoneID),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String(fmt.Sprintf("Substrate activation of %s", target)),
+			Changes: []*route53.Change{
+				{
+					Action: aws.String("UPSERT"),
+					ResourceRecordSet: &route53.ResourceRecordSet{
+						Name:            aws.String(name),
+						Type:            aws.String("CNAME"),
+						TTL:             aws.Int64(ttl),
+						ResourceRecords: []*route53.ResourceRecord{{Value: aws.String(target)}},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating CNAME record for %s in Route53 Hosted Zone %s: %v", name, hostedZoneID, err)
+	}
+	return *resp.ChangeInfo.Id, nil
+}
+
+// GetCNAMERecord looks up the CNAME record for `name` in a Hosted Zone. Returns its target, a boolean indicating whether the record exists, or an error if something bad happens.
+func GetCNAMERecord(svc *route53.Route53, hostedZoneID string, name string) (string, bool, error) {
+	recordSet, err := findRecordSet(svc, hostedZoneID, name, "CNAME")
+	if err != nil || recordSet == nil || len(recordSet.ResourceRecords) == 0 {
+		return "", false, err
+	}
+	return strings.TrimSuffix(*recordSet.ResourceRecords[0].Value, "."), true, nil
+}
+
+// WaitForChangeInsync polls a Route53 change until it has propagated to all the Route53 nameservers (its status is INSYNC), or until the timeout passes.
+func WaitForChangeInsync(svc *route53.Route53, changeID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := svc.GetChange(&route53.GetChangeInput{
+			Id: aws.String(changeID),
+		})
+		if err != nil {
+			return fmt.Errorf("error checking on Route53 change %s: %v", changeID, err)
+		}
+		if *resp.ChangeInfo.Status == "INSYNC" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for Route53 change %s to be INSYNC (still %s)", timeout, changeID, *resp.ChangeInfo.Status)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,188 @@
+package zone
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/logwatcher"
+	"github.com/SimpleFinance/substrate/cmd/substrate/util"
+)
+
+// ApplyInput contains the input parameters for applying a previously generated plan to a zone
+type ApplyInput struct {
+	Version      string
+	Prompt       bool
+	ManifestPath string
+	PlanPath     string
+}
+
+// startProvisioningLogs tails the zone system logs in the background,
+// printing the AMI provisioning events. Call the returned function to stop.
+// Tests can replace it to run without CloudWatch Logs.
+var startProvisioningLogs = func(zoneManifest *SubstrateZoneManifest) func() {
+	log := logwatcher.Start(
+		cloudwatchlogs.New(
+			session.New(),
+			&aws.Config{Region: aws.String(zoneManifest.AWSRegion())}),
+		zoneManifest.CloudWatchLogsGroupSystemLogs(),
+	)
+	go func() {
+		for event := range log.Events() {
+			// only output our AMI provisioning events at INFO or higher
+			if event.Record.Syslog.Identifier == "substrate-base-ami-provision" {
+				if event.Record.Priority != "DEBUG" {
+					fmt.Printf("base-ami-provision > %s\n", event.Record.Message)
+				}
+			}
+		}
+	}()
+	return func() {
+		err := log.Stop()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error watching logs: %v\n", err)
+		}
+	}
+}
+
+// Apply applies a plan file written by `substrate zone plan`, refusing if the
+// zone has changed since the plan was generated
+func Apply(params *ApplyInput) (err error) {
+	planFile, err := ReadPlanFile(params.PlanPath)
+	if err != nil {
+		return err
+	}
+
+	store, err := OpenManifestStore(params.ManifestPath)
+	if err != nil {
+		return err
+	}
+
+	// make sure nobody else is modifying the zone at the same time
+	err = store.Lock()
+	if err != nil {
+		return err
+	}
+	defer store.Unlock()
+
+	zoneManifest, err := ReadManifestFrom(store)
+	if err != nil {
+		return err
+	}
+
+	// pick up any state saved by a previous run that got interrupted
+	err = recoverManifestCheckpoint(store, zoneManifest, params.Version)
+	if err != nil {
+		return err
+	}
+
+	err = planFile.Verify(zoneManifest, params.Version)
+	if err != nil {
+		return fmt.Errorf("refusing to apply plan %q: %v", params.PlanPath, err)
+	}
+	err = checkNoUpgradeSteps(zoneManifest, params.Version, "apply")
+	if err != nil {
+		return fmt.Errorf("refusing to apply plan %q: %v", params.PlanPath, err)
+	}
+
+	fmt.Printf(
+		"applying plan %q for zone %s (generated by %s at %s)\n",
+		params.PlanPath,
+		planFile.ZoneName,
+		planFile.Operator,
+		planFile.Created.Local())
+	if planFile.Summary != nil {
+		planFile.Summary.Print(os.Stdout)
+	}
+
+	if params.Prompt {
+		err = util.Confirm("do you want to continue and apply this plan?")
+		if err != nil {
+			return err
+		}
+	}
+
+	workspace, err := newTerraformWorkspace(zoneManifest, os.Stdout)
+	if err != nil {
+		return err
+	}
+	defer workspace.Cleanup()
+
+	// release the lock even if we're interrupted
+	workspace.assets.OnInterrupt(func() { store.Unlock() })
+
+	// keep a transcript of everything Terraform does, for debugging later
+	transcript := workspace.startTranscript(zoneManifest, params.ManifestPath, params.Version, "apply --plan")
+	defer func() { transcript.Finish(err) }()
+
+	err = ioutil.WriteFile(workspace.PlanPath, planFile.TerraformPlan, 0600)
+	if err != nil {
+		return err
+	}
+
+	// run `terraform get` to install all our modules
+	_, err = workspace.Runner.Get()
+	if err != nil {
+		return err
+	}
+
+	stopLogs := startProvisioningLogs(zoneManifest)
+	defer stopLogs()
+
+	// save the .tfstate as Terraform goes, so an interrupted run doesn't orphan anything
+	checkpoints := startStateCheckpoints(store, zoneManifest, workspace.assets, workspace.StatePath, params.Version, "apply --plan")
+
+	_, terraformApplyErr := workspace.Runner.Apply(workspace.TerraformPaths, 0)
+	err = checkpoints.Stop()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error saving Terraform state checkpoint: %v\n", err)
+	}
+
+	// keep going and save the .tfstate even if `terraform apply` failed, so we don't orphan anything
+	// if anything goes wrong past this point, bail out with a prompt to the user but don't clean up the
+	// temp directory yet
+	bail := func(err error, msg string) error {
+		if params.Prompt {
+			fmt.Printf("%s: %v\n\nTemporary directory (may hold clues): %s\n", msg, err, workspace.Path(""))
+			util.Confirm("I'll leave the temp directory around so you can clean up. Ready to delete it?")
+		}
+		return err
+	}
+
+	err = workspace.ReadState(zoneManifest)
+	if err != nil {
+		return bail(err, "error reading .tfstate")
+	}
+
+	// the zone is only on this version once the plan has been applied
+	if terraformApplyErr == nil {
+		zoneManifest.Version = params.Version
+	}
+
+	err = backupManifest(store)
+	if err != nil {
+		return bail(err, "saving backup zone manifest")
+	}
+
+	err = WriteManifestTo(store, zoneManifest)
+	if err != nil {
+		return bail(err, "saving updated zone manifest")
+	}
+
+	err = recordManifestSnapshot(store, zoneManifest, params.Version, "apply --plan", terraformApplyErr)
+	if err != nil {
+		return bail(err, "saving manifest snapshot")
+	}
+
+	// the state is safely in the manifest now, so we don't need the checkpoint
+	err = checkpoints.Clear()
+	if err != nil {
+		return bail(err, "removing Terraform state checkpoint")
+	}
+
+	return terraformApplyErr
+}
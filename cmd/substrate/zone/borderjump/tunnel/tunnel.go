@@ -21,14 +21,20 @@ type Tunnel struct {
 	control   *chan int
 }
 
-// New initializes an ssh tunnel
-func New(user string, jhost *host.Host, lhost *host.Host, rhost *host.Host) *Tunnel {
+// New initializes an ssh tunnel, authenticating with the given keys (if any)
+// before falling back to ssh-agent
+func New(user string, jhost *host.Host, lhost *host.Host, rhost *host.Host, signers ...ssh.Signer) *Tunnel {
 	log.Printf("%s@%s -> %s@%s", user, jhost, user, rhost)
+	auth := []ssh.AuthMethod{}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if sshAgent := SSHAgent(); sshAgent != nil {
+		auth = append(auth, sshAgent)
+	}
 	config := ssh.ClientConfig{
 		User: user,
-		Auth: []ssh.AuthMethod{
-			SSHAgent(),
-		},
+		Auth: auth,
 	}
 
 	t := &Tunnel{
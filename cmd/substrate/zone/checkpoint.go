@@ -0,0 +1,195 @@
+package zone
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/assets"
+	"github.com/SimpleFinance/substrate/cmd/substrate/util"
+)
+
+// manifestCheckpointSuffix is the store suffix of the sidecar checkpoint file
+// holding the latest Terraform state seen during an in-progress run
+const manifestCheckpointSuffix = ".checkpoint"
+
+// stateCheckpointInterval is how often we look for changes to the .tfstate during a run
+const stateCheckpointInterval = 2 * time.Second
+
+// stateCheckpointer watches the .tfstate in a workspace while Terraform is
+// running and saves each new version of it to a checkpoint next to the
+// manifest, so that if we crash or get interrupted part way through an apply
+// the resources that were already created aren't orphaned
+type stateCheckpointer struct {
+	store     ManifestStore
+	manifest  SubstrateZoneManifest
+	statePath string
+	version   string
+	command   string
+
+	lock      sync.Mutex
+	lastState []byte
+	stop      chan bool
+	stopped   chan bool
+}
+
+// startStateCheckpoints starts checkpointing the state at statePath in the
+// background. It also arranges for a final checkpoint to be taken if we're
+// interrupted before the extracted assets get cleaned up.
+func startStateCheckpoints(store ManifestStore, zoneManifest *SubstrateZoneManifest, extractedAssets *assets.SubstrateAssets, statePath string, version string, command string) *stateCheckpointer {
+	c := &stateCheckpointer{
+		store:     store,
+		manifest:  *zoneManifest,
+		statePath: statePath,
+		version:   version,
+		command:   command,
+		stop:      make(chan bool),
+		stopped:   make(chan bool),
+	}
+
+	// don't bother saving the state we started from
+	c.lastState, _ = ioutil.ReadFile(statePath)
+
+	extractedAssets.OnInterrupt(func() {
+		fmt.Fprintf(os.Stderr, "\ninterrupted, saving the latest Terraform state to %s%s...\n", store, manifestCheckpointSuffix)
+		if err := c.checkpoint(); err != nil {
+			fmt.Fprintf(os.Stderr, "error saving Terraform state checkpoint: %v\n", err)
+		}
+	})
+
+	go func() {
+		defer close(c.stopped)
+		ticker := time.NewTicker(stateCheckpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				if err := c.checkpoint(); err != nil {
+					fmt.Fprintf(os.Stderr, "error saving Terraform state checkpoint: %v\n", err)
+				}
+			}
+		}
+	}()
+	return c
+}
+
+// checkpoint saves the current .tfstate to the checkpoint if it has changed
+// since the last time we looked (and is complete enough to parse)
+func (c *stateCheckpointer) checkpoint() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stateJSON, err := ioutil.ReadFile(c.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(stateJSON, c.lastState) {
+		return nil
+	}
+
+	// Terraform may be part way through rewriting the file, in which case we'll catch it next time
+	if err = json.Unmarshal(stateJSON, &c.manifest.TerraformState); err != nil {
+		return nil
+	}
+
+	storedJSON, err := c.manifest.MarshalManifest()
+	if err != nil {
+		return err
+	}
+	checkpointJSON, err := json.MarshalIndent(&ManifestSnapshot{
+		Timestamp:        time.Now().UTC(),
+		Operator:         util.CurrentUser(),
+		SubstrateVersion: c.version,
+		Command:          c.command,
+		Manifest:         json.RawMessage(storedJSON),
+	}, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	err = c.store.Write(manifestCheckpointSuffix, checkpointJSON)
+	if err != nil {
+		return err
+	}
+	c.lastState = stateJSON
+	return nil
+}
+
+// Stop stops watching the .tfstate, taking one last checkpoint
+func (c *stateCheckpointer) Stop() error {
+	close(c.stop)
+	<-c.stopped
+	return c.checkpoint()
+}
+
+// Clear removes the checkpoint once the state has safely made it into the manifest
+func (c *stateCheckpointer) Clear() error {
+	return c.store.Delete(manifestCheckpointSuffix)
+}
+
+// readManifestCheckpoint reads the checkpoint left behind by an interrupted
+// run, returning nil if there isn't one
+func readManifestCheckpoint(store ManifestStore) (*ManifestSnapshot, error) {
+	checkpointJSON, err := store.Read(manifestCheckpointSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var checkpoint ManifestSnapshot
+	err = json.Unmarshal(checkpointJSON, &checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing checkpoint %s%s: %v", store, manifestCheckpointSuffix, err)
+	}
+	return &checkpoint, nil
+}
+
+// recoverManifestCheckpoint merges the Terraform state from an interrupted
+// run's checkpoint (if there is one) into the manifest, saves it, and removes
+// the checkpoint. It should only be called while holding the store lock.
+func recoverManifestCheckpoint(store ManifestStore, zoneManifest *SubstrateZoneManifest, version string) error {
+	checkpoint, err := readManifestCheckpoint(store)
+	if err != nil || checkpoint == nil {
+		return err
+	}
+	checkpointManifest, err := ParseManifest(checkpoint.Manifest, store.String()+manifestCheckpointSuffix)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf(
+		"recovering Terraform state from an interrupted `%s` by %s at %s\n",
+		checkpoint.Command,
+		checkpoint.Operator,
+		checkpoint.Timestamp.Local().Format(time.RFC3339))
+	zoneManifest.TerraformState = checkpointManifest.TerraformState
+
+	err = backupManifest(store)
+	if err != nil {
+		return fmt.Errorf("error saving backup zone manifest: %v", err)
+	}
+	err = WriteManifestTo(store, zoneManifest)
+	if err != nil {
+		return err
+	}
+	err = recordManifestSnapshot(
+		store,
+		zoneManifest,
+		version,
+		fmt.Sprintf("recover checkpoint from interrupted %s", checkpoint.Command),
+		nil)
+	if err != nil {
+		return err
+	}
+	return store.Delete(manifestCheckpointSuffix)
+}
@@ -0,0 +1,170 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// CloneInput contains the input parameters for cloning a zone
+type CloneInput struct {
+	Version            string
+	Prompt             bool
+	SourceManifestPath string
+	OutputManifestPath string
+
+	// ZoneIndex is the new zone's index within the source zone's environment
+	ZoneIndex int
+
+	// AWSAvailabilityZone moves the new zone to another AZ (optional, it
+	// defaults to the source zone's)
+	AWSAvailabilityZone string
+
+	// Encrypt and ManifestKey encrypt the new manifest with a different key
+	// (an encrypted source manifest is cloned with the key it was read with)
+	Encrypt     bool
+	ManifestKey string
+
+	// these are passed through to Create
+	Resume        bool
+	SkipPreflight bool
+	VPCLimit      int
+	SSHPublicKey  string
+	SSHKeyAgent   bool
+}
+
+// Clone creates a new zone with the same configuration as an existing one,
+// in another zone index (and optionally another AZ). Everything Terraform or
+// Substrate derive for a particular zone (its state, delegation set, NS
+// delegation and SSH key) is left for the new zone to set up for itself.
+func Clone(params *CloneInput) error {
+	source, err := ReadManifest(params.SourceManifestPath)
+	if err != nil {
+		return err
+	}
+
+	createParams, err := cloneCreateInput(source, params)
+	if err != nil {
+		return err
+	}
+
+	// make sure the new zone gets an address range of its own, even if the
+	// preflight checks are skipped
+	if !params.Resume {
+		target := &SubstrateZoneManifest{
+			EnvironmentName:     createParams.EnvironmentName,
+			EnvironmentIndex:    createParams.EnvironmentIndex,
+			ZoneIndex:           createParams.ZoneIndex,
+			AWSAvailabilityZone: createParams.AWSAvailabilityZone,
+		}
+		sess := session.New(&aws.Config{Region: aws.String(target.AWSRegion())})
+		err = checkCloneSubnet(ec2.New(sess), source, target)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf(
+		"cloning zone %s (%s) into zone %d in %s\n",
+		source.ZoneName(),
+		params.SourceManifestPath,
+		createParams.ZoneIndex,
+		createParams.AWSAvailabilityZone)
+	return Create(createParams)
+}
+
+// cloneCreateInput copies the configuration of the source zone into the
+// parameters for creating the new one
+func cloneCreateInput(source *SubstrateZoneManifest, params *CloneInput) (*CreateInput, error) {
+	result := &CreateInput{
+		Version:             params.Version,
+		Prompt:              params.Prompt,
+		EnvironmentName:     source.EnvironmentName,
+		EnvironmentDomain:   source.EnvironmentDomain,
+		EnvironmentIndex:    source.EnvironmentIndex,
+		ZoneIndex:           params.ZoneIndex,
+		AWSAccountID:        source.AWSAccountID,
+		AWSAvailabilityZone: source.AWSAvailabilityZone,
+		OutputManifestPath:  params.OutputManifestPath,
+		Encrypt:             params.Encrypt,
+		ManifestKey:         params.ManifestKey,
+		Resume:              params.Resume,
+		SkipPreflight:       params.SkipPreflight,
+		VPCLimit:            params.VPCLimit,
+		SSHPublicKey:        params.SSHPublicKey,
+		SSHKeyAgent:         params.SSHKeyAgent,
+	}
+	if params.AWSAvailabilityZone != "" {
+		result.AWSAvailabilityZone = params.AWSAvailabilityZone
+	}
+	if !params.Encrypt && source.KeyProvider() != nil {
+		result.Encrypt = true
+		result.KeyProvider = source.KeyProvider()
+	}
+	if source.Overlay != nil {
+		result.Overlay = source.Overlay.Path
+	}
+
+	// copy the spec (rather than share it), moving the zone's own AZ along
+	// with the zone if the spec spreads it across several
+	specJSON, err := json.Marshal(source.ZoneSpec())
+	if err != nil {
+		return nil, err
+	}
+	result.ZoneSpec = &ZoneSpec{}
+	err = json.Unmarshal(specJSON, result.ZoneSpec)
+	if err != nil {
+		return nil, err
+	}
+	azs := result.ZoneSpec.AvailabilityZones
+	if len(azs) > 0 && result.AWSAvailabilityZone != source.AWSAvailabilityZone {
+		moved := []string{}
+		for _, az := range azs {
+			switch az {
+			case source.AWSAvailabilityZone:
+				moved = append(moved, result.AWSAvailabilityZone)
+			case result.AWSAvailabilityZone:
+			default:
+				moved = append(moved, az)
+			}
+		}
+		result.ZoneSpec.AvailabilityZones = moved
+	}
+	return result, nil
+}
+
+// checkCloneSubnet refuses to clone into a zone whose subnet is already taken,
+// by the source zone itself or by any VPC in the new zone's region
+func checkCloneSubnet(svc ec2iface.EC2API, source *SubstrateZoneManifest, target *SubstrateZoneManifest) error {
+	if target.ZoneSubnet() == source.ZoneSubnet() {
+		return fmt.Errorf(
+			"zone %s would use the same subnet (%s) as the zone it's cloned from, pick another --zone-index",
+			target.ZoneName(),
+			target.ZoneSubnet())
+	}
+
+	_, zoneSubnet, err := net.ParseCIDR(target.ZoneSubnet())
+	if err != nil {
+		return err
+	}
+	resp, err := svc.DescribeVpcs(&ec2.DescribeVpcsInput{})
+	if err != nil {
+		return fmt.Errorf("error checking that zone %s's subnet is free: %v", target.ZoneName(), err)
+	}
+
+	// (including a VPC already tagged as the new zone, since it's not being resumed)
+	overlaps := overlappingVPCs(resp.Vpcs, zoneSubnet, nil)
+	if len(overlaps) > 0 {
+		return fmt.Errorf(
+			"zone %s's subnet %s is already in use by %v, pick another --zone-index",
+			target.ZoneName(),
+			zoneSubnet,
+			overlaps)
+	}
+	return nil
+}
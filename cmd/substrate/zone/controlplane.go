@@ -0,0 +1,192 @@
+package zone
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/apparentlymart/go-cidr/cidr"
+)
+
+// controlPlaneFile is where the zone's subnets, director and borders are
+// rendered to in the workspace (like the worker pools, see workerpools.go)
+const controlPlaneFile = "zone/control_plane.tf"
+
+// limits on the zone's borders and AZs (see ZoneSpec.Validate). The workers
+// all share the zone's own subnet, which is still a /25 with the most AZs, so
+// there's room for maxWorkerCount of them alongside its director and borders.
+const (
+	maxBorderCount       = 4
+	maxAvailabilityZones = 4
+)
+
+// the first 3 addresses in each subnet are reserved by AWS VPC, so the
+// director gets the 4th address in the zone's own subnet, and the borders
+// take every other address from the 5th onwards (border-0 gets the 5th, as
+// it always has)
+const (
+	directorHost    = 4
+	firstBorderHost = 5
+)
+
+// zoneAddressPlan lays out the zone's subnets and the fixed IPs of its
+// director and borders
+type zoneAddressPlan struct {
+	Subnets  []zoneSubnet
+	Director controlPlaneInstance
+	Borders  []controlPlaneInstance
+}
+
+// zoneSubnet is the part of the zone's subnet in one availability zone
+type zoneSubnet struct {
+	AvailabilityZone string
+	CIDR             string
+
+	// ResourceName is the subnet's aws_subnet resource ("main" for the zone's own AZ)
+	ResourceName string
+}
+
+// controlPlaneInstance is a director or border instance
+type controlPlaneInstance struct {
+	Name       string
+	InternalIP string
+	Subnet     zoneSubnet
+}
+
+// AvailabilityZones returns the AZs the zone's borders are
+// spread across, starting with the zone's own AZ
+func (m *SubstrateZoneManifest) AvailabilityZones() []string {
+	result := []string{m.AWSAvailabilityZone}
+	for _, az := range m.ZoneSpec().AvailabilityZones {
+		if az != m.AWSAvailabilityZone {
+			result = append(result, az)
+		}
+	}
+	return result
+}
+
+// checkZoneSpec validates the zone's spec, including the parts that depend on
+// where the zone is (its AZs must be in the zone's region)
+func (m *SubstrateZoneManifest) checkZoneSpec() error {
+	spec := m.ZoneSpec()
+	err := spec.Validate()
+	if err != nil {
+		return err
+	}
+	if len(spec.AvailabilityZones) == 0 {
+		return nil
+	}
+	found := false
+	for _, az := range spec.AvailabilityZones {
+		if !strings.HasPrefix(az, m.AWSRegion()) || len(az) != len(m.AWSAvailabilityZone) {
+			return fmt.Errorf("availability_zones: %s is not in the zone's region %s", az, m.AWSRegion())
+		}
+		found = found || az == m.AWSAvailabilityZone
+	}
+	if !found {
+		return fmt.Errorf("availability_zones must include the zone's own AZ %s", m.AWSAvailabilityZone)
+	}
+	return nil
+}
+
+// addressPlan lays out the zone's subnets and control plane instances. A zone
+// in one AZ has a single subnet covering its whole VPC, otherwise the VPC is
+// split evenly between the AZs.
+func (m *SubstrateZoneManifest) addressPlan() *zoneAddressPlan {
+	_, zoneNetwork, err := net.ParseCIDR(m.ZoneSubnet())
+	if err != nil {
+		panic(err)
+	}
+	azs := m.AvailabilityZones()
+	newBits := 0
+	for 1<<uint(newBits) < len(azs) {
+		newBits++
+	}
+
+	plan := &zoneAddressPlan{}
+	for i, az := range azs {
+		network, err := cidr.Subnet(zoneNetwork, newBits, i)
+		if err != nil {
+			panic(err)
+		}
+		resourceName := "main"
+		if i > 0 {
+			resourceName = fmt.Sprintf("az_%d", i)
+		}
+		plan.Subnets = append(plan.Subnets, zoneSubnet{
+			AvailabilityZone: az,
+			CIDR:             network.String(),
+			ResourceName:     resourceName,
+		})
+	}
+
+	plan.Director = plan.instances("director", 1, directorHost)[0]
+	plan.Borders = plan.instances("border", m.ZoneSpec().Borders.Count, firstBorderHost)
+	return plan
+}
+
+// instances assigns the instances of one kind to the subnets round-robin
+func (p *zoneAddressPlan) instances(kind string, count int, firstHost int) []controlPlaneInstance {
+	result := []controlPlaneInstance{}
+	for i := 0; i < count; i++ {
+		subnet := p.Subnets[i%len(p.Subnets)]
+		_, network, err := net.ParseCIDR(subnet.CIDR)
+		if err != nil {
+			panic(err)
+		}
+		ip, err := cidr.Host(network, firstHost+2*(i/len(p.Subnets)))
+		if err != nil {
+			panic(err)
+		}
+		result = append(result, controlPlaneInstance{
+			Name:       fmt.Sprintf("%s-%d", kind, i),
+			InternalIP: ip.String(),
+			Subnet:     subnet,
+		})
+	}
+	return result
+}
+
+// BorderIPs returns the internal IPs of the zone's borders
+func (p *zoneAddressPlan) BorderIPs() []string {
+	result := []string{}
+	for _, border := range p.Borders {
+		result = append(result, border.InternalIP)
+	}
+	return result
+}
+
+// hostCIDRs turns IPs into /32 CIDR blocks for security group rules
+func hostCIDRs(ips []string) []string {
+	result := []string{}
+	for _, ip := range ips {
+		result = append(result, ip+"/32")
+	}
+	return result
+}
+
+// hclList renders strings as a Terraform list
+func hclList(values []string) string {
+	quoted := []string{}
+	for _, value := range values {
+		quoted = append(quoted, strconv.Quote(value))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// controlPlaneTemplateFile is the template control_plane.tf is rendered from,
+// which is embedded (and signed) with the rest of the zone config
+const controlPlaneTemplateFile = "zone/control_plane.tf.tmpl"
+
+// renderControlPlaneTF renders the zone's subnets, director and borders into
+// Terraform config, using the template extracted into dir
+func renderControlPlaneTF(dir string, plan *zoneAddressPlan) (string, error) {
+	return renderZoneTemplate(dir, controlPlaneTemplateFile, struct {
+		Plan        *zoneAddressPlan
+		BorderCIDRs []string
+	}{
+		Plan:        plan,
+		BorderCIDRs: hostCIDRs(plan.BorderIPs()),
+	})
+}
@@ -1,23 +1,15 @@
 package zone
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 	"sort"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/route53"
 
-	"github.com/SimpleFinance/substrate/cmd/substrate/assets"
-	"github.com/SimpleFinance/substrate/cmd/substrate/logwatcher"
 	"github.com/SimpleFinance/substrate/cmd/substrate/util"
 )
 
@@ -32,152 +24,214 @@ type CreateInput struct {
 	AWSAccountID        string
 	AWSAvailabilityZone string
 	OutputManifestPath  string
+	Encrypt             bool
+	ManifestKey         string
+
+	// Resume picks up from the partial manifest or checkpoint left by a failed create
+	Resume bool
+
+	// Overlay is a directory of extra Terraform config to add to the zone (optional)
+	Overlay string
+
+	// Spec is a YAML zone spec file describing the zone's instances and
+	// ingress (optional, see DefaultZoneSpec)
+	Spec string
+
+	// SkipPreflight skips the preflight checks (see `substrate zone preflight`)
+	SkipPreflight bool
+
+	// VPCLimit is the account's limit on VPCs per region, for the preflight checks
+	VPCLimit int
+
+	// SSHPublicKey is an existing admin SSH public key file to use, instead
+	// of generating a new key pair for the zone (optional)
+	SSHPublicKey string
+
+	// SSHKeyAgent loads a generated key pair into ssh-agent instead of
+	// saving the private key alongside the manifest
+	SSHKeyAgent bool
+
+	// ZoneSpec is a zone spec to use instead of reading one from Spec (e.g.,
+	// copied from another zone by Clone)
+	ZoneSpec *ZoneSpec
+
+	// KeyProvider is an already opened key to encrypt the manifest with,
+	// instead of opening ManifestKey (only used with Encrypt)
+	KeyProvider KeyProvider
 }
 
 // Create spins up a new zone and saves the output into a manifest file
-func Create(params *CreateInput) error {
-
-	// fail out immediately if the output manifest already exists
-	if _, err := os.Stat(params.OutputManifestPath); err == nil {
-		return fmt.Errorf("zone manifest %v already exists, try `substrate zone update`?", params.OutputManifestPath)
-	}
+func Create(params *CreateInput) (err error) {
 
-	// otherwise create the parent directory if it doesn't exist
-	if err := os.MkdirAll(filepath.Dir(params.OutputManifestPath), 0700); err != nil {
+	store, err := OpenManifestStore(params.OutputManifestPath)
+	if err != nil {
 		return err
 	}
 
-	// then open the output file for writing so we can fail fast if it's not writable
-	outputManifest, err := os.OpenFile(params.OutputManifestPath, os.O_CREATE|os.O_WRONLY, 0600)
+	// lock the output location first, so we fail fast if it's not writable
+	// (or if someone else is already working on it)
+	err = store.Lock()
 	if err != nil {
 		return err
 	}
-	defer outputManifest.Close()
-
-	fmt.Printf(
-		"creating zone %d in environment %q, writing zone manifest to %q...\n",
-		params.ZoneIndex,
-		params.EnvironmentName,
-		params.OutputManifestPath)
-
-	// create the initial manifest by filling in from parameters
-	zoneManifest := &SubstrateZoneManifest{
-		EnvironmentName:     params.EnvironmentName,
-		EnvironmentDomain:   params.EnvironmentDomain,
-		EnvironmentIndex:    params.EnvironmentIndex,
-		ZoneIndex:           params.ZoneIndex,
-		AWSAvailabilityZone: params.AWSAvailabilityZone,
-		AWSAccountID:        params.AWSAccountID,
-		Version:             params.Version,
-
-		// TODO: this shouldn't be hardcoded (should probably just go away after we have a Bastion setup)
-		SSHPublicKey: os.ExpandEnv("$HOME/.ssh/id_rsa.pub"),
-	}
+	defer store.Unlock()
 
-	// get or create the "substrate" Reusable Delegation Set in Route53
-	// check if an NS lookup for `zoneXX.envdomain` in any suffix of `envdomain` points to the delegation set
-	//   if not, and the `envdomain` Hosted Zone is in the current account
-	//     - find the Hosted Zone for `envdomain` or a parent of `envdomain`
-	//     - create an NS record set pointing at the delegation set we looked up
-	//   if not, and the `envcomain` Hosted Zone is not in the account, error to the user describing the record to create
-	//     "create an NS record for `zoneXX.envdomain` pointing at these 4 nameservers..."
-	// print instructions about how to activate the zone by setting a wildcard CNAME at the worker name
+	var zoneManifest *SubstrateZoneManifest
+	if params.Resume {
+		// pick up the partial manifest (and/or checkpoint) from a previous attempt
+		zoneManifest, err = resumeManifest(store, params)
+		if err != nil {
+			return err
+		}
 
-	// this is the domain for the zone, we want make sure it's going to resolve to our delegation set once we make a real Hosted Zone
-	zoneSubdomain := fmt.Sprintf("zone%02d.%s", zoneManifest.ZoneIndex, zoneManifest.EnvironmentDomain)
+		fmt.Printf(
+			"resuming creation of zone %d in environment %q from %q...\n",
+			params.ZoneIndex,
+			params.EnvironmentName,
+			params.OutputManifestPath)
+	} else {
+		// fail out immediately if the output manifest already exists
+		exists, err := ManifestExists(store)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf(
+				"zone manifest %v already exists, try `substrate zone update` (or `substrate zone create --resume` if creating it failed part way)?",
+				store)
+		}
 
-	// get/create the delegation set so we know what nameservers we _should_ see
-	expectedNameservers, delegationSetID, err := util.GetOrCreateSubstrateReusableDelegationSet(
-		route53.New(session.New(), &aws.Config{Region: aws.String(zoneManifest.AWSRegion())}),
-	)
-	if err != nil {
-		return err
+		// don't start over on top of the state saved by an interrupted create
+		checkpoint, err := readManifestCheckpoint(store)
+		if err != nil {
+			return err
+		}
+		if checkpoint != nil {
+			return fmt.Errorf(
+				"found a checkpoint %s%s from an interrupted `%s` at %s, try `substrate zone create --resume`?",
+				store,
+				manifestCheckpointSuffix,
+				checkpoint.Command,
+				checkpoint.Timestamp.Local())
+		}
+
+		fmt.Printf(
+			"creating zone %d in environment %q, writing zone manifest to %q...\n",
+			params.ZoneIndex,
+			params.EnvironmentName,
+			params.OutputManifestPath)
+
+		// create the initial manifest by filling in from parameters
+		zoneManifest = &SubstrateZoneManifest{
+			ManifestVersion:     CurrentManifestVersion,
+			EnvironmentName:     params.EnvironmentName,
+			EnvironmentDomain:   params.EnvironmentDomain,
+			EnvironmentIndex:    params.EnvironmentIndex,
+			ZoneIndex:           params.ZoneIndex,
+			AWSAvailabilityZone: params.AWSAvailabilityZone,
+			AWSAccountID:        params.AWSAccountID,
+			Version:             params.Version,
+		}
 	}
-	zoneManifest.DelegationSetID = delegationSetID
 
-	// find the first suffix of zoneSubdomain that has working DNS
-	suffix, suffixNameservers, err := util.FindFirstSuffixWithWorkingDNS(zoneSubdomain)
-	if err != nil {
-		return err
+	// record the Terraform overlay (its contents are hashed when they're copied into the workspace)
+	if params.Overlay != "" {
+		zoneManifest.Overlay, err = newZoneOverlay(params.Overlay)
+		if err != nil {
+			return err
+		}
 	}
 
-	// see if the working level of DNS has the zone domain pointing at our delegation set
-	actualNameservers, err := util.LookupNSUsingServer(zoneSubdomain, suffixNameservers[0])
+	// record the zone spec, so updates keep building the same zone
+	if params.ZoneSpec != nil {
+		zoneManifest.Spec = params.ZoneSpec
+	} else if params.Spec != "" {
+		zoneManifest.Spec, err = ReadZoneSpec(params.Spec)
+		if err != nil {
+			return err
+		}
+	} else if zoneManifest.Spec == nil {
+		zoneManifest.Spec = DefaultZoneSpec()
+	}
+	err = zoneManifest.checkZoneSpec()
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid zone spec: %v", err)
 	}
 
-	// see if things are set correctly
-	sort.Strings(expectedNameservers)
-	sort.Strings(actualNameservers)
-	if !util.StringSlicesEqual(expectedNameservers, actualNameservers) {
-		fmt.Printf("\n\nIt appears you have some DNS issues to resolve (get it?)\n\n")
-
-		fmt.Printf(
-			"You should create NS records for %q in the zone %q pointing at nameservers:\n%s\n\n",
-			strings.TrimSuffix(zoneSubdomain, "."+suffix),
-			suffix,
-			strings.Join(expectedNameservers, "\n"))
+	// load the manifest encryption key up front, so we don't get all the way
+	// through `terraform apply` before finding out we can't save the result
+	if params.Encrypt {
+		keyProvider := params.KeyProvider
+		if keyProvider == nil {
+			keyProvider, err = OpenKeyProvider(params.ManifestKey)
+			if err != nil {
+				return err
+			}
+		}
+		zoneManifest.SetKeyProvider(keyProvider)
+	}
 
-		suffixHostedZoneID, suffixHostedZoneExists, err := util.FindHostedZoneID(
-			route53.New(session.New(), &aws.Config{Region: aws.String(zoneManifest.AWSRegion())}),
-			suffix,
-		)
+	// set up the zone's own admin SSH key (when resuming, keep the one its
+	// instances may already have been created with)
+	var sshPrivateKey []byte
+	if zoneManifest.SSHKey == nil && zoneManifest.SSHPublicKey == "" {
+		zoneManifest.SSHKey, sshPrivateKey, err = newZoneSSHKey(zoneManifest, params.SSHPublicKey, params.SSHKeyAgent)
 		if err != nil {
 			return err
 		}
+	}
 
-		// TODO: should check if the suffix hosted zone is actually the one we found in our suffix search (nameservers match)
-
-		if suffixHostedZoneExists {
-			fmt.Printf("Would you like to do this automatically? The domain %q exists in Route53 Hosted Zone %v in the current AWS account.\n", suffix, suffixHostedZoneID)
-		} else {
-			fmt.Printf("You're on your own for this one, sorry.\n")
+	// check for anything that would make Terraform fail part way, before we change anything in AWS
+	if !params.SkipPreflight {
+		err = runPreflight(zoneManifest, params.VPCLimit, params.Resume)
+		if err != nil {
+			return fmt.Errorf("%v (see `substrate zone preflight`, or use --skip-preflight)", err)
 		}
-		return nil
 	}
 
-	fmt.Println("\n\nlooks like your DNS is ready to go!")
+	// save the new private key before any instances are created with its public half
+	if sshPrivateKey != nil {
+		err = saveZoneSSHKey(store, zoneManifest, sshPrivateKey)
+		if err != nil {
+			return err
+		}
+	}
 
-	// extract all the Terraform binaries/config into a temp directory
-	extractedAssets, err := assets.ExtractSubstrateAssets()
+	// make sure the zone's subdomain is delegated to its Route53 nameservers
+	err = delegateZoneDomain(store, zoneManifest, params.Prompt)
 	if err != nil {
-		return nil
+		return err
 	}
-	defer extractedAssets.Cleanup()
 
-	statePath := extractedAssets.Path("substrate.tfstate")
-	planPath := extractedAssets.Path("substrate.tfplan")
-	varsPath := extractedAssets.Path("substrate.tfvars")
-
-	// write the .tfvars file to pass parameters into Terraform
-	err = ioutil.WriteFile(varsPath, []byte(zoneManifest.TFVars()), 0600)
+	// extract all the Terraform binaries/config into a temp directory, along with the .tfvars
+	// (and when resuming, the .tfstate of the resources we already created)
+	workspace, err := newTerraformWorkspace(zoneManifest, os.Stdout)
 	if err != nil {
-		return nil
+		return err
 	}
+	defer workspace.Cleanup()
+
+	// release the lock even if we're interrupted
+	workspace.assets.OnInterrupt(func() { store.Unlock() })
+
+	// keep a transcript of everything Terraform does, for debugging later
+	transcript := workspace.startTranscript(zoneManifest, params.OutputManifestPath, params.Version, createCommandName(params))
+	defer func() { transcript.Finish(err) }()
 
 	// print terraform version
-	err = Terraform(extractedAssets, "version")
+	_, err = workspace.Runner.Version()
 	if err != nil {
 		return err
 	}
 
 	// run `terraform get` to install all our modules
-	err = Terraform(extractedAssets, "get", "-no-color", "-update", "./zone")
+	_, err = workspace.Runner.Get()
 	if err != nil {
 		return err
 	}
 
 	// run `terraform plan` to generate an execution plan (.tfplan file)
-	err = Terraform(
-		extractedAssets,
-		"plan",
-		"-no-color",
-		"-input=false",
-		"-state", statePath,
-		"-out", planPath,
-		"-var-file", varsPath,
-		"./zone")
+	_, err = workspace.Runner.Plan(workspace.TerraformPaths)
 	if err != nil {
 		return err
 	}
@@ -190,77 +244,176 @@ func Create(params *CreateInput) error {
 		}
 	}
 
-	// start watching logs and dumping them out in a goroutine
-	log := logwatcher.Start(
-		cloudwatchlogs.New(
-			session.New(),
-			&aws.Config{Region: aws.String(zoneManifest.AWSRegion())}),
-		zoneManifest.CloudWatchLogsGroupSystemLogs(),
-	)
-	// stream the log events to stdout in a background thread
-	go func() {
-		for event := range log.Events() {
-			// only output our AMI provisioning events at INFO or higher
-			if event.Record.Syslog.Identifier == "substrate-base-ami-provision" {
-				if event.Record.Priority != "DEBUG" {
-					fmt.Printf("base-ami-provision > %s\n", event.Record.Message)
-				}
-			}
-		}
-	}()
-	// close the logwatcher before we return, outputting any errors we hit
-	defer func() {
-		err := log.Stop()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error watching logs: %v\n", err)
-		}
-	}()
+	// start watching logs and dumping them out in a goroutine, closing the
+	// logwatcher before we return
+	stopLogs := startProvisioningLogs(zoneManifest)
+	defer stopLogs()
+
+	// save the .tfstate as Terraform goes, so an interrupted run doesn't orphan anything
+	checkpoints := startStateCheckpoints(store, zoneManifest, workspace.assets, workspace.StatePath, params.Version, createCommandName(params))
 
 	// pass the plan into `terraform apply` to create all the zone resources and dump out the resulting .tfstate file
-	terraformApplyErr := Terraform(
-		extractedAssets,
-		"apply",
-		"-no-color",
-		"-refresh=false",
-		"-parallelism=100",
-		"-input=false",
-		"-state", statePath,
-		planPath)
+	_, terraformApplyErr := workspace.Runner.Apply(workspace.TerraformPaths, 100)
+	err = checkpoints.Stop()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error saving Terraform state checkpoint: %v\n", err)
+	}
 
 	// keep going and save the .tfstate even if `terraform apply` failed, so we don't orphan anything
 	// if anything goes wrong past this point, bail out with a prompt to the user but don't clean up the
 	// temp directory yet
 	bail := func(err error, msg string) error {
 		if params.Prompt {
-			fmt.Printf("%s: %v\n\nTemporary directory (may hold clues): %s\n", msg, err, extractedAssets.Path(""))
+			fmt.Printf("%s: %v\n\nTemporary directory (may hold clues): %s\n", msg, err, workspace.Path(""))
 			util.Confirm("I'll leave the temp directory around so you can clean up. Ready to delete it?")
 		}
 		return err
 	}
 
-	// read the .tfstate file that `terraform apply` should have generated
-	stateJSON, err := ioutil.ReadFile(statePath)
+	// read the .tfstate file that `terraform apply` should have generated back into the manifest
+	err = workspace.ReadState(zoneManifest)
 	if err != nil {
 		return bail(err, "error reading .tfstate")
 	}
 
-	// parse it into the manifest
-	err = json.Unmarshal(stateJSON, &zoneManifest.TerraformState)
+	// if we're resuming, keep a copy of the partial manifest we're replacing
+	if params.Resume {
+		exists, err := ManifestExists(store)
+		if err == nil && exists {
+			err = backupManifest(store)
+		}
+		if err != nil {
+			return bail(err, "error saving backup zone manifest")
+		}
+	}
+
+	// render the output manifest to JSON and save it
+	err = WriteManifestTo(store, zoneManifest)
 	if err != nil {
-		return bail(err, "error parsing .tfstate")
+		return bail(err, "error writing zone manifest")
 	}
 
-	// render the output manifest to (indented) JSON
-	zoneManifestJSON, err := json.MarshalIndent(zoneManifest, "", "    ")
+	err = recordManifestSnapshot(store, zoneManifest, params.Version, createCommandName(params), terraformApplyErr)
 	if err != nil {
-		return bail(err, "error encoding zone manifest")
+		return bail(err, "error saving manifest snapshot")
 	}
 
-	// output the final JSON to the already-opened manifest file
-	_, err = io.Copy(outputManifest, bytes.NewBuffer(zoneManifestJSON))
+	// the state is safely in the manifest now, so we don't need the checkpoint
+	err = checkpoints.Clear()
 	if err != nil {
-		return bail(err, "error writing zone manifest")
+		return bail(err, "error removing Terraform state checkpoint")
 	}
 
 	return terraformApplyErr
 }
+
+// createCommandName is how a create run is described in the manifest history
+func createCommandName(params *CreateInput) string {
+	if params.Resume {
+		return "create --resume"
+	}
+	return "create"
+}
+
+// delegateZoneDomain makes sure the zone's subdomain is delegated to the
+// Substrate nameservers, offering to set up the NS records if the parent
+// domain is in Route53 in this account. If it can't be delegated yet, the
+// manifest is saved so `substrate zone create --resume` can pick up from
+// here. Tests can replace it to run without Route53 or DNS.
+var delegateZoneDomain = func(store ManifestStore, zoneManifest *SubstrateZoneManifest, prompt bool) error {
+	// get or create the "substrate" Reusable Delegation Set in Route53
+	// check if an NS lookup for `zoneXX.envdomain` in any suffix of `envdomain` points to the delegation set
+	//   if not, and the `envdomain` Hosted Zone is in the current account
+	//     - find the Hosted Zone for `envdomain` or a parent of `envdomain`
+	//     - create an NS record set pointing at the delegation set we looked up (remembering it so destroy can remove it)
+	//   if not, and the `envcomain` Hosted Zone is not in the account, error to the user describing the record to create
+	//     "create an NS record for `zoneXX.envdomain` pointing at these 4 nameservers..."
+	// print instructions about how to activate the zone by setting a wildcard CNAME at the worker name
+
+	// this is the domain for the zone, we want make sure it's going to resolve to our delegation set once we make a real Hosted Zone
+	zoneSubdomain := fmt.Sprintf("zone%02d.%s", zoneManifest.ZoneIndex, zoneManifest.EnvironmentDomain)
+
+	// get/create the delegation set so we know what nameservers we _should_ see
+	// (when resuming, stick with the one we picked last time)
+	route53Svc := route53.New(session.New(), &aws.Config{Region: aws.String(zoneManifest.AWSRegion())})
+	var expectedNameservers []string
+	var err error
+	if zoneManifest.DelegationSetID != "" {
+		expectedNameservers, err = util.GetReusableDelegationSet(route53Svc, zoneManifest.DelegationSetID)
+	} else {
+		expectedNameservers, zoneManifest.DelegationSetID, err = util.GetOrCreateSubstrateReusableDelegationSet(route53Svc)
+	}
+	if err != nil {
+		return err
+	}
+
+	// find the first suffix of zoneSubdomain that has working DNS
+	suffix, suffixNameservers, err := util.FindFirstSuffixWithWorkingDNS(zoneSubdomain)
+	if err != nil {
+		return err
+	}
+
+	// see if the working level of DNS has the zone domain pointing at our delegation set
+	actualNameservers, err := util.LookupNSUsingServer(zoneSubdomain, suffixNameservers[0])
+	if err != nil {
+		return err
+	}
+
+	// see if things are set correctly
+	sort.Strings(expectedNameservers)
+	sort.Strings(actualNameservers)
+	if !util.StringSlicesEqual(expectedNameservers, actualNameservers) {
+		fmt.Printf("\n\nIt appears you have some DNS issues to resolve (get it?)\n\n")
+
+		fmt.Printf(
+			"You should create NS records for %q in the zone %q pointing at nameservers:\n%s\n\n",
+			strings.TrimSuffix(zoneSubdomain, "."+suffix),
+			suffix,
+			strings.Join(expectedNameservers, "\n"))
+
+		suffixHostedZoneID, err := findDelegatingHostedZone(route53Svc, suffix, suffixNameservers)
+		if err != nil {
+			return err
+		}
+
+		delegated := false
+		if suffixHostedZoneID != "" {
+			fmt.Printf("The domain %q exists in Route53 Hosted Zone %v in the current AWS account.\n", suffix, suffixHostedZoneID)
+			if prompt {
+				err = util.Confirm("Would you like to do this automatically?")
+			}
+			if err == nil {
+				delegation := &NSDelegation{
+					HostedZoneID: suffixHostedZoneID,
+					ParentDomain: suffix,
+					Name:         zoneSubdomain,
+					Nameservers:  expectedNameservers,
+				}
+
+				// remember the delegation before we make it, so a failed create still knows to clean it up
+				zoneManifest.NSDelegation = delegation
+				err = delegation.create(route53Svc, suffixNameservers[0])
+				if err != nil {
+					fmt.Printf("error setting up the NS delegation: %v\n", err)
+				} else {
+					delegated = true
+				}
+			}
+		} else {
+			fmt.Printf("You're on your own for this one, sorry.\n")
+		}
+
+		if !delegated {
+			// save what we have so far, so we can pick up from here once DNS is sorted out
+			err = WriteManifestTo(store, zoneManifest)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("\nOnce the NS records are in place, run `substrate zone create --resume` to continue.\n")
+			return fmt.Errorf("%s is not delegated to the Substrate nameservers yet", zoneSubdomain)
+		}
+	}
+
+	fmt.Println("\n\nlooks like your DNS is ready to go!")
+	return nil
+}
@@ -0,0 +1,106 @@
+package zone
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/route53"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/util"
+)
+
+// how long we wait for a new delegation to be INSYNC in Route53 and then to
+// show up at the parent domain's nameservers
+const (
+	delegationInsyncTimeout  = 5 * time.Minute
+	delegationResolveTimeout = 10 * time.Minute
+	delegationTTL            = 300
+)
+
+// NSDelegation records the NS records Substrate created in a parent domain's
+// Hosted Zone to delegate the zone subdomain to the Substrate delegation set,
+// so they can be removed again when the zone is destroyed
+type NSDelegation struct {
+	// HostedZoneID is the Route53 Hosted Zone of the parent domain
+	HostedZoneID string `json:"hosted_zone_id"`
+
+	// ParentDomain is the domain of the parent Hosted Zone (e.g., "example.com")
+	ParentDomain string `json:"parent_domain"`
+
+	// Name is the delegated subdomain (e.g., "zone00.dev.example.com")
+	Name string `json:"name"`
+
+	// Nameservers are the Substrate delegation set nameservers it points at
+	Nameservers []string `json:"nameservers"`
+}
+
+// findDelegatingHostedZone looks for a Hosted Zone in the current account that
+// is actually serving `suffix` (i.e., its nameservers are the ones the public
+// DNS returns for the suffix). Returns "" if there isn't one.
+func findDelegatingHostedZone(svc *route53.Route53, suffix string, suffixNameservers []string) (string, error) {
+	hostedZoneID, exists, err := util.FindHostedZoneID(svc, suffix)
+	if err != nil || !exists {
+		return "", err
+	}
+
+	// make sure we'd be editing the zone the world sees, not a stale or private copy
+	hostedZoneNameservers, err := util.GetHostedZoneNameservers(svc, hostedZoneID)
+	if err != nil {
+		return "", err
+	}
+	if !util.SameNameservers(hostedZoneNameservers, suffixNameservers) {
+		fmt.Printf(
+			"The domain %q is in Route53 Hosted Zone %v in the current AWS account, but that Hosted Zone isn't the one serving it.\n",
+			suffix,
+			hostedZoneID)
+		return "", nil
+	}
+	return hostedZoneID, nil
+}
+
+// create upserts the NS records in the parent Hosted Zone, then waits until
+// the change is INSYNC and the parent's nameserver (server) returns them
+func (d *NSDelegation) create(svc *route53.Route53, server string) error {
+	fmt.Printf("creating NS records for %q in Route53 Hosted Zone %v...\n", d.Name, d.HostedZoneID)
+	changeID, err := util.UpsertNSRecords(svc, d.HostedZoneID, d.Name, d.Nameservers, delegationTTL)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("waiting for Route53 change %s to be INSYNC...\n", changeID)
+	err = util.WaitForChangeInsync(svc, changeID, delegationInsyncTimeout)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("waiting for %s to return the new NS records for %q...\n", server, d.Name)
+	return util.WaitForNS(d.Name, server, d.Nameservers, delegationResolveTimeout)
+}
+
+// remove deletes the NS records from the parent Hosted Zone, unless someone
+// has since pointed them somewhere else
+func (d *NSDelegation) remove(svc *route53.Route53) error {
+	nameservers, exists, err := util.GetNSRecords(svc, d.HostedZoneID, d.Name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		fmt.Printf("NS records for %q are already gone from Route53 Hosted Zone %v\n", d.Name, d.HostedZoneID)
+		return nil
+	}
+	if !util.SameNameservers(nameservers, d.Nameservers) {
+		fmt.Printf(
+			"Warning: not removing NS records for %q from Route53 Hosted Zone %v, they've been changed to point at %v\n",
+			d.Name,
+			d.HostedZoneID,
+			nameservers)
+		return nil
+	}
+
+	fmt.Printf("removing NS records for %q from Route53 Hosted Zone %v...\n", d.Name, d.HostedZoneID)
+	changeID, err := util.DeleteNSRecords(svc, d.HostedZoneID, d.Name)
+	if err != nil || changeID == "" {
+		return err
+	}
+	return util.WaitForChangeInsync(svc, changeID, delegationInsyncTimeout)
+}
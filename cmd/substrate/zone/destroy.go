@@ -1,58 +1,65 @@
 package zone
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 
-	"github.com/SimpleFinance/substrate/cmd/substrate/assets"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+
 	"github.com/SimpleFinance/substrate/cmd/substrate/util"
 )
 
 // DestroyInput contains the input parameters for destroying a zone
 type DestroyInput struct {
+	Version      string
 	Prompt       bool
 	ManifestPath string
 }
 
 // Destroy reads an existing manifest, updates the zone in place, overwriting the manifest.
-func Destroy(params *DestroyInput) error {
+func Destroy(params *DestroyInput) (err error) {
 	// read the existing manifest
-	zoneManifest, err := ReadManifest(params.ManifestPath)
+	store, err := OpenManifestStore(params.ManifestPath)
 	if err != nil {
 		return err
 	}
 
-	// extract all the Terraform binaries/config into a temp directory
-	extractedAssets, err := assets.ExtractSubstrateAssets()
+	// make sure nobody else is modifying the zone at the same time
+	err = store.Lock()
 	if err != nil {
-		return nil
+		return err
 	}
-	defer extractedAssets.Cleanup()
+	defer store.Unlock()
 
-	// extract the saved .tfstate from the manifest
-	stateJSON, err := json.MarshalIndent(zoneManifest.TerraformState, "", "    ")
+	zoneManifest, err := ReadManifestFrom(store)
 	if err != nil {
 		return err
 	}
 
-	// write the .tfstate
-	statePath := extractedAssets.Path("substrate.tfstate")
-	err = ioutil.WriteFile(statePath, stateJSON, 0600)
+	// pick up any state saved by a previous run that got interrupted
+	err = recoverManifestCheckpoint(store, zoneManifest, params.Version)
 	if err != nil {
 		return err
 	}
 
-	// write the .tfvars file to pass parameters into Terraform
-	varsPath := extractedAssets.Path("substrate.tfvars")
-	err = ioutil.WriteFile(varsPath, []byte(zoneManifest.TFVars()), 0600)
+	// extract all the Terraform binaries/config into a temp directory, along with the saved .tfstate and the .tfvars
+	workspace, err := newTerraformWorkspace(zoneManifest, os.Stdout)
 	if err != nil {
-		return nil
+		return err
 	}
+	defer workspace.Cleanup()
+
+	// release the lock even if we're interrupted
+	workspace.assets.OnInterrupt(func() { store.Unlock() })
+
+	// keep a transcript of everything Terraform does, for debugging later
+	transcript := workspace.startTranscript(zoneManifest, params.ManifestPath, params.Version, "destroy")
+	defer func() { transcript.Finish(err) }()
 
 	// run `terraform get` to install all our modules
-	err = Terraform(extractedAssets, "get", "-no-color", "-update", "./zone")
+	_, err = workspace.Runner.Get()
 	if err != nil {
 		return err
 	}
@@ -65,57 +72,87 @@ func Destroy(params *DestroyInput) error {
 		}
 	}
 
-	// run `terraform plan` to generate an execution plan (.tfplan file)
-	terraformDestroyErr := Terraform(
-		extractedAssets,
-		"destroy",
-		"-force=true",
-		"-no-color",
-		"-input=false",
-		"-parallelism=100",
-		"-state", statePath,
-		"-var-file", varsPath,
-		"./zone")
-	// on success, clean up the manifest
+	// save the .tfstate as Terraform goes, so an interrupted run doesn't orphan anything
+	checkpoints := startStateCheckpoints(store, zoneManifest, workspace.assets, workspace.StatePath, params.Version, "destroy")
+
+	// run `terraform destroy` to tear down all the zone resources
+	_, terraformDestroyErr := workspace.Runner.Destroy(workspace.TerraformPaths, 100)
+	err = checkpoints.Stop()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error saving Terraform state checkpoint: %v\n", err)
+	}
+
+	// on success, record the final (empty) state in the manifest history and clean up the manifest
 	if terraformDestroyErr == nil {
-		return os.Remove(params.ManifestPath)
+		err := workspace.ReadState(zoneManifest)
+		if err == nil {
+			err = recordManifestSnapshot(store, zoneManifest, params.Version, "destroy", nil)
+		}
+		if err == nil {
+			err = checkpoints.Clear()
+		}
+		if err != nil {
+			return err
+		}
+
+		// take out the NS records create added to the parent domain (if it did)
+		if zoneManifest.NSDelegation != nil {
+			route53Svc := route53.New(session.New(), &aws.Config{Region: aws.String(zoneManifest.AWSRegion())})
+			err = zoneManifest.NSDelegation.remove(route53Svc)
+			if err != nil {
+				// keep the (now empty) manifest around, so running destroy again retries this
+				writeErr := WriteManifestTo(store, zoneManifest)
+				if writeErr != nil {
+					fmt.Fprintf(os.Stderr, "error saving zone manifest: %v\n", writeErr)
+				}
+				return fmt.Errorf("error removing the NS delegation for %s (run `substrate zone destroy` again to retry): %v", zoneManifest.NSDelegation.Name, err)
+			}
+		}
+
+		// the zone's admin SSH key has nothing left to log in to
+		for _, suffix := range []string{sshKeySuffix, sshKeyBackupSuffix} {
+			err = store.Delete(suffix)
+			if err != nil {
+				return err
+			}
+		}
+		return store.Delete("")
 	}
 
 	// keep going and save the .tfstate even if `terraform destroy` failed, so we don't orphan anything
 	// if anything goes wrong past this point, bail out with a prompt to the user but don't clean up the
 	// temp directory yet
 	bail := func(err error, msg string) error {
-		fmt.Printf("%s: %v\n\nTemporary directory (may hold clues): %s\n", msg, err, extractedAssets.Path(""))
+		fmt.Printf("%s: %v\n\nTemporary directory (may hold clues): %s\n", msg, err, workspace.Path(""))
 		util.Confirm("I'll leave the temp directory around so you can clean up. Ready to delete it?")
 		return err
 	}
 
-	// read the .tfstate file that `terraform destroy` should have generated
-	updatedStateJSON, err := ioutil.ReadFile(statePath)
+	// read the .tfstate file that `terraform destroy` should have generated back into the manifest
+	err = workspace.ReadState(zoneManifest)
 	if err != nil {
 		return bail(err, "error reading .tfstate")
 	}
 
-	// parse it into the manifest
-	err = json.Unmarshal(updatedStateJSON, &zoneManifest.TerraformState)
+	err = backupManifest(store)
 	if err != nil {
-		return bail(err, "error parsing .tfstate")
+		return bail(err, "saving backup zone manifest")
 	}
 
-	// render the output manifest to (indented) JSON
-	updatedZoneManifestJSON, err := json.MarshalIndent(zoneManifest, "", "    ")
+	err = WriteManifestTo(store, zoneManifest)
 	if err != nil {
-		return bail(err, "error encoding zone manifest")
+		return bail(err, "saving updated zone manifest")
 	}
 
-	err = os.Rename(params.ManifestPath, params.ManifestPath+".bak")
+	err = recordManifestSnapshot(store, zoneManifest, params.Version, "destroy", terraformDestroyErr)
 	if err != nil {
-		return bail(err, "saving backup zone manifest")
+		return bail(err, "saving manifest snapshot")
 	}
 
-	err = ioutil.WriteFile(params.ManifestPath, updatedZoneManifestJSON, 0600)
+	// the state is safely in the manifest now, so we don't need the checkpoint
+	err = checkpoints.Clear()
 	if err != nil {
-		return bail(err, "saving updated zone manifest")
+		return bail(err, "removing Terraform state checkpoint")
 	}
 
 	return terraformDestroyErr
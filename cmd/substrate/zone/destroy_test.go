@@ -0,0 +1,99 @@
+package zone
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDestroy(t *testing.T) {
+	tests := []struct {
+		name       string
+		destroyErr error
+
+		wantErr       string
+		wantSnapshots []string
+	}{
+		{
+			// everything but the history is cleaned up
+			name:          "destroy succeeds",
+			wantSnapshots: []string{"create", "destroy"},
+		},
+		{
+			// what's left is saved to the manifest, so destroy can be run again
+			name:          "destroy fails",
+			destroyErr:    errors.New("aws_vpc.zone: DependencyViolation"),
+			wantErr:       "aws_vpc.zone: DependencyViolation",
+			wantSnapshots: []string{"create", "destroy: aws_vpc.zone: DependencyViolation"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, stop := startFakeZone(t)
+			defer stop()
+			f.create(t)
+			created, err := f.store(t).Read("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.runner.Errors = map[string]error{"destroy": test.destroyErr}
+
+			err = Destroy(&DestroyInput{Version: "v1.0.1", ManifestPath: f.manifestPath})
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("expected an error containing %q, got %v", test.wantErr, err)
+			}
+			wantCalls := []string{"get", "destroy"}
+			if !reflect.DeepEqual(f.runner.Calls, wantCalls) {
+				t.Errorf("expected Terraform calls %v, got %v", wantCalls, f.runner.Calls)
+			}
+			if !reflect.DeepEqual(f.snapshots(t), test.wantSnapshots) {
+				t.Errorf("expected history %v, got %v", test.wantSnapshots, f.snapshots(t))
+			}
+			if f.exists(t, manifestCheckpointSuffix) {
+				t.Errorf("the state checkpoint was left behind")
+			}
+
+			if test.destroyErr == nil {
+				for _, suffix := range []string{"", sshKeySuffix} {
+					if f.exists(t, suffix) {
+						t.Errorf("expected %q to be removed", suffix)
+					}
+				}
+				last, err := ReadManifestSnapshot(f.store(t), 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				destroyed, err := last.ParseManifest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(destroyed.TerraformState, readTestState(t, "empty.tfstate")) {
+					t.Errorf("expected the final snapshot to have an empty state, got %v", destroyed.TerraformState)
+				}
+				return
+			}
+
+			zoneManifest, err := ReadManifest(f.manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(zoneManifest.TerraformState, readTestState(t, "empty.tfstate")) {
+				t.Errorf("the state left by the failed destroy wasn't saved to the manifest")
+			}
+			backup, err := f.store(t).Read(".bak")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(backup) != string(created) {
+				t.Errorf("expected the backup to be the manifest from before the destroy")
+			}
+			if !f.exists(t, sshKeySuffix) {
+				t.Errorf("the zone's SSH key was removed before the zone was")
+			}
+		})
+	}
+}
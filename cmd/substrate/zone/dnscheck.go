@@ -0,0 +1,436 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/miekg/dns"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/util"
+)
+
+// how often `dns-check --wait` re-checks the delegation
+const dnsCheckPollInterval = 10 * time.Second
+
+// statuses of the nameservers in a DNSCheckReport
+const (
+	// the parent nameserver delegates to exactly the Substrate nameservers,
+	// or the Substrate nameserver answers authoritatively for the zone
+	dnsCheckOK = "ok"
+
+	// the parent nameserver has no delegation for the zone
+	dnsCheckMissing = "missing"
+
+	// the parent nameserver delegates to some other set of nameservers
+	dnsCheckMismatch = "mismatch"
+
+	// the Substrate nameserver doesn't answer authoritatively for the zone
+	dnsCheckLame = "lame"
+
+	// the nameserver couldn't be resolved or didn't answer
+	dnsCheckUnreachable = "unreachable"
+)
+
+// DNSCheckInput contains the input parameters for checking a zone's DNS delegation
+type DNSCheckInput struct {
+	// ManifestPath is the manifest of an existing zone to check
+	ManifestPath string
+
+	// EnvironmentDomain and ZoneIndex describe a proposed zone to check
+	// instead (using the Substrate delegation set in the current account)
+	EnvironmentDomain string
+	ZoneIndex         int
+
+	// Wait polls until the delegation is consistent (or Timeout passes)
+	Wait    bool
+	Timeout time.Duration
+
+	// JSON prints the report as JSON
+	JSON bool
+
+	// RecursiveNameserver is the IP of the nameserver used to find the parent
+	// zone and resolve nameserver names (defaults to the first nameserver in
+	// /etc/resolv.conf)
+	RecursiveNameserver string
+
+	// Resolver sends the DNS queries (defaults to a util.DNSClientResolver)
+	Resolver util.DNSResolver
+}
+
+// ParentNameserverCheck is what one of the parent zone's nameservers says about the delegation
+type ParentNameserverCheck struct {
+	Name        string   `json:"name"`
+	Address     string   `json:"address,omitempty"`
+	Status      string   `json:"status"`
+	Nameservers []string `json:"nameservers,omitempty"`
+	MissingGlue []string `json:"missing_glue,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// DelegatedNameserverCheck is what one of the Substrate nameservers says about the zone
+type DelegatedNameserverCheck struct {
+	Name      string `json:"name"`
+	Address   string `json:"address,omitempty"`
+	Status    string `json:"status"`
+	SOASerial uint32 `json:"soa_serial,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// DNSCheckReport describes how consistently a zone subdomain is delegated to
+// the Substrate nameservers
+type DNSCheckReport struct {
+	Zone                string                     `json:"zone"`
+	ParentZone          string                     `json:"parent_zone"`
+	ExpectedNameservers []string                   `json:"expected_nameservers"`
+	Parents             []ParentNameserverCheck    `json:"parent_nameservers"`
+	Delegated           []DelegatedNameserverCheck `json:"delegated_nameservers"`
+	Problems            []string                   `json:"problems"`
+	Consistent          bool                       `json:"consistent"`
+}
+
+// dnsChecker runs the queries for a DNS check
+type dnsChecker struct {
+	resolver  util.DNSResolver
+	recursive string
+}
+
+// query sends a query, returning an error for anything but NOERROR or NXDOMAIN
+func (c *dnsChecker) query(server string, name string, qtype uint16, recursive bool) (*dns.Msg, error) {
+	reply, err := c.resolver.Query(server, name, qtype, recursive)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s returned %s for %s %s", server, dns.RcodeToString[reply.Rcode], name, dns.TypeToString[qtype])
+	}
+	return reply, nil
+}
+
+// lookupAddress resolves a nameserver name to an IPv4 address with the recursive nameserver
+func (c *dnsChecker) lookupAddress(name string) (string, error) {
+	reply, err := c.query(c.recursive, name, dns.TypeA, true)
+	if err != nil {
+		return "", err
+	}
+	for _, answer := range reply.Answer {
+		if a, ok := answer.(*dns.A); ok {
+			return a.A.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no address found for %s", name)
+}
+
+// findParentZone finds the closest enclosing zone of `name` that has
+// nameservers, returning the zone and its nameserver names
+func (c *dnsChecker) findParentZone(name string) (string, []string, error) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		suffix := strings.Join(labels[i:], ".")
+		reply, err := c.query(c.recursive, suffix, dns.TypeNS, true)
+		if err != nil {
+			return "", nil, err
+		}
+		nameservers := []string{}
+		for _, answer := range reply.Answer {
+			if ns, ok := answer.(*dns.NS); ok && strings.EqualFold(dns.Fqdn(ns.Hdr.Name), dns.Fqdn(suffix)) {
+				nameservers = append(nameservers, strings.TrimSuffix(ns.Ns, "."))
+			}
+		}
+		if len(nameservers) > 0 {
+			sort.Strings(nameservers)
+			return suffix, nameservers, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no parent zone of %q found w/working DNS", name)
+}
+
+// checkParent asks a parent nameserver (without recursion) who `zone` is delegated to
+func (c *dnsChecker) checkParent(name string, zone string, expected []string) ParentNameserverCheck {
+	result := ParentNameserverCheck{Name: name}
+	address, err := c.lookupAddress(name)
+	if err != nil {
+		result.Status = dnsCheckUnreachable
+		result.Error = err.Error()
+		return result
+	}
+	result.Address = address
+
+	reply, err := c.query(address, zone, dns.TypeNS, false)
+	if err != nil {
+		result.Status = dnsCheckUnreachable
+		result.Error = err.Error()
+		return result
+	}
+
+	// normally we get a referral in the authority section, but if the parent
+	// nameserver happens to host the zone too it answers authoritatively
+	records := reply.Ns
+	if reply.Authoritative && len(reply.Answer) > 0 {
+		records = reply.Answer
+	}
+	for _, record := range records {
+		if ns, ok := record.(*dns.NS); ok && strings.EqualFold(dns.Fqdn(ns.Hdr.Name), dns.Fqdn(zone)) {
+			result.Nameservers = append(result.Nameservers, strings.TrimSuffix(ns.Ns, "."))
+		}
+	}
+	sort.Strings(result.Nameservers)
+
+	// nameservers inside the zone itself can't be found without glue records
+	glue := map[string]bool{}
+	for _, extra := range reply.Extra {
+		if a, ok := extra.(*dns.A); ok {
+			glue[strings.ToLower(dns.Fqdn(a.Hdr.Name))] = true
+		}
+		if aaaa, ok := extra.(*dns.AAAA); ok {
+			glue[strings.ToLower(dns.Fqdn(aaaa.Hdr.Name))] = true
+		}
+	}
+	for _, ns := range result.Nameservers {
+		if dns.IsSubDomain(dns.Fqdn(zone), dns.Fqdn(ns)) && !glue[strings.ToLower(dns.Fqdn(ns))] {
+			result.MissingGlue = append(result.MissingGlue, ns)
+		}
+	}
+
+	switch {
+	case len(result.Nameservers) == 0:
+		result.Status = dnsCheckMissing
+	case !util.SameNameservers(result.Nameservers, expected):
+		result.Status = dnsCheckMismatch
+	default:
+		result.Status = dnsCheckOK
+	}
+	return result
+}
+
+// checkDelegated asks a Substrate nameserver (without recursion) for the SOA of `zone`
+func (c *dnsChecker) checkDelegated(name string, zone string) DelegatedNameserverCheck {
+	result := DelegatedNameserverCheck{Name: name}
+	address, err := c.lookupAddress(name)
+	if err != nil {
+		result.Status = dnsCheckUnreachable
+		result.Error = err.Error()
+		return result
+	}
+	result.Address = address
+
+	reply, err := c.query(address, zone, dns.TypeSOA, false)
+	if err != nil {
+		result.Status = dnsCheckUnreachable
+		result.Error = err.Error()
+		return result
+	}
+	for _, answer := range reply.Answer {
+		if soa, ok := answer.(*dns.SOA); ok && strings.EqualFold(dns.Fqdn(soa.Hdr.Name), dns.Fqdn(zone)) {
+			result.SOASerial = soa.Serial
+		}
+	}
+	if !reply.Authoritative || result.SOASerial == 0 {
+		result.Status = dnsCheckLame
+		result.Error = "no authoritative SOA record"
+		return result
+	}
+	result.Status = dnsCheckOK
+	return result
+}
+
+// checkDelegation queries every nameserver of the parent zone and every
+// expected (Substrate) nameserver to see how consistently `zone` is delegated
+func checkDelegation(resolver util.DNSResolver, recursiveNameserver string, zone string, expected []string) (*DNSCheckReport, error) {
+	c := &dnsChecker{resolver: resolver, recursive: recursiveNameserver}
+	expectedNames := []string{}
+	for _, name := range expected {
+		expectedNames = append(expectedNames, strings.TrimSuffix(name, "."))
+	}
+	expected = expectedNames
+	sort.Strings(expected)
+
+	parentZone, parentNameservers, err := c.findParentZone(zone)
+	if err != nil {
+		return nil, err
+	}
+	report := &DNSCheckReport{
+		Zone:                zone,
+		ParentZone:          parentZone,
+		ExpectedNameservers: expected,
+		Parents:             []ParentNameserverCheck{},
+		Delegated:           []DelegatedNameserverCheck{},
+		Problems:            []string{},
+	}
+
+	delegating := 0
+	for _, name := range parentNameservers {
+		result := c.checkParent(name, zone, expected)
+		report.Parents = append(report.Parents, result)
+		switch result.Status {
+		case dnsCheckOK:
+			delegating++
+		case dnsCheckMissing:
+			report.Problems = append(report.Problems, fmt.Sprintf("parent nameserver %s has no delegation for %s", name, zone))
+		case dnsCheckMismatch:
+			report.Problems = append(report.Problems, fmt.Sprintf(
+				"parent nameserver %s delegates %s to [%s] instead",
+				name,
+				zone,
+				strings.Join(result.Nameservers, ", ")))
+		default:
+			report.Problems = append(report.Problems, fmt.Sprintf("parent nameserver %s: %s", name, result.Error))
+		}
+		if len(result.MissingGlue) > 0 {
+			report.Problems = append(report.Problems, fmt.Sprintf(
+				"parent nameserver %s has no glue records for [%s]",
+				name,
+				strings.Join(result.MissingGlue, ", ")))
+		}
+	}
+	if delegating > 0 && delegating < len(parentNameservers) {
+		report.Problems = append(report.Problems, fmt.Sprintf(
+			"the delegation is only partially propagated (%d of %d parent nameservers have it)",
+			delegating,
+			len(parentNameservers)))
+	}
+
+	serials := map[uint32]bool{}
+	for _, name := range expected {
+		result := c.checkDelegated(name, zone)
+		report.Delegated = append(report.Delegated, result)
+		switch result.Status {
+		case dnsCheckOK:
+			serials[result.SOASerial] = true
+		case dnsCheckLame:
+			report.Problems = append(report.Problems, fmt.Sprintf("lame delegation: %s is not authoritative for %s", name, zone))
+		default:
+			report.Problems = append(report.Problems, fmt.Sprintf("Substrate nameserver %s: %s", name, result.Error))
+		}
+	}
+	if len(serials) > 1 {
+		report.Problems = append(report.Problems, fmt.Sprintf("the Substrate nameservers disagree on the SOA serial of %s", zone))
+	}
+
+	report.Consistent = len(report.Problems) == 0
+	return report, nil
+}
+
+// Print writes a human readable version of the report
+func (r *DNSCheckReport) Print(out io.Writer) {
+	fmt.Fprintf(out, "\ndelegation of %s from %s\n", r.Zone, r.ParentZone)
+	fmt.Fprintf(out, "\nparent nameservers:\n")
+	for _, parent := range r.Parents {
+		fmt.Fprintf(out, "    %-40s %-16s %s\n", parent.Name, parent.Address, parent.Status)
+	}
+	fmt.Fprintf(out, "\nSubstrate nameservers:\n")
+	for _, delegated := range r.Delegated {
+		serial := ""
+		if delegated.SOASerial != 0 {
+			serial = fmt.Sprintf("(SOA serial %d)", delegated.SOASerial)
+		}
+		fmt.Fprintf(out, "    %-40s %-16s %s %s\n", delegated.Name, delegated.Address, delegated.Status, serial)
+	}
+	if r.Consistent {
+		fmt.Fprintf(out, "\n%s is delegated to the Substrate nameservers\n", r.Zone)
+		return
+	}
+	fmt.Fprintf(out, "\n%d problems found:\n", len(r.Problems))
+	for _, problem := range r.Problems {
+		fmt.Fprintf(out, "    %s\n", problem)
+	}
+}
+
+// DNSCheck checks whether an existing or proposed zone's subdomain is
+// delegated to the Substrate nameservers by every nameserver of its parent
+// zone, and whether the Substrate nameservers are serving it
+func DNSCheck(params *DNSCheckInput) (*DNSCheckReport, error) {
+	var zone string
+	var expected []string
+	route53Svc := route53.New(session.New(), &aws.Config{Region: aws.String("us-east-1")})
+	if params.EnvironmentDomain != "" {
+		zone = fmt.Sprintf("zone%02d.%s", params.ZoneIndex, params.EnvironmentDomain)
+		nameservers, _, found, err := util.FindSubstrateReusableDelegationSet(route53Svc)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("there's no Substrate Route53 Reusable Delegation Set in the current AWS account yet (`substrate zone create` makes one)")
+		}
+		expected = nameservers
+	} else {
+		zoneManifest, err := ReadManifest(params.ManifestPath)
+		if err != nil {
+			return nil, err
+		}
+		zone = fmt.Sprintf("zone%02d.%s", zoneManifest.ZoneIndex, zoneManifest.EnvironmentDomain)
+		if zoneManifest.DelegationSetID == "" {
+			return nil, fmt.Errorf("zone manifest %q has no delegation set ID", params.ManifestPath)
+		}
+		expected, err = util.GetReusableDelegationSet(route53Svc, zoneManifest.DelegationSetID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resolver := params.Resolver
+	if resolver == nil {
+		resolver = &util.DNSClientResolver{Timeout: 5 * time.Second}
+	}
+	recursiveNameserver := params.RecursiveNameserver
+	if recursiveNameserver == "" {
+		var err error
+		recursiveNameserver, err = util.DefaultRecursiveNameserver()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// keep stdout clean for the JSON report
+	var progressOut io.Writer = os.Stdout
+	if params.JSON {
+		progressOut = os.Stderr
+	}
+
+	report, err := waitForDelegation(resolver, recursiveNameserver, zone, expected, params.Wait, params.Timeout, progressOut)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.JSON {
+		reportJSON, err := json.MarshalIndent(report, "", "    ")
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println(string(reportJSON))
+	} else {
+		report.Print(os.Stdout)
+	}
+	return report, nil
+}
+
+// waitForDelegation checks the delegation, and if wait is set keeps checking
+// until it's consistent or the timeout passes (returning the last report).
+// Progress is written to out.
+func waitForDelegation(resolver util.DNSResolver, recursiveNameserver string, zone string, expected []string, wait bool, timeout time.Duration, out io.Writer) (*DNSCheckReport, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		report, err := checkDelegation(resolver, recursiveNameserver, zone, expected)
+		if err != nil {
+			return nil, err
+		}
+		if !wait || report.Consistent || time.Now().After(deadline) {
+			return report, nil
+		}
+		fmt.Fprintf(
+			out,
+			"%s: %d problems with the delegation of %s, checking again in %v...\n",
+			time.Now().Format("15:04:05"),
+			len(report.Problems),
+			zone,
+			dnsCheckPollInterval)
+		time.Sleep(dnsCheckPollInterval)
+	}
+}
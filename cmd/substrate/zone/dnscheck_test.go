@@ -0,0 +1,216 @@
+package zone
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// fakeResolver answers DNS queries from canned replies, by server address
+// and then "name TYPE". Servers it has no replies for are unreachable.
+type fakeResolver map[string]map[string]*dns.Msg
+
+func (r fakeResolver) Query(server string, name string, qtype uint16, recursive bool) (*dns.Msg, error) {
+	replies, ok := r[server]
+	if !ok {
+		return nil, fmt.Errorf("error querying %s: i/o timeout", server)
+	}
+	reply, ok := replies[dns.Fqdn(name)+" "+dns.TypeToString[qtype]]
+	if !ok {
+		// an empty NOERROR reply, like a nameserver with nothing to say
+		return &dns.Msg{}, nil
+	}
+	return reply, nil
+}
+
+func testRRs(t *testing.T, records ...string) []dns.RR {
+	result := []dns.RR{}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("%q: %v", record, err)
+		}
+		result = append(result, rr)
+	}
+	return result
+}
+
+const (
+	testRecursive = "10.0.0.2"
+	testZone      = "zone00.dev.example.com"
+)
+
+var testSubstrateNameservers = []string{"ns-1.awsdns-01.com", "ns-2.awsdns-02.net"}
+
+// newTestDNS is a working recursive nameserver, two nameservers for the
+// parent zone (dev.example.com) and the two Substrate nameservers, with the
+// given replies from the parent nameservers to `zone NS` and from the
+// Substrate nameservers to `zone SOA`
+func newTestDNS(t *testing.T, parents [2]*dns.Msg, delegated [2]*dns.Msg) fakeResolver {
+	recursive := map[string]*dns.Msg{
+		"dev.example.com. NS": {Answer: testRRs(t,
+			"dev.example.com. 300 IN NS ns1.example.org.",
+			"dev.example.com. 300 IN NS ns2.example.org.")},
+	}
+	addresses := map[string]string{
+		"ns1.example.org.":    "192.0.2.1",
+		"ns2.example.org.":    "192.0.2.2",
+		"ns-1.awsdns-01.com.": "198.51.100.1",
+		"ns-2.awsdns-02.net.": "198.51.100.2",
+	}
+	for name, address := range addresses {
+		recursive[name+" A"] = &dns.Msg{Answer: testRRs(t, fmt.Sprintf("%s 300 IN A %s", name, address))}
+	}
+	resolver := fakeResolver{testRecursive: recursive}
+	for i, address := range []string{"192.0.2.1", "192.0.2.2"} {
+		if parents[i] != nil {
+			resolver[address] = map[string]*dns.Msg{dns.Fqdn(testZone) + " NS": parents[i]}
+		}
+	}
+	for i, address := range []string{"198.51.100.1", "198.51.100.2"} {
+		if delegated[i] != nil {
+			resolver[address] = map[string]*dns.Msg{dns.Fqdn(testZone) + " SOA": delegated[i]}
+		}
+	}
+	return resolver
+}
+
+func TestCheckDelegation(t *testing.T) {
+	referral := &dns.Msg{Ns: testRRs(t,
+		"zone00.dev.example.com. 172800 IN NS ns-1.awsdns-01.com.",
+		"zone00.dev.example.com. 172800 IN NS ns-2.awsdns-02.net.")}
+	wrongReferral := &dns.Msg{Ns: testRRs(t,
+		"zone00.dev.example.com. 172800 IN NS ns-9.awsdns-09.org.")}
+	noDelegation := &dns.Msg{Ns: testRRs(t,
+		"dev.example.com. 900 IN SOA ns1.example.org. hostmaster.example.com. 7 7200 900 1209600 86400")}
+	noDelegation.Rcode = dns.RcodeNameError
+	authoritative := func(serial int) *dns.Msg {
+		reply := &dns.Msg{Answer: testRRs(t, fmt.Sprintf(
+			"zone00.dev.example.com. 900 IN SOA ns-1.awsdns-01.com. awsdns-hostmaster.amazon.com. %d 7200 900 1209600 86400",
+			serial))}
+		reply.Authoritative = true
+		return reply
+	}
+	// a nameserver that doesn't host the zone, answering without authority
+	lame := &dns.Msg{}
+
+	tests := []struct {
+		name      string
+		parents   [2]*dns.Msg
+		delegated [2]*dns.Msg
+
+		wantParents   []string
+		wantDelegated []string
+		wantProblems  []string
+	}{
+		{
+			name:          "consistent",
+			parents:       [2]*dns.Msg{referral, referral},
+			delegated:     [2]*dns.Msg{authoritative(1), authoritative(1)},
+			wantParents:   []string{dnsCheckOK, dnsCheckOK},
+			wantDelegated: []string{dnsCheckOK, dnsCheckOK},
+			wantProblems:  []string{},
+		},
+		{
+			name:          "partially propagated",
+			parents:       [2]*dns.Msg{referral, noDelegation},
+			delegated:     [2]*dns.Msg{authoritative(1), authoritative(1)},
+			wantParents:   []string{dnsCheckOK, dnsCheckMissing},
+			wantDelegated: []string{dnsCheckOK, dnsCheckOK},
+			wantProblems: []string{
+				"parent nameserver ns2.example.org has no delegation",
+				"only partially propagated (1 of 2",
+			},
+		},
+		{
+			name:          "lame",
+			parents:       [2]*dns.Msg{referral, referral},
+			delegated:     [2]*dns.Msg{authoritative(1), lame},
+			wantParents:   []string{dnsCheckOK, dnsCheckOK},
+			wantDelegated: []string{dnsCheckOK, dnsCheckLame},
+			wantProblems:  []string{"lame delegation: ns-2.awsdns-02.net is not authoritative"},
+		},
+		{
+			name:          "missing",
+			parents:       [2]*dns.Msg{noDelegation, noDelegation},
+			delegated:     [2]*dns.Msg{authoritative(1), authoritative(1)},
+			wantParents:   []string{dnsCheckMissing, dnsCheckMissing},
+			wantDelegated: []string{dnsCheckOK, dnsCheckOK},
+			wantProblems: []string{
+				"parent nameserver ns1.example.org has no delegation",
+				"parent nameserver ns2.example.org has no delegation",
+			},
+		},
+		{
+			name:          "delegated elsewhere",
+			parents:       [2]*dns.Msg{wrongReferral, wrongReferral},
+			delegated:     [2]*dns.Msg{authoritative(1), authoritative(1)},
+			wantParents:   []string{dnsCheckMismatch, dnsCheckMismatch},
+			wantDelegated: []string{dnsCheckOK, dnsCheckOK},
+			wantProblems: []string{
+				"parent nameserver ns1.example.org delegates zone00.dev.example.com to [ns-9.awsdns-09.org] instead",
+				"parent nameserver ns2.example.org delegates zone00.dev.example.com to [ns-9.awsdns-09.org] instead",
+			},
+		},
+		{
+			name:          "serials disagree and a nameserver is down",
+			parents:       [2]*dns.Msg{referral, nil},
+			delegated:     [2]*dns.Msg{authoritative(1), authoritative(2)},
+			wantParents:   []string{dnsCheckOK, dnsCheckUnreachable},
+			wantDelegated: []string{dnsCheckOK, dnsCheckOK},
+			wantProblems: []string{
+				"parent nameserver ns2.example.org: error querying 192.0.2.2",
+				"only partially propagated (1 of 2",
+				"disagree on the SOA serial",
+			},
+		},
+	}
+	for _, test := range tests {
+		resolver := newTestDNS(t, test.parents, test.delegated)
+		report, err := checkDelegation(resolver, testRecursive, testZone, testSubstrateNameservers)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if report.ParentZone != "dev.example.com" {
+			t.Errorf("%s: expected parent zone dev.example.com, got %q", test.name, report.ParentZone)
+		}
+		parents := []string{}
+		for _, parent := range report.Parents {
+			parents = append(parents, parent.Status)
+		}
+		if !reflect.DeepEqual(parents, test.wantParents) {
+			t.Errorf("%s: expected parent statuses %v, got %v", test.name, test.wantParents, parents)
+		}
+		delegated := []string{}
+		for _, substrate := range report.Delegated {
+			delegated = append(delegated, substrate.Status)
+		}
+		if !reflect.DeepEqual(delegated, test.wantDelegated) {
+			t.Errorf("%s: expected Substrate nameserver statuses %v, got %v", test.name, test.wantDelegated, delegated)
+		}
+
+		if len(report.Problems) != len(test.wantProblems) {
+			t.Errorf("%s: expected %d problems, got %q", test.name, len(test.wantProblems), report.Problems)
+			continue
+		}
+		for i, want := range test.wantProblems {
+			if !strings.Contains(report.Problems[i], want) {
+				t.Errorf("%s: expected problem %q, got %q", test.name, want, report.Problems[i])
+			}
+		}
+		if report.Consistent != (len(test.wantProblems) == 0) {
+			t.Errorf("%s: expected consistent to be %v", test.name, len(test.wantProblems) == 0)
+		}
+	}
+}
+
+func TestCheckDelegationNoParent(t *testing.T) {
+	_, err := checkDelegation(fakeResolver{testRecursive: {}}, testRecursive, testZone, testSubstrateNameservers)
+	if err == nil || !strings.Contains(err.Error(), "no parent zone") {
+		t.Fatalf("expected an error finding the parent zone, got %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// DriftInput contains the input parameters for detecting drift in a zone
+type DriftInput struct {
+	ManifestPath string
+
+	// JSON prints the drift report as JSON (and sends Terraform's output to stderr)
+	JSON bool
+}
+
+// DriftedAttribute is a resource attribute whose live value differs from the manifest
+type DriftedAttribute struct {
+	Name     string `json:"name"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// DriftedResource is a resource whose live state differs from the manifest
+type DriftedResource struct {
+	Address string `json:"address"`
+	Module  string `json:"module"`
+	ID      string `json:"id"`
+
+	// Status is "missing" if the resource no longer exists, or "changed"
+	Status     string             `json:"status"`
+	Attributes []DriftedAttribute `json:"attributes,omitempty"`
+}
+
+// DriftReport lists every resource in a zone that has drifted from the state in its manifest
+type DriftReport struct {
+	ZoneName  string            `json:"zone_name"`
+	Drifted   bool              `json:"drifted"`
+	Resources []DriftedResource `json:"resources"`
+}
+
+// compareTerraformStates reports how the resources in the actual state differ from the expected state
+func compareTerraformStates(expectedState interface{}, actualState interface{}) ([]DriftedResource, error) {
+	expected, err := terraformStateResources(expectedState)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := terraformStateResources(actualState)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := []string{}
+	for address := range expected {
+		if !isDataResource(address) {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+
+	result := []DriftedResource{}
+	for _, address := range addresses {
+		expectedResource := expected[address]
+		drifted := DriftedResource{
+			Address: address,
+			Module:  expectedResource.Module,
+			ID:      expectedResource.ID,
+		}
+
+		actualResource, ok := actual[address]
+		if !ok {
+			drifted.Status = "missing"
+			result = append(result, drifted)
+			continue
+		}
+
+		names := map[string]bool{}
+		for name := range expectedResource.Attributes {
+			names[name] = true
+		}
+		for name := range actualResource.Attributes {
+			names[name] = true
+		}
+		sortedNames := []string{}
+		for name := range names {
+			sortedNames = append(sortedNames, name)
+		}
+		sort.Strings(sortedNames)
+
+		for _, name := range sortedNames {
+			expectedValue, expectedOK := expectedResource.Attributes[name]
+			actualValue, actualOK := actualResource.Attributes[name]
+			if expectedOK && actualOK && expectedValue == actualValue {
+				continue
+			}
+			if !expectedOK {
+				expectedValue = "<unset>"
+			}
+			if !actualOK {
+				actualValue = "<unset>"
+			}
+			drifted.Attributes = append(drifted.Attributes, DriftedAttribute{
+				Name:     name,
+				Expected: expectedValue,
+				Actual:   actualValue,
+			})
+		}
+		if len(drifted.Attributes) > 0 {
+			drifted.Status = "changed"
+			result = append(result, drifted)
+		}
+	}
+	return result, nil
+}
+
+// Print writes a human readable version of the report
+func (r *DriftReport) Print(out io.Writer) {
+	if !r.Drifted {
+		fmt.Fprintf(out, "\nno drift detected in zone %s\n", r.ZoneName)
+		return
+	}
+	fmt.Fprintf(out, "\n%d resources in zone %s have drifted from the manifest:\n", len(r.Resources), r.ZoneName)
+	for _, resource := range r.Resources {
+		fmt.Fprintf(out, "\n%s (%s) %s\n", resource.Address, resource.ID, resource.Status)
+		for _, attribute := range resource.Attributes {
+			fmt.Fprintf(out, "    %s: %q => %q\n", attribute.Name, attribute.Expected, attribute.Actual)
+		}
+	}
+}
+
+// Drift refreshes a temporary copy of a zone's Terraform state against AWS
+// and reports every resource that no longer matches the manifest. The
+// manifest itself is never modified.
+func Drift(params *DriftInput) (*DriftReport, error) {
+	zoneManifest, err := ReadManifest(params.ManifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep stdout clean for the JSON report
+	var terraformOut io.Writer = os.Stdout
+	if params.JSON {
+		terraformOut = os.Stderr
+	}
+
+	workspace, err := newTerraformWorkspace(zoneManifest, terraformOut)
+	if err != nil {
+		return nil, err
+	}
+	defer workspace.Cleanup()
+
+	_, err = workspace.Runner.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	// refresh the temporary copy of the state in place
+	_, err = workspace.Runner.Refresh(workspace.TerraformPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshedStateJSON, err := ioutil.ReadFile(workspace.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	var refreshedState interface{}
+	err = json.Unmarshal(refreshedStateJSON, &refreshedState)
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := compareTerraformStates(zoneManifest.TerraformState, refreshedState)
+	if err != nil {
+		return nil, err
+	}
+	report := &DriftReport{
+		ZoneName:  zoneManifest.ZoneName(),
+		Drifted:   len(resources) > 0,
+		Resources: resources,
+	}
+
+	if params.JSON {
+		reportJSON, err := json.MarshalIndent(report, "", "    ")
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println(string(reportJSON))
+	} else {
+		report.Print(os.Stdout)
+	}
+	return report, nil
+}
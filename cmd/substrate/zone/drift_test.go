@@ -0,0 +1,117 @@
+package zone
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func readTestState(t *testing.T, fixture string) interface{} {
+	stateJSON, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tfState interface{}
+	err = json.Unmarshal(stateJSON, &tfState)
+	if err != nil {
+		t.Fatalf("%s: %v", fixture, err)
+	}
+	return tfState
+}
+
+func TestCompareTerraformStates(t *testing.T) {
+	tests := []struct {
+		refreshed string
+		want      []DriftedResource
+	}{
+		{
+			refreshed: "refreshed-unchanged.tfstate",
+			want:      []DriftedResource{},
+		},
+		{
+			// the border was changed by hand, the legacy record and a worker
+			// were deleted, and a security group was added outside Terraform
+			// (which isn't drift in anything we manage). The data source was
+			// re-read, which isn't drift either.
+			refreshed: "refreshed-drifted.tfstate",
+			want: []DriftedResource{
+				{
+					Address: "aws_route53_record.legacy",
+					Module:  "root",
+					ID:      "Z3M3LMPEXAMPLE_legacy.zone00.dev.example.com_CNAME",
+					Status:  "missing",
+				},
+				{
+					Address: "module.border-0.aws_instance.border",
+					Module:  "border-0",
+					ID:      "i-0a1b2c3d4e5f60718",
+					Status:  "changed",
+					Attributes: []DriftedAttribute{
+						{Name: "instance_type", Expected: "t2.nano", Actual: "t2.micro"},
+						{Name: "source_dest_check", Expected: "false", Actual: "<unset>"},
+						{Name: "tags.%", Expected: "1", Actual: "2"},
+						{Name: "tags.Owner", Expected: "<unset>", Actual: "someone"},
+					},
+				},
+				{
+					Address: "module.workers.aws_instance.workers.1",
+					Module:  "workers",
+					ID:      "i-0918273645aabbccd",
+					Status:  "missing",
+				},
+			},
+		},
+	}
+	expected := readTestState(t, "expected.tfstate")
+	for _, test := range tests {
+		got, err := compareTerraformStates(expected, readTestState(t, test.refreshed))
+		if err != nil {
+			t.Fatalf("%s: %v", test.refreshed, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected\n%+v\ngot\n%+v", test.refreshed, test.want, got)
+		}
+	}
+}
+
+func TestCompareTerraformStatesMalformed(t *testing.T) {
+	_, err := compareTerraformStates(readTestState(t, "expected.tfstate"), []interface{}{})
+	if err == nil {
+		t.Fatal("expected an error comparing against a malformed state")
+	}
+}
+
+func TestTerraformStateResources(t *testing.T) {
+	resources, err := terraformStateResources(readTestState(t, "expected.tfstate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		address string
+		module  string
+		data    bool
+	}{
+		{"aws_vpc.zone", "root", false},
+		{"data.aws_caller_identity.current", "root", true},
+		{"module.border-0.aws_eip.border", "border-0", false},
+		{"module.workers.aws_instance.workers.0", "workers", false},
+	}
+	for _, test := range tests {
+		resource, ok := resources[test.address]
+		if !ok {
+			t.Errorf("%s: missing from %v", test.address, resources)
+			continue
+		}
+		if resource.Module != test.module {
+			t.Errorf("%s: expected module %q, got %q", test.address, test.module, resource.Module)
+		}
+		if isDataResource(test.address) != test.data {
+			t.Errorf("%s: expected isDataResource to be %v", test.address, test.data)
+		}
+	}
+	if len(resources) != 7 {
+		t.Errorf("expected 7 resources, got %d", len(resources))
+	}
+}
@@ -0,0 +1,358 @@
+package zone
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ManifestKeyEnvVar names an environment variable holding the key provider
+// spec (e.g., "keyfile:/path/to/key") used to encrypt and decrypt manifests
+const ManifestKeyEnvVar = "SUBSTRATE_MANIFEST_KEY"
+
+// ManifestPassphraseEnvVar names the environment variable read by the "passphrase" key provider
+const ManifestPassphraseEnvVar = "SUBSTRATE_MANIFEST_PASSPHRASE"
+
+// DefaultManifestKeyFile is where the "keyfile" key provider looks for its key if no path is given
+var DefaultManifestKeyFile = os.ExpandEnv("$HOME/.substrate/manifest.key")
+
+// KeyProvider wraps and unwraps the random per-write data keys used to
+// encrypt zone manifests (envelope encryption)
+type KeyProvider interface {
+	// Name returns the name under which this provider is registered
+	Name() string
+
+	// KeyID returns a non-secret identifier for the key this provider wraps with
+	KeyID() string
+
+	// WrapKey encrypts a data key
+	WrapKey(dataKey []byte) ([]byte, error)
+
+	// UnwrapKey decrypts a data key previously encrypted with WrapKey
+	UnwrapKey(wrappedKey []byte) ([]byte, error)
+}
+
+// KeyProviderFactory creates a KeyProvider from the argument part of a key
+// provider spec (the part after the "name:" prefix, possibly empty)
+type KeyProviderFactory func(arg string) (KeyProvider, error)
+
+// keyProviders maps key provider names to their factories
+var keyProviders = map[string]KeyProviderFactory{
+	"keyfile":    newKeyFileProvider,
+	"passphrase": newPassphraseProvider,
+}
+
+// RegisterKeyProvider makes a key provider available under the given name
+func RegisterKeyProvider(name string, factory KeyProviderFactory) {
+	keyProviders[name] = factory
+}
+
+// OpenKeyProvider creates a KeyProvider from a spec like "keyfile:/path/to/key"
+// or "passphrase". An empty spec uses $SUBSTRATE_MANIFEST_KEY, falling back
+// to the default key file.
+func OpenKeyProvider(spec string) (KeyProvider, error) {
+	if spec == "" {
+		spec = os.Getenv(ManifestKeyEnvVar)
+	}
+	if spec == "" {
+		spec = "keyfile"
+	}
+
+	parts := strings.SplitN(spec, ":", 2)
+	factory, ok := keyProviders[parts[0]]
+	if !ok {
+		names := []string{}
+		for name := range keyProviders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown manifest key provider %q (expected one of: %s)", parts[0], strings.Join(names, ", "))
+	}
+
+	arg := ""
+	if len(parts) == 2 {
+		arg = parts[1]
+	}
+	return factory(arg)
+}
+
+// encryptedManifestEnvelope is the on-disk form of an encrypted manifest
+type encryptedManifestEnvelope struct {
+	Encrypted struct {
+		Version     int    `json:"version"`
+		KeyProvider string `json:"key_provider"`
+		KeyID       string `json:"key_id"`
+		WrappedKey  []byte `json:"wrapped_key"`
+		Nonce       []byte `json:"nonce"`
+		Ciphertext  []byte `json:"ciphertext"`
+	} `json:"substrate_encrypted_manifest"`
+}
+
+// encryptedManifestAAD binds the ciphertext to its purpose
+var encryptedManifestAAD = []byte("substrate-encrypted-manifest-v1")
+
+// encryptManifestJSON encrypts a plaintext manifest under a fresh data key wrapped by the provider
+func encryptManifestJSON(plaintext []byte, provider KeyProvider) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	nonce, ciphertext, err := sealAESGCM(dataKey, plaintext, encryptedManifestAAD)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := provider.WrapKey(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("error wrapping manifest data key with %s key %s: %v", provider.Name(), provider.KeyID(), err)
+	}
+
+	var envelope encryptedManifestEnvelope
+	envelope.Encrypted.Version = 1
+	envelope.Encrypted.KeyProvider = provider.Name()
+	envelope.Encrypted.KeyID = provider.KeyID()
+	envelope.Encrypted.WrappedKey = wrappedKey
+	envelope.Encrypted.Nonce = nonce
+	envelope.Encrypted.Ciphertext = ciphertext
+	return json.MarshalIndent(&envelope, "", "    ")
+}
+
+// decodeManifestJSON returns the plaintext JSON of a stored manifest, along
+// with the key provider it was encrypted with (nil if it was stored in plaintext)
+func decodeManifestJSON(stored []byte) ([]byte, KeyProvider, error) {
+	var envelope encryptedManifestEnvelope
+	if err := json.Unmarshal(stored, &envelope); err != nil {
+		return nil, nil, err
+	}
+	if envelope.Encrypted.KeyProvider == "" {
+		return stored, nil, nil
+	}
+	if envelope.Encrypted.Version != 1 {
+		return nil, nil, fmt.Errorf("unsupported encrypted manifest version %d", envelope.Encrypted.Version)
+	}
+
+	provider, err := keyProviderFor(envelope.Encrypted.KeyProvider, envelope.Encrypted.KeyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey, err := provider.UnwrapKey(envelope.Encrypted.WrappedKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error unwrapping manifest data key with %s key %s: %v", provider.Name(), provider.KeyID(), err)
+	}
+
+	plaintext, err := openAESGCM(dataKey, envelope.Encrypted.Nonce, envelope.Encrypted.Ciphertext, encryptedManifestAAD)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decrypting manifest: %v", err)
+	}
+	return plaintext, provider, nil
+}
+
+// keyProviderFor finds a key provider that can unwrap keys from the named
+// provider and key ID, using $SUBSTRATE_MANIFEST_KEY if it's set or else the
+// provider's default configuration
+func keyProviderFor(name string, keyID string) (KeyProvider, error) {
+	spec := os.Getenv(ManifestKeyEnvVar)
+	if spec == "" || strings.SplitN(spec, ":", 2)[0] != name {
+		spec = name
+	}
+	provider, err := OpenKeyProvider(spec)
+	if err != nil {
+		return nil, fmt.Errorf("manifest is encrypted with %s key %s: %v", name, keyID, err)
+	}
+	if provider.KeyID() != keyID {
+		return nil, fmt.Errorf(
+			"manifest is encrypted with %s key %s, but the configured key is %s (set $%s to point at the right key)",
+			name,
+			keyID,
+			provider.KeyID(),
+			ManifestKeyEnvVar)
+	}
+	return provider, nil
+}
+
+func sealAESGCM(key []byte, plaintext []byte, aad []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, plaintext, aad), nil
+}
+
+func openAESGCM(key []byte, nonce []byte, ciphertext []byte, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed nonce")
+	}
+	return gcm.Open(nil, nonce, ciphertext, aad)
+}
+
+// keyFileProvider wraps data keys with a 256-bit key read from a local file
+type keyFileProvider struct {
+	key []byte
+}
+
+// keyFilePrefix marks the line in a key file that holds the key itself
+const keyFilePrefix = "SUBSTRATE-MANIFEST-KEY-"
+
+func newKeyFileProvider(path string) (KeyProvider, error) {
+	if path == "" {
+		path = DefaultManifestKeyFile
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest key file (create one with `substrate zone rekey --generate-key`?): %v", err)
+	}
+
+	// ignore blank lines and comments, so the key can be annotated
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, keyFilePrefix) {
+			continue
+		}
+		key, err := hex.DecodeString(strings.TrimPrefix(line, keyFilePrefix))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("malformed key in manifest key file %q", path)
+		}
+		return &keyFileProvider{key: key}, nil
+	}
+	return nil, fmt.Errorf("no %s... line found in manifest key file %q", keyFilePrefix, path)
+}
+
+// GenerateKeyFile writes a new random key to the given path (or the default
+// key file path if it's empty), refusing to overwrite an existing key
+func GenerateKeyFile(path string) (string, error) {
+	if path == "" {
+		path = DefaultManifestKeyFile
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	keyFile, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer keyFile.Close()
+
+	_, err = fmt.Fprintf(
+		keyFile,
+		"# Substrate zone manifest key (keep this secret, and keep a copy somewhere safe)\n%s%s\n",
+		keyFilePrefix,
+		hex.EncodeToString(key))
+	return path, err
+}
+
+func (p *keyFileProvider) Name() string {
+	return "keyfile"
+}
+
+func (p *keyFileProvider) KeyID() string {
+	sum := sha256.Sum256(p.key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (p *keyFileProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	nonce, sealed, err := sealAESGCM(p.key, dataKey, []byte(p.KeyID()))
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, sealed...), nil
+}
+
+func (p *keyFileProvider) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	if len(wrappedKey) < 12 {
+		return nil, fmt.Errorf("malformed wrapped key")
+	}
+	return openAESGCM(p.key, wrappedKey[:12], wrappedKey[12:], []byte(p.KeyID()))
+}
+
+// passphraseProvider wraps data keys with a key derived (via scrypt) from a
+// passphrase in $SUBSTRATE_MANIFEST_PASSPHRASE
+type passphraseProvider struct {
+	passphrase []byte
+}
+
+const passphraseSaltSize = 16
+
+func newPassphraseProvider(arg string) (KeyProvider, error) {
+	passphrase := os.Getenv(ManifestPassphraseEnvVar)
+	if passphrase == "" {
+		return nil, fmt.Errorf("$%s is not set", ManifestPassphraseEnvVar)
+	}
+	return &passphraseProvider{passphrase: []byte(passphrase)}, nil
+}
+
+func (p *passphraseProvider) Name() string {
+	return "passphrase"
+}
+
+// KeyID is the same for every passphrase, since we can't derive anything
+// from the passphrase without weakening it
+func (p *passphraseProvider) KeyID() string {
+	return "passphrase"
+}
+
+func (p *passphraseProvider) deriveKey(salt []byte) ([]byte, error) {
+	return scrypt.Key(p.passphrase, salt, 1<<15, 8, 1, 32)
+}
+
+func (p *passphraseProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	key, err := p.deriveKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce, sealed, err := sealAESGCM(key, dataKey, salt)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(salt, nonce...), sealed...), nil
+}
+
+func (p *passphraseProvider) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	if len(wrappedKey) < passphraseSaltSize+12 {
+		return nil, fmt.Errorf("malformed wrapped key")
+	}
+	salt := wrappedKey[:passphraseSaltSize]
+	key, err := p.deriveKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	return openAESGCM(key, wrappedKey[passphraseSaltSize:passphraseSaltSize+12], wrappedKey[passphraseSaltSize+12:], salt)
+}
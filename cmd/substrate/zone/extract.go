@@ -0,0 +1,88 @@
+package zone
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/assets"
+)
+
+// ExtractAssetsInput contains the input parameters for extracting the
+// embedded assets along with the zone config generated from a zone spec
+type ExtractAssetsInput struct {
+	// Directory to extract into (created if needed, but must be empty)
+	Directory string
+
+	// ManifestPath is the zone to render the generated config for (optional)
+	ManifestPath string
+
+	// Spec is a zone spec file to render the generated config from, for a
+	// zone placed by EnvironmentIndex, ZoneIndex and AWSAvailabilityZone
+	// (ignored if ManifestPath is set, and the defaults are used if it's empty)
+	Spec                string
+	EnvironmentIndex    int
+	ZoneIndex           int
+	AWSAvailabilityZone string
+}
+
+// ExtractAssets extracts the embedded assets (see assets.Extract), then
+// renders the zone's worker pools, director and borders from the extracted
+// templates, the same way Substrate does before it runs Terraform. The
+// rendered files aren't in the checksum manifest, since they depend on the
+// zone, but they're only ever generated from the signed templates.
+func ExtractAssets(params *ExtractAssetsInput) error {
+	zoneManifest, err := extractedZoneManifest(params)
+	if err != nil {
+		return err
+	}
+
+	err = assets.Extract(&assets.ExtractInput{Directory: params.Directory})
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(params.Directory)
+	if err != nil {
+		return err
+	}
+	err = writeZoneSpecTF(dir, zoneManifest)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf(
+		"rendered %s and %s from the zone spec (they depend on the zone, so they're not in %s)\n",
+		controlPlaneFile,
+		workerPoolsFile,
+		assets.ChecksumsFile)
+	fmt.Printf("to run Terraform against the zone configuration (with a .tfvars file for the zone):\n")
+	fmt.Printf("  cd %s\n", dir)
+	fmt.Printf("  PATH=\"$PWD/bin\" terraform get ./zone\n")
+	fmt.Printf("  PATH=\"$PWD/bin\" terraform plan -var-file=substrate.tfvars ./zone\n")
+	return nil
+}
+
+// extractedZoneManifest returns the zone to render the generated config for:
+// the one in the manifest, or else a zone with the given spec and placement
+func extractedZoneManifest(params *ExtractAssetsInput) (*SubstrateZoneManifest, error) {
+	if params.ManifestPath != "" {
+		return ReadManifest(params.ManifestPath)
+	}
+
+	zoneManifest := &SubstrateZoneManifest{
+		EnvironmentIndex:    params.EnvironmentIndex,
+		ZoneIndex:           params.ZoneIndex,
+		AWSAvailabilityZone: params.AWSAvailabilityZone,
+	}
+	if params.Spec != "" {
+		spec, err := ReadZoneSpec(params.Spec)
+		if err != nil {
+			return nil, err
+		}
+		zoneManifest.Spec = spec
+	}
+	err := zoneManifest.checkZoneSpec()
+	if err != nil {
+		return nil, err
+	}
+	return zoneManifest, nil
+}
@@ -0,0 +1,135 @@
+package zone
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestExtractAssets(t *testing.T) {
+	f, stop := startFakeZone(t)
+	defer stop()
+	f.create(t)
+
+	specPath := filepath.Join(f.dir, "spec.yaml")
+	err := ioutil.WriteFile(specPath, []byte(`
+worker_pools:
+  - name: batch
+    count: 2
+borders:
+  count: 3
+availability_zones: [us-west-2a, us-west-2b, us-west-2c]
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		params ExtractAssetsInput
+
+		wantControlPlane []string
+		wantWorkerPools  []string
+	}{
+		{
+			name:             "zone manifest",
+			params:           ExtractAssetsInput{ManifestPath: f.manifestPath},
+			wantControlPlane: []string{`module "director-0"`, `internal_ip = "172.16.0.4"`, `module "border-0"`},
+			wantWorkerPools:  []string{`module "workers"`, `instance_count   = 4`},
+		},
+		{
+			name:             "default spec",
+			params:           ExtractAssetsInput{EnvironmentIndex: 127, AWSAvailabilityZone: "us-west-2a"},
+			wantControlPlane: []string{`module "director-0"`, `internal_ip = "172.31.224.4"`, `module "border-0"`},
+			wantWorkerPools:  []string{`module "workers"`, `instance_count   = 4`},
+		},
+		{
+			name: "spec file",
+			params: ExtractAssetsInput{
+				Spec:                specPath,
+				EnvironmentIndex:    1,
+				ZoneIndex:           2,
+				AWSAvailabilityZone: "us-west-2b",
+			},
+			wantControlPlane: []string{`module "border-2"`, `availability_zone       = "us-west-2c"`},
+			wantWorkerPools:  []string{`module "workers_batch"`, `instance_count   = 2`},
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := test.params
+			params.Directory = filepath.Join(f.dir, "extracted", strconv.Itoa(i))
+			err := ExtractAssets(&params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for file, want := range map[string][]string{
+				controlPlaneFile: test.wantControlPlane,
+				workerPoolsFile:  test.wantWorkerPools,
+			} {
+				rendered, err := ioutil.ReadFile(filepath.Join(params.Directory, file))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.Contains(string(rendered), "{{") {
+					t.Errorf("%s wasn't rendered: %s", file, rendered)
+				}
+				for _, text := range want {
+					if !strings.Contains(string(rendered), text) {
+						t.Errorf("expected %s to contain %q:\n%s", file, text, rendered)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestExtractAssetsInvalidSpec(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+
+		wantErr string
+	}{
+		{
+			name:    "zone's own AZ left out",
+			spec:    "availability_zones: [us-west-2b, us-west-2c]\n",
+			wantErr: "must include the zone's own AZ",
+		},
+		{
+			// there's only ever one director (see ZoneSpec.Directors)
+			name:    "several directors",
+			spec:    "directors:\n  count: 3\n",
+			wantErr: "directors.count must be 1 (not 3)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "substrate-extract")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			specPath := filepath.Join(dir, "spec.yaml")
+			err = ioutil.WriteFile(specPath, []byte(test.spec), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ExtractAssets(&ExtractAssetsInput{
+				Directory:           filepath.Join(dir, "extracted"),
+				Spec:                specPath,
+				AWSAvailabilityZone: "us-west-2a",
+			})
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", test.wantErr, err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "extracted")); !os.IsNotExist(err) {
+				t.Errorf("assets were extracted for an invalid spec")
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/util"
+)
+
+// manifestHistoryPrefix is the store suffix under which manifest snapshots are kept
+const manifestHistoryPrefix = ".history/"
+
+// ManifestSnapshot is an immutable copy of a zone manifest recorded after a
+// command that changed the zone, along with some details of how it came to be
+type ManifestSnapshot struct {
+	Index            int       `json:"index"`
+	Timestamp        time.Time `json:"timestamp"`
+	Operator         string    `json:"operator"`
+	SubstrateVersion string    `json:"substrate_version"`
+	Command          string    `json:"command"`
+	Error            string    `json:"error,omitempty"`
+
+	// Manifest is the stored form of the manifest (so it's encrypted if the manifest was)
+	Manifest json.RawMessage `json:"manifest"`
+}
+
+// Succeeded returns whether the command that produced the snapshot succeeded
+func (s *ManifestSnapshot) Succeeded() bool {
+	return s.Error == ""
+}
+
+// ParseManifest parses the manifest stored in the snapshot
+func (s *ManifestSnapshot) ParseManifest() (*SubstrateZoneManifest, error) {
+	return ParseManifest(s.Manifest, fmt.Sprintf("snapshot %d", s.Index))
+}
+
+func manifestSnapshotSuffix(index int) string {
+	return fmt.Sprintf("%s%06d.json", manifestHistoryPrefix, index)
+}
+
+// ListManifestSnapshots returns all the snapshots in a store, oldest first
+func ListManifestSnapshots(store ManifestStore) ([]*ManifestSnapshot, error) {
+	suffixes, err := store.List(manifestHistoryPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*ManifestSnapshot{}
+	for _, suffix := range suffixes {
+		snapshot, err := readManifestSnapshotSuffix(store, suffix)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, snapshot)
+	}
+	return result, nil
+}
+
+// ReadManifestSnapshot reads the snapshot with the given index from a store
+func ReadManifestSnapshot(store ManifestStore, index int) (*ManifestSnapshot, error) {
+	return readManifestSnapshotSuffix(store, manifestSnapshotSuffix(index))
+}
+
+func readManifestSnapshotSuffix(store ManifestStore, suffix string) (*ManifestSnapshot, error) {
+	snapshotJSON, err := store.Read(suffix)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot ManifestSnapshot
+	err = json.Unmarshal(snapshotJSON, &snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest snapshot %s%s: %v", store, suffix, err)
+	}
+	return &snapshot, nil
+}
+
+// nextManifestSnapshotIndex returns the index the next snapshot in a store should get
+func nextManifestSnapshotIndex(store ManifestStore) (int, error) {
+	suffixes, err := store.List(manifestHistoryPrefix)
+	if err != nil {
+		return 0, err
+	}
+	next := 1
+	for _, suffix := range suffixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(suffix, manifestHistoryPrefix), ".json")
+		if index, err := strconv.Atoi(name); err == nil && index >= next {
+			next = index + 1
+		}
+	}
+	return next, nil
+}
+
+// recordManifestSnapshot appends a snapshot of the manifest to the store's
+// history. It should only be called while holding the store lock.
+func recordManifestSnapshot(store ManifestStore, zoneManifest *SubstrateZoneManifest, version string, command string, commandErr error) error {
+	storedJSON, err := zoneManifest.MarshalManifest()
+	if err != nil {
+		return err
+	}
+
+	index, err := nextManifestSnapshotIndex(store)
+	if err != nil {
+		return err
+	}
+
+	snapshot := ManifestSnapshot{
+		Index:            index,
+		Timestamp:        time.Now().UTC(),
+		Operator:         util.CurrentUser(),
+		SubstrateVersion: version,
+		Command:          command,
+		Manifest:         json.RawMessage(storedJSON),
+	}
+	if commandErr != nil {
+		snapshot.Error = commandErr.Error()
+	}
+
+	snapshotJSON, err := json.MarshalIndent(&snapshot, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// snapshots are immutable, so never overwrite one
+	suffix := manifestSnapshotSuffix(index)
+	if _, err = store.Read(suffix); !os.IsNotExist(err) {
+		return fmt.Errorf("manifest snapshot %s%s already exists", store, suffix)
+	}
+	err = store.Write(suffix, snapshotJSON)
+	if err != nil {
+		return fmt.Errorf("error saving manifest snapshot: %v", err)
+	}
+	fmt.Printf("saved manifest snapshot %d to %s%s\n", index, store, suffix)
+	return nil
+}
+
+// HistoryInput contains the input parameters for listing the history of a zone manifest
+type HistoryInput struct {
+	ManifestPath string
+}
+
+// History prints the snapshots recorded for a zone manifest
+func History(params *HistoryInput) error {
+	store, err := OpenManifestStore(params.ManifestPath)
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := ListManifestSnapshots(store)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		fmt.Printf("no snapshots recorded for zone manifest %s\n", store)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "N\tTIMESTAMP\tOPERATOR\tVERSION\tCOMMAND\tRESULT")
+	for _, snapshot := range snapshots {
+		result := "ok"
+		if !snapshot.Succeeded() {
+			result = "failed: " + snapshot.Error
+		}
+		fmt.Fprintf(
+			w,
+			"%d\t%s\t%s\t%s\t%s\t%s\n",
+			snapshot.Index,
+			snapshot.Timestamp.Local().Format(time.RFC3339),
+			snapshot.Operator,
+			snapshot.SubstrateVersion,
+			snapshot.Command,
+			result)
+	}
+	return w.Flush()
+}
+
+// RollbackInput contains the input parameters for rolling back a zone manifest
+type RollbackInput struct {
+	Version      string
+	Prompt       bool
+	ManifestPath string
+	To           int
+}
+
+// Rollback restores the Terraform state from a manifest snapshot, then shows
+// a plan of what it would take to bring the zone in line with that state
+func Rollback(params *RollbackInput) error {
+	store, err := OpenManifestStore(params.ManifestPath)
+	if err != nil {
+		return err
+	}
+
+	err = store.Lock()
+	if err != nil {
+		return err
+	}
+	defer store.Unlock()
+
+	zoneManifest, err := ReadManifestFrom(store)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := ReadManifestSnapshot(store, params.To)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no snapshot %d for zone manifest %s (see `substrate zone history`)", params.To, store)
+	}
+	if err != nil {
+		return err
+	}
+	snapshotManifest, err := snapshot.ParseManifest()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf(
+		"rolling back the Terraform state of zone %s to snapshot %d (%s by %s at %s)\n",
+		zoneManifest.ZoneName(),
+		snapshot.Index,
+		snapshot.Command,
+		snapshot.Operator,
+		snapshot.Timestamp.Local().Format(time.RFC3339))
+
+	if params.Prompt {
+		err = util.Confirm("do you want to continue and replace the current Terraform state?")
+		if err != nil {
+			return err
+		}
+	}
+
+	// only the Terraform state is rolled back, the rest of the manifest stays current
+	zoneManifest.TerraformState = snapshotManifest.TerraformState
+
+	err = backupManifest(store)
+	if err != nil {
+		return fmt.Errorf("error saving backup zone manifest: %v", err)
+	}
+	err = WriteManifestTo(store, zoneManifest)
+	if err != nil {
+		return err
+	}
+	err = recordManifestSnapshot(store, zoneManifest, params.Version, fmt.Sprintf("rollback --to %d", params.To), nil)
+	if err != nil {
+		return err
+	}
+
+	// re-plan against the restored state so the operator can see what
+	// `substrate zone update` would do now
+	workspace, err := newTerraformWorkspace(zoneManifest, os.Stdout)
+	if err != nil {
+		return err
+	}
+	defer workspace.Cleanup()
+
+	_, err = workspace.Runner.Get()
+	if err != nil {
+		return err
+	}
+	_, err = workspace.Runner.Plan(workspace.TerraformPaths)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nrestored snapshot %d, run `substrate zone update` to apply the plan above\n", params.To)
+	return nil
+}
@@ -0,0 +1,310 @@
+package zone
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// kubernetesAPIAddress is where the director serves the Kubernetes API without
+// authentication (kubeadm only binds it to localhost, so we reach it by
+// logging in to the director through the border)
+const kubernetesAPIAddress = "127.0.0.1:8080"
+
+// kubernetesRequestTimeout bounds each request to the Kubernetes API
+const kubernetesRequestTimeout = 30 * time.Second
+
+// kubernetesClient talks to a zone's Kubernetes API through SSH tunnels
+type kubernetesClient struct {
+	http *http.Client
+}
+
+// kubernetesNode is the part of a Kubernetes node we care about
+type kubernetesNode struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Status struct {
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// kubernetesPod is the part of a Kubernetes pod we care about
+type kubernetesPod struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		Annotations     map[string]string `json:"annotations"`
+		OwnerReferences []struct {
+			Kind string `json:"kind"`
+		} `json:"ownerReferences"`
+	} `json:"metadata"`
+}
+
+// newKubernetesClient returns a client for the Kubernetes API on the zone's
+// (first) director, logging in through the given border
+func newKubernetesClient(zoneManifest *SubstrateZoneManifest, auth []ssh.AuthMethod, borderEIP string) (*kubernetesClient, error) {
+	directorIP, err := zoneManifest.StringOutput("director_ip")
+	if err != nil {
+		return nil, err
+	}
+	config := zoneSSHConfig(auth)
+
+	// log in again for each connection, so we can ride out the border or
+	// director going away for a while
+	dial := func(network, addr string) (net.Conn, error) {
+		border, err := ssh.Dial("tcp", net.JoinHostPort(borderEIP, "22"), config)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to the border at %s: %v", borderEIP, err)
+		}
+		director, err := dialThroughBorder(border, config, directorIP)
+		if err != nil {
+			border.Close()
+			return nil, fmt.Errorf("error connecting to the director at %s: %v", directorIP, err)
+		}
+		conn, err := director.Dial("tcp", kubernetesAPIAddress)
+		if err != nil {
+			director.Close()
+			border.Close()
+			return nil, fmt.Errorf("error connecting to the Kubernetes API on the director: %v", err)
+		}
+		return &tunnelledConn{Conn: conn, clients: []*ssh.Client{director, border}}, nil
+	}
+
+	return &kubernetesClient{
+		http: &http.Client{
+			Transport: &http.Transport{Dial: dial},
+			Timeout:   kubernetesRequestTimeout,
+		},
+	}, nil
+}
+
+// tunnelledConn is a connection through one or more SSH clients, which are
+// closed along with it
+type tunnelledConn struct {
+	net.Conn
+	clients []*ssh.Client
+}
+
+func (c *tunnelledConn) Close() error {
+	err := c.Conn.Close()
+	for _, client := range c.clients {
+		client.Close()
+	}
+	return err
+}
+
+// do makes a request to the Kubernetes API, decoding the JSON response into
+// result (if it's not nil). Any status other than 2xx is an error, with the
+// status code available through kubernetesStatus.
+func (k *kubernetesClient) do(method string, path string, contentType string, body interface{}, result interface{}) error {
+	var requestBody io.Reader
+	if body != nil {
+		bodyJSON, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(bodyJSON)
+	}
+	request, err := http.NewRequest(method, "http://kubernetes"+path, requestBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	response, err := k.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode/100 != 2 {
+		return &kubernetesError{
+			Method:     method,
+			Path:       path,
+			StatusCode: response.StatusCode,
+			Body:       strings.TrimSpace(string(responseBody)),
+		}
+	}
+	if result != nil {
+		return json.Unmarshal(responseBody, result)
+	}
+	return nil
+}
+
+// kubernetesError is a failed Kubernetes API request
+type kubernetesError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *kubernetesError) Error() string {
+	return fmt.Sprintf("Kubernetes API %s %s failed with HTTP %d: %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+// kubernetesStatus returns the HTTP status of a failed Kubernetes API request (0 if it never got one)
+func kubernetesStatus(err error) int {
+	if e, ok := err.(*kubernetesError); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// Nodes lists the nodes in the cluster
+func (k *kubernetesClient) Nodes() ([]kubernetesNode, error) {
+	var nodes struct {
+		Items []kubernetesNode `json:"items"`
+	}
+	err := k.do("GET", "/api/v1/nodes", "", nil, &nodes)
+	return nodes.Items, err
+}
+
+// Cordon marks a node unschedulable
+func (k *kubernetesClient) Cordon(name string) error {
+	patch := map[string]interface{}{"spec": map[string]interface{}{"unschedulable": true}}
+	return k.do("PATCH", "/api/v1/nodes/"+url.QueryEscape(name), "application/strategic-merge-patch+json", patch, nil)
+}
+
+// DeleteNode removes a node (e.g., one whose instance is gone) from the cluster
+func (k *kubernetesClient) DeleteNode(name string) error {
+	err := k.do("DELETE", "/api/v1/nodes/"+url.QueryEscape(name), "", nil, nil)
+	if kubernetesStatus(err) == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// Pods lists the pods running on a node
+func (k *kubernetesClient) Pods(nodeName string) ([]kubernetesPod, error) {
+	var pods struct {
+		Items []kubernetesPod `json:"items"`
+	}
+	query := url.Values{"fieldSelector": {"spec.nodeName=" + nodeName}}
+	err := k.do("GET", "/api/v1/pods?"+query.Encode(), "", nil, &pods)
+	return pods.Items, err
+}
+
+// Evict asks Kubernetes to evict a pod, respecting any disruption budget. A
+// pod the budget doesn't allow evicting right now is left for the next try.
+func (k *kubernetesClient) Evict(pod kubernetesPod) error {
+	eviction := map[string]interface{}{
+		"apiVersion": "policy/v1beta1",
+		"kind":       "Eviction",
+		"metadata": map[string]interface{}{
+			"name":      pod.Metadata.Name,
+			"namespace": pod.Metadata.Namespace,
+		},
+	}
+	path := fmt.Sprintf(
+		"/api/v1/namespaces/%s/pods/%s/eviction",
+		url.QueryEscape(pod.Metadata.Namespace),
+		url.QueryEscape(pod.Metadata.Name))
+	err := k.do("POST", path, "application/json", eviction, nil)
+	switch kubernetesStatus(err) {
+	case http.StatusTooManyRequests, http.StatusNotFound:
+		return nil
+	}
+	return err
+}
+
+// Drain cordons a node and evicts its pods (except the ones that belong to
+// the node itself, like `kubectl drain --ignore-daemonsets`), waiting for
+// them to be gone
+func (k *kubernetesClient) Drain(name string, timeout time.Duration) error {
+	err := k.Cordon(name)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		pods, err := k.Pods(name)
+		if err != nil {
+			return err
+		}
+		remaining := 0
+		for _, pod := range pods {
+			if pod.isNodePod() {
+				continue
+			}
+			remaining++
+			err := k.Evict(pod)
+			if err != nil {
+				return fmt.Errorf("error evicting pod %s/%s: %v", pod.Metadata.Namespace, pod.Metadata.Name, err)
+			}
+		}
+		if remaining == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v draining node %s (%d pods left)", timeout, name, remaining)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// isNodePod returns whether a pod belongs to its node rather than being
+// scheduled there (a static pod, or one run by a DaemonSet), so draining the
+// node shouldn't evict it
+func (p kubernetesPod) isNodePod() bool {
+	if _, ok := p.Metadata.Annotations["kubernetes.io/config.mirror"]; ok {
+		return true
+	}
+	for _, owner := range p.Metadata.OwnerReferences {
+		if owner.Kind == "DaemonSet" {
+			return true
+		}
+	}
+
+	// Kubernetes 1.5 only records who created the pod in an annotation
+	var createdBy struct {
+		Reference struct {
+			Kind string `json:"kind"`
+		} `json:"reference"`
+	}
+	err := json.Unmarshal([]byte(p.Metadata.Annotations["kubernetes.io/created-by"]), &createdBy)
+	return err == nil && createdBy.Reference.Kind == "DaemonSet"
+}
+
+// InternalIP returns the node's internal IP address ("" if it hasn't reported one)
+func (n kubernetesNode) InternalIP() string {
+	for _, address := range n.Status.Addresses {
+		if address.Type == "InternalIP" {
+			return address.Address
+		}
+	}
+	return ""
+}
+
+// Ready returns whether the node's Ready condition is true
+func (n kubernetesNode) Ready() bool {
+	for _, condition := range n.Status.Conditions {
+		if condition.Type == "Ready" {
+			return condition.Status == "True"
+		}
+	}
+	return false
+}
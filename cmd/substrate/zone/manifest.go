@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net"
+	"strings"
 
 	"github.com/apparentlymart/go-cidr/cidr"
 )
@@ -23,16 +23,36 @@ const SubstrateZoneBits = 4
 
 // SubstrateZoneManifest represents the on-disk structure of the Substrate zone manifest file
 type SubstrateZoneManifest struct {
-	Version             string      `json:"substrate_version"`
-	EnvironmentName     string      `json:"environment_name"`
-	EnvironmentDomain   string      `json:"environment_domain"`
-	EnvironmentIndex    int         `json:"environment_index"`
-	ZoneIndex           int         `json:"zone_index"`
-	AWSAvailabilityZone string      `json:"aws_availability_zone"`
-	AWSAccountID        string      `json:"aws_account_id"`
-	DelegationSetID     string      `json:"delegation_set_id"`
-	SSHPublicKey        string      `json:"ssh_public_key"`
-	TerraformState      interface{} `json:"terraform_state"`
+	ManifestVersion     int           `json:"manifest_version"`
+	Version             string        `json:"substrate_version"`
+	UpgradingTo         string        `json:"upgrading_to,omitempty"`
+	EnvironmentName     string        `json:"environment_name"`
+	EnvironmentDomain   string        `json:"environment_domain"`
+	EnvironmentIndex    int           `json:"environment_index"`
+	ZoneIndex           int           `json:"zone_index"`
+	AWSAvailabilityZone string        `json:"aws_availability_zone"`
+	AWSAccountID        string        `json:"aws_account_id"`
+	DelegationSetID     string        `json:"delegation_set_id"`
+	SSHPublicKey        string        `json:"ssh_public_key,omitempty"`
+	SSHKey              *ZoneSSHKey   `json:"ssh_key,omitempty"`
+	NSDelegation        *NSDelegation `json:"ns_delegation,omitempty"`
+	Overlay             *ZoneOverlay  `json:"overlay,omitempty"`
+	Spec                *ZoneSpec     `json:"spec,omitempty"`
+	TerraformState      interface{}   `json:"terraform_state"`
+
+	// keyProvider is the key provider the manifest is encrypted with when
+	// stored, or nil if it is stored in plaintext
+	keyProvider KeyProvider
+}
+
+// targetVersion returns the Substrate version the zone's resources are built
+// for: the version an unfinished upgrade is upgrading the zone to, or else the
+// version that last updated it
+func (m *SubstrateZoneManifest) targetVersion() string {
+	if m.UpgradingTo != "" {
+		return m.UpgradingTo
+	}
+	return m.Version
 }
 
 // AWSRegion returns the AWS region name of the zone (derived from the AZ name)
@@ -90,7 +110,7 @@ func (m *SubstrateZoneManifest) CloudWatchLogsGroupVPCFlowLogs() string {
 func (m *SubstrateZoneManifest) TFVars() string {
 	var result bytes.Buffer
 	varMap := map[string]string{
-		"substrate_version":                             m.Version,
+		"substrate_version":                             m.targetVersion(),
 		"substrate_environment":                         m.EnvironmentName,
 		"substrate_environment_domain":                  m.EnvironmentDomain,
 		"substrate_environment_subnet":                  m.EnvironmentSubnet(),
@@ -103,30 +123,97 @@ func (m *SubstrateZoneManifest) TFVars() string {
 		"aws_availability_zone":                         m.AWSAvailabilityZone,
 		"aws_account_id":                                m.AWSAccountID,
 		"delegation_set_id":                             m.DelegationSetID,
-		"ssh_public_key":                                m.SSHPublicKey,
+		"ssh_public_key":                                m.sshPublicKeyPath(),
 	}
+	listVarMap := map[string][]string{}
+	m.ZoneSpec().addTFVars(varMap, listVarMap)
+	plan := m.addressPlan()
+	varMap["main_subnet_cidr"] = plan.Subnets[0].CIDR
+	listVarMap["border_internal_ips"] = plan.BorderIPs()
 	for k, v := range varMap {
 		result.WriteString(fmt.Sprintf("%s = \"%s\"\n", k, v))
 	}
+	for k, v := range listVarMap {
+		result.WriteString(fmt.Sprintf("%s = [\"%s\"]\n", k, strings.Join(v, "\", \"")))
+	}
 	return result.String()
 }
 
-// ReadManifest reads a SubstrateZoneManifest from the file at the given path
-func ReadManifest(path string) (*SubstrateZoneManifest, error) {
-	marshalledJSON, err := ioutil.ReadFile(path)
+// sshPublicKeyPath is the admin SSH public key file passed to Terraform, which
+// is the copy written into the workspace unless this is an older zone that
+// still points at a local file
+func (m *SubstrateZoneManifest) sshPublicKeyPath() string {
+	if m.SSHKey == nil {
+		return m.SSHPublicKey
+	}
+	return sshPublicKeyWorkspaceFile
+}
+
+// ReadManifest reads a SubstrateZoneManifest from the given location (a local
+// path or s3:// URL), upgrading it in memory to the current manifest schema
+// version if needed
+func ReadManifest(location string) (*SubstrateZoneManifest, error) {
+	store, err := OpenManifestStore(location)
 	if err != nil {
 		return nil, err
 	}
+	return ReadManifestFrom(store)
+}
+
+// ParseManifest parses the stored form of a SubstrateZoneManifest, decrypting
+// it if needed and running the migrations needed to bring it up to
+// CurrentManifestVersion. The source is only used to describe where the
+// manifest came from in errors.
+func ParseManifest(storedJSON []byte, source string) (*SubstrateZoneManifest, error) {
+	marshalledJSON, keyProvider, err := decodeManifestJSON(storedJSON)
+	if err != nil {
+		return nil, fmt.Errorf("error reading zone manifest %q: %v", source, err)
+	}
+
+	migratedJSON, _, err := migrateManifestJSON(marshalledJSON)
+	if err != nil {
+		return nil, fmt.Errorf("error migrating zone manifest %q: %v", source, err)
+	}
 
 	var result SubstrateZoneManifest
-	err = json.Unmarshal(marshalledJSON, &result)
+	err = json.Unmarshal(migratedJSON, &result)
 	if err != nil {
 		return nil, err
 	}
 
 	if result.Version == "" {
-		return nil, fmt.Errorf("expected to find `substrate_version` key in zone manifest %q", path)
+		return nil, fmt.Errorf("expected to find `substrate_version` key in zone manifest %q", source)
+	}
+
+	// specs recorded before there were worker pools use the `workers` shorthand
+	if result.Spec != nil {
+		result.Spec.normalize()
 	}
 
+	result.keyProvider = keyProvider
 	return &result, nil
 }
+
+// MarshalManifest renders the manifest to the (indented) JSON form we store,
+// encrypting it if the manifest has a key provider
+func (m *SubstrateZoneManifest) MarshalManifest() ([]byte, error) {
+	marshalledJSON, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	if m.keyProvider == nil {
+		return marshalledJSON, nil
+	}
+	return encryptManifestJSON(marshalledJSON, m.keyProvider)
+}
+
+// KeyProvider returns the key provider the manifest is encrypted with, or nil if it's stored in plaintext
+func (m *SubstrateZoneManifest) KeyProvider() KeyProvider {
+	return m.keyProvider
+}
+
+// SetKeyProvider changes how the manifest will be encrypted the next time
+// it's stored (nil means it will be stored in plaintext)
+func (m *SubstrateZoneManifest) SetKeyProvider(keyProvider KeyProvider) {
+	m.keyProvider = keyProvider
+}
@@ -0,0 +1,47 @@
+package zone
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseManifestNormalizesSpec(t *testing.T) {
+	// a spec recorded before there were worker pools
+	manifestJSON := `{
+		"substrate_version": "v1.0.1",
+		"environment_name": "dev",
+		"aws_availability_zone": "us-west-2a",
+		"spec": {
+			"workers": {"instance_type": "r4.2xlarge", "count": 6},
+			"directors": {"instance_type": "t2.medium", "count": 1},
+			"borders": {"instance_type": "t2.medium", "count": 1},
+			"ingress": {"ssh": ["0.0.0.0/0"], "http": ["0.0.0.0/0"]}
+		}
+	}`
+	zoneManifest, err := ParseManifest([]byte(manifestJSON), "zone00.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := manifestHash(zoneManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ZoneSpecWorkerPool{DefaultZoneSpec().WorkerPools[0]}
+	want[0].InstanceType = "r4.2xlarge"
+	want[0].Count = 6
+	if zoneManifest.Spec.Workers != nil || !reflect.DeepEqual(zoneManifest.Spec.WorkerPools, want) {
+		t.Errorf("expected the workers shorthand to be read as pools %+v, got %+v", want, zoneManifest.Spec)
+	}
+
+	// reading the spec doesn't change the manifest a plan was generated from
+	zoneManifest.ZoneSpec()
+	zoneManifest.WorkerPool(defaultWorkerPoolName)
+	afterHash, err := manifestHash(zoneManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if afterHash != hash {
+		t.Errorf("reading the zone spec changed the manifest")
+	}
+}
@@ -0,0 +1,83 @@
+package zone
+
+import (
+	"fmt"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/util"
+)
+
+// MigrateManifestInput contains the input parameters for migrating a zone manifest
+type MigrateManifestInput struct {
+	Prompt       bool
+	ManifestPath string
+}
+
+// MigrateManifest rewrites a zone manifest using the current manifest schema
+// version, keeping a copy of the original alongside it
+func MigrateManifest(params *MigrateManifestInput) error {
+	store, err := OpenManifestStore(params.ManifestPath)
+	if err != nil {
+		return err
+	}
+
+	err = store.Lock()
+	if err != nil {
+		return err
+	}
+	defer store.Unlock()
+
+	originalJSON, err := store.Read("")
+	if err != nil {
+		return err
+	}
+
+	plaintextJSON, _, err := decodeManifestJSON(originalJSON)
+	if err != nil {
+		return fmt.Errorf("error reading zone manifest %q: %v", params.ManifestPath, err)
+	}
+
+	_, originalVersion, err := migrateManifestJSON(plaintextJSON)
+	if err != nil {
+		return fmt.Errorf("error migrating zone manifest %q: %v", params.ManifestPath, err)
+	}
+	if originalVersion == CurrentManifestVersion {
+		fmt.Printf("zone manifest %q is already at schema version %d, nothing to do\n", params.ManifestPath, originalVersion)
+		return nil
+	}
+
+	fmt.Printf(
+		"migrating zone manifest %q from schema version %d to %d:\n",
+		params.ManifestPath,
+		originalVersion,
+		CurrentManifestVersion)
+	for i, migration := range ManifestMigrationsFrom(originalVersion) {
+		fmt.Printf(" - v%d -> v%d: %s\n", originalVersion+i, originalVersion+i+1, migration.Description)
+	}
+
+	zoneManifest, err := ParseManifest(originalJSON, params.ManifestPath)
+	if err != nil {
+		return err
+	}
+
+	migratedJSON, err := zoneManifest.MarshalManifest()
+	if err != nil {
+		return err
+	}
+
+	if params.Prompt {
+		err = util.Confirm("do you want to continue and rewrite the manifest?")
+		if err != nil {
+			return err
+		}
+	}
+
+	// keep the original around, named after the schema version it was written with
+	backupSuffix := fmt.Sprintf(".v%d.bak", originalVersion)
+	err = store.Write(backupSuffix, originalJSON)
+	if err != nil {
+		return fmt.Errorf("error saving backup zone manifest: %v", err)
+	}
+	fmt.Printf("saved original zone manifest to %q\n", store.String()+backupSuffix)
+
+	return store.Write("", migratedJSON)
+}
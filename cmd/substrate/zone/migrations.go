@@ -0,0 +1,102 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ManifestMigration upgrades the raw JSON form of a zone manifest from one
+// schema version to the next
+type ManifestMigration struct {
+	// Description is a short summary of what changed in the schema
+	Description string
+
+	// Migrate modifies the decoded manifest JSON object in place
+	Migrate func(raw map[string]interface{}) error
+}
+
+// manifestMigrations is the ordered chain of manifest schema migrations.
+// manifestMigrations[N] upgrades a manifest at schema version N to version
+// N+1, so new migrations must only ever be appended to the end of this list
+// (released manifests depend on the position of every migration in it).
+var manifestMigrations = []ManifestMigration{
+	{
+		Description: "add explicit `manifest_version` (manifests written by Substrate v1.0.x and earlier)",
+		Migrate:     migrateManifestV0,
+	},
+}
+
+// CurrentManifestVersion is the manifest schema version written by this version of Substrate
+var CurrentManifestVersion = len(manifestMigrations)
+
+// ManifestMigrationsFrom returns the migrations that would be run to upgrade a
+// manifest at the given schema version to CurrentManifestVersion
+func ManifestMigrationsFrom(version int) []ManifestMigration {
+	if version < 0 || version >= len(manifestMigrations) {
+		return []ManifestMigration{}
+	}
+	return manifestMigrations[version:]
+}
+
+// manifestSchemaVersion returns the schema version recorded in a decoded
+// manifest (manifests without the key predate schema versioning and are version 0)
+func manifestSchemaVersion(raw map[string]interface{}) (int, error) {
+	value, ok := raw["manifest_version"]
+	if !ok || value == nil {
+		return 0, nil
+	}
+	number, ok := value.(float64)
+	if !ok || number != float64(int(number)) || number < 0 {
+		return 0, fmt.Errorf("malformed `manifest_version` %v", value)
+	}
+	return int(number), nil
+}
+
+// migrateManifestJSON runs all the migrations needed to bring the manifest
+// JSON up to CurrentManifestVersion. It returns the migrated JSON along with
+// the schema version the input was originally written with.
+func migrateManifestJSON(marshalledJSON []byte) ([]byte, int, error) {
+	var raw map[string]interface{}
+	err := json.Unmarshal(marshalledJSON, &raw)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	originalVersion, err := manifestSchemaVersion(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	if originalVersion > CurrentManifestVersion {
+		return nil, originalVersion, fmt.Errorf(
+			"manifest schema version %d is newer than the latest version this Substrate understands (%d), try upgrading Substrate",
+			originalVersion,
+			CurrentManifestVersion)
+	}
+	if originalVersion == CurrentManifestVersion {
+		return marshalledJSON, originalVersion, nil
+	}
+
+	for version := originalVersion; version < CurrentManifestVersion; version++ {
+		err = manifestMigrations[version].Migrate(raw)
+		if err != nil {
+			return nil, originalVersion, fmt.Errorf("migrating manifest schema from version %d to %d: %v", version, version+1, err)
+		}
+		raw["manifest_version"] = version + 1
+	}
+
+	migratedJSON, err := json.Marshal(raw)
+	if err != nil {
+		return nil, originalVersion, err
+	}
+	return migratedJSON, originalVersion, nil
+}
+
+// migrateManifestV0 upgrades manifests written before schema versioning was
+// introduced. The fields themselves didn't change, so this only checks that
+// the manifest looks like one of ours before it gets stamped with version 1.
+func migrateManifestV0(raw map[string]interface{}) error {
+	if _, ok := raw["substrate_version"]; !ok {
+		return fmt.Errorf("missing `substrate_version` key")
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useManifestMigrations swaps in a migration chain for a test, returning a
+// function that puts the real one back
+func useManifestMigrations(migrations []ManifestMigration) func() {
+	previousMigrations := manifestMigrations
+	previousVersion := CurrentManifestVersion
+	manifestMigrations = migrations
+	CurrentManifestVersion = len(migrations)
+	return func() {
+		manifestMigrations = previousMigrations
+		CurrentManifestVersion = previousVersion
+	}
+}
+
+func TestMigrateManifestJSON(t *testing.T) {
+	// each migration records that it ran, and the one from version 2 fails
+	// on manifests marked "broken"
+	migration := func(version int) ManifestMigration {
+		return ManifestMigration{
+			Description: fmt.Sprintf("migration %d", version),
+			Migrate: func(raw map[string]interface{}) error {
+				if version == 2 && raw["broken"] == true {
+					return fmt.Errorf("broken manifest")
+				}
+				ran, _ := raw["ran"].([]interface{})
+				raw["ran"] = append(ran, float64(version))
+				return nil
+			},
+		}
+	}
+	defer useManifestMigrations([]ManifestMigration{migration(0), migration(1), migration(2)})()
+
+	tests := []struct {
+		name string
+		json string
+
+		wantOriginal int
+		wantRan      []interface{}
+		wantErr      string
+	}{
+		{
+			name:         "unversioned manifest runs every migration in order",
+			json:         `{"substrate_version": "v1.0.1"}`,
+			wantOriginal: 0,
+			wantRan:      []interface{}{0.0, 1.0, 2.0},
+		},
+		{
+			name:         "older manifest runs the migrations from its version",
+			json:         `{"manifest_version": 1, "substrate_version": "v1.0.1"}`,
+			wantOriginal: 1,
+			wantRan:      []interface{}{1.0, 2.0},
+		},
+		{
+			name:         "current manifest is left alone",
+			json:         `{"manifest_version": 3, "substrate_version": "v1.0.1"}`,
+			wantOriginal: 3,
+		},
+		{
+			name:    "newer manifest is rejected",
+			json:    `{"manifest_version": 4, "substrate_version": "v1.0.1"}`,
+			wantErr: "manifest schema version 4 is newer than the latest version this Substrate understands (3)",
+		},
+		{
+			name:    "malformed version",
+			json:    `{"manifest_version": "2", "substrate_version": "v1.0.1"}`,
+			wantErr: "malformed `manifest_version`",
+		},
+		{
+			name:    "failed migration",
+			json:    `{"manifest_version": 1, "substrate_version": "v1.0.1", "broken": true}`,
+			wantErr: "migrating manifest schema from version 2 to 3: broken manifest",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			migratedJSON, originalVersion, err := migrateManifestJSON([]byte(test.json))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if originalVersion != test.wantOriginal {
+				t.Errorf("expected original version %d, got %d", test.wantOriginal, originalVersion)
+			}
+			if test.wantRan == nil && string(migratedJSON) != test.json {
+				t.Errorf("expected the manifest to be unchanged, got %s", migratedJSON)
+			}
+
+			var raw map[string]interface{}
+			err = json.Unmarshal(migratedJSON, &raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if raw["manifest_version"] != 3.0 {
+				t.Errorf("expected manifest_version 3, got %v", raw["manifest_version"])
+			}
+			if ran, _ := raw["ran"].([]interface{}); !reflect.DeepEqual(ran, test.wantRan) {
+				t.Errorf("expected migrations %v to run, got %v", test.wantRan, ran)
+			}
+		})
+	}
+}
+
+func TestMigrateManifest(t *testing.T) {
+	unversionedJSON := `{"substrate_version": "v1.0.1", "environment_name": "dev"}`
+	currentJSON := fmt.Sprintf(`{"manifest_version": %d, "substrate_version": "v1.0.1", "environment_name": "dev"}`, CurrentManifestVersion)
+
+	tests := []struct {
+		name string
+		json string
+
+		wantBackup string
+	}{
+		{
+			name:       "unversioned manifest",
+			json:       unversionedJSON,
+			wantBackup: ".v0.bak",
+		},
+		{
+			name: "current manifest",
+			json: currentJSON,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "substrate-migrate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			manifestPath := filepath.Join(dir, "zone00.json")
+			err = ioutil.WriteFile(manifestPath, []byte(test.json), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = MigrateManifest(&MigrateManifestInput{ManifestPath: manifestPath})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			backups, err := filepath.Glob(manifestPath + ".v*.bak")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.wantBackup == "" {
+				if len(backups) > 0 {
+					t.Errorf("expected no backup, got %v", backups)
+				}
+				migratedJSON, err := ioutil.ReadFile(manifestPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(migratedJSON) != test.json {
+					t.Errorf("expected the manifest to be unchanged, got %s", migratedJSON)
+				}
+				return
+			}
+
+			if !reflect.DeepEqual(backups, []string{manifestPath + test.wantBackup}) {
+				t.Fatalf("expected a %s backup, got %v", test.wantBackup, backups)
+			}
+			backupJSON, err := ioutil.ReadFile(backups[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(backupJSON) != test.json {
+				t.Errorf("expected the backup to be the original manifest, got %s", backupJSON)
+			}
+			zoneManifest, err := ReadManifest(manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if zoneManifest.ManifestVersion != CurrentManifestVersion || zoneManifest.EnvironmentName != "dev" {
+				t.Errorf("expected a current manifest for dev, got version %d for %q", zoneManifest.ManifestVersion, zoneManifest.EnvironmentName)
+			}
+		})
+	}
+}
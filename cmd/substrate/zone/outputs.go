@@ -0,0 +1,320 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Terraform output types, as recorded in the state by Terraform 0.7+
+const (
+	TerraformOutputString = "string"
+	TerraformOutputList   = "list"
+	TerraformOutputMap    = "map"
+)
+
+// TerraformOutput is a single output of a zone's root Terraform module
+type TerraformOutput struct {
+	// Type is one of "string", "list" or "map"
+	Type      string      `json:"type"`
+	Sensitive bool        `json:"sensitive"`
+	Value     interface{} `json:"value"`
+}
+
+// String returns the value of a string output
+func (o *TerraformOutput) String() (string, error) {
+	if o.Type != TerraformOutputString {
+		return "", fmt.Errorf("output is a %s, not a string", o.Type)
+	}
+	return formatTerraformOutputScalar(o.Value), nil
+}
+
+// List returns the values of a list output
+func (o *TerraformOutput) List() ([]string, error) {
+	list, ok := o.Value.([]interface{})
+	if o.Type != TerraformOutputList || !ok {
+		return nil, fmt.Errorf("output is a %s, not a list", o.Type)
+	}
+	result := make([]string, len(list))
+	for i, element := range list {
+		result[i] = formatTerraformOutputScalar(element)
+	}
+	return result, nil
+}
+
+// Map returns the values of a map output
+func (o *TerraformOutput) Map() (map[string]string, error) {
+	m, ok := o.Value.(map[string]interface{})
+	if o.Type != TerraformOutputMap || !ok {
+		return nil, fmt.Errorf("output is a %s, not a map", o.Type)
+	}
+	result := map[string]string{}
+	for key, value := range m {
+		result[key] = formatTerraformOutputScalar(value)
+	}
+	return result, nil
+}
+
+// formatTerraformOutputScalar renders a single value the way Terraform would
+// interpolate it. Newer Terraform versions keep numbers and bools as JSON
+// types, where older versions stored everything as strings.
+func formatTerraformOutputScalar(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	case float64, bool:
+		return fmt.Sprintf("%v", v)
+	default:
+		j, _ := json.Marshal(v)
+		return string(j)
+	}
+}
+
+// newTerraformOutput builds an output from its raw value, inferring the type
+// (for state formats that don't record one, or record a type we don't use)
+func newTerraformOutput(value interface{}, sensitive bool) *TerraformOutput {
+	o := &TerraformOutput{Sensitive: sensitive, Value: value}
+	switch value.(type) {
+	case []interface{}:
+		o.Type = TerraformOutputList
+	case map[string]interface{}:
+		o.Type = TerraformOutputMap
+	default:
+		o.Type = TerraformOutputString
+	}
+	return o
+}
+
+// parseTerraformOutputs reads the outputs of the root module from a Terraform
+// state. It understands the version 1-2 formats (Terraform 0.6 and earlier,
+// where outputs were bare strings), version 3 (0.7 to 0.11, where outputs are
+// per module) and version 4 (0.12+, where there are only root outputs).
+func parseTerraformOutputs(tfState interface{}) (map[string]*TerraformOutput, error) {
+	tfStateMap, ok := tfState.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("malformed Terraform state")
+	}
+
+	var rawOutputs interface{}
+	if version, _ := tfStateMap["version"].(float64); version >= 4 {
+		rawOutputs = tfStateMap["outputs"]
+	} else {
+		modules, ok := tfStateMap["modules"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("couldn't find \"modules\" list in Terraform state")
+		}
+		for _, module := range modules {
+			moduleMap, ok := module.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("malformed module in Terraform state")
+			}
+			path, _ := moduleMap["path"].([]interface{})
+			if len(path) == 1 && path[0] == planRootModule {
+				rawOutputs = moduleMap["outputs"]
+				break
+			}
+		}
+	}
+
+	result := map[string]*TerraformOutput{}
+	if rawOutputs == nil {
+		return result, nil
+	}
+	outputsMap, ok := rawOutputs.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("malformed outputs in root module of Terraform state")
+	}
+	for name, output := range outputsMap {
+		outputMap, ok := output.(map[string]interface{})
+		if !ok {
+			// Terraform 0.6 and earlier
+			result[name] = newTerraformOutput(output, false)
+			continue
+		}
+		value, ok := outputMap["value"]
+		if !ok {
+			return nil, fmt.Errorf("output %q in root module of Terraform state is missing its \"value\"", name)
+		}
+		sensitive, _ := outputMap["sensitive"].(bool)
+		result[name] = newTerraformOutput(value, sensitive)
+	}
+	return result, nil
+}
+
+// TerraformOutputs returns all the outputs of the zone's root Terraform module
+func (m *SubstrateZoneManifest) TerraformOutputs() (map[string]*TerraformOutput, error) {
+	if m.TerraformState == nil {
+		return map[string]*TerraformOutput{}, nil
+	}
+	return parseTerraformOutputs(m.TerraformState)
+}
+
+// TerraformOutput returns a single output of the zone's root Terraform module
+func (m *SubstrateZoneManifest) TerraformOutput(name string) (*TerraformOutput, error) {
+	outputs, err := m.TerraformOutputs()
+	if err != nil {
+		return nil, err
+	}
+	output, ok := outputs[name]
+	if !ok {
+		return nil, fmt.Errorf("could not find output %q in root module of Terraform state", name)
+	}
+	return output, nil
+}
+
+// StringOutput returns the value of a string output, e.g. "border_eip"
+func (m *SubstrateZoneManifest) StringOutput(name string) (string, error) {
+	output, err := m.TerraformOutput(name)
+	if err != nil {
+		return "", err
+	}
+	result, err := output.String()
+	if err != nil {
+		return "", fmt.Errorf("error reading Terraform output %q: %v", name, err)
+	}
+	return result, nil
+}
+
+// ListOutput returns the values of a list output, e.g. "worker_public_ips"
+func (m *SubstrateZoneManifest) ListOutput(name string) ([]string, error) {
+	output, err := m.TerraformOutput(name)
+	if err != nil {
+		return nil, err
+	}
+	result, err := output.List()
+	if err != nil {
+		return nil, fmt.Errorf("error reading Terraform output %q: %v", name, err)
+	}
+	return result, nil
+}
+
+// MapOutput returns the values of a map output
+func (m *SubstrateZoneManifest) MapOutput(name string) (map[string]string, error) {
+	output, err := m.TerraformOutput(name)
+	if err != nil {
+		return nil, err
+	}
+	result, err := output.Map()
+	if err != nil {
+		return nil, fmt.Errorf("error reading Terraform output %q: %v", name, err)
+	}
+	return result, nil
+}
+
+// OutputsInput contains the input parameters for printing a zone's Terraform outputs
+type OutputsInput struct {
+	ManifestPath string
+
+	// Name is the single output to print (all of them if empty)
+	Name string
+
+	// JSON prints the outputs in the same format as `terraform output -json`
+	JSON bool
+}
+
+// formatTerraformOutput renders an output on a single line
+func formatTerraformOutput(o *TerraformOutput) string {
+	switch o.Type {
+	case TerraformOutputList:
+		list, _ := o.List()
+		return "[" + strings.Join(list, ", ") + "]"
+	case TerraformOutputMap:
+		m, _ := o.Map()
+		keys := []string{}
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := []string{}
+		for _, key := range keys {
+			pairs = append(pairs, fmt.Sprintf("%s = %s", key, m[key]))
+		}
+		return "{" + strings.Join(pairs, ", ") + "}"
+	default:
+		s, _ := o.String()
+		return s
+	}
+}
+
+// printTerraformOutputValue prints the value of a single output so it's easy
+// to consume from a script: strings as-is, lists one element per line, and
+// maps one "key = value" per line
+func printTerraformOutputValue(out io.Writer, o *TerraformOutput) {
+	switch o.Type {
+	case TerraformOutputList:
+		list, _ := o.List()
+		for _, element := range list {
+			fmt.Fprintln(out, element)
+		}
+	case TerraformOutputMap:
+		m, _ := o.Map()
+		keys := []string{}
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(out, "%s = %s\n", key, m[key])
+		}
+	default:
+		s, _ := o.String()
+		fmt.Fprintln(out, s)
+	}
+}
+
+// Outputs prints the Terraform outputs of a zone (e.g., "worker_dns" or "director_ip")
+func Outputs(params *OutputsInput) error {
+	zoneManifest, err := ReadManifest(params.ManifestPath)
+	if err != nil {
+		return err
+	}
+
+	if params.Name != "" {
+		output, err := zoneManifest.TerraformOutput(params.Name)
+		if err != nil {
+			return err
+		}
+		if params.JSON {
+			outputJSON, err := json.MarshalIndent(output, "", "    ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(outputJSON))
+			return nil
+		}
+		printTerraformOutputValue(os.Stdout, output)
+		return nil
+	}
+
+	outputs, err := zoneManifest.TerraformOutputs()
+	if err != nil {
+		return err
+	}
+	if params.JSON {
+		outputsJSON, err := json.MarshalIndent(outputs, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(outputsJSON))
+		return nil
+	}
+
+	names := []string{}
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := formatTerraformOutput(outputs[name])
+		if outputs[name].Sensitive {
+			value = "<sensitive>"
+		}
+		fmt.Printf("%s = %s\n", name, value)
+	}
+	return nil
+}
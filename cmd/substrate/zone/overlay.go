@@ -0,0 +1,166 @@
+package zone
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ZoneOverlay is a directory of extra Terraform configuration (.tf files and
+// modules) that gets copied into the embedded zone configuration, so a zone
+// can be customized without forking Substrate
+type ZoneOverlay struct {
+	// Path is the absolute path to the overlay directory
+	Path string `json:"path"`
+
+	// SHA256 is a hash of the overlay contents as of the last time the zone
+	// was planned or applied with it, and Files lists what it contained
+	SHA256 string   `json:"sha256,omitempty"`
+	Files  []string `json:"files,omitempty"`
+}
+
+// newZoneOverlay records the overlay at dir, which must be a directory
+func newZoneOverlay(dir string) (*ZoneOverlay, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(absDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading overlay: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("overlay %s is not a directory", absDir)
+	}
+	return &ZoneOverlay{Path: absDir}, nil
+}
+
+// isOverlayFile returns whether a file in an overlay should be copied, skipping
+// hidden files (like .terraform/) and editor backups
+func isOverlayFile(name string) bool {
+	return !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, "~")
+}
+
+// overlayFiles lists the files in the overlay (relative to its root, sorted)
+func (o *ZoneOverlay) overlayFiles() ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(o.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == o.Path {
+			return nil
+		}
+		if !isOverlayFile(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("overlay file %s is not a regular file", path)
+		}
+		rel, err := filepath.Rel(o.Path, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading overlay %s: %v", o.Path, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// hash returns a hash of the names and contents of the overlay files
+func (o *ZoneOverlay) hash(files []string) (string, error) {
+	h := sha256.New()
+	for _, name := range files {
+		f, err := os.Open(filepath.Join(o.Path, filepath.FromSlash(name)))
+		if err != nil {
+			return "", err
+		}
+		fileHash := sha256.New()
+		_, err = io.Copy(fileHash, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%x\n", name, fileHash.Sum(nil))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// apply copies the overlay into the extracted zone configuration at zoneDir,
+// refusing to replace any embedded file. If the overlay has changed since its
+// hash was recorded, it prints a warning to out and records the new hash.
+func (o *ZoneOverlay) apply(zoneDir string, out io.Writer) error {
+	files, err := o.overlayFiles()
+	if err != nil {
+		return err
+	}
+	sum, err := o.hash(files)
+	if err != nil {
+		return err
+	}
+	if o.SHA256 != "" && o.SHA256 != sum {
+		fmt.Fprintf(
+			out,
+			"Warning: Terraform overlay %s has changed since the zone was last updated (was %d files, now %d files)\n",
+			o.Path,
+			len(o.Files),
+			len(files))
+	}
+	o.SHA256 = sum
+	o.Files = files
+
+	// check every file before copying any, so we don't half apply an overlay
+	collisions := []string{}
+	for _, name := range files {
+		_, err := os.Stat(filepath.Join(zoneDir, filepath.FromSlash(name)))
+		if err == nil {
+			collisions = append(collisions, name)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(collisions) > 0 {
+		return fmt.Errorf(
+			"Terraform overlay %s would replace files in the embedded zone configuration (rename them in the overlay): %s",
+			o.Path,
+			strings.Join(collisions, ", "))
+	}
+
+	for _, name := range files {
+		src := filepath.Join(o.Path, filepath.FromSlash(name))
+		dest := filepath.Join(zoneDir, filepath.FromSlash(name))
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(dest), 0700)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(dest, data, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package zone
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// PlanInput contains the input parameters for planning an update to a zone
+type PlanInput struct {
+	Version      string
+	ManifestPath string
+
+	// PlanPath is where the plan file will be saved (see PlanFile)
+	PlanPath string
+
+	// JSON prints the change summary as JSON (and sends Terraform's output to stderr)
+	JSON bool
+}
+
+// PlanResourceChange is a single resource change in a Terraform plan
+type PlanResourceChange struct {
+	Address string `json:"address"`
+	Module  string `json:"module"`
+	Action  string `json:"action"`
+}
+
+// PlanChangeCounts counts the resource changes in (part of) a Terraform plan
+type PlanChangeCounts struct {
+	Add     int `json:"add"`
+	Change  int `json:"change"`
+	Destroy int `json:"destroy"`
+}
+
+// PlanSummary is a machine-readable summary of a Terraform plan
+type PlanSummary struct {
+	PlanPath  string                       `json:"plan_path"`
+	Changes   bool                         `json:"changes"`
+	Total     PlanChangeCounts             `json:"total"`
+	Modules   map[string]*PlanChangeCounts `json:"modules"`
+	Resources []PlanResourceChange         `json:"resources"`
+}
+
+// planRootModule is the name we use in summaries for resources outside of any module
+const planRootModule = "root"
+
+// planResourceLine matches the header line for each resource in the output of
+// `terraform show` on a plan file (the attribute lines under each are indented)
+var planResourceLine = regexp.MustCompile(`^\s{0,2}(-/\+|\+|~|-|<=) (\S+)`)
+
+// planActions maps the `terraform show` action markers to action names
+var planActions = map[string]string{
+	"+":   "create",
+	"~":   "update",
+	"-":   "destroy",
+	"-/+": "replace",
+}
+
+// parsePlanSummary builds a summary from the output of `terraform show` on a plan file
+func parsePlanSummary(showOutput []byte) (*PlanSummary, error) {
+	summary := &PlanSummary{
+		Modules:   map[string]*PlanChangeCounts{},
+		Resources: []PlanResourceChange{},
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(showOutput))
+	for scanner.Scan() {
+		match := planResourceLine.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		action, ok := planActions[match[1]]
+		if !ok {
+			// "<=" is a data source read, which doesn't change anything
+			continue
+		}
+
+		change := PlanResourceChange{
+			Address: match[2],
+			Module:  planRootModule,
+			Action:  action,
+		}
+		if parts := strings.SplitN(change.Address, ".", 3); parts[0] == "module" && len(parts) == 3 {
+			change.Module = parts[1]
+		}
+		summary.Resources = append(summary.Resources, change)
+
+		counts, ok := summary.Modules[change.Module]
+		if !ok {
+			counts = &PlanChangeCounts{}
+			summary.Modules[change.Module] = counts
+		}
+		for _, c := range []*PlanChangeCounts{counts, &summary.Total} {
+			switch action {
+			case "create":
+				c.Add++
+			case "update":
+				c.Change++
+			case "destroy":
+				c.Destroy++
+			case "replace":
+				c.Add++
+				c.Destroy++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	summary.Changes = len(summary.Resources) > 0
+	return summary, nil
+}
+
+// Print writes a human readable table of the summary
+func (s *PlanSummary) Print(out io.Writer) error {
+	if !s.Changes {
+		_, err := fmt.Fprintf(out, "\nno changes, the zone is up to date\n")
+		return err
+	}
+
+	modules := []string{}
+	for module := range s.Modules {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+
+	fmt.Fprintf(out, "\n")
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MODULE\tADD\tCHANGE\tDESTROY")
+	for _, module := range modules {
+		counts := s.Modules[module]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", module, counts.Add, counts.Change, counts.Destroy)
+	}
+	fmt.Fprintf(w, "total\t%d\t%d\t%d\n", s.Total.Add, s.Total.Change, s.Total.Destroy)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "\nplan saved to %s (apply it with `substrate zone apply --plan %s`)\n", s.PlanPath, s.PlanPath)
+	return err
+}
+
+// planZone runs `terraform plan` for the zone in a workspace, saving the plan
+// to the workspace plan path, and returns a summary of the changes in it
+func planZone(workspace *terraformWorkspace) (*PlanSummary, error) {
+	_, err := workspace.Runner.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = workspace.Runner.Plan(workspace.TerraformPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	show, err := workspace.Runner.Show(workspace.TerraformPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	summary, err := parsePlanSummary(show.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	summary.PlanPath = workspace.PlanPath
+	return summary, nil
+}
+
+// Plan writes a Terraform plan for updating a zone to a file and summarizes
+// the changes in it, without changing anything
+func Plan(params *PlanInput) (*PlanSummary, error) {
+	zoneManifest, err := ReadManifest(params.ManifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep stdout clean for the JSON summary
+	var terraformOut io.Writer = os.Stdout
+	if params.JSON {
+		terraformOut = os.Stderr
+	}
+
+	err = checkNoUpgradeSteps(zoneManifest, params.Version, "apply")
+	if err != nil {
+		fmt.Fprintf(terraformOut, "Warning: %v\n", err)
+	}
+
+	workspace, err := newTerraformWorkspace(zoneManifest, terraformOut)
+	if err != nil {
+		return nil, err
+	}
+	defer workspace.Cleanup()
+
+	summary, err := planZone(workspace)
+	if err != nil {
+		return nil, err
+	}
+	summary.PlanPath = params.PlanPath
+
+	// wrap the Terraform plan up with what we need to check it before applying it
+	terraformPlan, err := ioutil.ReadFile(workspace.PlanPath)
+	if err != nil {
+		return nil, err
+	}
+	planFile, err := newPlanFile(zoneManifest, params.Version, summary, terraformPlan)
+	if err != nil {
+		return nil, err
+	}
+	err = writePlanFile(params.PlanPath, planFile, zoneManifest.KeyProvider())
+	if err != nil {
+		return nil, err
+	}
+
+	if params.JSON {
+		summaryJSON, err := json.MarshalIndent(summary, "", "    ")
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println(string(summaryJSON))
+		return summary, nil
+	}
+	return summary, summary.Print(os.Stdout)
+}
@@ -0,0 +1,99 @@
+package zone
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPlanResourceLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		action  string
+		address string
+	}{
+		{"+ aws_vpc.zone", "+", "aws_vpc.zone"},
+		{"~ module.director.aws_security_group.director", "~", "module.director.aws_security_group.director"},
+		{"- aws_route53_record.legacy", "-", "aws_route53_record.legacy"},
+		{"-/+ module.border-0.aws_eip.border (tainted)", "-/+", "module.border-0.aws_eip.border"},
+		{"<= module.node-ami.data.aws_ami.base", "<=", "module.node-ami.data.aws_ami.base"},
+		{"  + module.workers.aws_instance.workers.2", "+", "module.workers.aws_instance.workers.2"},
+
+		// attribute lines (and anything else) aren't resources
+		{`    ami:   "ami-0d8a1e6a" => "ami-4b1f7a2b" (forces new resource)`, "", ""},
+		{`    - aws_instance.indented.too.far`, "", ""},
+		{"This plan does nothing.", "", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		match := planResourceLine.FindStringSubmatch(test.line)
+		if test.action == "" {
+			if match != nil {
+				t.Errorf("%q: expected no match, got %q", test.line, match)
+			}
+			continue
+		}
+		if match == nil || match[1] != test.action || match[2] != test.address {
+			t.Errorf("%q: expected %s %s, got %q", test.line, test.action, test.address, match)
+		}
+	}
+}
+
+func TestParsePlanSummary(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		changes   bool
+		total     PlanChangeCounts
+		modules   map[string]*PlanChangeCounts
+		resources []PlanResourceChange
+	}{
+		{
+			fixture: "plan-show.txt",
+			changes: true,
+			total:   PlanChangeCounts{Add: 4, Change: 1, Destroy: 4},
+			modules: map[string]*PlanChangeCounts{
+				"workers":  {Add: 2, Destroy: 1},
+				"border-0": {Add: 2, Destroy: 2},
+				"director": {Change: 1},
+				"root":     {Destroy: 1},
+			},
+			resources: []PlanResourceChange{
+				{Address: "module.workers.aws_instance.workers.2", Module: "workers", Action: "create"},
+				{Address: "module.border-0.aws_instance.border", Module: "border-0", Action: "replace"},
+				{Address: "module.border-0.aws_eip.border", Module: "border-0", Action: "replace"},
+				{Address: "module.director.aws_security_group.director", Module: "director", Action: "update"},
+				{Address: "aws_route53_record.legacy", Module: "root", Action: "destroy"},
+				{Address: "module.workers.module.node.aws_launch_configuration.node", Module: "workers", Action: "replace"},
+			},
+		},
+		{
+			fixture:   "plan-show-empty.txt",
+			changes:   false,
+			modules:   map[string]*PlanChangeCounts{},
+			resources: []PlanResourceChange{},
+		},
+	}
+	for _, test := range tests {
+		showOutput, err := ioutil.ReadFile(filepath.Join("testdata", test.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		summary, err := parsePlanSummary(showOutput)
+		if err != nil {
+			t.Fatalf("%s: %v", test.fixture, err)
+		}
+		if summary.Changes != test.changes {
+			t.Errorf("%s: expected changes %v, got %v", test.fixture, test.changes, summary.Changes)
+		}
+		if summary.Total != test.total {
+			t.Errorf("%s: expected totals %+v, got %+v", test.fixture, test.total, summary.Total)
+		}
+		if !reflect.DeepEqual(summary.Modules, test.modules) {
+			t.Errorf("%s: expected module counts %v, got %v", test.fixture, test.modules, summary.Modules)
+		}
+		if !reflect.DeepEqual(summary.Resources, test.resources) {
+			t.Errorf("%s: expected resources\n%+v\ngot\n%+v", test.fixture, test.resources, summary.Resources)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package zone
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/util"
+)
+
+// planFileFormatVersion is the current version of the PlanFile format
+const planFileFormatVersion = 1
+
+// PlanFile is the artifact written by `substrate zone plan`. It wraps the
+// Terraform plan with enough context to make sure it's only ever applied to
+// the zone (and the exact manifest and overlay) it was generated from.
+type PlanFile struct {
+	FormatVersion    int    `json:"format_version"`
+	SubstrateVersion string `json:"substrate_version"`
+	ZoneName         string `json:"zone_name"`
+
+	// ManifestSHA256 is a hash of the manifest the plan was generated from
+	// (see manifestHash), and OverlaySHA256 a hash of the overlay's contents
+	// at the time ("" if the zone has no overlay)
+	ManifestSHA256 string `json:"manifest_sha256"`
+	OverlaySHA256  string `json:"overlay_sha256,omitempty"`
+
+	Created       time.Time    `json:"created"`
+	Operator      string       `json:"operator"`
+	Summary       *PlanSummary `json:"summary"`
+	TerraformPlan []byte       `json:"terraform_plan"`
+}
+
+// manifestHash returns a hash of everything in a manifest that a plan depends
+// on: the whole manifest (Go marshals struct fields in order and map keys
+// sorted, so its JSON is stable across reads) and the key it's encrypted
+// with. The record of the overlay's contents is left out, since planning
+// updates it in memory; the contents themselves are checked separately.
+func manifestHash(zoneManifest *SubstrateZoneManifest) (string, error) {
+	canonical := *zoneManifest
+	if canonical.Overlay != nil {
+		overlay := *canonical.Overlay
+		overlay.SHA256 = ""
+		overlay.Files = nil
+		canonical.Overlay = &overlay
+	}
+	manifestJSON, err := json.Marshal(&canonical)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(manifestJSON)
+	if keyProvider := zoneManifest.KeyProvider(); keyProvider != nil {
+		fmt.Fprintf(h, "\x00%s\x00%s", keyProvider.Name(), keyProvider.KeyID())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// overlayHash returns a hash of the current contents of the zone's overlay, or "" if it has none
+func overlayHash(zoneManifest *SubstrateZoneManifest) (string, error) {
+	if zoneManifest.Overlay == nil {
+		return "", nil
+	}
+	files, err := zoneManifest.Overlay.overlayFiles()
+	if err != nil {
+		return "", err
+	}
+	return zoneManifest.Overlay.hash(files)
+}
+
+// newPlanFile wraps a Terraform plan for a zone in a PlanFile
+func newPlanFile(zoneManifest *SubstrateZoneManifest, version string, summary *PlanSummary, terraformPlan []byte) (*PlanFile, error) {
+	manifestSum, err := manifestHash(zoneManifest)
+	if err != nil {
+		return nil, err
+	}
+	overlaySum, err := overlayHash(zoneManifest)
+	if err != nil {
+		return nil, err
+	}
+	return &PlanFile{
+		FormatVersion:    planFileFormatVersion,
+		SubstrateVersion: version,
+		ZoneName:         zoneManifest.ZoneName(),
+		ManifestSHA256:   manifestSum,
+		OverlaySHA256:    overlaySum,
+		Created:          time.Now().UTC(),
+		Operator:         util.CurrentUser(),
+		Summary:          summary,
+		TerraformPlan:    terraformPlan,
+	}, nil
+}
+
+// writePlanFile saves a PlanFile. Terraform plans embed the full state, so if
+// the manifest is encrypted the plan file is encrypted with the same key.
+func writePlanFile(path string, planFile *PlanFile, keyProvider KeyProvider) error {
+	planJSON, err := json.MarshalIndent(planFile, "", "    ")
+	if err != nil {
+		return err
+	}
+	if keyProvider != nil {
+		planJSON, err = encryptManifestJSON(planJSON, keyProvider)
+		if err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path, planJSON, 0600)
+}
+
+// ReadPlanFile reads (and if needed decrypts) a PlanFile
+func ReadPlanFile(path string) (*PlanFile, error) {
+	storedJSON, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	planJSON, _, err := decodeManifestJSON(storedJSON)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plan file %q: %v", path, err)
+	}
+
+	var planFile PlanFile
+	err = json.Unmarshal(planJSON, &planFile)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing plan file %q: %v", path, err)
+	}
+	if planFile.FormatVersion != planFileFormatVersion {
+		return nil, fmt.Errorf("plan file %q has unsupported format version %d", path, planFile.FormatVersion)
+	}
+	return &planFile, nil
+}
+
+// Verify checks that the plan can safely be applied to the zone by this
+// version of Substrate: it must have been generated by the same version,
+// for the same zone, from exactly the manifest (including the Terraform
+// state) and overlay contents the zone has now
+func (p *PlanFile) Verify(zoneManifest *SubstrateZoneManifest, version string) error {
+	if p.SubstrateVersion != version {
+		return fmt.Errorf("plan was generated by Substrate %s, but this is Substrate %s", p.SubstrateVersion, version)
+	}
+	if p.ZoneName != zoneManifest.ZoneName() {
+		return fmt.Errorf("plan was generated for zone %s, not %s", p.ZoneName, zoneManifest.ZoneName())
+	}
+	manifestSum, err := manifestHash(zoneManifest)
+	if err != nil {
+		return err
+	}
+	if p.ManifestSHA256 != manifestSum {
+		return fmt.Errorf("zone manifest has changed since the plan was generated, run `substrate zone plan` again")
+	}
+	overlaySum, err := overlayHash(zoneManifest)
+	if err != nil {
+		return err
+	}
+	if p.OverlaySHA256 != overlaySum {
+		return fmt.Errorf("Terraform overlay has changed since the plan was generated, run `substrate zone plan` again")
+	}
+	return nil
+}
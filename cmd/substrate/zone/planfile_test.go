@@ -0,0 +1,141 @@
+package zone
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanFileVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "substrate-planfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	overlayDir := filepath.Join(dir, "overlay")
+	otherOverlayDir := filepath.Join(dir, "other-overlay")
+	for _, overlay := range []string{overlayDir, otherOverlayDir} {
+		err = os.Mkdir(overlay, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(overlay, "extra.tf"), []byte("# extra\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	keyPath, err := GenerateKeyFile(filepath.Join(dir, "manifest.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyProvider, err := OpenKeyProvider("keyfile:" + keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newManifest := func() *SubstrateZoneManifest {
+		return &SubstrateZoneManifest{
+			ManifestVersion:     CurrentManifestVersion,
+			Version:             "v1.0.1",
+			EnvironmentName:     "dev",
+			AWSAvailabilityZone: "us-west-2a",
+			SSHKey:              &ZoneSSHKey{PublicKey: "ssh-ed25519 AAAA", Storage: "file"},
+			Overlay:             &ZoneOverlay{Path: overlayDir},
+			Spec:                &ZoneSpec{Directors: ZoneSpecInstances{InstanceType: "t2.medium", Count: 1}},
+			TerraformState:      map[string]interface{}{"serial": 1.0},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		version string
+		change  func(m *SubstrateZoneManifest)
+		wantErr bool
+	}{
+		{name: "unchanged", change: func(m *SubstrateZoneManifest) {}},
+		{
+			// planning records the overlay's contents, which isn't a change
+			name: "overlay contents recorded",
+			change: func(m *SubstrateZoneManifest) {
+				m.Overlay.SHA256 = "recorded"
+				m.Overlay.Files = []string{"extra.tf"}
+			},
+		},
+		{name: "different Substrate version", version: "v1.0.2", change: func(m *SubstrateZoneManifest) {}, wantErr: true},
+		{name: "different zone", change: func(m *SubstrateZoneManifest) { m.ZoneIndex = 1 }, wantErr: true},
+		{name: "state changed", change: func(m *SubstrateZoneManifest) { m.TerraformState = map[string]interface{}{"serial": 2.0} }, wantErr: true},
+		{name: "spec changed", change: func(m *SubstrateZoneManifest) { m.Spec.Borders.Count = 3 }, wantErr: true},
+		{name: "SSH key changed", change: func(m *SubstrateZoneManifest) { m.SSHKey.PublicKey = "ssh-ed25519 BBBB" }, wantErr: true},
+		{name: "overlay moved", change: func(m *SubstrateZoneManifest) { m.Overlay.Path = otherOverlayDir }, wantErr: true},
+		{name: "overlay removed", change: func(m *SubstrateZoneManifest) { m.Overlay = nil }, wantErr: true},
+		{name: "encrypted", change: func(m *SubstrateZoneManifest) { m.SetKeyProvider(keyProvider) }, wantErr: true},
+		{
+			name: "overlay edited",
+			change: func(m *SubstrateZoneManifest) {
+				err := ioutil.WriteFile(filepath.Join(overlayDir, "more.tf"), []byte("# more\n"), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		planned := newManifest()
+		planFile, err := newPlanFile(planned, "v1.0.1", &PlanSummary{}, []byte("plan"))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		current := newManifest()
+		test.change(current)
+		version := test.version
+		if version == "" {
+			version = "v1.0.1"
+		}
+		err = planFile.Verify(current, version)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, wanted an error: %v", test.name, err, test.wantErr)
+		}
+		os.Remove(filepath.Join(overlayDir, "more.tf"))
+	}
+}
+
+func TestReadPlanFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "substrate-planfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zoneManifest := &SubstrateZoneManifest{Version: "v1.0.1", EnvironmentName: "dev"}
+	planFile, err := newPlanFile(zoneManifest, "v1.0.1", &PlanSummary{}, []byte("plan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	planPath := filepath.Join(dir, "zone.plan")
+	err = writePlanFile(planPath, planFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBack, err := ReadPlanFile(planPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = readBack.Verify(zoneManifest, "v1.0.1")
+	if err != nil {
+		t.Fatalf("plan read back doesn't verify: %v", err)
+	}
+
+	// plans in a format this version doesn't know about are refused
+	err = ioutil.WriteFile(planPath, []byte(`{"format_version": 2}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadPlanFile(planPath)
+	if err == nil {
+		t.Fatal("expected an error reading a plan file in an unknown format")
+	}
+}
@@ -0,0 +1,391 @@
+package zone
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"golang.org/x/crypto/ssh"
+)
+
+// what a zone needs from its region (see ./zone/*.tf), besides an Elastic IP
+// for each border: the main VPC and the VPC the base AMI is built in
+const zoneVPCs = 2
+
+// defaultVPCLimit is the default limit on VPCs per region. The limit isn't
+// exposed by the EC2 API, so accounts with a raised limit need to pass
+// --vpc-limit.
+const defaultVPCLimit = 5
+
+// results of a single preflight check
+const (
+	preflightPass = "PASS"
+	preflightWarn = "WARN"
+	preflightFail = "FAIL"
+)
+
+// PreflightInput contains the input parameters for checking that a zone can be created
+type PreflightInput struct {
+	EnvironmentName     string
+	EnvironmentDomain   string
+	EnvironmentIndex    int
+	ZoneIndex           int
+	AWSAccountID        string
+	AWSAvailabilityZone string
+
+	// VPCLimit is the account's limit on VPCs per region (0 means the AWS default)
+	VPCLimit int
+
+	// SSHPublicKey is the admin SSH public key file the zone would use
+	// (optional, a new key pair is generated for the zone if it's not set)
+	SSHPublicKey string
+
+	// Spec is the YAML zone spec the zone would be created with (optional)
+	Spec string
+}
+
+// PreflightCheck is the result of a single preflight check
+type PreflightCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// PreflightReport lists the results of all the preflight checks for a zone
+type PreflightReport struct {
+	ZoneName string           `json:"zone_name"`
+	Checks   []PreflightCheck `json:"checks"`
+	Passed   bool             `json:"passed"`
+}
+
+func (r *PreflightReport) add(name string, status string, format string, a ...interface{}) {
+	r.Checks = append(r.Checks, PreflightCheck{
+		Name:   name,
+		Status: status,
+		Detail: fmt.Sprintf(format, a...),
+	})
+	if status == preflightFail {
+		r.Passed = false
+	}
+}
+
+// Print writes a human readable version of the report
+func (r *PreflightReport) Print(out io.Writer) {
+	fmt.Fprintf(out, "\npreflight checks for zone %s:\n", r.ZoneName)
+	failed := 0
+	for _, check := range r.Checks {
+		fmt.Fprintf(out, "    [%s] %-22s %s\n", check.Status, check.Name, check.Detail)
+		if check.Status == preflightFail {
+			failed++
+		}
+	}
+	if r.Passed {
+		fmt.Fprintf(out, "\npreflight checks passed\n")
+	} else {
+		fmt.Fprintf(out, "\npreflight checks failed (%d of %d checks failed)\n", failed, len(r.Checks))
+	}
+}
+
+// preflightChecker checks a proposed zone against its AWS account
+type preflightChecker struct {
+	ec2Svc ec2iface.EC2API
+	stsSvc stsiface.STSAPI
+
+	vpcLimit int
+
+	// resuming is set when the zone may already have some of its resources
+	// (from a failed create), which count against the limits we check
+	resuming bool
+}
+
+// newPreflightChecker creates the checker for a zone, using the AWS APIs for
+// its region. Tests can replace it to check against fake ones.
+var newPreflightChecker = func(zoneManifest *SubstrateZoneManifest, vpcLimit int, resuming bool) *preflightChecker {
+	sess := session.New(&aws.Config{Region: aws.String(zoneManifest.AWSRegion())})
+	if vpcLimit == 0 {
+		vpcLimit = defaultVPCLimit
+	}
+	return &preflightChecker{
+		ec2Svc:   ec2.New(sess),
+		stsSvc:   sts.New(sess),
+		vpcLimit: vpcLimit,
+		resuming: resuming,
+	}
+}
+
+// run runs every check, reporting on them all (rather than stopping at the
+// first failure) so everything can be fixed in one go
+func (c *preflightChecker) run(zoneManifest *SubstrateZoneManifest) *PreflightReport {
+	report := &PreflightReport{
+		ZoneName: zoneManifest.ZoneName(),
+		Checks:   []PreflightCheck{},
+		Passed:   true,
+	}
+	c.checkCredentials(report, zoneManifest)
+	c.checkAvailabilityZone(report, zoneManifest)
+	c.checkElasticIPs(report, zoneManifest)
+	c.checkVPCs(report, zoneManifest)
+	checkSSHKey(report, zoneManifest)
+	return report
+}
+
+// quotaStatus is the status of a limit check that comes up short: a warning
+// if we're resuming (since our own resources may be what's using it up)
+func (c *preflightChecker) quotaStatus() string {
+	if c.resuming {
+		return preflightWarn
+	}
+	return preflightFail
+}
+
+// checkCredentials checks that the active AWS credentials work and belong to the zone's account
+func (c *preflightChecker) checkCredentials(report *PreflightReport, zoneManifest *SubstrateZoneManifest) {
+	const name = "AWS credentials"
+	resp, err := c.stsSvc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		report.add(name, preflightFail, "error calling sts:GetCallerIdentity: %v", err)
+		return
+	}
+	if *resp.Account != zoneManifest.AWSAccountID {
+		report.add(
+			name,
+			preflightFail,
+			"credentials are for account %s (%s), not --aws-account-id %s",
+			*resp.Account,
+			*resp.Arn,
+			zoneManifest.AWSAccountID)
+		return
+	}
+	report.add(name, preflightPass, "%s in account %s", *resp.Arn, *resp.Account)
+}
+
+// checkAvailabilityZone checks that the zone's AZs exist in its region and are available
+func (c *preflightChecker) checkAvailabilityZone(report *PreflightReport, zoneManifest *SubstrateZoneManifest) {
+	const name = "availability zone"
+	resp, err := c.ec2Svc.DescribeAvailabilityZones(&ec2.DescribeAvailabilityZonesInput{})
+	if err != nil {
+		report.add(name, preflightFail, "error listing availability zones in %s: %v", zoneManifest.AWSRegion(), err)
+		return
+	}
+	available := []string{}
+	for _, az := range resp.AvailabilityZones {
+		if *az.State == "available" {
+			available = append(available, *az.ZoneName)
+		}
+	}
+	for _, zoneAZ := range zoneManifest.AvailabilityZones() {
+		found := false
+		for _, az := range available {
+			found = found || az == zoneAZ
+		}
+		if found {
+			report.add(name, preflightPass, "%s is available", zoneAZ)
+		} else {
+			report.add(
+				name,
+				preflightFail,
+				"%s is not an available zone in %s (try one of %v)",
+				zoneAZ,
+				zoneManifest.AWSRegion(),
+				available)
+		}
+	}
+}
+
+// checkElasticIPs checks there are enough VPC Elastic IPs left under the account limit
+func (c *preflightChecker) checkElasticIPs(report *PreflightReport, zoneManifest *SubstrateZoneManifest) {
+	const name = "Elastic IP limit"
+	zoneElasticIPs := zoneManifest.ZoneSpec().Borders.Count
+	attributes, err := c.ec2Svc.DescribeAccountAttributes(&ec2.DescribeAccountAttributesInput{
+		AttributeNames: []*string{aws.String("vpc-max-elastic-ips")},
+	})
+	if err != nil {
+		report.add(name, preflightFail, "error looking up the Elastic IP limit: %v", err)
+		return
+	}
+	limit := -1
+	for _, attribute := range attributes.AccountAttributes {
+		for _, value := range attribute.AttributeValues {
+			if parsed, err := strconv.Atoi(*value.AttributeValue); err == nil {
+				limit = parsed
+			}
+		}
+	}
+	if limit < 0 {
+		report.add(name, preflightWarn, "couldn't find the vpc-max-elastic-ips account attribute")
+		return
+	}
+
+	addresses, err := c.ec2Svc.DescribeAddresses(&ec2.DescribeAddressesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("domain"),
+				Values: []*string{aws.String("vpc")},
+			},
+		},
+	})
+	if err != nil {
+		report.add(name, preflightFail, "error listing Elastic IPs: %v", err)
+		return
+	}
+	used := len(addresses.Addresses)
+	if used+zoneElasticIPs > limit {
+		report.add(name, c.quotaStatus(), "%d of %d in use, the zone needs %d more", used, limit, zoneElasticIPs)
+		return
+	}
+	report.add(name, preflightPass, "%d of %d in use, the zone needs %d more", used, limit, zoneElasticIPs)
+}
+
+// checkVPCs checks there's room for the zone's VPCs under the limit, and that
+// the zone subnet doesn't overlap with any existing VPC
+func (c *preflightChecker) checkVPCs(report *PreflightReport, zoneManifest *SubstrateZoneManifest) {
+	resp, err := c.ec2Svc.DescribeVpcs(&ec2.DescribeVpcsInput{})
+	if err != nil {
+		report.add("VPC limit", preflightFail, "error listing VPCs: %v", err)
+		report.add("zone subnet", preflightFail, "error listing VPCs: %v", err)
+		return
+	}
+
+	used := len(resp.Vpcs)
+	if used+zoneVPCs > c.vpcLimit {
+		report.add("VPC limit", c.quotaStatus(), "%d of %d in use, the zone needs %d more (pass --vpc-limit if the limit has been raised)", used, c.vpcLimit, zoneVPCs)
+	} else {
+		report.add("VPC limit", preflightPass, "%d of %d in use, the zone needs %d more", used, c.vpcLimit, zoneVPCs)
+	}
+
+	_, zoneSubnet, err := net.ParseCIDR(zoneManifest.ZoneSubnet())
+	if err != nil {
+		report.add("zone subnet", preflightFail, "invalid zone subnet: %v", err)
+		return
+	}
+	overlaps := overlappingVPCs(resp.Vpcs, zoneSubnet, zoneManifest)
+	if len(overlaps) > 0 {
+		report.add("zone subnet", preflightFail, "%s overlaps with %v", zoneSubnet, overlaps)
+		return
+	}
+	report.add("zone subnet", preflightPass, "%s doesn't overlap with any VPC in %s", zoneSubnet, zoneManifest.AWSRegion())
+}
+
+// overlappingVPCs lists the VPCs that overlap with the zone subnet, other than
+// the zone's own VPC (unless zoneManifest is nil)
+func overlappingVPCs(vpcs []*ec2.Vpc, zoneSubnet *net.IPNet, zoneManifest *SubstrateZoneManifest) []string {
+	overlaps := []string{}
+	for _, vpc := range vpcs {
+		_, vpcSubnet, err := net.ParseCIDR(*vpc.CidrBlock)
+		if err != nil {
+			continue
+		}
+		if !subnetsOverlap(zoneSubnet, vpcSubnet) {
+			continue
+		}
+
+		// a failed create may have left our own VPC behind
+		if zoneManifest != nil && vpcTag(vpc, "substrate:zone") == zoneManifest.ZoneName() && vpcTag(vpc, "substrate:environment") == zoneManifest.EnvironmentName {
+			continue
+		}
+		overlaps = append(overlaps, fmt.Sprintf("%s (%s)", *vpc.VpcId, *vpc.CidrBlock))
+	}
+	return overlaps
+}
+
+// subnetsOverlap returns whether two CIDR blocks share any addresses
+func subnetsOverlap(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// vpcTag returns the value of a tag on a VPC, or "" if it isn't set
+func vpcTag(vpc *ec2.Vpc, key string) string {
+	return ec2TagValue(vpc.Tags, key)
+}
+
+// ec2TagValue returns the value of an EC2 tag, or "" if it isn't set
+func ec2TagValue(tags []*ec2.Tag, key string) string {
+	for _, tag := range tags {
+		if *tag.Key == key {
+			return *tag.Value
+		}
+	}
+	return ""
+}
+
+// checkSSHKey checks the zone's admin SSH public key
+func checkSSHKey(report *PreflightReport, zoneManifest *SubstrateZoneManifest) {
+	const name = "SSH public key"
+	switch {
+	case zoneManifest.SSHKey != nil:
+		_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(zoneManifest.SSHKey.PublicKey))
+		if err != nil {
+			report.add(name, preflightFail, "the zone's SSH public key is malformed: %v", err)
+			return
+		}
+		report.add(name, preflightPass, "%s (private key kept in %s)", zoneManifest.SSHKey.Fingerprint, zoneManifest.SSHKey.Storage)
+	case zoneManifest.SSHPublicKey != "":
+		checkSSHPublicKey(report, zoneManifest.SSHPublicKey)
+	default:
+		report.add(name, preflightPass, "a new key pair will be generated for the zone")
+	}
+}
+
+// checkSSHPublicKey checks that an admin SSH public key file exists and parses
+func checkSSHPublicKey(report *PreflightReport, path string) {
+	const name = "SSH public key"
+	keyData, err := ioutil.ReadFile(path)
+	if err != nil {
+		report.add(name, preflightFail, "error reading %s: %v", path, err)
+		return
+	}
+	_, comment, _, _, err := ssh.ParseAuthorizedKey(keyData)
+	if err != nil {
+		report.add(name, preflightFail, "%s is not an SSH public key: %v", path, err)
+		return
+	}
+	report.add(name, preflightPass, "%s (%s)", path, comment)
+}
+
+// runPreflight runs the preflight checks for a zone and prints the report,
+// returning an error if any of them failed
+func runPreflight(zoneManifest *SubstrateZoneManifest, vpcLimit int, resuming bool) error {
+	report := newPreflightChecker(zoneManifest, vpcLimit, resuming).run(zoneManifest)
+	report.Print(os.Stdout)
+	if !report.Passed {
+		return fmt.Errorf("preflight checks failed for zone %s", zoneManifest.ZoneName())
+	}
+	return nil
+}
+
+// Preflight checks that a zone could be created with the given parameters
+// (and the active AWS credentials), without changing anything
+func Preflight(params *PreflightInput) error {
+	zoneManifest := &SubstrateZoneManifest{
+		EnvironmentName:     params.EnvironmentName,
+		EnvironmentDomain:   params.EnvironmentDomain,
+		EnvironmentIndex:    params.EnvironmentIndex,
+		ZoneIndex:           params.ZoneIndex,
+		AWSAvailabilityZone: params.AWSAvailabilityZone,
+		AWSAccountID:        params.AWSAccountID,
+
+		// check the key file itself, since it hasn't been copied into a manifest yet
+		SSHPublicKey: params.SSHPublicKey,
+	}
+	if params.Spec != "" {
+		var err error
+		zoneManifest.Spec, err = ReadZoneSpec(params.Spec)
+		if err != nil {
+			return err
+		}
+		err = zoneManifest.checkZoneSpec()
+		if err != nil {
+			return fmt.Errorf("invalid zone spec: %v", err)
+		}
+	}
+	return runPreflight(zoneManifest, params.VPCLimit, false)
+}
@@ -0,0 +1,217 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/util"
+)
+
+// RekeyInput contains the input parameters for re-encrypting a zone manifest
+type RekeyInput struct {
+	Prompt       bool
+	ManifestPath string
+
+	// NewKey is the key provider spec to encrypt with from now on (e.g., "keyfile:/path/to/new.key")
+	NewKey string
+
+	// GenerateKey creates a new key file for a "keyfile" NewKey before using it
+	GenerateKey bool
+
+	// Decrypt stores the manifest in plaintext instead of re-encrypting it
+	Decrypt bool
+}
+
+// rekeyedSuffixes are the files stored alongside a manifest that hold copies
+// of it, and so need to be re-encrypted along with it (in addition to the
+// manifest history and any outstanding checkpoint). The zone replacement
+// record holds no manifest data, so it's stored in plaintext and left alone.
+var rekeyedSuffixes = []string{"", ".bak"}
+
+// rekeyedSSHKeySuffixes are the files holding the zone's admin SSH private
+// key (encrypted with the same key as the manifest, if it's encrypted)
+var rekeyedSSHKeySuffixes = []string{sshKeySuffix, sshKeyBackupSuffix}
+
+// Rekey re-encrypts a zone manifest (and the copies stored with it) under a
+// new key. This is the one case where manifest snapshots are rewritten, since
+// otherwise the old key could never be retired.
+func Rekey(params *RekeyInput) error {
+	var newKeyProvider KeyProvider
+	if !params.Decrypt {
+		if params.GenerateKey {
+			if params.NewKey != "" && !strings.HasPrefix(params.NewKey, "keyfile") {
+				return fmt.Errorf("--generate-key only works with keyfile keys, not %q", params.NewKey)
+			}
+			path, err := GenerateKeyFile(strings.TrimPrefix(strings.TrimPrefix(params.NewKey, "keyfile"), ":"))
+			if err != nil {
+				return fmt.Errorf("error generating manifest key: %v", err)
+			}
+			fmt.Printf("generated new manifest key %q, make sure you keep a copy somewhere safe\n", path)
+			params.NewKey = "keyfile:" + path
+		}
+
+		var err error
+		newKeyProvider, err = OpenKeyProvider(params.NewKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	store, err := OpenManifestStore(params.ManifestPath)
+	if err != nil {
+		return err
+	}
+
+	err = store.Lock()
+	if err != nil {
+		return err
+	}
+	defer store.Unlock()
+
+	// decrypt everything before we write anything, so we never end up with a
+	// mix of old and new keys if one of them turns out to be unreadable
+	manifests := map[string]*SubstrateZoneManifest{}
+	for _, suffix := range rekeyedSuffixes {
+		storedJSON, err := store.Read(suffix)
+		if os.IsNotExist(err) && suffix != "" {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		manifests[suffix], err = ParseManifest(storedJSON, store.String()+suffix)
+		if err != nil {
+			return err
+		}
+	}
+
+	sshKeys := map[string][]byte{}
+	for _, suffix := range rekeyedSSHKeySuffixes {
+		stored, err := store.Read(suffix)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		sshKeys[suffix], err = decodeZoneSSHKey(stored)
+		if err != nil {
+			return fmt.Errorf("error decrypting %s%s: %v", store, suffix, err)
+		}
+	}
+
+	snapshots, err := ListManifestSnapshots(store)
+	if err != nil {
+		return err
+	}
+	snapshotManifests := map[int]*SubstrateZoneManifest{}
+	for _, snapshot := range snapshots {
+		snapshotManifests[snapshot.Index], err = snapshot.ParseManifest()
+		if err != nil {
+			return err
+		}
+	}
+
+	// an interrupted run's checkpoint has to stay readable, or recovering it
+	// would fail once the old key is retired
+	checkpoint, err := readManifestCheckpoint(store)
+	if err != nil {
+		return err
+	}
+	var checkpointManifest *SubstrateZoneManifest
+	if checkpoint != nil {
+		checkpointManifest, err = ParseManifest(checkpoint.Manifest, store.String()+manifestCheckpointSuffix)
+		if err != nil {
+			return err
+		}
+	}
+
+	describe := func(p KeyProvider) string {
+		if p == nil {
+			return "plaintext"
+		}
+		return fmt.Sprintf("%s key %s", p.Name(), p.KeyID())
+	}
+	fmt.Printf(
+		"re-encrypting zone manifest %s from %s to %s\n",
+		store,
+		describe(manifests[""].KeyProvider()),
+		describe(newKeyProvider))
+
+	if params.Prompt {
+		err = util.Confirm("do you want to continue?")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, suffix := range rekeyedSuffixes {
+		zoneManifest, ok := manifests[suffix]
+		if !ok {
+			continue
+		}
+		zoneManifest.SetKeyProvider(newKeyProvider)
+		marshalledJSON, err := zoneManifest.MarshalManifest()
+		if err != nil {
+			return err
+		}
+		err = store.Write(suffix, marshalledJSON)
+		if err != nil {
+			return fmt.Errorf("error writing %s%s: %v", store, suffix, err)
+		}
+	}
+
+	for _, suffix := range rekeyedSSHKeySuffixes {
+		privateKeyPEM, ok := sshKeys[suffix]
+		if !ok {
+			continue
+		}
+		stored, err := encodeZoneSSHKey(privateKeyPEM, newKeyProvider)
+		if err != nil {
+			return err
+		}
+		err = store.Write(suffix, stored)
+		if err != nil {
+			return fmt.Errorf("error writing %s%s: %v", store, suffix, err)
+		}
+	}
+
+	for _, snapshot := range snapshots {
+		zoneManifest := snapshotManifests[snapshot.Index]
+		zoneManifest.SetKeyProvider(newKeyProvider)
+		marshalledJSON, err := zoneManifest.MarshalManifest()
+		if err != nil {
+			return err
+		}
+		snapshot.Manifest = json.RawMessage(marshalledJSON)
+		snapshotJSON, err := json.MarshalIndent(snapshot, "", "    ")
+		if err != nil {
+			return err
+		}
+		suffix := manifestSnapshotSuffix(snapshot.Index)
+		err = store.Write(suffix, snapshotJSON)
+		if err != nil {
+			return fmt.Errorf("error writing %s%s: %v", store, suffix, err)
+		}
+	}
+
+	if checkpoint != nil {
+		checkpointManifest.SetKeyProvider(newKeyProvider)
+		marshalledJSON, err := checkpointManifest.MarshalManifest()
+		if err != nil {
+			return err
+		}
+		checkpoint.Manifest = json.RawMessage(marshalledJSON)
+		checkpointJSON, err := json.MarshalIndent(checkpoint, "", "    ")
+		if err != nil {
+			return err
+		}
+		err = store.Write(manifestCheckpointSuffix, checkpointJSON)
+		if err != nil {
+			return fmt.Errorf("error writing %s%s: %v", store, manifestCheckpointSuffix, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package zone
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRekeyCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "substrate-rekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv(ManifestKeyEnvVar, os.Getenv(ManifestKeyEnvVar))
+
+	oldKey, err := GenerateKeyFile(filepath.Join(dir, "old.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := GenerateKeyFile(filepath.Join(dir, "new.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldProvider, err := OpenKeyProvider("keyfile:" + oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(ManifestKeyEnvVar, "keyfile:"+oldKey)
+
+	// an encrypted manifest, with a checkpoint left by an interrupted apply
+	store, err := OpenManifestStore(filepath.Join(dir, "zone.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zoneManifest := &SubstrateZoneManifest{
+		ManifestVersion: CurrentManifestVersion,
+		Version:         "v1.0.1",
+		EnvironmentName: "dev",
+	}
+	zoneManifest.SetKeyProvider(oldProvider)
+	err = WriteManifestTo(store, zoneManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zoneManifest.TerraformState = map[string]interface{}{"serial": 2.0}
+	storedJSON, err := zoneManifest.MarshalManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpointJSON, err := json.Marshal(&ManifestSnapshot{Command: "update", Manifest: storedJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Write(manifestCheckpointSuffix, checkpointJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Rekey(&RekeyInput{ManifestPath: filepath.Join(dir, "zone.json"), NewKey: "keyfile:" + newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// retire the old key, then recover the checkpoint with the new one
+	err = os.Remove(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(ManifestKeyEnvVar, "keyfile:"+newKey)
+	zoneManifest, err = ReadManifestFrom(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = recoverManifestCheckpoint(store, zoneManifest, "v1.0.1")
+	if err != nil {
+		t.Fatalf("error recovering the checkpoint after rekeying: %v", err)
+	}
+	state, _ := zoneManifest.TerraformState.(map[string]interface{})
+	if state["serial"] != 2.0 {
+		t.Fatalf("expected the checkpoint's state to be recovered, got %v", zoneManifest.TerraformState)
+	}
+}
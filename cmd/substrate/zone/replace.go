@@ -0,0 +1,643 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/route53"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/util"
+)
+
+// zoneReplacementSuffix is the store suffix (next to the old zone's manifest)
+// of the record of a zone replacement in progress
+const zoneReplacementSuffix = ".replacement"
+
+// activationTTL is the TTL of the CNAME record that activates a zone, kept
+// short so switching back to the old zone takes effect quickly
+const activationTTL = 60
+
+// how often we check on the new zone's Kubernetes nodes while waiting for it to be healthy
+const replaceHealthPollInterval = 15 * time.Second
+
+// the steps of a zone replacement, in order
+const (
+	replaceStepCreate         = "create"
+	replaceStepWaitHealthy    = "wait-healthy"
+	replaceStepSwitchDNS      = "switch-dns"
+	replaceStepGracePeriod    = "grace-period"
+	replaceStepDestroyOldZone = "destroy-old-zone"
+)
+
+// ZoneReplacement records how far a blue/green replacement of a zone has got,
+// so that `substrate zone replace --resume` can pick up after the last
+// finished step. It's kept alongside the old zone's manifest until the old
+// zone has been destroyed.
+type ZoneReplacement struct {
+	// Step is the next step to run
+	Step string `json:"step"`
+
+	Started          time.Time `json:"started"`
+	Operator         string    `json:"operator"`
+	SubstrateVersion string    `json:"substrate_version"`
+
+	// NewManifestPath, NewZoneIndex and AWSAvailabilityZone are where the new zone goes
+	NewManifestPath     string `json:"new_manifest_path"`
+	NewZoneIndex        int    `json:"new_zone_index"`
+	AWSAvailabilityZone string `json:"aws_availability_zone"`
+
+	// ActivationName is the environment-level (usually wildcard) CNAME record
+	// that sends traffic to the active zone, and ActivationPool is the worker
+	// pool in the zone it points at
+	ActivationName string `json:"activation_name"`
+	ActivationPool string `json:"activation_pool"`
+
+	// HostedZoneID is the Route53 Hosted Zone the activation record is in,
+	// or "" if it's managed outside the account
+	HostedZoneID string `json:"hosted_zone_id,omitempty"`
+
+	// PreviousTarget is what the activation record pointed at before it was
+	// switched ("" if there wasn't one), and NewTarget is the new zone's pool
+	PreviousTarget string     `json:"previous_target,omitempty"`
+	NewTarget      string     `json:"new_target,omitempty"`
+	SwitchedAt     *time.Time `json:"switched_at,omitempty"`
+}
+
+// ReplaceInput contains the input parameters for replacing a zone
+type ReplaceInput struct {
+	Version      string
+	Prompt       bool
+	ManifestPath string
+
+	// NewManifestPath is where to write the new zone's manifest
+	NewManifestPath string
+
+	// ZoneIndex is the new zone's index, or -1 to pick the first free one
+	ZoneIndex int
+
+	// AWSAvailabilityZone moves the new zone to another AZ (optional)
+	AWSAvailabilityZone string
+
+	// ActivationName is the CNAME record to switch to the new zone (defaults
+	// to "*.<environment domain>"), and ActivationPool the worker pool it
+	// points at (defaults to "worker")
+	ActivationName string
+	ActivationPool string
+
+	// GracePeriod is how long to keep the old zone around after switching
+	// DNS, and HealthTimeout how long to wait for the new zone to be healthy
+	GracePeriod   time.Duration
+	HealthTimeout time.Duration
+
+	// Resume picks up a replacement that stopped part way
+	Resume bool
+
+	// DestroyOldZone confirms that the old zone should be destroyed once the grace period is over
+	DestroyOldZone bool
+
+	// these are passed through to Clone
+	Encrypt       bool
+	ManifestKey   string
+	SkipPreflight bool
+	VPCLimit      int
+	SSHKeyAgent   bool
+}
+
+// Replace does a blue/green replacement of a zone: it creates a new zone with
+// the same configuration (and this version of Substrate) at a free zone index,
+// waits for it to be healthy, switches the environment's activation CNAME over
+// to it, and then (once the grace period is over, and only when asked to)
+// destroys the old zone. It stops after each step that leaves the zones in a
+// consistent state, and can be resumed from there with --resume.
+func Replace(params *ReplaceInput) error {
+	oldStore, err := OpenManifestStore(params.ManifestPath)
+	if err != nil {
+		return err
+	}
+
+	// hold the old zone's lock throughout, so nobody updates or destroys it
+	// (or resumes the same replacement) while we're working on it
+	err = oldStore.Lock()
+	if err != nil {
+		return err
+	}
+	defer oldStore.Unlock()
+
+	record, err := readZoneReplacement(oldStore)
+	if err != nil {
+		return err
+	}
+	switch {
+	case record == nil && params.Resume:
+		return fmt.Errorf("there is no zone replacement in progress for %v to resume", oldStore)
+	case record != nil && !params.Resume:
+		return fmt.Errorf(
+			"zone %v is already being replaced by %s (started by %s at %s, next step %q), run `substrate zone replace --resume` to pick it up",
+			oldStore,
+			record.NewManifestPath,
+			record.Operator,
+			record.Started.Local(),
+			record.Step)
+	case record == nil:
+		record, err = startZoneReplacement(oldStore, params)
+		if err != nil {
+			return err
+		}
+	case record.Step == replaceStepCreate && record.SubstrateVersion != params.Version:
+		return fmt.Errorf(
+			"the new zone is being created with Substrate %s, resume the replacement with that version (this is %s)",
+			record.SubstrateVersion,
+			params.Version)
+	default:
+		fmt.Printf("resuming the replacement of zone %v by %s at step %q\n", oldStore, record.NewManifestPath, record.Step)
+	}
+
+	for {
+		var next string
+		switch record.Step {
+		case replaceStepCreate:
+			next, err = replaceCreate(params, record)
+		case replaceStepWaitHealthy:
+			next, err = replaceWaitHealthy(params, record)
+		case replaceStepSwitchDNS:
+			next, err = replaceSwitchDNS(oldStore, params, record)
+		case replaceStepGracePeriod:
+			next, err = replaceGracePeriod(params, record)
+		case replaceStepDestroyOldZone:
+			return replaceDestroyOldZone(oldStore, params, record)
+		default:
+			return fmt.Errorf("zone replacement record %s%s has unknown step %q", oldStore, zoneReplacementSuffix, record.Step)
+		}
+		if err != nil {
+			return err
+		}
+		if next == record.Step {
+			// waiting on the operator (or the clock) before going any further
+			return nil
+		}
+		record.Step = next
+		err = writeZoneReplacement(oldStore, record)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// startZoneReplacement works out where the new zone goes and saves the record of a new replacement
+func startZoneReplacement(oldStore ManifestStore, params *ReplaceInput) (*ZoneReplacement, error) {
+	oldManifest, err := ReadManifestFrom(oldStore)
+	if err != nil {
+		return nil, err
+	}
+	if params.NewManifestPath == "" {
+		return nil, fmt.Errorf("--new-manifest is required to start replacing a zone")
+	}
+	if params.ZoneIndex > 15 {
+		return nil, fmt.Errorf("zone index must be 0..15, not %d", params.ZoneIndex)
+	}
+	if params.NewManifestPath == params.ManifestPath {
+		return nil, fmt.Errorf("--new-manifest must be different from the old zone's manifest (%s)", params.ManifestPath)
+	}
+
+	record := &ZoneReplacement{
+		Step:                replaceStepCreate,
+		Started:             time.Now().UTC(),
+		Operator:            util.CurrentUser(),
+		SubstrateVersion:    params.Version,
+		NewManifestPath:     params.NewManifestPath,
+		NewZoneIndex:        params.ZoneIndex,
+		AWSAvailabilityZone: params.AWSAvailabilityZone,
+		ActivationName:      params.ActivationName,
+		ActivationPool:      params.ActivationPool,
+	}
+	if record.AWSAvailabilityZone == "" {
+		record.AWSAvailabilityZone = oldManifest.AWSAvailabilityZone
+	}
+	if record.ActivationName == "" {
+		record.ActivationName = "*." + oldManifest.EnvironmentDomain
+	}
+	if record.ActivationPool == "" {
+		record.ActivationPool = defaultWorkerPoolName
+	}
+	if _, ok := oldManifest.WorkerPool(record.ActivationPool); !ok {
+		return nil, fmt.Errorf("zone %s has no worker pool named %q to activate", oldManifest.ZoneName(), record.ActivationPool)
+	}
+
+	if record.NewZoneIndex < 0 {
+		sess := session.New(&aws.Config{Region: aws.String(oldManifest.AWSRegion())})
+		record.NewZoneIndex, err = findFreeZoneIndex(ec2.New(sess), oldManifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if upgrade, err := planUpgrade(oldManifest.Version, params.Version); err == nil {
+		fmt.Printf("note: zone %s could be updated in place instead (%s), see `substrate zone update --check`\n", oldManifest.ZoneName(), upgrade.Kind)
+	}
+	fmt.Printf(
+		"replacing zone %s (Substrate %s) with a new zone %d in %s (Substrate %s), then switching %s over to it\n",
+		oldManifest.ZoneName(),
+		oldManifest.Version,
+		record.NewZoneIndex,
+		record.AWSAvailabilityZone,
+		params.Version,
+		record.ActivationName)
+
+	err = writeZoneReplacement(oldStore, record)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// findFreeZoneIndex picks the first zone index in the old zone's environment
+// whose subnet doesn't overlap any VPC in the region (the old zone's included)
+func findFreeZoneIndex(svc ec2iface.EC2API, oldManifest *SubstrateZoneManifest) (int, error) {
+	resp, err := svc.DescribeVpcs(&ec2.DescribeVpcsInput{})
+	if err != nil {
+		return 0, fmt.Errorf("error looking for a free zone index: %v", err)
+	}
+	for index := 0; index <= 15; index++ {
+		if index == oldManifest.ZoneIndex {
+			continue
+		}
+		candidate := &SubstrateZoneManifest{
+			EnvironmentName:  oldManifest.EnvironmentName,
+			EnvironmentIndex: oldManifest.EnvironmentIndex,
+			ZoneIndex:        index,
+		}
+		_, zoneSubnet, err := net.ParseCIDR(candidate.ZoneSubnet())
+		if err != nil {
+			return 0, err
+		}
+		if len(overlappingVPCs(resp.Vpcs, zoneSubnet, nil)) == 0 {
+			return index, nil
+		}
+	}
+	return 0, fmt.Errorf("there's no free zone index left in environment %s, pick one with --zone-index", oldManifest.EnvironmentName)
+}
+
+// replaceCreate creates (or finishes creating) the new zone
+func replaceCreate(params *ReplaceInput, record *ZoneReplacement) (string, error) {
+	newStore, err := OpenManifestStore(record.NewManifestPath)
+	if err != nil {
+		return "", err
+	}
+	created, partial, err := zoneCreateStatus(newStore)
+	if err != nil {
+		return "", err
+	}
+	if created {
+		fmt.Printf("the new zone %v has already been created\n", newStore)
+		return replaceStepWaitHealthy, nil
+	}
+
+	err = Clone(&CloneInput{
+		Version:             params.Version,
+		Prompt:              params.Prompt,
+		SourceManifestPath:  params.ManifestPath,
+		OutputManifestPath:  record.NewManifestPath,
+		ZoneIndex:           record.NewZoneIndex,
+		AWSAvailabilityZone: record.AWSAvailabilityZone,
+		Encrypt:             params.Encrypt,
+		ManifestKey:         params.ManifestKey,
+		Resume:              partial,
+		SkipPreflight:       params.SkipPreflight,
+		VPCLimit:            params.VPCLimit,
+		SSHKeyAgent:         params.SSHKeyAgent,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating the new zone (run `substrate zone replace --resume` to pick up where it stopped): %v", err)
+	}
+	return replaceStepWaitHealthy, nil
+}
+
+// zoneCreateStatus returns whether a zone was created successfully, and
+// whether there's a partial zone left behind by a create that didn't finish
+func zoneCreateStatus(store ManifestStore) (bool, bool, error) {
+	exists, err := ManifestExists(store)
+	if err != nil {
+		return false, false, err
+	}
+	if exists {
+		snapshots, err := ListManifestSnapshots(store)
+		if err != nil {
+			return false, false, err
+		}
+		if len(snapshots) > 0 && snapshots[len(snapshots)-1].Succeeded() {
+			return true, false, nil
+		}
+		return false, true, nil
+	}
+	checkpoint, err := readManifestCheckpoint(store)
+	if err != nil {
+		return false, false, err
+	}
+	return false, checkpoint != nil, nil
+}
+
+// replaceWaitHealthy waits for every director and worker in the new zone to
+// be a Ready Kubernetes node
+func replaceWaitHealthy(params *ReplaceInput, record *ZoneReplacement) (string, error) {
+	newStore, newManifest, err := openReplacementManifest(record)
+	if err != nil {
+		return "", err
+	}
+
+	spec := newManifest.ZoneSpec()
+	expected := spec.Directors.Count
+	for _, pool := range spec.WorkerPools {
+		expected += pool.Count
+	}
+
+	borderEIP, err := healthyBorderEIP(newManifest)
+	if err != nil {
+		return "", err
+	}
+	signer, err := zoneSSHSigner(newStore, newManifest)
+	if err != nil {
+		return "", err
+	}
+	kubernetes, err := newKubernetesClient(newManifest, sshAuthMethods(signer), borderEIP)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Printf("waiting for zone %s's %d nodes to be Ready...\n", newManifest.ZoneName(), expected)
+	deadline := time.Now().Add(params.HealthTimeout)
+	for {
+		nodes, err := kubernetes.Nodes()
+		if err != nil {
+			fmt.Printf("error listing Kubernetes nodes (will retry): %v\n", err)
+		} else {
+			ready, notReady := countReadyNodes(nodes)
+			if ready >= expected && len(notReady) == 0 {
+				fmt.Printf("zone %s is healthy (%d Ready nodes)\n", newManifest.ZoneName(), ready)
+				return replaceStepSwitchDNS, nil
+			}
+			fmt.Printf("%d of %d nodes Ready\n", ready, expected)
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf(
+				"timed out after %v waiting for zone %s to be healthy, run `substrate zone replace --resume` to keep waiting",
+				params.HealthTimeout,
+				newManifest.ZoneName())
+		}
+		time.Sleep(replaceHealthPollInterval)
+	}
+}
+
+// countReadyNodes counts the Ready nodes, and lists the names of the others
+func countReadyNodes(nodes []kubernetesNode) (int, []string) {
+	ready := 0
+	notReady := []string{}
+	for _, node := range nodes {
+		if node.Ready() {
+			ready++
+		} else {
+			notReady = append(notReady, node.Metadata.Name)
+		}
+	}
+	return ready, notReady
+}
+
+// replaceSwitchDNS points the activation CNAME at the new zone's worker pool,
+// in Route53 if the record's domain is served from this account, or else by
+// asking the operator to do it and checking it's been done
+func replaceSwitchDNS(oldStore ManifestStore, params *ReplaceInput, record *ZoneReplacement) (string, error) {
+	_, newManifest, err := openReplacementManifest(record)
+	if err != nil {
+		return "", err
+	}
+	record.NewTarget, err = newManifest.StringOutput(workerPoolOutputPrefix(record.ActivationPool) + "_dns")
+	if err != nil {
+		return "", err
+	}
+
+	route53Svc := route53.New(session.New(), &aws.Config{Region: aws.String(newManifest.AWSRegion())})
+	if record.HostedZoneID == "" {
+		suffix, suffixNameservers, err := util.FindFirstSuffixWithWorkingDNS(record.ActivationName)
+		if err != nil {
+			return "", err
+		}
+		record.HostedZoneID, err = findDelegatingHostedZone(route53Svc, suffix, suffixNameservers)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if record.HostedZoneID == "" {
+		// we can't change the record ourselves, so see if someone else has
+		current, err := lookupActivationTarget(record.ActivationName)
+		if err == nil && current == record.NewTarget {
+			return replaceSwitched(record), nil
+		}
+		fmt.Printf(
+			"\nThe Hosted Zone for %q isn't in this AWS account, so Substrate can't switch it over for you.\n"+
+				"To activate the new zone, set this record and then run `substrate zone replace --resume`:\n\n"+
+				"    %s CNAME %s\n\n",
+			record.ActivationName,
+			record.ActivationName,
+			record.NewTarget)
+		return record.Step, nil
+	}
+
+	current, exists, err := util.GetCNAMERecord(route53Svc, record.HostedZoneID, record.ActivationName)
+	if err != nil {
+		return "", err
+	}
+	if exists && current == record.NewTarget {
+		fmt.Printf("%s already points at the new zone (%s)\n", record.ActivationName, record.NewTarget)
+		return replaceSwitched(record), nil
+	}
+	if exists {
+		// save it before changing anything, so we can still tell the operator
+		// how to switch back if we're interrupted
+		record.PreviousTarget = current
+		err = writeZoneReplacement(oldStore, record)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	fmt.Printf("switching %s from %q to %s\n", record.ActivationName, current, record.NewTarget)
+	if params.Prompt {
+		err = util.Confirm("do you want to switch traffic over to the new zone?")
+		if err != nil {
+			return "", err
+		}
+	}
+	changeID, err := util.UpsertCNAMERecord(route53Svc, record.HostedZoneID, record.ActivationName, record.NewTarget, activationTTL)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("waiting for Route53 change %s to be INSYNC...\n", changeID)
+	err = util.WaitForChangeInsync(route53Svc, changeID, delegationInsyncTimeout)
+	if err != nil {
+		return "", err
+	}
+	return replaceSwitched(record), nil
+}
+
+// replaceSwitched notes when DNS was switched over, which starts the grace period
+func replaceSwitched(record *ZoneReplacement) string {
+	now := time.Now().UTC()
+	record.SwitchedAt = &now
+	return replaceStepGracePeriod
+}
+
+// lookupActivationTarget resolves the CNAME at a (possibly wildcard) activation name
+func lookupActivationTarget(name string) (string, error) {
+	if strings.HasPrefix(name, "*.") {
+		name = "substrate-activation-check" + strings.TrimPrefix(name, "*")
+	}
+	cname, err := net.LookupCNAME(name)
+	return strings.TrimSuffix(cname, "."), err
+}
+
+// replaceGracePeriod keeps the old zone until the grace period is over
+func replaceGracePeriod(params *ReplaceInput, record *ZoneReplacement) (string, error) {
+	deadline := record.SwitchedAt.Add(params.GracePeriod)
+	if time.Now().Before(deadline) {
+		fmt.Printf(
+			"%s has pointed at the new zone since %s, keeping the old zone %s until %s\n",
+			record.ActivationName,
+			record.SwitchedAt.Local(),
+			params.ManifestPath,
+			deadline.Local())
+		printSwitchBack(record)
+		fmt.Printf("after that, run `substrate zone replace --resume --destroy-old-zone` to destroy it\n")
+		return record.Step, nil
+	}
+	return replaceStepDestroyOldZone, nil
+}
+
+// printSwitchBack tells the operator how to send traffic back to the old zone
+func printSwitchBack(record *ZoneReplacement) {
+	if record.PreviousTarget == "" {
+		fmt.Printf("(%s didn't point anywhere before, so there's nothing to switch back to)\n", record.ActivationName)
+		return
+	}
+	fmt.Printf("to switch back, point %s at %s again\n", record.ActivationName, record.PreviousTarget)
+}
+
+// replaceDestroyOldZone destroys the old zone, once the operator has said to,
+// and then forgets about the replacement. The old zone's lock (held by
+// Replace) is released while it's destroyed.
+func replaceDestroyOldZone(oldStore ManifestStore, params *ReplaceInput, record *ZoneReplacement) error {
+	exists, err := ManifestExists(oldStore)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if !params.DestroyOldZone {
+			fmt.Printf("the grace period is over, run `substrate zone replace --resume --destroy-old-zone` to destroy the old zone %v\n", oldStore)
+			printSwitchBack(record)
+			return nil
+		}
+
+		// this version can only destroy the old zone if it could update it in
+		// place, otherwise it has to be destroyed by the version that built it
+		oldManifest, err := ReadManifestFrom(oldStore)
+		if err != nil {
+			return err
+		}
+		_, err = planUpgrade(oldManifest.Version, params.Version)
+		if err != nil {
+			return fmt.Errorf(
+				"%v, so the old zone can't be destroyed by this version: run `substrate zone destroy --manifest %s` with Substrate %s, then `substrate zone replace --resume` to finish",
+				err,
+				params.ManifestPath,
+				oldManifest.Version)
+		}
+
+		// don't take down the old zone if traffic has been switched back to it
+		if record.HostedZoneID != "" {
+			route53Svc := route53.New(session.New(), &aws.Config{Region: aws.String(oldManifest.AWSRegion())})
+			current, _, err := util.GetCNAMERecord(route53Svc, record.HostedZoneID, record.ActivationName)
+			if err != nil {
+				return err
+			}
+			if current != record.NewTarget {
+				return fmt.Errorf(
+					"%s points at %q now rather than the new zone (%s), so the old zone is not being destroyed",
+					record.ActivationName,
+					current,
+					record.NewTarget)
+			}
+		}
+
+		// Destroy takes the old zone's lock itself
+		fmt.Printf("destroying the old zone %v\n", oldStore)
+		err = oldStore.Unlock()
+		if err != nil {
+			return err
+		}
+		err = Destroy(&DestroyInput{
+			Version:      params.Version,
+			Prompt:       params.Prompt,
+			ManifestPath: params.ManifestPath,
+		})
+		if err != nil {
+			return fmt.Errorf("error destroying the old zone (run `substrate zone replace --resume --destroy-old-zone` to retry): %v", err)
+		}
+		err = oldStore.Lock()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = oldStore.Delete(zoneReplacementSuffix)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("zone %v has been replaced by %s\n", oldStore, record.NewManifestPath)
+	return nil
+}
+
+// openReplacementManifest reads the new zone's manifest
+func openReplacementManifest(record *ZoneReplacement) (ManifestStore, *SubstrateZoneManifest, error) {
+	store, err := OpenManifestStore(record.NewManifestPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	zoneManifest, err := ReadManifestFrom(store)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, zoneManifest, nil
+}
+
+// readZoneReplacement reads the record of a replacement in progress, returning nil if there isn't one
+func readZoneReplacement(store ManifestStore) (*ZoneReplacement, error) {
+	recordJSON, err := store.Read(zoneReplacementSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record ZoneReplacement
+	err = json.Unmarshal(recordJSON, &record)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing zone replacement record %s%s: %v", store, zoneReplacementSuffix, err)
+	}
+	return &record, nil
+}
+
+// writeZoneReplacement saves the record of a replacement in progress
+func writeZoneReplacement(store ManifestStore, record *ZoneReplacement) error {
+	recordJSON, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.Write(zoneReplacementSuffix, recordJSON)
+}
@@ -0,0 +1,112 @@
+package zone
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplaceDestroyOldZone(t *testing.T) {
+	tests := []struct {
+		name       string
+		oldVersion string
+
+		wantErr       string
+		wantDestroyed bool
+	}{
+		{
+			name:          "old zone could be updated in place",
+			oldVersion:    "v1.0.1",
+			wantDestroyed: true,
+		},
+		{
+			name:       "old zone is from an older major version",
+			oldVersion: "v0.9.0",
+			wantErr:    "run `substrate zone destroy --manifest",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, stop := startFakeZone(t)
+			defer stop()
+			params := f.createInput()
+			params.Version = test.oldVersion
+			err := Create(params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.runner.Calls = nil
+
+			// the new zone is up and traffic was switched over to it long ago
+			switched := time.Now().Add(-48 * time.Hour)
+			err = writeZoneReplacement(f.store(t), &ZoneReplacement{
+				Step:            replaceStepDestroyOldZone,
+				NewManifestPath: f.dir + "/zone01.json",
+				NewZoneIndex:    1,
+				ActivationName:  "*.dev.example.com",
+				ActivationPool:  defaultWorkerPoolName,
+				SwitchedAt:      &switched,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = Replace(&ReplaceInput{
+				Version:        "v1.1.0",
+				ManifestPath:   f.manifestPath,
+				Resume:         true,
+				DestroyOldZone: true,
+			})
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("expected an error containing %q, got %v", test.wantErr, err)
+			}
+			if f.exists(t, "") == test.wantDestroyed {
+				t.Errorf("expected the old zone to be destroyed: %v", test.wantDestroyed)
+			}
+			if f.exists(t, zoneReplacementSuffix) == test.wantDestroyed {
+				t.Errorf("expected the replacement record to be removed: %v", test.wantDestroyed)
+			}
+			if !test.wantDestroyed && len(f.runner.Calls) > 0 {
+				t.Errorf("expected Terraform not to run, got %v", f.runner.Calls)
+			}
+
+			// the old zone's lock is released either way
+			store := f.store(t)
+			err = store.Lock()
+			if err != nil {
+				t.Fatalf("the old zone was left locked: %v", err)
+			}
+			store.Unlock()
+		})
+	}
+}
+
+func TestReplaceLocksOldZone(t *testing.T) {
+	f, stop := startFakeZone(t)
+	defer stop()
+	f.create(t)
+
+	// someone else is working on the old zone
+	store := f.store(t)
+	err := store.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Unlock()
+
+	err = Replace(&ReplaceInput{
+		Version:         "v1.0.1",
+		ManifestPath:    f.manifestPath,
+		NewManifestPath: f.dir + "/zone01.json",
+		ZoneIndex:       1,
+	})
+	if err == nil || !strings.Contains(err.Error(), "is locked by") {
+		t.Fatalf("expected replace to fail on the locked zone, got %v", err)
+	}
+	if f.exists(t, zoneReplacementSuffix) {
+		t.Errorf("a replacement was started on the locked zone")
+	}
+}
@@ -0,0 +1,108 @@
+package zone
+
+import (
+	"fmt"
+)
+
+// resumeManifest loads whatever an interrupted or failed `substrate zone
+// create` left behind: the partial manifest saved when it stopped, the state
+// checkpoint saved while `terraform apply` was running, or both. The result
+// carries over the Terraform state and delegation set so that creating the
+// zone can pick up where it left off. It should only be called while holding
+// the store lock.
+func resumeManifest(store ManifestStore, params *CreateInput) (*SubstrateZoneManifest, error) {
+	var zoneManifest *SubstrateZoneManifest
+
+	exists, err := ManifestExists(store)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		zoneManifest, err = ReadManifestFrom(store)
+		if err != nil {
+			return nil, err
+		}
+
+		// a manifest whose latest snapshot succeeded is for a zone that's already up
+		snapshots, err := ListManifestSnapshots(store)
+		if err != nil {
+			return nil, err
+		}
+		if len(snapshots) > 0 && snapshots[len(snapshots)-1].Succeeded() {
+			return nil, fmt.Errorf(
+				"zone manifest %v is for a zone that was created successfully, try `substrate zone update`?",
+				store)
+		}
+	}
+
+	checkpoint, err := readManifestCheckpoint(store)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint != nil {
+		if zoneManifest != nil {
+			err = recoverManifestCheckpoint(store, zoneManifest, params.Version)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			// interrupted before the manifest was ever written, so the checkpoint is all we have.
+			// It stays in place until the resumed run saves the manifest.
+			fmt.Printf(
+				"recovering Terraform state from an interrupted `%s` by %s at %s\n",
+				checkpoint.Command,
+				checkpoint.Operator,
+				checkpoint.Timestamp.Local())
+			zoneManifest, err = checkpoint.ParseManifest()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if zoneManifest == nil {
+		return nil, fmt.Errorf("there is no partial zone manifest or checkpoint at %v to resume", store)
+	}
+
+	// make sure we're resuming the zone we've been asked to create
+	mismatch := func(name string, actual interface{}, requested interface{}) error {
+		return fmt.Errorf(
+			"can't resume zone manifest %v: it has %s %v, but %v was requested",
+			store,
+			name,
+			actual,
+			requested)
+	}
+	switch {
+	case zoneManifest.EnvironmentName != params.EnvironmentName:
+		return nil, mismatch("environment", zoneManifest.EnvironmentName, params.EnvironmentName)
+	case zoneManifest.EnvironmentDomain != params.EnvironmentDomain:
+		return nil, mismatch("environment domain", zoneManifest.EnvironmentDomain, params.EnvironmentDomain)
+	case zoneManifest.EnvironmentIndex != params.EnvironmentIndex:
+		return nil, mismatch("environment index", zoneManifest.EnvironmentIndex, params.EnvironmentIndex)
+	case zoneManifest.ZoneIndex != params.ZoneIndex:
+		return nil, mismatch("zone index", zoneManifest.ZoneIndex, params.ZoneIndex)
+	case zoneManifest.AWSAvailabilityZone != params.AWSAvailabilityZone:
+		return nil, mismatch("availability zone", zoneManifest.AWSAvailabilityZone, params.AWSAvailabilityZone)
+	case zoneManifest.AWSAccountID != params.AWSAccountID:
+		return nil, mismatch("AWS account ID", zoneManifest.AWSAccountID, params.AWSAccountID)
+	}
+
+	// we might be picking up after a create run by an older release
+	if zoneManifest.Version != params.Version {
+		upgrade, err := planUpgrade(zoneManifest.Version, params.Version)
+		if err != nil {
+			return nil, err
+		}
+		if len(upgrade.Steps) > 0 {
+			return nil, fmt.Errorf(
+				"the create was started by Substrate %s and finishing it with this version would need upgrade steps, finish it with Substrate %s instead (or destroy the zone and start again)",
+				zoneManifest.Version,
+				zoneManifest.Version)
+		}
+		zoneManifest.Version = params.Version
+	}
+	zoneManifest.ManifestVersion = CurrentManifestVersion
+
+	return zoneManifest, nil
+}
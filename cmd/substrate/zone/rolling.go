@@ -0,0 +1,313 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/util"
+)
+
+// rollingPollInterval is how often to check whether a replacement worker has
+// become a Ready node
+var rollingPollInterval = 10 * time.Second
+
+// workerInstanceAddress matches the Terraform address of a worker instance
+// (in any pool), with its count index if the pool has more than one
+var workerInstanceAddress = regexp.MustCompile(`^module\.(workers(?:_\w+)?)\.aws_instance\.workers(?:\.(\d+))?$`)
+
+// rollingUpdate replaces the workers an update would replace a batch at a
+// time, draining each one through the Kubernetes API first and waiting for its
+// replacement to become Ready before moving on
+type rollingUpdate struct {
+	// BatchSize is how many workers to replace at once
+	BatchSize int
+
+	// Timeout is how long to wait for a worker to drain, and for its
+	// replacement to join the cluster and become Ready
+	Timeout time.Duration
+
+	// Prompt shows each batch's plan and asks before applying it
+	Prompt bool
+
+	kubernetes   *kubernetesClient
+	replacements []workerReplacement
+}
+
+// workerReplacement is a worker instance an update is going to replace
+type workerReplacement struct {
+	Address string
+	Module  string
+	Index   int
+
+	// PrivateIP is the address of the instance being replaced
+	PrivateIP string
+}
+
+// Target is the replacement's address as a Terraform -target
+func (r workerReplacement) Target() string {
+	match := workerInstanceAddress.FindStringSubmatch(r.Address)
+	if match[2] == "" {
+		return r.Address
+	}
+	return fmt.Sprintf("module.%s.aws_instance.workers[%s]", match[1], match[2])
+}
+
+// findWorkerReplacements lists the workers being replaced in a plan, in order
+func findWorkerReplacements(summary *PlanSummary, zoneManifest *SubstrateZoneManifest) ([]workerReplacement, error) {
+	resources, err := terraformStateResources(zoneManifest.TerraformState)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []workerReplacement{}
+	for _, change := range summary.Resources {
+		match := workerInstanceAddress.FindStringSubmatch(change.Address)
+		if match == nil || change.Action != "replace" {
+			continue
+		}
+		replacement := workerReplacement{Address: change.Address, Module: match[1]}
+		if match[2] != "" {
+			replacement.Index, _ = strconv.Atoi(match[2])
+		}
+		if resource, ok := resources[change.Address]; ok {
+			replacement.PrivateIP = resource.Attributes["private_ip"]
+		}
+		result = append(result, replacement)
+	}
+	sort.Sort(byPoolAndIndex(result))
+	return result, nil
+}
+
+type byPoolAndIndex []workerReplacement
+
+func (s byPoolAndIndex) Len() int      { return len(s) }
+func (s byPoolAndIndex) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPoolAndIndex) Less(i, j int) bool {
+	if s[i].Module != s[j].Module {
+		return s[i].Module < s[j].Module
+	}
+	return s[i].Index < s[j].Index
+}
+
+// plan works out which workers the update in the workspace plan replaces,
+// and makes sure we can reach the Kubernetes API to drain them
+func (r *rollingUpdate) plan(workspace *terraformWorkspace, zoneManifest *SubstrateZoneManifest, store ManifestStore) error {
+	show, err := workspace.Runner.Show(workspace.TerraformPaths)
+	if err != nil {
+		return err
+	}
+	summary, err := parsePlanSummary(show.Stdout)
+	if err != nil {
+		return err
+	}
+	r.replacements, err = findWorkerReplacements(summary, zoneManifest)
+	if err != nil {
+		return err
+	}
+	if len(r.replacements) == 0 {
+		fmt.Printf("no workers are being replaced, so there's nothing to roll\n")
+		return nil
+	}
+
+	borderEIP, err := healthyBorderEIP(zoneManifest)
+	if err != nil {
+		return err
+	}
+	signer, err := zoneSSHSigner(store, zoneManifest)
+	if err != nil {
+		return err
+	}
+	r.kubernetes, err = newKubernetesClient(zoneManifest, sshAuthMethods(signer), borderEIP)
+	if err != nil {
+		return err
+	}
+	_, err = r.kubernetes.Nodes()
+	if err != nil {
+		return fmt.Errorf("can't reach the Kubernetes API to drain workers: %v", err)
+	}
+
+	fmt.Printf("replacing %d workers, %d at a time, draining each one first:\n", len(r.replacements), r.BatchSize)
+	for _, replacement := range r.replacements {
+		fmt.Printf("  %s (%s)\n", replacement.Address, replacement.PrivateIP)
+	}
+	fmt.Printf("the rest of the changes are applied once they're done\n")
+	return nil
+}
+
+// replaceWorkers replaces the planned workers a batch at a time with targeted
+// applies (which also apply anything the workers depend on, like a new AMI),
+// then plans the rest of the update into the workspace plan. Each batch's plan
+// is summarized (and confirmed, if prompting) before its workers are drained.
+// It stops at the first worker that fails to drain or whose replacement
+// doesn't become Ready within the timeout.
+func (r *rollingUpdate) replaceWorkers(workspace *terraformWorkspace) error {
+	if len(r.replacements) == 0 {
+		return nil
+	}
+
+	for start := 0; start < len(r.replacements); start += r.BatchSize {
+		end := start + r.BatchSize
+		if end > len(r.replacements) {
+			end = len(r.replacements)
+		}
+		batch := r.replacements[start:end]
+		fmt.Printf("replacing workers %d-%d of %d\n", start+1, end, len(r.replacements))
+
+		oldNodes, err := r.checkHealthy(batch)
+		if err != nil {
+			return err
+		}
+
+		err = r.planBatch(workspace, batch)
+		if err != nil {
+			return err
+		}
+
+		for _, replacement := range batch {
+			node, ok := oldNodes[replacement.PrivateIP]
+			if !ok {
+				fmt.Printf("Warning: %s (%s) isn't a Kubernetes node, replacing it without draining\n", replacement.Address, replacement.PrivateIP)
+				continue
+			}
+			fmt.Printf("draining node %s (%s)...\n", node.Metadata.Name, replacement.Address)
+			err = r.kubernetes.Drain(node.Metadata.Name, r.Timeout)
+			if err != nil {
+				return fmt.Errorf("error draining node %s, stopping the rolling update: %v", node.Metadata.Name, err)
+			}
+		}
+
+		_, err = workspace.Runner.Apply(workspace.TerraformPaths, 0)
+		if err != nil {
+			return err
+		}
+
+		newIPs, err := workerPrivateIPs(workspace, batch)
+		if err != nil {
+			return err
+		}
+		for i, replacement := range batch {
+			fmt.Printf("waiting for %s (%s) to become Ready...\n", replacement.Address, newIPs[i])
+			err = r.waitForNode(newIPs[i])
+			if err != nil {
+				return fmt.Errorf("%v, stopping the rolling update", err)
+			}
+			if node, ok := oldNodes[replacement.PrivateIP]; ok {
+				err = r.kubernetes.DeleteNode(node.Metadata.Name)
+				if err != nil {
+					return fmt.Errorf("error removing the old node %s: %v", node.Metadata.Name, err)
+				}
+			}
+		}
+	}
+
+	// plan everything else now the workers are done
+	_, err := workspace.Runner.Plan(workspace.TerraformPaths)
+	return err
+}
+
+// planBatch plans the replacement of a batch of workers into the workspace
+// plan, printing a summary of it and asking before going on if prompting
+func (r *rollingUpdate) planBatch(workspace *terraformWorkspace, batch []workerReplacement) error {
+	targets := []string{}
+	for _, replacement := range batch {
+		targets = append(targets, replacement.Target())
+	}
+	_, err := workspace.Runner.Plan(workspace.TerraformPaths, targets...)
+	if err != nil {
+		return err
+	}
+	show, err := workspace.Runner.Show(workspace.TerraformPaths)
+	if err != nil {
+		return err
+	}
+	summary, err := parsePlanSummary(show.Stdout)
+	if err != nil {
+		return err
+	}
+	err = summary.Print(os.Stdout)
+	if err != nil {
+		return err
+	}
+	if r.Prompt {
+		return util.Confirm("do you want to continue and drain and replace these workers?")
+	}
+	return nil
+}
+
+// checkHealthy makes sure every node outside the batch is Ready before we
+// take any more workers away, returning the batch's nodes by IP
+func (r *rollingUpdate) checkHealthy(batch []workerReplacement) (map[string]kubernetesNode, error) {
+	nodes, err := r.kubernetes.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	batchIPs := map[string]bool{}
+	for _, replacement := range batch {
+		batchIPs[replacement.PrivateIP] = true
+	}
+
+	result := map[string]kubernetesNode{}
+	for _, node := range nodes {
+		if batchIPs[node.InternalIP()] {
+			result[node.InternalIP()] = node
+			continue
+		}
+		if !node.Ready() {
+			return nil, fmt.Errorf("node %s (%s) is not Ready, stopping the rolling update", node.Metadata.Name, node.InternalIP())
+		}
+	}
+	return result, nil
+}
+
+// waitForNode waits for the node with an internal IP to join the cluster and become Ready
+func (r *rollingUpdate) waitForNode(ip string) error {
+	deadline := time.Now().Add(r.Timeout)
+	for {
+		nodes, err := r.kubernetes.Nodes()
+		if err != nil {
+			fmt.Printf("error listing Kubernetes nodes (will retry): %v\n", err)
+		}
+		for _, node := range nodes {
+			if node.InternalIP() == ip && node.Ready() {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for the worker at %s to become a Ready node", r.Timeout, ip)
+		}
+		time.Sleep(rollingPollInterval)
+	}
+}
+
+// workerPrivateIPs reads the private IPs of the replacement workers from the workspace state
+func workerPrivateIPs(workspace *terraformWorkspace, batch []workerReplacement) ([]string, error) {
+	stateJSON, err := ioutil.ReadFile(workspace.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	var tfState interface{}
+	err = json.Unmarshal(stateJSON, &tfState)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := terraformStateResources(tfState)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, replacement := range batch {
+		resource, ok := resources[replacement.Address]
+		if !ok || resource.Attributes["private_ip"] == "" {
+			return nil, fmt.Errorf("can't find the replacement for %s in the Terraform state", replacement.Address)
+		}
+		result = append(result, resource.Attributes["private_ip"])
+	}
+	return result, nil
+}
@@ -0,0 +1,177 @@
+package zone
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKubernetes serves just enough of the Kubernetes API for a rolling
+// update, with a Ready node for each of ReadyIPs and no pods to evict
+type fakeKubernetes struct {
+	ReadyIPs []string
+
+	// Cordoned and Deleted record the nodes drained and removed, in order
+	Cordoned []string
+	Deleted  []string
+
+	lock sync.Mutex
+}
+
+func (k *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api/v1/nodes":
+		nodes := []map[string]interface{}{}
+		for _, ip := range k.ReadyIPs {
+			nodes = append(nodes, map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "node-" + ip},
+				"status": map[string]interface{}{
+					"addresses":  []map[string]string{{"type": "InternalIP", "address": ip}},
+					"conditions": []map[string]string{{"type": "Ready", "status": "True"}},
+				},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": nodes})
+	case r.Method == "GET" && r.URL.Path == "/api/v1/pods":
+		w.Write([]byte(`{"items": []}`))
+	case r.Method == "PATCH" && strings.HasPrefix(r.URL.Path, "/api/v1/nodes/"):
+		k.Cordoned = append(k.Cordoned, strings.TrimPrefix(r.URL.Path, "/api/v1/nodes/"))
+		w.Write([]byte(`{}`))
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/api/v1/nodes/"):
+		k.Deleted = append(k.Deleted, strings.TrimPrefix(r.URL.Path, "/api/v1/nodes/"))
+		w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// client returns a kubernetesClient that talks to the fake instead of
+// tunnelling to a director
+func (k *fakeKubernetes) client(server *httptest.Server) *kubernetesClient {
+	dial := func(network, addr string) (net.Conn, error) {
+		return net.Dial("tcp", server.Listener.Addr().String())
+	}
+	return &kubernetesClient{http: &http.Client{Transport: &http.Transport{Dial: dial}}}
+}
+
+func TestRollingUpdateReplaceWorkers(t *testing.T) {
+	previousInterval := rollingPollInterval
+	rollingPollInterval = time.Millisecond
+	defer func() { rollingPollInterval = previousInterval }()
+
+	showOutput, err := ioutil.ReadFile(filepath.Join("testdata", "plan-show.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the workers are replaced by the ones in expected.tfstate (172.17.1.10 and .11)
+	replacements := []workerReplacement{
+		{Address: "module.workers.aws_instance.workers.0", Module: "workers", Index: 0, PrivateIP: "172.17.1.100"},
+		{Address: "module.workers.aws_instance.workers.1", Module: "workers", Index: 1, PrivateIP: "172.17.1.101"},
+	}
+	worker0 := "module.workers.aws_instance.workers[0]"
+	worker1 := "module.workers.aws_instance.workers[1]"
+
+	tests := []struct {
+		name      string
+		batchSize int
+		readyIPs  []string
+
+		wantErr         string
+		wantCalls       []string
+		wantPlanTargets [][]string
+		wantDeleted     []string
+	}{
+		{
+			// each batch is planned on its own, and the rest of the update once they're done
+			name:            "one at a time",
+			batchSize:       1,
+			readyIPs:        []string{"172.17.1.100", "172.17.1.101", "172.17.1.10", "172.17.1.11"},
+			wantCalls:       []string{"plan", "show", "apply", "plan", "show", "apply", "plan"},
+			wantPlanTargets: [][]string{{worker0}, {worker1}, {}},
+			wantDeleted:     []string{"node-172.17.1.100", "node-172.17.1.101"},
+		},
+		{
+			name:            "one batch",
+			batchSize:       2,
+			readyIPs:        []string{"172.17.1.100", "172.17.1.101", "172.17.1.10", "172.17.1.11"},
+			wantCalls:       []string{"plan", "show", "apply", "plan"},
+			wantPlanTargets: [][]string{{worker0, worker1}, {}},
+			wantDeleted:     []string{"node-172.17.1.100", "node-172.17.1.101"},
+		},
+		{
+			// the second replacement never joins the cluster, so the rest of the update isn't planned
+			name:            "replacement never becomes Ready",
+			batchSize:       1,
+			readyIPs:        []string{"172.17.1.100", "172.17.1.101", "172.17.1.10"},
+			wantErr:         "timed out after 20ms waiting for the worker at 172.17.1.11 to become a Ready node",
+			wantCalls:       []string{"plan", "show", "apply", "plan", "show", "apply"},
+			wantPlanTargets: [][]string{{worker0}, {worker1}},
+			wantDeleted:     []string{"node-172.17.1.100"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "substrate-rolling")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			kubernetes := &fakeKubernetes{ReadyIPs: test.readyIPs}
+			server := httptest.NewServer(kubernetes)
+			defer server.Close()
+
+			runner := &FakeTerraformRunner{
+				State:      readTestState(t, "expected.tfstate"),
+				ShowOutput: string(showOutput),
+			}
+			workspace := &terraformWorkspace{
+				TerraformPaths: TerraformPaths{
+					StatePath: filepath.Join(dir, "terraform.tfstate"),
+					PlanPath:  filepath.Join(dir, "terraform.tfplan"),
+				},
+				Runner: runner,
+			}
+			rolling := &rollingUpdate{
+				BatchSize:    test.batchSize,
+				Timeout:      20 * time.Millisecond,
+				kubernetes:   kubernetes.client(server),
+				replacements: replacements,
+			}
+
+			err = rolling.replaceWorkers(workspace)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("expected an error containing %q, got %v", test.wantErr, err)
+			}
+			if !reflect.DeepEqual(runner.Calls, test.wantCalls) {
+				t.Errorf("expected Terraform calls %v, got %v", test.wantCalls, runner.Calls)
+			}
+			if !reflect.DeepEqual(runner.PlanTargets, test.wantPlanTargets) {
+				t.Errorf("expected plans targeting %v, got %v", test.wantPlanTargets, runner.PlanTargets)
+			}
+			wantCordoned := []string{"node-172.17.1.100", "node-172.17.1.101"}
+			if !reflect.DeepEqual(kubernetes.Cordoned, wantCordoned) {
+				t.Errorf("expected nodes %v to be drained, got %v", wantCordoned, kubernetes.Cordoned)
+			}
+			if !reflect.DeepEqual(kubernetes.Deleted, test.wantDeleted) {
+				t.Errorf("expected nodes %v to be removed, got %v", test.wantDeleted, kubernetes.Deleted)
+			}
+		})
+	}
+}
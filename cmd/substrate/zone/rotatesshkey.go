@@ -0,0 +1,339 @@
+package zone
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/util"
+	tunnel "github.com/SimpleFinance/substrate/cmd/substrate/zone/borderjump/tunnel"
+)
+
+// RotateSSHKeyInput contains the input parameters for rotating a zone's admin SSH key
+type RotateSSHKeyInput struct {
+	Version      string
+	Prompt       bool
+	ManifestPath string
+
+	// SSHPublicKey is an existing SSH public key file to rotate to, instead
+	// of generating a new key pair (optional)
+	SSHPublicKey string
+
+	// SSHKeyAgent loads a generated key pair into ssh-agent instead of
+	// saving the private key alongside the manifest
+	SSHKeyAgent bool
+}
+
+// zoneInstance is a running EC2 instance in a zone
+type zoneInstance struct {
+	Name      string
+	ID        string
+	PrivateIP string
+	PublicIP  string
+}
+
+// RotateSSHKey replaces a zone's admin SSH key: the new key is added to every
+// running instance (logging in with the old one), saved with the manifest and
+// pushed to the EC2 key pair with Terraform, and then the old key is removed
+// from the instances (logging in with the new one)
+func RotateSSHKey(params *RotateSSHKeyInput) (err error) {
+	store, err := OpenManifestStore(params.ManifestPath)
+	if err != nil {
+		return err
+	}
+
+	// make sure nobody else is modifying the zone at the same time
+	err = store.Lock()
+	if err != nil {
+		return err
+	}
+	defer store.Unlock()
+
+	zoneManifest, err := ReadManifestFrom(store)
+	if err != nil {
+		return err
+	}
+
+	// pick up any state saved by a previous run that got interrupted
+	err = recoverManifestCheckpoint(store, zoneManifest, params.Version)
+	if err != nil {
+		return err
+	}
+
+	// the key pair is updated by applying this version's Terraform config
+	err = checkNoUpgradeSteps(zoneManifest, params.Version, "rotate-ssh-key")
+	if err != nil {
+		return err
+	}
+
+	borderEIP, err := healthyBorderEIP(zoneManifest)
+	if err != nil {
+		return err
+	}
+
+	// log in with the current key, whether it's kept with the manifest or in ssh-agent
+	oldKey := currentZoneSSHKey(zoneManifest)
+	oldSigner, err := zoneSSHSigner(store, zoneManifest)
+	if err != nil {
+		return err
+	}
+	var oldPrivateKey []byte
+	if zoneManifest.SSHKey != nil && zoneManifest.SSHKey.Storage == sshKeyStorageManifest {
+		oldPrivateKey, err = store.Read(sshKeySuffix)
+		if err != nil {
+			return err
+		}
+	}
+
+	newKey, newPrivateKeyPEM, err := newZoneSSHKey(zoneManifest, params.SSHPublicKey, params.SSHKeyAgent)
+	if err != nil {
+		return err
+	}
+	if oldKey != nil && oldKey.Fingerprint == newKey.Fingerprint {
+		return fmt.Errorf("the zone is already using SSH key %s", newKey.Fingerprint)
+	}
+	var newSigner ssh.Signer
+	if newPrivateKeyPEM != nil {
+		newSigner, err = ssh.ParsePrivateKey(newPrivateKeyPEM)
+		if err != nil {
+			return err
+		}
+	}
+
+	sess := session.New(&aws.Config{Region: aws.String(zoneManifest.AWSRegion())})
+	instances, err := findZoneInstances(ec2.New(sess), zoneManifest)
+	if err != nil {
+		return err
+	}
+
+	describe := func(k *ZoneSSHKey) string {
+		if k == nil {
+			return "an unknown key"
+		}
+		return fmt.Sprintf("%s (private key kept in %s)", k.Fingerprint, k.Storage)
+	}
+	fmt.Printf("rotating the SSH key for zone %s\n", zoneManifest.ZoneName())
+	fmt.Printf("  from: %s\n", describe(oldKey))
+	fmt.Printf("    to: %s\n", describe(newKey))
+	fmt.Printf("on %d running instances:\n", len(instances))
+	for _, instance := range instances {
+		fmt.Printf("  %s (%s, %s)\n", instance.Name, instance.ID, instance.PrivateIP)
+	}
+	if params.Prompt {
+		err = util.Confirm("do you want to continue?")
+		if err != nil {
+			return err
+		}
+	}
+
+	// authorize the new key everywhere before we let go of the old one
+	fmt.Printf("adding the new key to the zone's instances...\n")
+	err = runOnZoneInstances(sshAuthMethods(oldSigner), borderEIP, instances, addAuthorizedKeyCommand(newKey))
+	if err != nil {
+		return fmt.Errorf("error adding the new SSH key (nothing else has been changed): %v", err)
+	}
+
+	// keep the old private key around until it's been removed from the
+	// instances, then save the new one along with the manifest that uses it
+	if oldPrivateKey != nil {
+		err = store.Write(sshKeyBackupSuffix, oldPrivateKey)
+		if err != nil {
+			return err
+		}
+	}
+	zoneManifest.SSHKey = newKey
+	zoneManifest.SSHPublicKey = ""
+	if newPrivateKeyPEM != nil {
+		err = saveZoneSSHKey(store, zoneManifest, newPrivateKeyPEM)
+	} else {
+		err = store.Delete(sshKeySuffix)
+	}
+	if err != nil {
+		return err
+	}
+	err = WriteManifestTo(store, zoneManifest)
+	if err != nil {
+		return err
+	}
+
+	// replace `aws_key_pair.admin`, so new instances get the new key
+	err = applyZoneChanges(store, zoneManifest, params.ManifestPath, params.Version, params.Prompt, "rotate-ssh-key", nil, nil)
+	if err != nil {
+		return fmt.Errorf(
+			"error updating the zone's EC2 key pair (the new key is already on the instances and saved with the manifest, run `substrate zone update` to finish): %v",
+			err)
+	}
+
+	if oldKey == nil {
+		fmt.Printf("Warning: don't know what the old SSH key was, so it hasn't been removed from the zone's instances\n")
+		return nil
+	}
+	fmt.Printf("removing the old key from the zone's instances...\n")
+	err = runOnZoneInstances(sshAuthMethods(newSigner), borderEIP, instances, removeAuthorizedKeyCommand(oldKey))
+	if err != nil {
+		fmt.Printf("Warning: the old SSH key %s may still be authorized on some instances: %v\n", oldKey.Fingerprint, err)
+		return nil
+	}
+	if oldPrivateKey != nil {
+		err = store.Delete(sshKeyBackupSuffix)
+		if err != nil {
+			fmt.Printf("Warning: error removing the old SSH private key %s%s: %v\n", store, sshKeyBackupSuffix, err)
+		}
+	}
+	return nil
+}
+
+// currentZoneSSHKey describes the zone's admin SSH key, reading the public key
+// file of zones that don't have a key of their own yet (nil if it's unreadable)
+func currentZoneSSHKey(zoneManifest *SubstrateZoneManifest) *ZoneSSHKey {
+	if zoneManifest.SSHKey != nil {
+		return zoneManifest.SSHKey
+	}
+	keyData, err := ioutil.ReadFile(zoneManifest.SSHPublicKey)
+	if err != nil {
+		return nil
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(keyData)
+	if err != nil {
+		return nil
+	}
+	return newZoneSSHKeyFrom(publicKey, sshKeyStorageFile)
+}
+
+// findZoneInstances lists the running instances tagged as part of the zone
+func findZoneInstances(svc ec2iface.EC2API, zoneManifest *SubstrateZoneManifest) ([]zoneInstance, error) {
+	result := []zoneInstance{}
+	err := svc.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:substrate:environment"), Values: []*string{aws.String(zoneManifest.EnvironmentName)}},
+			{Name: aws.String("tag:substrate:zone"), Values: []*string{aws.String(zoneManifest.ZoneName())}},
+			{Name: aws.String("instance-state-name"), Values: []*string{aws.String(ec2.InstanceStateNameRunning)}},
+		},
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				result = append(result, zoneInstance{
+					Name:      ec2TagValue(instance.Tags, "Name"),
+					ID:        aws.StringValue(instance.InstanceId),
+					PrivateIP: aws.StringValue(instance.PrivateIpAddress),
+					PublicIP:  aws.StringValue(instance.PublicIpAddress),
+				})
+			}
+		}
+		return true
+	})
+	return result, err
+}
+
+// sshAuthMethods logs in with the given key (if any), falling back to ssh-agent
+func sshAuthMethods(signer ssh.Signer) []ssh.AuthMethod {
+	result := []ssh.AuthMethod{}
+	if signer != nil {
+		result = append(result, ssh.PublicKeys(signer))
+	}
+	if sshAgent := tunnel.SSHAgent(); sshAgent != nil {
+		result = append(result, sshAgent)
+	}
+	return result
+}
+
+// addAuthorizedKeyCommand adds a key to ~/.ssh/authorized_keys, unless it's already there
+func addAuthorizedKeyCommand(k *ZoneSSHKey) string {
+	return fmt.Sprintf(
+		"grep -qF %s ~/.ssh/authorized_keys || echo %s >> ~/.ssh/authorized_keys",
+		shellQuote(k.authorizedKeysMatch()),
+		shellQuote(k.PublicKey))
+}
+
+// removeAuthorizedKeyCommand removes every line with the key from ~/.ssh/authorized_keys
+func removeAuthorizedKeyCommand(k *ZoneSSHKey) string {
+	return fmt.Sprintf(
+		"grep -vF %s ~/.ssh/authorized_keys > ~/.ssh/authorized_keys.new; chmod 600 ~/.ssh/authorized_keys.new && mv ~/.ssh/authorized_keys.new ~/.ssh/authorized_keys",
+		shellQuote(k.authorizedKeysMatch()))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "'\\''", -1) + "'"
+}
+
+// runOnZoneInstances runs a shell command on each instance as the admin user,
+// connecting to the border directly and to everything else through it
+func runOnZoneInstances(auth []ssh.AuthMethod, borderEIP string, instances []zoneInstance, command string) error {
+	config := zoneSSHConfig(auth)
+	border, err := ssh.Dial("tcp", net.JoinHostPort(borderEIP, "22"), config)
+	if err != nil {
+		return fmt.Errorf("error connecting to the border at %s: %v", borderEIP, err)
+	}
+	defer border.Close()
+
+	failures := 0
+	for _, instance := range instances {
+		err := runOnZoneInstance(border, config, borderEIP, instance, command)
+		if err != nil {
+			fmt.Printf("  %s (%s): FAILED: %v\n", instance.Name, instance.PrivateIP, err)
+			failures++
+		} else {
+			fmt.Printf("  %s (%s): OK\n", instance.Name, instance.PrivateIP)
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("failed on %d of %d instances", failures, len(instances))
+	}
+	return nil
+}
+
+// zoneSSHConfig is the SSH client config for logging in to the zone's instances
+func zoneSSHConfig(auth []ssh.AuthMethod) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User: "ubuntu",
+		Auth: auth,
+
+		// we don't know the instances' host keys (same as `substrate zone ssh`)
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error { return nil },
+	}
+}
+
+// dialThroughBorder logs in to an instance's private IP by way of the border
+func dialThroughBorder(border *ssh.Client, config *ssh.ClientConfig, privateIP string) (*ssh.Client, error) {
+	addr := net.JoinHostPort(privateIP, "22")
+	conn, err := border.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
+
+func runOnZoneInstance(border *ssh.Client, config *ssh.ClientConfig, borderEIP string, instance zoneInstance, command string) error {
+	client := border
+	if instance.PublicIP != borderEIP {
+		var err error
+		client, err = dialThroughBorder(border, config, instance.PrivateIP)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	output, err := session.CombinedOutput(command)
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package zone
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// maxWorkerCount is a sanity limit on the number of worker instances in a zone
+const maxWorkerCount = 100
+
+// defaultWorkerPoolName is the name of the worker pool zones had before they
+// could have more than one
+const defaultWorkerPoolName = "worker"
+
+// defaultInstanceType is the EC2 instance type used when a spec doesn't pick one
+const defaultInstanceType = "t2.medium"
+
+// instanceTypePattern matches EC2 instance type names (e.g., "r4.2xlarge")
+var instanceTypePattern = regexp.MustCompile(`^[a-z][a-z0-9-]*\.[a-z0-9]+$`)
+
+// workerPoolNamePattern matches worker pool names, which end up in DNS names,
+// Terraform resource names and hostnames
+var workerPoolNamePattern = regexp.MustCompile(`^[a-z][a-z0-9]*(-[a-z0-9]+)*$`)
+
+// availabilityZonePattern matches AWS availability zone names (e.g., "us-west-2a")
+var availabilityZonePattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+[a-z]$`)
+
+// reservedWorkerPoolNames can't be used for worker pools, since the border
+// DNS already uses them for the zone's other instances
+var reservedWorkerPoolNames = []string{"border", "director", "base-ami", "ami-builder"}
+
+// nodeLabelKeyPattern and nodeLabelValuePattern match Kubernetes label keys
+// (with an optional DNS prefix) and values
+var (
+	nodeLabelKeyPattern   = regexp.MustCompile(`^([a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*/)?[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$`)
+	nodeLabelValuePattern = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?)?$`)
+)
+
+// nodeTaintEffects are the Kubernetes taint effects
+var nodeTaintEffects = []string{"NoSchedule", "PreferNoSchedule", "NoExecute"}
+
+// reservedNodeLabelPrefix is used for the labels Substrate sets on every node
+const reservedNodeLabelPrefix = "substrate.zone/"
+
+// ZoneSpec is the declarative description of a zone's instances and network
+// access, read from a YAML file passed to `substrate zone create --spec`.
+// Anything left out of the file gets the defaults from DefaultZoneSpec.
+type ZoneSpec struct {
+	// Workers is shorthand for a single public worker pool named "worker"
+	// (it's turned into WorkerPools when the spec is read)
+	Workers *ZoneSpecInstances `json:"workers,omitempty" yaml:"workers"`
+
+	WorkerPools []ZoneSpecWorkerPool `json:"worker_pools" yaml:"worker_pools"`
+
+	// Directors can only have a count of 1: the director runs the Kubernetes
+	// API and calico's etcd, and neither can be clustered yet (kubeadm can't
+	// run more than one master), so extra directors wouldn't keep them up
+	Directors ZoneSpecInstances `json:"directors" yaml:"directors"`
+
+	Borders ZoneSpecInstances `json:"borders" yaml:"borders"`
+	Ingress ZoneSpecIngress   `json:"ingress" yaml:"ingress"`
+
+	// AvailabilityZones are the AZs the borders are spread across
+	// (round-robin, starting with the zone's own AZ, which must be one of
+	// them). The director and workers all stay in the zone's own AZ. Leave it
+	// out to keep everything in the zone's own AZ.
+	AvailabilityZones []string `json:"availability_zones,omitempty" yaml:"availability_zones"`
+}
+
+// ZoneSpecInstances describes one kind of instance in the zone
+type ZoneSpecInstances struct {
+	// InstanceType is the EC2 instance type (e.g., "r4.2xlarge")
+	InstanceType string `json:"instance_type" yaml:"instance_type"`
+
+	// Count is how many instances to run
+	Count int `json:"count" yaml:"count"`
+}
+
+// ZoneSpecWorkerPool describes a group of identical worker instances
+type ZoneSpecWorkerPool struct {
+	// Name of the pool, used in its DNS record (<name>.zoneXX.<domain>),
+	// Terraform outputs and hostnames
+	Name string `json:"name" yaml:"name"`
+
+	InstanceType string `json:"instance_type" yaml:"instance_type"`
+	Count        int    `json:"count" yaml:"count"`
+
+	// Public pools get public IPs and accept HTTP(S) from `ingress.http`,
+	// private ones can only be reached from inside the environment
+	Public bool `json:"public" yaml:"public"`
+
+	// Labels and Taints are registered on the pool's Kubernetes nodes
+	// (taints are written like "dedicated=batch:NoSchedule")
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels"`
+	Taints []string          `json:"taints,omitempty" yaml:"taints"`
+}
+
+// ZoneSpecIngress lists the CIDR blocks allowed to reach the zone from outside
+type ZoneSpecIngress struct {
+	// SSH is who can SSH to the border
+	SSH []string `json:"ssh" yaml:"ssh"`
+
+	// HTTP is who can reach the workers on ports 80 and 443
+	HTTP []string `json:"http" yaml:"http"`
+}
+
+// DefaultZoneSpec is the spec of a zone created without --spec (matching what
+// the zone configuration hardcoded before there were specs)
+func DefaultZoneSpec() *ZoneSpec {
+	return &ZoneSpec{
+		WorkerPools: []ZoneSpecWorkerPool{
+			{Name: defaultWorkerPoolName, InstanceType: defaultInstanceType, Count: 4, Public: true},
+		},
+		Directors: ZoneSpecInstances{InstanceType: defaultInstanceType, Count: 1},
+		Borders:   ZoneSpecInstances{InstanceType: defaultInstanceType, Count: 1},
+		Ingress: ZoneSpecIngress{
+			SSH:  []string{"0.0.0.0/0"},
+			HTTP: []string{"0.0.0.0/0"},
+		},
+	}
+}
+
+// ReadZoneSpec reads a zone spec from a YAML file, filling in defaults for
+// anything it leaves out, and validates it
+func ReadZoneSpec(path string) (*ZoneSpec, error) {
+	specYAML, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading zone spec: %v", err)
+	}
+
+	// start from the defaults, so the file only needs what it wants to change
+	spec := DefaultZoneSpec()
+	spec.WorkerPools = nil
+	err = yaml.UnmarshalStrict(specYAML, spec)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing zone spec %s: %v", path, err)
+	}
+	spec.normalize()
+
+	err = spec.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid zone spec %s: %v", path, err)
+	}
+	return spec, nil
+}
+
+// normalize turns the `workers` shorthand into a worker pool, and fills in
+// the default worker pool and instance types if they're left out
+func (s *ZoneSpec) normalize() {
+	if s.Workers != nil && s.WorkerPools == nil {
+		pool := DefaultZoneSpec().WorkerPools[0]
+		if s.Workers.InstanceType != "" {
+			pool.InstanceType = s.Workers.InstanceType
+		}
+		pool.Count = s.Workers.Count
+		s.WorkerPools = []ZoneSpecWorkerPool{pool}
+		s.Workers = nil
+	}
+	if s.Workers == nil && s.WorkerPools == nil {
+		s.WorkerPools = DefaultZoneSpec().WorkerPools
+	}
+	for i := range s.WorkerPools {
+		if s.WorkerPools[i].InstanceType == "" {
+			s.WorkerPools[i].InstanceType = defaultInstanceType
+		}
+	}
+}
+
+// Validate checks that the spec describes a zone we can build, returning an
+// error listing everything wrong with it
+func (s *ZoneSpec) Validate() error {
+	problems := []string{}
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, instances := range []struct {
+		name string
+		spec ZoneSpecInstances
+	}{
+		{"directors", s.Directors},
+		{"borders", s.Borders},
+	} {
+		if !instanceTypePattern.MatchString(instances.spec.InstanceType) {
+			problem("%s.instance_type %q is not an EC2 instance type", instances.name, instances.spec.InstanceType)
+		}
+	}
+
+	if s.Workers != nil {
+		problem("use either workers or worker_pools, not both")
+	}
+	if len(s.WorkerPools) == 0 {
+		problem("worker_pools must list at least one pool")
+	}
+	workerCount := 0
+	poolNames := map[string]bool{}
+	for i, pool := range s.WorkerPools {
+		name := fmt.Sprintf("worker_pools[%d]", i)
+		switch {
+		case !workerPoolNamePattern.MatchString(pool.Name):
+			problem("%s.name %q must be lower case letters, digits and dashes", name, pool.Name)
+		case isReservedWorkerPoolName(pool.Name):
+			problem("%s.name %q is reserved", name, pool.Name)
+		case poolNames[pool.Name]:
+			problem("%s.name %q is used by more than one pool", name, pool.Name)
+		default:
+			name = fmt.Sprintf("worker pool %q", pool.Name)
+		}
+		poolNames[pool.Name] = true
+
+		if !instanceTypePattern.MatchString(pool.InstanceType) {
+			problem("%s: instance_type %q is not an EC2 instance type", name, pool.InstanceType)
+		}
+		if pool.Count < 1 {
+			problem("%s: count must be at least 1 (not %d)", name, pool.Count)
+		}
+		workerCount += pool.Count
+
+		for key, value := range pool.Labels {
+			if !nodeLabelKeyPattern.MatchString(key) || !nodeLabelValuePattern.MatchString(value) {
+				problem("%s: %q is not a valid Kubernetes label", name, key+"="+value)
+			} else if strings.HasPrefix(key, reservedNodeLabelPrefix) {
+				problem("%s: label %q uses the reserved prefix %q", name, key, reservedNodeLabelPrefix)
+			}
+		}
+		for _, taint := range pool.Taints {
+			if !isValidNodeTaint(taint) {
+				problem("%s: %q is not a valid Kubernetes taint (expected KEY[=VALUE]:EFFECT, with EFFECT one of %s)", name, taint, strings.Join(nodeTaintEffects, ", "))
+			}
+		}
+	}
+	if workerCount > maxWorkerCount {
+		problem("the worker pools have %d workers between them, the limit is %d", workerCount, maxWorkerCount)
+	}
+	// the director runs the only Kubernetes API server and etcd member
+	if s.Directors.Count != 1 {
+		problem("directors.count must be 1 (not %d)", s.Directors.Count)
+	}
+	// every border is one of the zone's DNS servers, and DHCP only hands out 4
+	if s.Borders.Count < 1 || s.Borders.Count > maxBorderCount {
+		problem("borders.count must be between 1 and %d (not %d)", maxBorderCount, s.Borders.Count)
+	}
+
+	if len(s.AvailabilityZones) > maxAvailabilityZones {
+		problem("availability_zones can list at most %d AZs (not %d)", maxAvailabilityZones, len(s.AvailabilityZones))
+	}
+	seenAZs := map[string]bool{}
+	for _, az := range s.AvailabilityZones {
+		if !availabilityZonePattern.MatchString(az) {
+			problem("availability_zones: %q is not an AWS availability zone", az)
+		} else if seenAZs[az] {
+			problem("availability_zones: %q is listed more than once", az)
+		}
+		seenAZs[az] = true
+	}
+
+	for _, ingress := range []struct {
+		name  string
+		cidrs []string
+	}{
+		{"ingress.ssh", s.Ingress.SSH},
+		{"ingress.http", s.Ingress.HTTP},
+	} {
+		if len(ingress.cidrs) == 0 {
+			problem("%s must list at least one CIDR block", ingress.name)
+		}
+		for _, cidr := range ingress.cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil || network.IP.To4() == nil {
+				problem("%s: %q is not an IPv4 CIDR block", ingress.name, cidr)
+			} else if network.String() != cidr {
+				problem("%s: %q has host bits set (did you mean %q?)", ingress.name, cidr, network.String())
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// isReservedWorkerPoolName returns whether a worker pool name would clash with
+// the names of the zone's other instances
+func isReservedWorkerPoolName(name string) bool {
+	for _, reserved := range reservedWorkerPoolNames {
+		if name == reserved || strings.HasPrefix(name, reserved+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidNodeTaint checks a taint written like "key=value:NoSchedule" (the
+// value is optional)
+func isValidNodeTaint(taint string) bool {
+	colon := strings.LastIndex(taint, ":")
+	if colon < 0 {
+		return false
+	}
+	keyValue, effect := taint[:colon], taint[colon+1:]
+	validEffect := false
+	for _, e := range nodeTaintEffects {
+		validEffect = validEffect || e == effect
+	}
+	parts := strings.SplitN(keyValue, "=", 2)
+	if len(parts) == 1 {
+		parts = append(parts, "")
+	}
+	return validEffect && nodeLabelKeyPattern.MatchString(parts[0]) && nodeLabelValuePattern.MatchString(parts[1])
+}
+
+// checkChange checks that a zone built from this spec can be updated to the new
+// one. The zone's subnets and the borders' addresses are laid out when it's
+// created, so they can't change afterwards.
+func (s *ZoneSpec) checkChange(newSpec *ZoneSpec) error {
+	problems := []string{}
+	if newSpec.Borders.Count != s.Borders.Count {
+		problems = append(problems, fmt.Sprintf("borders.count from %d to %d", s.Borders.Count, newSpec.Borders.Count))
+	}
+	if strings.Join(newSpec.AvailabilityZones, ",") != strings.Join(s.AvailabilityZones, ",") {
+		problems = append(problems, fmt.Sprintf("availability_zones from %v to %v", s.AvailabilityZones, newSpec.AvailabilityZones))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("can't change %s after the zone is created", strings.Join(problems, " or "))
+	}
+	return nil
+}
+
+// ZoneSpec returns the zone's spec (the defaults, for zones created without
+// one). Specs are normalized when they're read, so this never changes the manifest.
+func (m *SubstrateZoneManifest) ZoneSpec() *ZoneSpec {
+	if m.Spec == nil {
+		return DefaultZoneSpec()
+	}
+	return m.Spec
+}
+
+// WorkerPool finds a worker pool in the zone's spec by name
+func (m *SubstrateZoneManifest) WorkerPool(name string) (*ZoneSpecWorkerPool, bool) {
+	spec := m.ZoneSpec()
+	for i := range spec.WorkerPools {
+		if spec.WorkerPools[i].Name == name {
+			return &spec.WorkerPools[i], true
+		}
+	}
+	return nil, false
+}
+
+// addTFVars adds the Terraform variables the spec sets to the string and list variables
+// (the worker pools are rendered into their own Terraform file, see workerpools.go)
+func (s *ZoneSpec) addTFVars(vars map[string]string, listVars map[string][]string) {
+	vars["director_instance_type"] = s.Directors.InstanceType
+	vars["border_instance_type"] = s.Borders.InstanceType
+	listVars["border_ssh_ingress_cidrs"] = s.Ingress.SSH
+	listVars["worker_ingress_cidrs"] = s.Ingress.HTTP
+}
@@ -2,10 +2,22 @@ package zone
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// borderDialTimeout is how long to wait for a border to accept an SSH
+// connection before trying the next one
+const borderDialTimeout = 5 * time.Second
+
+// workerHostPattern matches a numbered instance in a worker pool (e.g., "batch-2")
+var workerHostPattern = regexp.MustCompile(`^(.+)-(\d+)$`)
+
 // SSHInput contains the input parameters for SSHing
 type SSHInput struct {
 	ManifestPath string
@@ -13,92 +25,108 @@ type SSHInput struct {
 	Args         []string
 }
 
-func getTerraformOutput(name string, tfState interface{}) (string, error) {
-	tfStateMap, ok := tfState.(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("malformed Terraform state")
+// SSH connects to a zone instance over SSH
+func SSH(params *SSHInput) error {
+	// read the manifest
+	store, err := OpenManifestStore(params.ManifestPath)
+	if err != nil {
+		return err
 	}
-
-	modules, ok := tfStateMap["modules"]
-	if !ok {
-		return "", fmt.Errorf("couldn't find \"modules\" list in Terraform state")
+	zoneManifest, err := ReadManifestFrom(store)
+	if err != nil {
+		return err
 	}
 
-	modulesList, ok := modules.([]interface{})
-	if !ok {
-		return "", fmt.Errorf("malformed modules list in Terraform state")
+	borderEIP, err := healthyBorderEIP(zoneManifest)
+	if err != nil {
+		return err
 	}
 
-	if len(modulesList) < 1 {
-		return "", fmt.Errorf("empty modules list in Terraform state")
+	host, err := resolveSSHHost(zoneManifest, params.Host)
+	if err != nil {
+		return err
 	}
 
-	rootModuleMap, ok := modulesList[0].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("malformed root module in Terraform state")
+	// use the zone's own admin key if it's kept with the manifest (otherwise
+	// it's up to ssh-agent or ~/.ssh)
+	identity, cleanup, err := writeZoneSSHIdentity(store, zoneManifest)
+	if err != nil {
+		return err
 	}
+	defer cleanup()
 
-	outputs, ok := rootModuleMap["outputs"]
-	if !ok {
-		return "", fmt.Errorf("couldn't find \"outputs\" map in root module of Terraform state")
-	}
+	args := append(
+		sshOptions(identity),
+		"-o",
+		fmt.Sprintf(
+			"ProxyCommand=ssh %s -W %%h:%%p ubuntu@%s", strings.Join(sshOptions(identity), " "), borderEIP))
+	args = append(args, fmt.Sprintf("ubuntu@%s", host))
+	args = append(args, params.Args...)
 
-	outputsMap, ok := outputs.(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("malformed \"outputs\" map in root module of Terraform state")
-	}
+	cmd := exec.Command("ssh", args...)
+	cmd.Env = os.Environ()
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
 
-	specificOutput, ok := outputsMap[name]
-	if !ok {
-		return "", fmt.Errorf("could not find output %q in root module of Terraform state", name)
+// healthyBorderEIP picks the border to jump through: the first of the zone's
+// borders (starting with border-0) that accepts a connection on the SSH port
+func healthyBorderEIP(zoneManifest *SubstrateZoneManifest) (string, error) {
+	borderEIPs, err := zoneManifest.ListOutput("border_eips")
+	if err != nil || len(borderEIPs) == 1 {
+		// there's only the one border (or the zone hasn't been updated since
+		// there could be more), so there's nothing to choose from
+		return zoneManifest.StringOutput("border_eip")
 	}
-
-	specificOutputMap, ok := specificOutput.(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("malformed specific output map in root module of Terraform state")
+	for _, borderEIP := range borderEIPs {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(borderEIP, "22"), borderDialTimeout)
+		if err == nil {
+			conn.Close()
+			return borderEIP, nil
+		}
+		fmt.Fprintf(os.Stderr, "Warning: can't reach the border at %s, trying the next one: %v\n", borderEIP, err)
 	}
+	return "", fmt.Errorf("can't reach any of the zone's borders (%s)", strings.Join(borderEIPs, ", "))
+}
 
-	result, ok := specificOutputMap["value"]
-	if !ok {
-		return "", fmt.Errorf("malformed specific output map missing \"value\" field in root module of Terraform state")
+// resolveSSHHost looks up numbered worker pool instances (like "worker-0") in
+// the zone's Terraform outputs, since the border DNS only knows them by pool
+// name. Anything else is passed through for the border DNS to resolve.
+func resolveSSHHost(zoneManifest *SubstrateZoneManifest, host string) (string, error) {
+	match := workerHostPattern.FindStringSubmatch(host)
+	if match == nil {
+		return host, nil
 	}
-
-	resultString, ok := result.(string)
+	pool, ok := zoneManifest.WorkerPool(match[1])
 	if !ok {
-		return "", fmt.Errorf("output %q in root module of Terraform state was not a string", name)
+		return host, nil
 	}
-
-	return resultString, nil
-}
-
-// SSH connects to a zone instance over SSH
-func SSH(params *SSHInput) error {
-	// read the manifest
-	zoneManifest, err := ReadManifest(params.ManifestPath)
+	index, err := strconv.Atoi(match[2])
 	if err != nil {
-		return err
+		return "", err
 	}
-
-	borderEIP, err := getTerraformOutput("border_eip", zoneManifest.TerraformState)
+	ips, err := zoneManifest.ListOutput(workerPoolOutputPrefix(pool.Name) + "_private_ips")
 	if err != nil {
-		return err
+		return "", fmt.Errorf("can't find the instances in worker pool %q (has the zone been updated since it was added?): %v", pool.Name, err)
 	}
+	if index >= len(ips) {
+		return "", fmt.Errorf("worker pool %q only has %d instances", pool.Name, len(ips))
+	}
+	return ips[index], nil
+}
 
-	args := []string{
+// sshOptions are the OpenSSH options for connecting to zone instances (whose
+// host keys we don't know), using the given private key file if it's not ""
+func sshOptions(identity string) []string {
+	options := []string{
 		"-q",
-		"-o",
-		fmt.Sprintf(
-			"ProxyCommand=ssh -q -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no -W %%h:%%p ubuntu@%s", borderEIP),
 		"-o", "UserKnownHostsFile=/dev/null",
 		"-o", "StrictHostKeyChecking=no",
-		fmt.Sprintf("ubuntu@%s", params.Host),
 	}
-	args = append(args, params.Args...)
-
-	cmd := exec.Command("ssh", args...)
-	cmd.Env = os.Environ()
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	if identity != "" {
+		options = append(options, "-i", identity, "-o", "IdentitiesOnly=yes")
+	}
+	return options
 }
@@ -0,0 +1,253 @@
+package zone
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshKeySuffix is where the private half of a zone's admin SSH
+// key is stored, alongside the manifest
+const sshKeySuffix = ".ssh-key"
+
+// sshKeyBackupSuffix keeps the previous private key while it's being rotated
+const sshKeyBackupSuffix = ".ssh-key.bak"
+
+// sshPublicKeyWorkspaceFile is the file (relative to the Terraform workspace)
+// the zone's admin SSH public key is written to for `aws_key_pair.admin`
+const sshPublicKeyWorkspaceFile = "admin_ssh_key.pub"
+
+// sshKeyBits is the size of the RSA keys we generate (RSA, since it's the
+// only key type EC2 will import)
+const sshKeyBits = 4096
+
+// where the private half of a zone's admin SSH key is kept
+const (
+	// sshKeyStorageFile is a key pair the user brought (via --ssh-public-key),
+	// so the private key is wherever they keep it (~/.ssh, ssh-agent, ...)
+	sshKeyStorageFile = "file"
+
+	// sshKeyStorageManifest is a generated key stored next to the manifest
+	// (encrypted if the manifest is)
+	sshKeyStorageManifest = "manifest"
+
+	// sshKeyStorageAgent is a generated key that was only loaded into ssh-agent
+	sshKeyStorageAgent = "agent"
+)
+
+// ZoneSSHKey describes the admin SSH key the zone's instances accept
+type ZoneSSHKey struct {
+	// PublicKey is the public key, in authorized_keys format
+	PublicKey string `json:"public_key"`
+
+	// Fingerprint is the SHA256 fingerprint of the public key (as printed by `ssh-keygen -l`)
+	Fingerprint string `json:"fingerprint"`
+
+	// Storage is where the private key is kept ("file", "manifest" or "agent")
+	Storage string `json:"storage"`
+}
+
+// newZoneSSHKey sets up a new admin SSH key for a zone: either the public key
+// read from publicKeyPath, or a newly generated key pair (in which case the
+// PEM encoded private key is returned so it can be saved with saveZoneSSHKey)
+func newZoneSSHKey(zoneManifest *SubstrateZoneManifest, publicKeyPath string, useAgent bool) (*ZoneSSHKey, []byte, error) {
+	if publicKeyPath != "" {
+		keyData, err := ioutil.ReadFile(publicKeyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading SSH public key: %v", err)
+		}
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey(keyData)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s is not an SSH public key: %v", publicKeyPath, err)
+		}
+		return newZoneSSHKeyFrom(publicKey, sshKeyStorageFile), nil, nil
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, sshKeyBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	storage := sshKeyStorageManifest
+	if useAgent {
+		storage = sshKeyStorageAgent
+	}
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+	return newZoneSSHKeyFrom(publicKey, storage), privateKeyPEM, nil
+}
+
+func newZoneSSHKeyFrom(publicKey ssh.PublicKey, storage string) *ZoneSSHKey {
+	sum := sha256.Sum256(publicKey.Marshal())
+	return &ZoneSSHKey{
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))),
+		Fingerprint: "SHA256:" + strings.TrimRight(base64.StdEncoding.EncodeToString(sum[:]), "="),
+		Storage:     storage,
+	}
+}
+
+// authorizedKeysMatch returns a pattern matching the key in an
+// authorized_keys line, whatever comment or options it was written with
+func (k *ZoneSSHKey) authorizedKeysMatch() string {
+	fields := strings.Fields(k.PublicKey)
+	if len(fields) < 2 {
+		return k.PublicKey
+	}
+	return fields[0] + " " + fields[1]
+}
+
+// saveZoneSSHKey puts a newly generated private key wherever the zone's key
+// says it's kept: in the manifest store (protected the same way as the
+// manifest, see encodeZoneSSHKey) or loaded into ssh-agent
+func saveZoneSSHKey(store ManifestStore, zoneManifest *SubstrateZoneManifest, privateKeyPEM []byte) error {
+	switch zoneManifest.SSHKey.Storage {
+	case sshKeyStorageAgent:
+		return addZoneSSHKeyToAgent(zoneManifest, privateKeyPEM)
+	case sshKeyStorageManifest:
+		keyProvider := zoneManifest.KeyProvider()
+		stored, err := encodeZoneSSHKey(privateKeyPEM, keyProvider)
+		if err != nil {
+			return err
+		}
+		err = store.Write(sshKeySuffix, stored)
+		if err != nil {
+			return fmt.Errorf("error saving the zone's SSH private key: %v", err)
+		}
+		if keyProvider == nil {
+			fmt.Printf(
+				"saved the zone's SSH private key (%s) to %s%s, unencrypted like the manifest\n",
+				zoneManifest.SSHKey.Fingerprint,
+				store,
+				sshKeySuffix)
+			return nil
+		}
+		fmt.Printf(
+			"saved the zone's SSH private key (%s) to %s%s, encrypted with %s key %s\n",
+			zoneManifest.SSHKey.Fingerprint,
+			store,
+			sshKeySuffix,
+			keyProvider.Name(),
+			keyProvider.KeyID())
+		return nil
+	}
+	return fmt.Errorf("don't know how to save an SSH private key kept in %q", zoneManifest.SSHKey.Storage)
+}
+
+// encodeZoneSSHKey returns the stored form of a private key kept with the
+// manifest: encrypted with the manifest's key, or just the PEM (which the
+// manifest store only makes readable by its owner) if the manifest isn't
+// encrypted either, since its Terraform state is just as sensitive
+func encodeZoneSSHKey(privateKeyPEM []byte, keyProvider KeyProvider) ([]byte, error) {
+	if keyProvider == nil {
+		return privateKeyPEM, nil
+	}
+	return encryptManifestJSON(privateKeyPEM, keyProvider)
+}
+
+// decodeZoneSSHKey returns the PEM encoded private key from its stored form
+// (see encodeZoneSSHKey), decrypting it if needed
+func decodeZoneSSHKey(stored []byte) ([]byte, error) {
+	if block, _ := pem.Decode(stored); block != nil {
+		return stored, nil
+	}
+	privateKeyPEM, _, err := decodeManifestJSON(stored)
+	return privateKeyPEM, err
+}
+
+// addZoneSSHKeyToAgent loads a private key into the running ssh-agent
+func addZoneSSHKeyToAgent(zoneManifest *SubstrateZoneManifest, privateKeyPEM []byte) error {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return fmt.Errorf("malformed SSH private key")
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	agentConn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		return fmt.Errorf("can't connect to ssh-agent (is $SSH_AUTH_SOCK set?): %v", err)
+	}
+	defer agentConn.Close()
+
+	err = agent.NewClient(agentConn).Add(agent.AddedKey{
+		PrivateKey: privateKey,
+		Comment:    fmt.Sprintf("substrate zone %s admin key", zoneManifest.ZoneName()),
+	})
+	if err != nil {
+		return fmt.Errorf("error adding the zone's SSH private key to ssh-agent: %v", err)
+	}
+	fmt.Printf(
+		"added the zone's SSH private key (%s) to ssh-agent, it isn't saved anywhere else so don't lose it\n",
+		zoneManifest.SSHKey.Fingerprint)
+	return nil
+}
+
+// readZoneSSHPrivateKey reads and decrypts the zone's admin SSH private key
+// from the manifest store, returning nil if the zone's key isn't kept there
+func readZoneSSHPrivateKey(store ManifestStore, zoneManifest *SubstrateZoneManifest) ([]byte, error) {
+	if zoneManifest.SSHKey == nil || zoneManifest.SSHKey.Storage != sshKeyStorageManifest {
+		return nil, nil
+	}
+	stored, err := store.Read(sshKeySuffix)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the zone's SSH private key from %s%s: %v", store, sshKeySuffix, err)
+	}
+	privateKeyPEM, err := decodeZoneSSHKey(stored)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting the zone's SSH private key: %v", err)
+	}
+	return privateKeyPEM, nil
+}
+
+// zoneSSHSigner returns a signer for the zone's admin SSH key if its private
+// half is kept with the manifest, or nil if it's up to ssh-agent
+func zoneSSHSigner(store ManifestStore, zoneManifest *SubstrateZoneManifest) (ssh.Signer, error) {
+	privateKeyPEM, err := readZoneSSHPrivateKey(store, zoneManifest)
+	if err != nil || privateKeyPEM == nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(privateKeyPEM)
+}
+
+// writeZoneSSHIdentity writes the zone's admin SSH private key (if it's kept
+// with the manifest) to a temporary file that can be passed to `ssh -i`.
+// Returns "" if there's no such key, and a function to remove the file.
+func writeZoneSSHIdentity(store ManifestStore, zoneManifest *SubstrateZoneManifest) (string, func(), error) {
+	privateKeyPEM, err := readZoneSSHPrivateKey(store, zoneManifest)
+	if err != nil || privateKeyPEM == nil {
+		return "", func() {}, err
+	}
+
+	identityFile, err := ioutil.TempFile("", "substrate-ssh-key-")
+	if err != nil {
+		return "", func() {}, err
+	}
+	cleanup := func() { os.Remove(identityFile.Name()) }
+	_, err = identityFile.Write(privateKeyPEM)
+	if closeErr := identityFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	return identityFile.Name(), cleanup, nil
+}
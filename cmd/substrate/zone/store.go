@@ -0,0 +1,148 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/util"
+)
+
+// ManifestStore is somewhere a zone manifest (and the files we keep alongside
+// it) can be persisted. Everything in a store is addressed by a suffix
+// relative to the manifest location: "" is the manifest itself, ".bak" is the
+// backup copy next to it, and so on.
+type ManifestStore interface {
+	// Read returns the data stored under the suffix. If nothing is stored
+	// there, the returned error satisfies os.IsNotExist.
+	Read(suffix string) ([]byte, error)
+
+	// Write replaces the data stored under the suffix.
+	Write(suffix string, data []byte) error
+
+	// Delete removes the data stored under the suffix (it's not an error if nothing is there).
+	Delete(suffix string) error
+
+	// List returns all the suffixes with data stored under them that start with the prefix, in sorted order.
+	List(prefix string) ([]string, error)
+
+	// Lock takes an exclusive lock on the manifest so that only one operator
+	// can modify the zone at a time. It fails if someone else holds the lock.
+	Lock() error
+
+	// Unlock releases a lock taken by Lock.
+	Unlock() error
+
+	// String returns a human readable description of where the manifest lives
+	String() string
+}
+
+// S3EndpointEnvVar names an environment variable which, when set, overrides
+// the S3 endpoint used by s3:// manifest stores (e.g., to point at a local
+// S3-compatible server for testing)
+const S3EndpointEnvVar = "SUBSTRATE_S3_ENDPOINT"
+
+// OpenManifestStore returns the ManifestStore for a manifest location, which
+// is either a local file path or an S3 URL like `s3://bucket/env/zone00.json`
+func OpenManifestStore(location string) (ManifestStore, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return newLocalManifestStore(location), nil
+	}
+
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest URL %q: %v", location, err)
+	}
+	key := strings.TrimPrefix(parsed.Path, "/")
+	if parsed.Host == "" || key == "" {
+		return nil, fmt.Errorf("invalid manifest URL %q, expected s3://BUCKET/KEY", location)
+	}
+	return newS3ManifestStore(
+		parsed.Host,
+		key,
+		parsed.Query().Get("region"),
+		os.Getenv(S3EndpointEnvVar),
+	), nil
+}
+
+// ManifestExists returns whether a manifest has been written to the store
+func ManifestExists(store ManifestStore) (bool, error) {
+	_, err := store.Read("")
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReadManifestFrom reads a SubstrateZoneManifest from a store, upgrading it
+// in memory to the current manifest schema version if needed
+func ReadManifestFrom(store ManifestStore) (*SubstrateZoneManifest, error) {
+	marshalledJSON, err := store.Read("")
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(marshalledJSON, store.String())
+}
+
+// WriteManifestTo renders a SubstrateZoneManifest to JSON and saves it in the store
+func WriteManifestTo(store ManifestStore, m *SubstrateZoneManifest) error {
+	marshalledJSON, err := m.MarshalManifest()
+	if err != nil {
+		return err
+	}
+	return store.Write("", marshalledJSON)
+}
+
+// backupManifest copies the current manifest in a store to the ".bak" suffix
+func backupManifest(store ManifestStore) error {
+	marshalledJSON, err := store.Read("")
+	if err != nil {
+		return err
+	}
+	return store.Write(".bak", marshalledJSON)
+}
+
+// manifestLock is the content of the lock we hold while modifying a zone, so
+// that whoever runs into it can tell who they're waiting on
+type manifestLock struct {
+	ID       string    `json:"id"`
+	Operator string    `json:"operator"`
+	Hostname string    `json:"hostname"`
+	Created  time.Time `json:"created"`
+}
+
+func newManifestLock() ([]byte, string, error) {
+	hostname, _ := os.Hostname()
+	lock := manifestLock{
+		ID:       util.RandomHex(16),
+		Operator: util.CurrentUser(),
+		Hostname: hostname,
+		Created:  time.Now().UTC(),
+	}
+	lockJSON, err := json.Marshal(&lock)
+	return lockJSON, lock.ID, err
+}
+
+// describeLock returns a human readable description of who holds a lock
+func describeLock(lockJSON []byte) string {
+	var lock manifestLock
+	if err := json.Unmarshal(lockJSON, &lock); err != nil {
+		return "an unknown operator"
+	}
+	return fmt.Sprintf("%s@%s (since %s)", lock.Operator, lock.Hostname, lock.Created.Format(time.RFC3339))
+}
+
+// lockedError is returned when someone else holds the lock on a manifest
+func lockedError(store ManifestStore, lockLocation string, lockJSON []byte) error {
+	return fmt.Errorf(
+		"zone manifest %s is locked by %s. If you're sure nobody else is working on this zone, remove %s and try again",
+		store,
+		describeLock(lockJSON),
+		lockLocation)
+}
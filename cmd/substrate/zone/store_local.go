@@ -0,0 +1,106 @@
+package zone
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// localManifestStore keeps a manifest in a file on the local filesystem
+type localManifestStore struct {
+	path   string
+	lockID string
+}
+
+func newLocalManifestStore(path string) *localManifestStore {
+	return &localManifestStore{path: path}
+}
+
+func (s *localManifestStore) String() string {
+	return s.path
+}
+
+func (s *localManifestStore) Read(suffix string) ([]byte, error) {
+	return ioutil.ReadFile(s.path + suffix)
+}
+
+// Write writes to a temp file and renames it into place so that a crash
+// part way through never leaves a truncated manifest behind
+func (s *localManifestStore) Write(suffix string, data []byte) error {
+	path := s.path + suffix
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+func (s *localManifestStore) Delete(suffix string) error {
+	err := os.Remove(s.path + suffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localManifestStore) List(prefix string) ([]string, error) {
+	matches, err := filepath.Glob(s.path + prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, match := range matches {
+		if strings.HasSuffix(match, ".tmp") {
+			continue
+		}
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			continue
+		}
+		result = append(result, strings.TrimPrefix(match, s.path))
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Lock creates a ".lock" file next to the manifest, failing if it already exists
+func (s *localManifestStore) Lock() error {
+	lockPath := s.path + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0700); err != nil {
+		return err
+	}
+
+	lockJSON, lockID, err := newManifestLock()
+	if err != nil {
+		return err
+	}
+
+	lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		existingJSON, _ := ioutil.ReadFile(lockPath)
+		return lockedError(s, lockPath, existingJSON)
+	}
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+
+	if _, err = lockFile.Write(lockJSON); err != nil {
+		os.Remove(lockPath)
+		return err
+	}
+	s.lockID = lockID
+	return nil
+}
+
+func (s *localManifestStore) Unlock() error {
+	if s.lockID == "" {
+		return nil
+	}
+	s.lockID = ""
+	return s.Delete(".lock")
+}
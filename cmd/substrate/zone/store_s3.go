@@ -0,0 +1,239 @@
+package zone
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3ManifestStore keeps a manifest as an object in S3.
+//
+// Two mechanisms keep operators from stepping on each other, both built on S3
+// conditional writes. A ".lock" object next to the manifest is created with
+// "If-None-Match: *" and held for the duration of any command that modifies
+// the zone, and writes to objects we've read are made with "If-Match" on the
+// ETag we read (or "If-None-Match: *" if we saw it didn't exist), so a write
+// never silently clobbers something someone else saved in the meantime.
+//
+// The endpoint has to support conditional writes (S3 itself does, as do most
+// S3-compatible stand-ins); one that ignores the headers gets no protection.
+type s3ManifestStore struct {
+	svc    *s3.S3
+	bucket string
+	key    string
+	lockID string
+
+	// etags records the ETag of each object as of our first read or last write,
+	// or "" for an object we found didn't exist (checkpoints are written from
+	// a background goroutine, hence the lock)
+	etags     map[string]string
+	etagsLock sync.Mutex
+}
+
+func newS3ManifestStore(bucket string, key string, region string, endpoint string) *s3ManifestStore {
+	config := &aws.Config{}
+	if region != "" {
+		config.Region = aws.String(region)
+	}
+	if endpoint != "" {
+		// S3-compatible stand-ins generally don't do virtual-host style bucket addressing
+		config.Endpoint = aws.String(endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+		if region == "" {
+			config.Region = aws.String("us-east-1")
+		}
+	}
+	return &s3ManifestStore{
+		svc:    s3.New(session.New(), config),
+		bucket: bucket,
+		key:    key,
+		etags:  map[string]string{},
+	}
+}
+
+func (s *s3ManifestStore) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.key)
+}
+
+func (s *s3ManifestStore) setETag(suffix string, etag string) {
+	s.etagsLock.Lock()
+	defer s.etagsLock.Unlock()
+	s.etags[suffix] = etag
+}
+
+func (s *s3ManifestStore) forgetETag(suffix string) {
+	s.etagsLock.Lock()
+	defer s.etagsLock.Unlock()
+	delete(s.etags, suffix)
+}
+
+// isS3NotFound returns whether an S3 error means the object doesn't exist
+func isS3NotFound(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoSuchKey" {
+		return true
+	}
+	return false
+}
+
+// isS3PreconditionFailed returns whether an S3 error means a conditional
+// write lost (409 is S3's answer to a conditional write racing another one)
+func isS3PreconditionFailed(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusPreconditionFailed || reqErr.StatusCode() == http.StatusConflict
+	}
+	return false
+}
+
+func (s *s3ManifestStore) Read(suffix string) ([]byte, error) {
+	resp, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key + suffix),
+	})
+	if isS3NotFound(err) {
+		s.etagsLock.Lock()
+		if _, ok := s.etags[suffix]; !ok {
+			s.etags[suffix] = ""
+		}
+		s.etagsLock.Unlock()
+		return nil, &os.PathError{Op: "read", Path: s.String() + suffix, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// only remember the first ETag we see, so re-reading an object part way
+	// through a command doesn't hide changes someone else made in the meantime
+	s.etagsLock.Lock()
+	if _, ok := s.etags[suffix]; !ok {
+		s.etags[suffix] = aws.StringValue(resp.ETag)
+	}
+	s.etagsLock.Unlock()
+	return data, nil
+}
+
+func (s *s3ManifestStore) Write(suffix string, data []byte) error {
+	// refuse to overwrite an object that changed (or appeared) since we read it
+	s.etagsLock.Lock()
+	expected, ok := s.etags[suffix]
+	s.etagsLock.Unlock()
+	header, value := "", ""
+	switch {
+	case ok && expected == "":
+		header, value = "If-None-Match", "*"
+	case ok:
+		header, value = "If-Match", expected
+	}
+
+	etag, err := s.put(suffix, data, header, value)
+	if isS3PreconditionFailed(err) {
+		return fmt.Errorf("%s%s was modified by someone else since we read it, refusing to overwrite it", s, suffix)
+	}
+	if err != nil {
+		return err
+	}
+	s.setETag(suffix, etag)
+	return nil
+}
+
+// put writes an object, conditional on a precondition header if one is given,
+// and returns its new ETag
+func (s *s3ManifestStore) put(suffix string, data []byte, header string, value string) (string, error) {
+	req, resp := s.svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.key + suffix),
+		Body:                 bytes.NewReader(data),
+		ServerSideEncryption: aws.String("AES256"),
+	})
+	if header != "" {
+		req.HTTPRequest.Header.Set(header, value)
+	}
+	err := req.Send()
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(resp.ETag), nil
+}
+
+func (s *s3ManifestStore) Delete(suffix string) error {
+	_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key + suffix),
+	})
+	if err != nil && !isS3NotFound(err) {
+		return err
+	}
+	s.forgetETag(suffix)
+	return nil
+}
+
+func (s *s3ManifestStore) List(prefix string) ([]string, error) {
+	result := []string{}
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.key + prefix),
+	}
+	err := s.svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, object := range page.Contents {
+			result = append(result, strings.TrimPrefix(aws.StringValue(object.Key), s.key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Lock creates a ".lock" object next to the manifest, with a conditional
+// write that fails if someone else's lock is already there
+func (s *s3ManifestStore) Lock() error {
+	lockJSON, lockID, err := newManifestLock()
+	if err != nil {
+		return err
+	}
+	etag, err := s.put(".lock", lockJSON, "If-None-Match", "*")
+	if isS3PreconditionFailed(err) {
+		existingJSON, readErr := s.Read(".lock")
+		if os.IsNotExist(readErr) {
+			// released again in the meantime (or we lost a race for a fresh lock)
+			return fmt.Errorf("zone manifest %s was locked by someone else just now, try again", s)
+		}
+		if readErr != nil {
+			return readErr
+		}
+		return lockedError(s, s.String()+".lock", existingJSON)
+	}
+	if err != nil {
+		return err
+	}
+	s.setETag(".lock", etag)
+	s.lockID = lockID
+	return nil
+}
+
+func (s *s3ManifestStore) Unlock() error {
+	if s.lockID == "" {
+		return nil
+	}
+	s.lockID = ""
+	return s.Delete(".lock")
+}
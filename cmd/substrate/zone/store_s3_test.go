@@ -0,0 +1,270 @@
+package zone
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a minimal S3-compatible server: path-style GET, HEAD, PUT and
+// DELETE of objects (with conditional PUTs) and ListObjects, all in memory
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+}
+
+// startFakeS3 starts a fake S3 server and points s3:// manifest stores at it
+// (with credentials for it to ignore), returning a function that puts
+// everything back
+func startFakeS3() func() {
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	previous := map[string]string{}
+	for name, value := range map[string]string{
+		S3EndpointEnvVar:        server.URL,
+		"AWS_ACCESS_KEY_ID":     "AKIAFAKE",
+		"AWS_SECRET_ACCESS_KEY": "fake",
+	} {
+		previous[name] = os.Getenv(name)
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, value := range previous {
+			os.Setenv(name, value)
+		}
+		server.Close()
+	}
+}
+
+func fakeETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) == 1 || parts[1] == "" {
+		f.list(w, parts[0], r.URL.Query().Get("prefix"))
+		return
+	}
+	name := parts[0] + "/" + parts[1]
+	data, exists := f.objects[name]
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if !exists {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", fakeETag(data))
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case "PUT":
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || match != fakeETag(data)) {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[name] = body
+		w.Header().Set("ETag", fakeETag(body))
+	case "DELETE":
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, prefix string) {
+	type content struct {
+		Key string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		IsTruncated bool
+		Contents    []content
+	}{Name: bucket, Prefix: prefix}
+
+	keys := []string{}
+	for name := range f.objects {
+		if strings.HasPrefix(name, bucket+"/"+prefix) {
+			keys = append(keys, strings.TrimPrefix(name, bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.Contents = append(result.Contents, content{Key: key})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(&result)
+}
+
+func openTestS3Store(t *testing.T) ManifestStore {
+	store, err := OpenManifestStore("s3://bucket/dev/zone00.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestS3ManifestStoreReadWrite(t *testing.T) {
+	defer startFakeS3()()
+	store := openTestS3Store(t)
+
+	_, err := store.Read("")
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected a not-exist error reading a missing manifest, got %v", err)
+	}
+	for _, suffix := range []string{"", ".bak", ".history/000001.json"} {
+		err = store.Write(suffix, []byte("data"+suffix))
+		if err != nil {
+			t.Fatalf("error writing %q: %v", suffix, err)
+		}
+	}
+	data, err := store.Read(".bak")
+	if err != nil || string(data) != "data.bak" {
+		t.Fatalf("read back %q, %v", data, err)
+	}
+	suffixes, err := store.List(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(suffixes, ",") != ".bak,.history/000001.json" {
+		t.Fatalf("unexpected listing %v", suffixes)
+	}
+	err = store.Delete(".bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Read(".bak")
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected .bak to be gone, got %v", err)
+	}
+}
+
+func TestS3ManifestStoreConditionalWrites(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// first and second both read the manifest, then write in this order
+		existing    bool
+		secondWrite bool
+		wantErr     bool
+	}{
+		{name: "update after someone else updated", existing: true, secondWrite: true, wantErr: true},
+		{name: "create after someone else created", existing: false, secondWrite: true, wantErr: true},
+		{name: "update with nobody else writing", existing: true, wantErr: false},
+		{name: "create with nobody else writing", existing: false, wantErr: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer startFakeS3()()
+			if test.existing {
+				err := openTestS3Store(t).Write("", []byte("original"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			first, second := openTestS3Store(t), openTestS3Store(t)
+			first.Read("")
+			second.Read("")
+			if test.secondWrite {
+				err := second.Write("", []byte("second"))
+				if err != nil {
+					t.Fatalf("unexpected error from the second writer: %v", err)
+				}
+			}
+			err := first.Write("", []byte("first"))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, wanted an error: %v", err, test.wantErr)
+			}
+
+			// our own writes don't conflict with each other
+			if err == nil {
+				err = first.Write("", []byte("first again"))
+				if err != nil {
+					t.Fatalf("error writing again: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestS3ManifestStoreLock(t *testing.T) {
+	defer startFakeS3()()
+	first, second := openTestS3Store(t), openTestS3Store(t)
+
+	err := first.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = second.Lock()
+	if err == nil || !strings.Contains(err.Error(), "is locked by") {
+		t.Fatalf("expected the second lock to fail, got %v", err)
+	}
+	err = first.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = second.Lock()
+	if err != nil {
+		t.Fatalf("expected the lock to be free again, got %v", err)
+	}
+	second.Unlock()
+}
+
+func TestS3ManifestStoreLockRace(t *testing.T) {
+	defer startFakeS3()()
+
+	const operators = 10
+	results := make(chan error, operators)
+	var start sync.WaitGroup
+	start.Add(1)
+	for i := 0; i < operators; i++ {
+		store := openTestS3Store(t)
+		go func() {
+			start.Wait()
+			results <- store.Lock()
+		}()
+	}
+	start.Done()
+
+	held := 0
+	for i := 0; i < operators; i++ {
+		if <-results == nil {
+			held++
+		}
+	}
+	if held != 1 {
+		t.Fatalf("%d operators got the lock at once", held)
+	}
+}
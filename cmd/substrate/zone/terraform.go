@@ -1,26 +1,195 @@
 package zone
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
+	"text/template"
 
 	"github.com/goware/prefixer"
 
 	"github.com/SimpleFinance/substrate/cmd/substrate/assets"
 )
 
-// Terraform runs `terraform` in the extracted working directory
-func Terraform(extractedAssets *assets.SubstrateAssets, arg ...string) error {
-	tpath := extractedAssets.Path("bin/terraform")
+// TerraformPaths are the files a Terraform run reads and writes
+type TerraformPaths struct {
+	StatePath string
+	PlanPath  string
+	VarsPath  string
+}
+
+// TerraformResult describes a finished Terraform run
+type TerraformResult struct {
+	// Command is the Terraform subcommand that was run (e.g., "plan")
+	Command string
+	Args    []string
+
+	// ExitStatus is the exit status of Terraform (-1 if it never ran)
+	ExitStatus int
+
+	// Stdout and Stderr are the captured (unprefixed) output of the run
+	Stdout []byte
+	Stderr []byte
+
+	// PlanPath and StatePath are the plan and state files the run used, if any
+	PlanPath  string
+	StatePath string
+}
+
+// TerraformRunner runs Terraform against the zone configuration. The error
+// returned by each method is non-nil if Terraform failed, in which case the
+// result (if any) says how.
+type TerraformRunner interface {
+	// Version prints the Terraform version
+	Version() (*TerraformResult, error)
+
+	// Get installs the modules used by the zone configuration
+	Get() (*TerraformResult, error)
+
+	// Plan writes an execution plan to the plan path, limited to the given
+	// resource addresses (and what they depend on) if there are any
+	Plan(paths TerraformPaths, targets ...string) (*TerraformResult, error)
+
+	// Show renders the plan at the plan path as text (in the result's Stdout)
+	Show(paths TerraformPaths) (*TerraformResult, error)
+
+	// Apply applies the plan at the plan path, updating the state. A
+	// parallelism of 0 uses the Terraform default.
+	Apply(paths TerraformPaths, parallelism int) (*TerraformResult, error)
+
+	// Destroy destroys every resource in the state
+	Destroy(paths TerraformPaths, parallelism int) (*TerraformResult, error)
+
+	// Refresh updates the state to match the real resources
+	Refresh(paths TerraformPaths) (*TerraformResult, error)
+
+	// Output reads the root module outputs from the state
+	Output(paths TerraformPaths) (map[string]*TerraformOutput, *TerraformResult, error)
+
+	// StateMove moves a resource (or module) to a new address in the state
+	StateMove(paths TerraformPaths, from string, to string) (*TerraformResult, error)
+}
+
+// newTerraformRunner creates the TerraformRunner used for a set of extracted
+// assets, streaming Terraform's stdout to out. Tests can replace it to run
+// against a FakeTerraformRunner instead.
+var newTerraformRunner = func(extractedAssets *assets.SubstrateAssets, out io.Writer) TerraformRunner {
+	return &execTerraformRunner{
+		assets: extractedAssets,
+		stdout: out,
+		stderr: os.Stderr,
+	}
+}
+
+// execTerraformRunner runs the `terraform` binary from the extracted assets
+type execTerraformRunner struct {
+	assets *assets.SubstrateAssets
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (r *execTerraformRunner) Version() (*TerraformResult, error) {
+	return r.run(true, TerraformPaths{}, "version")
+}
+
+func (r *execTerraformRunner) Get() (*TerraformResult, error) {
+	return r.run(true, TerraformPaths{}, "get", "-no-color", "-update", "./zone")
+}
+
+func (r *execTerraformRunner) Plan(paths TerraformPaths, targets ...string) (*TerraformResult, error) {
+	args := []string{"plan", "-no-color", "-input=false"}
+	for _, target := range targets {
+		args = append(args, "-target", target)
+	}
+	args = append(args, "-state", paths.StatePath, "-out", paths.PlanPath, "-var-file", paths.VarsPath, "./zone")
+	return r.run(true, paths, args...)
+}
+
+func (r *execTerraformRunner) Show(paths TerraformPaths) (*TerraformResult, error) {
+	return r.run(false, paths, "show", "-no-color", paths.PlanPath)
+}
+
+func (r *execTerraformRunner) Apply(paths TerraformPaths, parallelism int) (*TerraformResult, error) {
+	args := []string{"apply", "-no-color", "-refresh=false", "-input=false"}
+	if parallelism > 0 {
+		args = append(args, fmt.Sprintf("-parallelism=%d", parallelism))
+	}
+	args = append(args, "-state", paths.StatePath, paths.PlanPath)
+	return r.run(true, paths, args...)
+}
+
+func (r *execTerraformRunner) Destroy(paths TerraformPaths, parallelism int) (*TerraformResult, error) {
+	args := []string{"destroy", "-force=true", "-no-color", "-input=false"}
+	if parallelism > 0 {
+		args = append(args, fmt.Sprintf("-parallelism=%d", parallelism))
+	}
+	args = append(args, "-state", paths.StatePath, "-var-file", paths.VarsPath, "./zone")
+	return r.run(true, paths, args...)
+}
+
+func (r *execTerraformRunner) Refresh(paths TerraformPaths) (*TerraformResult, error) {
+	return r.run(
+		true,
+		paths,
+		"refresh",
+		"-no-color",
+		"-input=false",
+		"-state", paths.StatePath,
+		"-var-file", paths.VarsPath,
+		"./zone")
+}
+
+func (r *execTerraformRunner) Output(paths TerraformPaths) (map[string]*TerraformOutput, *TerraformResult, error) {
+	result, err := r.run(false, paths, "output", "-no-color", "-json", "-state", paths.StatePath)
+	if err != nil {
+		return nil, result, err
+	}
+	var rawOutputs map[string]struct {
+		Sensitive bool        `json:"sensitive"`
+		Value     interface{} `json:"value"`
+	}
+	err = json.Unmarshal(result.Stdout, &rawOutputs)
+	if err != nil {
+		return nil, result, fmt.Errorf("error parsing `terraform output -json`: %v", err)
+	}
+	outputs := map[string]*TerraformOutput{}
+	for name, output := range rawOutputs {
+		outputs[name] = newTerraformOutput(output.Value, output.Sensitive)
+	}
+	return outputs, result, nil
+}
+
+func (r *execTerraformRunner) StateMove(paths TerraformPaths, from string, to string) (*TerraformResult, error) {
+	return r.run(true, paths, "state", "mv", "-state", paths.StatePath, from, to)
+}
+
+// run runs `terraform` in the extracted working directory, capturing its
+// output. If stream is set, stdout is also copied to our output with each line
+// prefixed. Stderr is always streamed (prefixed) to our stderr.
+func (r *execTerraformRunner) run(stream bool, paths TerraformPaths, arg ...string) (*TerraformResult, error) {
+	result := &TerraformResult{
+		Command:    arg[0],
+		Args:       arg,
+		ExitStatus: -1,
+		StatePath:  paths.StatePath,
+		PlanPath:   paths.PlanPath,
+	}
+
+	tpath := r.assets.Path("bin/terraform")
 	cmd := exec.Command(tpath, arg...)
 	log.Printf("%s %s", tpath, strings.Join(arg[:], " "))
 	cmd.Env = []string{
-		fmt.Sprintf("PATH=%s", extractedAssets.Path("bin")),
+		fmt.Sprintf("PATH=%s", r.assets.Path("bin")),
 	}
 
 	// pass through AWS_* variables as well
@@ -31,33 +200,38 @@ func Terraform(extractedAssets *assets.SubstrateAssets, arg ...string) error {
 	}
 
 	// run it with the root of the temp directory as working directory
-	cmd.Dir = extractedAssets.Path("")
+	cmd.Dir = r.assets.Path("")
 
 	// stream stdout and strderr, but prefix each line of the output
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return err
+		return result, err
 	}
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	err = cmd.Start()
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	name := fmt.Sprintf("terraform %s", arg[0])
+	var stdout, stderr bytes.Buffer
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		io.Copy(os.Stdout, prefixer.New(stdoutPipe, fmt.Sprintf("%s > ", name)))
+		if stream {
+			io.Copy(r.stdout, prefixer.New(io.TeeReader(stdoutPipe, &stdout), fmt.Sprintf("%s > ", name)))
+		} else {
+			io.Copy(&stdout, stdoutPipe)
+		}
 	}()
 	go func() {
 		defer wg.Done()
-		io.Copy(os.Stderr, prefixer.New(stderrPipe, fmt.Sprintf("%s ! ", name)))
+		io.Copy(r.stderr, prefixer.New(io.TeeReader(stderrPipe, &stderr), fmt.Sprintf("%s ! ", name)))
 	}()
 
 	// wait for the subprocess to finish
@@ -66,6 +240,160 @@ func Terraform(extractedAssets *assets.SubstrateAssets, arg ...string) error {
 	// then wait for both of the stdout/stderr copying goroutines to finish
 	wg.Wait()
 
+	result.Stdout = stdout.Bytes()
+	result.Stderr = stderr.Bytes()
+	result.ExitStatus = 0
+	if err != nil {
+		result.ExitStatus = 1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				result.ExitStatus = status.ExitStatus()
+			}
+		}
+	}
+
 	// return the exit status of the subprocess
-	return err
+	return result, err
+}
+
+// extractSubstrateAssets extracts the assets for a new workspace. Tests can
+// replace it to skip extracting the real Terraform binaries and config.
+var extractSubstrateAssets = assets.ExtractSubstrateAssets
+
+// terraformWorkspace is an extracted copy of the Substrate assets with a
+// zone's Terraform state and variables written out, ready to run Terraform in
+type terraformWorkspace struct {
+	TerraformPaths
+	Runner TerraformRunner
+
+	assets *assets.SubstrateAssets
+}
+
+// zoneTemplateFuncs are the functions available in the zone config templates
+var zoneTemplateFuncs = template.FuncMap{
+	"hcl": hclList,
+}
+
+// renderZoneTemplate renders one of the zone config templates from an
+// extracted copy of the assets in dir, so the Terraform config Substrate runs
+// is only ever generated from the signed templates
+func renderZoneTemplate(dir string, name string, data interface{}) (string, error) {
+	templateText, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New(path.Base(name)).Funcs(zoneTemplateFuncs).Parse(string(templateText))
+	if err != nil {
+		return "", fmt.Errorf("error parsing %s: %v", name, err)
+	}
+	var result bytes.Buffer
+	err = tmpl.Execute(&result, data)
+	if err != nil {
+		return "", fmt.Errorf("error rendering %s: %v", name, err)
+	}
+	return result.String(), nil
+}
+
+// writeZoneSpecTF renders the parts of the Terraform config that depend on the
+// zone spec into an extracted copy of the assets in dir
+func writeZoneSpecTF(dir string, zoneManifest *SubstrateZoneManifest) error {
+	plan := zoneManifest.addressPlan()
+	controlPlaneTF, err := renderControlPlaneTF(dir, plan)
+	if err != nil {
+		return err
+	}
+	workerPoolsTF, err := renderWorkerPoolsTF(dir, zoneManifest.ZoneSpec())
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(controlPlaneFile)), []byte(controlPlaneTF), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(workerPoolsFile)), []byte(workerPoolsTF), 0600)
+}
+
+// newTerraformWorkspace extracts the Substrate assets (plus the zone's
+// Terraform overlay, if it has one) into a temp directory and writes out the
+// .tfstate and .tfvars for the zone. Terraform's stdout is streamed to out.
+func newTerraformWorkspace(zoneManifest *SubstrateZoneManifest, out io.Writer) (*terraformWorkspace, error) {
+	extractedAssets, err := extractSubstrateAssets()
+	if err != nil {
+		return nil, err
+	}
+	w := &terraformWorkspace{
+		TerraformPaths: TerraformPaths{
+			StatePath: extractedAssets.Path("substrate.tfstate"),
+			PlanPath:  extractedAssets.Path("substrate.tfplan"),
+			VarsPath:  extractedAssets.Path("substrate.tfvars"),
+		},
+		Runner: newTerraformRunner(extractedAssets, out),
+		assets: extractedAssets,
+	}
+
+	// render the control plane and worker pools from the zone spec
+	err = writeZoneSpecTF(extractedAssets.Path(""), zoneManifest)
+	if err != nil {
+		w.Cleanup()
+		return nil, err
+	}
+
+	// copy in the zone's own additions to the Terraform config
+	if zoneManifest.Overlay != nil {
+		err = zoneManifest.Overlay.apply(w.Path("zone"), out)
+		if err != nil {
+			w.Cleanup()
+			return nil, err
+		}
+	}
+
+	// write the saved .tfstate from the manifest (if there is one yet)
+	if zoneManifest.TerraformState != nil {
+		stateJSON, err := json.MarshalIndent(zoneManifest.TerraformState, "", "    ")
+		if err != nil {
+			w.Cleanup()
+			return nil, err
+		}
+		err = ioutil.WriteFile(w.StatePath, stateJSON, 0600)
+		if err != nil {
+			w.Cleanup()
+			return nil, err
+		}
+	}
+
+	// write the zone's admin SSH public key where the .tfvars points Terraform
+	if zoneManifest.SSHKey != nil {
+		err = ioutil.WriteFile(w.Path(sshPublicKeyWorkspaceFile), []byte(zoneManifest.SSHKey.PublicKey+"\n"), 0600)
+		if err != nil {
+			w.Cleanup()
+			return nil, err
+		}
+	}
+
+	// write the .tfvars file to pass parameters into Terraform
+	err = ioutil.WriteFile(w.VarsPath, []byte(zoneManifest.TFVars()), 0600)
+	if err != nil {
+		w.Cleanup()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Path returns the absolute path to the specified file in the workspace
+func (w *terraformWorkspace) Path(name string) string {
+	return w.assets.Path(name)
+}
+
+// ReadState parses the workspace .tfstate back into the manifest
+func (w *terraformWorkspace) ReadState(zoneManifest *SubstrateZoneManifest) error {
+	stateJSON, err := ioutil.ReadFile(w.StatePath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(stateJSON, &zoneManifest.TerraformState)
+}
+
+// Cleanup removes the workspace temp directory
+func (w *terraformWorkspace) Cleanup() {
+	w.assets.Cleanup()
 }
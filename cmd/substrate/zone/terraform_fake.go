@@ -0,0 +1,174 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// FakeTerraformRunner is an in-memory TerraformRunner for testing commands
+// without AWS. It never runs Terraform: Apply and Refresh write the canned
+// State to the state path, Destroy writes an empty state, Plan writes a
+// placeholder plan, and StateMove only records the move.
+type FakeTerraformRunner struct {
+	// State is the .tfstate written by Apply and Refresh
+	State interface{}
+
+	// ShowOutput is what Show returns as the text of the plan
+	ShowOutput string
+
+	// Errors makes the named commands (e.g., "apply") fail. The state is
+	// still written first, like a real Terraform run that fails part way.
+	Errors map[string]error
+
+	// Calls records the commands run, in order
+	Calls []string
+
+	// StateMoves records the `terraform state mv` operations run, in order
+	StateMoves []TerraformStateMove
+
+	// PlanTargets records the -target arguments of each plan, in order
+	PlanTargets [][]string
+
+	lock sync.Mutex
+}
+
+// fakeEmptyTerraformState is what's left after a destroy
+var fakeEmptyTerraformState = map[string]interface{}{
+	"version": 3,
+	"serial":  1,
+	"modules": []interface{}{
+		map[string]interface{}{
+			"path":      []interface{}{planRootModule},
+			"outputs":   map[string]interface{}{},
+			"resources": map[string]interface{}{},
+		},
+	},
+}
+
+// fakeTerraformPlan is the placeholder written as the plan file
+const fakeTerraformPlan = "fake terraform plan\n"
+
+func (f *FakeTerraformRunner) run(command string, paths TerraformPaths) (*TerraformResult, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.Calls = append(f.Calls, command)
+	return &TerraformResult{
+		Command:   command,
+		Args:      []string{command},
+		StatePath: paths.StatePath,
+		PlanPath:  paths.PlanPath,
+	}, nil
+}
+
+// finish sets the result's exit status from any configured error for the command
+func (f *FakeTerraformRunner) finish(result *TerraformResult) (*TerraformResult, error) {
+	err := f.Errors[result.Command]
+	if err != nil {
+		result.ExitStatus = 1
+		result.Stderr = []byte(err.Error())
+	}
+	return result, err
+}
+
+func (f *FakeTerraformRunner) writeState(path string, state interface{}) error {
+	stateJSON, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, stateJSON, 0600)
+}
+
+// Version pretends to print the Terraform version
+func (f *FakeTerraformRunner) Version() (*TerraformResult, error) {
+	result, _ := f.run("version", TerraformPaths{})
+	result.Stdout = []byte("Terraform v0.0.0-fake\n")
+	return f.finish(result)
+}
+
+// Get does nothing
+func (f *FakeTerraformRunner) Get() (*TerraformResult, error) {
+	result, _ := f.run("get", TerraformPaths{})
+	return f.finish(result)
+}
+
+// Plan writes a placeholder plan, recording any targets
+func (f *FakeTerraformRunner) Plan(paths TerraformPaths, targets ...string) (*TerraformResult, error) {
+	result, _ := f.run("plan", paths)
+	result.Args = append(result.Args, targets...)
+	f.lock.Lock()
+	f.PlanTargets = append(f.PlanTargets, append([]string{}, targets...))
+	f.lock.Unlock()
+	err := ioutil.WriteFile(paths.PlanPath, []byte(fakeTerraformPlan), 0600)
+	if err != nil {
+		return result, err
+	}
+	return f.finish(result)
+}
+
+// Show returns ShowOutput
+func (f *FakeTerraformRunner) Show(paths TerraformPaths) (*TerraformResult, error) {
+	result, _ := f.run("show", paths)
+	result.Stdout = []byte(f.ShowOutput)
+	return f.finish(result)
+}
+
+// Apply writes State to the state path
+func (f *FakeTerraformRunner) Apply(paths TerraformPaths, parallelism int) (*TerraformResult, error) {
+	result, _ := f.run("apply", paths)
+	if f.State == nil {
+		return result, fmt.Errorf("FakeTerraformRunner has no State to apply")
+	}
+	err := f.writeState(paths.StatePath, f.State)
+	if err != nil {
+		return result, err
+	}
+	return f.finish(result)
+}
+
+// Destroy writes an empty state to the state path
+func (f *FakeTerraformRunner) Destroy(paths TerraformPaths, parallelism int) (*TerraformResult, error) {
+	result, _ := f.run("destroy", paths)
+	err := f.writeState(paths.StatePath, fakeEmptyTerraformState)
+	if err != nil {
+		return result, err
+	}
+	return f.finish(result)
+}
+
+// Refresh writes State to the state path
+func (f *FakeTerraformRunner) Refresh(paths TerraformPaths) (*TerraformResult, error) {
+	result, _ := f.run("refresh", paths)
+	if f.State == nil {
+		return result, fmt.Errorf("FakeTerraformRunner has no State to refresh to")
+	}
+	err := f.writeState(paths.StatePath, f.State)
+	if err != nil {
+		return result, err
+	}
+	return f.finish(result)
+}
+
+// Output returns the outputs of State
+func (f *FakeTerraformRunner) Output(paths TerraformPaths) (map[string]*TerraformOutput, *TerraformResult, error) {
+	result, _ := f.run("output", paths)
+	if f.State == nil {
+		return map[string]*TerraformOutput{}, result, nil
+	}
+	outputs, err := parseTerraformOutputs(f.State)
+	if err != nil {
+		return nil, result, err
+	}
+	result, err = f.finish(result)
+	return outputs, result, err
+}
+
+// StateMove records the move, leaving the state alone
+func (f *FakeTerraformRunner) StateMove(paths TerraformPaths, from string, to string) (*TerraformResult, error) {
+	result, _ := f.run("state mv", paths)
+	f.lock.Lock()
+	f.StateMoves = append(f.StateMoves, TerraformStateMove{From: from, To: to})
+	f.lock.Unlock()
+	return f.finish(result)
+}
@@ -0,0 +1,88 @@
+package zone
+
+import (
+	"fmt"
+	"strings"
+)
+
+// terraformStateResource is a single resource instance from a Terraform state
+type terraformStateResource struct {
+	// Module is the name of the top level module the resource is in ("root" for none)
+	Module string
+
+	// Type is the Terraform resource type (e.g., "aws_instance")
+	Type string
+
+	// ID is the provider ID of the resource (e.g., an EC2 instance ID)
+	ID string
+
+	// Attributes are the flattened attributes Terraform recorded for the resource
+	Attributes map[string]string
+}
+
+// terraformStateResources returns all the resources in a Terraform state
+// (the version 3 format written by Terraform 0.7+), keyed by their full
+// address, e.g. "module.border-0.aws_instance.border"
+func terraformStateResources(tfState interface{}) (map[string]*terraformStateResource, error) {
+	result := map[string]*terraformStateResource{}
+
+	tfStateMap, ok := tfState.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("malformed Terraform state")
+	}
+	modules, _ := tfStateMap["modules"].([]interface{})
+
+	for _, module := range modules {
+		moduleMap, ok := module.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("malformed module in Terraform state")
+		}
+
+		// module paths look like ["root", "border-0"]
+		addressPrefix := ""
+		moduleName := planRootModule
+		path, _ := moduleMap["path"].([]interface{})
+		for i, element := range path {
+			if i == 0 {
+				continue
+			}
+			name, _ := element.(string)
+			if i == 1 {
+				moduleName = name
+			}
+			addressPrefix += fmt.Sprintf("module.%s.", name)
+		}
+
+		resources, _ := moduleMap["resources"].(map[string]interface{})
+		for key, resource := range resources {
+			resourceMap, ok := resource.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("malformed resource %q in Terraform state", key)
+			}
+			parsed := &terraformStateResource{
+				Module:     moduleName,
+				Attributes: map[string]string{},
+			}
+			parsed.Type, _ = resourceMap["type"].(string)
+			primary, _ := resourceMap["primary"].(map[string]interface{})
+			parsed.ID, _ = primary["id"].(string)
+			attributes, _ := primary["attributes"].(map[string]interface{})
+			for name, value := range attributes {
+				parsed.Attributes[name] = fmt.Sprintf("%v", value)
+			}
+			result[addressPrefix+key] = parsed
+		}
+	}
+	return result, nil
+}
+
+// isDataResource returns whether a state address refers to a data source rather than a managed resource
+func isDataResource(address string) bool {
+	parts := strings.Split(address, ".")
+	for i := 0; i+1 < len(parts); i += 2 {
+		if parts[i] != "module" {
+			return parts[i] == "data"
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package zone
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/runs"
+)
+
+// names of the files we save in each run directory, alongside the output and metadata
+const (
+	transcriptVarsFile        = "substrate.tfvars"
+	transcriptPlanFile        = "substrate.tfplan"
+	transcriptBeforeStateFile = "before.tfstate"
+	transcriptAfterStateFile  = "after.tfstate"
+)
+
+// terraformTranscript records every Terraform run in a workspace to a run
+// directory under ~/.substrate/runs, so there's something left to debug a
+// failed run with after the workspace is cleaned up
+type terraformTranscript struct {
+	run         *runs.Run
+	workspace   *terraformWorkspace
+	keyProvider KeyProvider
+
+	// stdout and stderr are all the output so far if the manifest is
+	// encrypted, since Terraform's output includes resource attributes. An
+	// encrypted file can't be appended to, so it's re-encrypted in full
+	// after each phase.
+	stdout []byte
+	stderr []byte
+	lock   sync.Mutex
+}
+
+// startTranscript starts recording the Terraform runs in the workspace, saving
+// the .tfvars and the state we're starting from. Failing to record a
+// transcript isn't worth failing the command over, so on error this prints a
+// warning and returns nil (which is safe to call Finish on).
+func (w *terraformWorkspace) startTranscript(zoneManifest *SubstrateZoneManifest, manifestPath string, version string, command string) *terraformTranscript {
+	run, err := runs.Start(runs.DefaultDirectory, command, zoneManifest.ZoneName(), manifestPath, version)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: not saving a transcript of this run: %v\n", err)
+		return nil
+	}
+	t := &terraformTranscript{
+		run:         run,
+		workspace:   w,
+		keyProvider: zoneManifest.KeyProvider(),
+	}
+	t.saveFile(transcriptVarsFile, w.VarsPath, false)
+	t.saveFile(transcriptBeforeStateFile, w.StatePath, true)
+
+	w.Runner = &recordingTerraformRunner{runner: w.Runner, transcript: t}
+	w.assets.OnInterrupt(func() { t.Finish(fmt.Errorf("interrupted")) })
+	fmt.Printf("saving a transcript of this run to %s\n", run.Path(""))
+	return t
+}
+
+// saveFile copies a workspace file into the run directory (if it exists).
+// State and plans (like Terraform's output, see recordPhase) are encrypted
+// with the manifest key if the manifest is.
+func (t *terraformTranscript) saveFile(name string, path string, sensitive bool) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil && sensitive && t.keyProvider != nil {
+		data, err = encryptManifestJSON(data, t.keyProvider)
+	}
+	if err == nil {
+		err = t.run.WriteFile(name, data)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: error saving %s to the run transcript: %v\n", name, err)
+	}
+}
+
+// recordPhase saves the output and timing of a Terraform run
+func (t *terraformTranscript) recordPhase(started time.Time, result *TerraformResult, runErr error) {
+	phase := runs.Phase{
+		Started:  started,
+		Finished: time.Now().UTC(),
+	}
+	var stdout, stderr []byte
+	if result != nil {
+		phase.Name = result.Command
+		phase.Args = result.Args
+		phase.ExitStatus = result.ExitStatus
+		stdout = result.Stdout
+		stderr = result.Stderr
+	}
+	if runErr != nil {
+		phase.Error = runErr.Error()
+	}
+	if t.keyProvider != nil {
+		err := t.saveEncryptedOutput(stdout, stderr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: error saving the output of terraform %s to the run transcript: %v\n", phase.Name, err)
+		}
+		stdout, stderr = nil, nil
+	}
+	err := t.run.RecordPhase(phase, stdout, stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: error saving terraform %s to the run transcript: %v\n", phase.Name, err)
+	}
+}
+
+// saveEncryptedOutput adds a phase's output to what we have so far, and saves
+// it all encrypted with the manifest key
+func (t *terraformTranscript) saveEncryptedOutput(stdout []byte, stderr []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.stdout = append(t.stdout, stdout...)
+	t.stderr = append(t.stderr, stderr...)
+	for name, data := range map[string][]byte{runs.StdoutFile: t.stdout, runs.StderrFile: t.stderr} {
+		encrypted, err := encryptManifestJSON(data, t.keyProvider)
+		if err != nil {
+			return err
+		}
+		err = t.run.WriteFile(name, encrypted)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finish saves the plan and the resulting state, and records the outcome of the run
+func (t *terraformTranscript) Finish(runErr error) {
+	if t == nil {
+		return
+	}
+	t.saveFile(transcriptPlanFile, t.workspace.PlanPath, true)
+	t.saveFile(transcriptAfterStateFile, t.workspace.StatePath, true)
+	err := t.run.Finish(runErr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: error saving the run transcript: %v\n", err)
+	}
+}
+
+// recordingTerraformRunner wraps another TerraformRunner, saving each run to a transcript
+type recordingTerraformRunner struct {
+	runner     TerraformRunner
+	transcript *terraformTranscript
+}
+
+func (r *recordingTerraformRunner) record(run func() (*TerraformResult, error)) (*TerraformResult, error) {
+	started := time.Now().UTC()
+	result, err := run()
+	r.transcript.recordPhase(started, result, err)
+	return result, err
+}
+
+func (r *recordingTerraformRunner) Version() (*TerraformResult, error) {
+	return r.record(r.runner.Version)
+}
+
+func (r *recordingTerraformRunner) Get() (*TerraformResult, error) {
+	return r.record(r.runner.Get)
+}
+
+func (r *recordingTerraformRunner) Plan(paths TerraformPaths, targets ...string) (*TerraformResult, error) {
+	return r.record(func() (*TerraformResult, error) { return r.runner.Plan(paths, targets...) })
+}
+
+func (r *recordingTerraformRunner) Show(paths TerraformPaths) (*TerraformResult, error) {
+	return r.record(func() (*TerraformResult, error) { return r.runner.Show(paths) })
+}
+
+func (r *recordingTerraformRunner) Apply(paths TerraformPaths, parallelism int) (*TerraformResult, error) {
+	return r.record(func() (*TerraformResult, error) { return r.runner.Apply(paths, parallelism) })
+}
+
+func (r *recordingTerraformRunner) Destroy(paths TerraformPaths, parallelism int) (*TerraformResult, error) {
+	return r.record(func() (*TerraformResult, error) { return r.runner.Destroy(paths, parallelism) })
+}
+
+func (r *recordingTerraformRunner) Refresh(paths TerraformPaths) (*TerraformResult, error) {
+	return r.record(func() (*TerraformResult, error) { return r.runner.Refresh(paths) })
+}
+
+func (r *recordingTerraformRunner) Output(paths TerraformPaths) (map[string]*TerraformOutput, *TerraformResult, error) {
+	var outputs map[string]*TerraformOutput
+	result, err := r.record(func() (*TerraformResult, error) {
+		var result *TerraformResult
+		var err error
+		outputs, result, err = r.runner.Output(paths)
+		return result, err
+	})
+	return outputs, result, err
+}
+
+func (r *recordingTerraformRunner) StateMove(paths TerraformPaths, from string, to string) (*TerraformResult, error) {
+	return r.record(func() (*TerraformResult, error) { return r.runner.StateMove(paths, from, to) })
+}
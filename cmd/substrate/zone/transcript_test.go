@@ -0,0 +1,57 @@
+package zone
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SimpleFinance/substrate/cmd/substrate/runs"
+)
+
+// readTranscriptOutput creates a zone and returns the stdout saved in the
+// transcript of the run, as stored and decoded
+func readTranscriptOutput(t *testing.T, encrypt bool) ([]byte, []byte, KeyProvider) {
+	f, stop := startFakeZone(t)
+	defer stop()
+	params := f.createInput()
+	params.Encrypt = encrypt
+	err := Create(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorded, err := runs.ListRuns(runs.DefaultDirectory)
+	if err != nil || len(recorded) != 1 {
+		t.Fatalf("expected one run, got %v (%v)", recorded, err)
+	}
+	stored, err := ioutil.ReadFile(filepath.Join(runs.DefaultDirectory, recorded[0].ID, runs.StdoutFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encrypt {
+		return stored, stored, nil
+	}
+	decoded, keyProvider, err := decodeManifestJSON(stored)
+	if err != nil {
+		t.Fatalf("error decrypting transcript output: %v", err)
+	}
+	return stored, decoded, keyProvider
+}
+
+func TestTranscriptOutput(t *testing.T) {
+	stored, _, _ := readTranscriptOutput(t, false)
+	if !strings.Contains(string(stored), "Terraform v0.0.0-fake") {
+		t.Errorf("unexpected transcript output %q", stored)
+	}
+}
+
+func TestTranscriptOutputEncrypted(t *testing.T) {
+	stored, decoded, keyProvider := readTranscriptOutput(t, true)
+	if strings.Contains(string(stored), "Terraform v0.0.0-fake") || keyProvider == nil {
+		t.Errorf("transcript output of an encrypted zone was saved in plaintext: %q", stored)
+	}
+	if !strings.Contains(string(decoded), "Terraform v0.0.0-fake") {
+		t.Errorf("unexpected decrypted transcript output %q", decoded)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"log"
 	"net"
 
+	"golang.org/x/crypto/ssh"
+
 	host "github.com/SimpleFinance/substrate/cmd/substrate/zone/borderjump/host"
 	tunnel "github.com/SimpleFinance/substrate/cmd/substrate/zone/borderjump/tunnel"
 )
@@ -21,13 +23,17 @@ type TunnelInput struct {
 // Fetches and applies defaults for border and director if not provided
 func MakeTunnel(params *TunnelInput) error {
 	user := params.JumpHostUser
-	zoneManifest, err := ReadManifest(params.ManifestPath)
+	store, err := OpenManifestStore(params.ManifestPath)
+	if err != nil {
+		return err
+	}
+	zoneManifest, err := ReadManifestFrom(store)
 
 	if err != nil {
 		return err
 	}
 
-	borderEIP, err := getTerraformOutput("border_eip", zoneManifest.TerraformState)
+	borderEIP, err := healthyBorderEIP(zoneManifest)
 	if err != nil {
 		return err
 	}
@@ -35,7 +41,7 @@ func MakeTunnel(params *TunnelInput) error {
 	// use the director IP as the default host
 	rhostIP := params.Rip.String()
 	if rhostIP == "<nil>" { // @@ mmmmmkay.
-		rhostIP, err = getTerraformOutput("director_ip", zoneManifest.TerraformState)
+		rhostIP, err = zoneManifest.StringOutput("director_ip")
 		log.Printf("Using director ip: %s", rhostIP)
 		if err != nil {
 			return err
@@ -46,7 +52,17 @@ func MakeTunnel(params *TunnelInput) error {
 	lhost := host.New("127.0.0.1", params.LocalPort)
 
 	rhost := host.New(rhostIP, params.RemotePort)
-	t := tunnel.New(user, jhost, lhost, rhost)
+
+	// authenticate with the zone's own admin key if it's kept with the manifest
+	signers := []ssh.Signer{}
+	signer, err := zoneSSHSigner(store, zoneManifest)
+	if err != nil {
+		return err
+	}
+	if signer != nil {
+		signers = append(signers, signer)
+	}
+	t := tunnel.New(user, jhost, lhost, rhost, signers...)
 
 	err = t.Start()
 	if err != nil {
@@ -1,17 +1,10 @@
 package zone
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
-
-	"github.com/SimpleFinance/substrate/cmd/substrate/assets"
-	"github.com/SimpleFinance/substrate/cmd/substrate/logwatcher"
 	"github.com/SimpleFinance/substrate/cmd/substrate/util"
 )
 
@@ -21,171 +14,291 @@ type UpdateInput struct {
 	Prompt        bool
 	ManifestPath  string
 	UnsafeUpgrade bool
-}
 
-// IsCompatibleUpgrade takes an old version number and a current version number
-// and returns nil if an in-place upgrade is possible, or else an error describing why not
-func IsCompatibleUpgrade(old string, new string) error {
-	if old == new {
-		return nil
-	}
-	// TODO: allow patch/minor version bumps
-	return fmt.Errorf("in-place upgrade from Substrate %s to %s is not supported", old, new)
+	// Overlay points the zone at a (new) Terraform overlay directory (optional)
+	Overlay string
+
+	// Spec replaces the zone spec with the one in this YAML file (optional)
+	Spec string
+
+	// Check only explains how the zone would be upgraded, without changing anything
+	Check bool
+
+	// Rolling replaces workers RollingBatchSize at a time, draining each one
+	// first and waiting up to RollingTimeout for it to drain and for its
+	// replacement to become a Ready Kubernetes node
+	Rolling          bool
+	RollingBatchSize int
+	RollingTimeout   time.Duration
 }
 
 // Update reads an existing manifest, updates the zone in place, overwriting the manifest.
-func Update(params *UpdateInput) error {
-	zoneManifest, err := ReadManifest(params.ManifestPath)
+func Update(params *UpdateInput) (err error) {
+	if params.Check {
+		return checkUpdate(params)
+	}
+
+	store, err := OpenManifestStore(params.ManifestPath)
+	if err != nil {
+		return err
+	}
+
+	// make sure nobody else is modifying the zone at the same time
+	err = store.Lock()
+	if err != nil {
+		return err
+	}
+	defer store.Unlock()
+
+	zoneManifest, err := ReadManifestFrom(store)
+	if err != nil {
+		return err
+	}
+
+	// pick up any state saved by a previous run that got interrupted
+	err = recoverManifestCheckpoint(store, zoneManifest, params.Version)
 	if err != nil {
 		return err
 	}
 
-	// check version compatibility
-	err = IsCompatibleUpgrade(zoneManifest.Version, params.Version)
+	// check version compatibility, and run any upgrade steps that change the
+	// manifest before we go any further (the rest run as the changes are applied)
+	upgrade, err := planUpgrade(zoneManifest.Version, params.Version)
 	if err != nil {
 		if params.UnsafeUpgrade {
-			fmt.Printf("Warning: %v. Continuing anyway because of --unsafe...\n", err)
+			fmt.Printf("Warning: %v. Continuing anyway because of --unsafe (without running any upgrade steps)...\n", err)
 		} else {
 			return fmt.Errorf("%v. You need to destroy and recreate the zone (or bypass this check with --unsafe if you are sure you want to do this)", err)
 		}
+	} else {
+		err = upgrade.prepare(zoneManifest)
+		if err != nil {
+			return err
+		}
+
+		// the zone keeps its current version until the upgrade has been
+		// applied and checked, so a failed upgrade can be retried from the start
+		zoneManifest.UpgradingTo = ""
+		if zoneManifest.Version != params.Version {
+			zoneManifest.UpgradingTo = params.Version
+		}
 	}
 
-	// extract all the Terraform binaries/config into a temp directory
-	extractedAssets, err := assets.ExtractSubstrateAssets()
+	// switch to a new overlay directory, keeping the recorded hash if it's the
+	// same one so we can still warn if its contents have changed
+	if params.Overlay != "" {
+		overlay, err := newZoneOverlay(params.Overlay)
+		if err != nil {
+			return err
+		}
+		if zoneManifest.Overlay == nil || zoneManifest.Overlay.Path != overlay.Path {
+			fmt.Printf("using Terraform overlay %s\n", overlay.Path)
+			zoneManifest.Overlay = overlay
+		}
+	}
+	if zoneManifest.Overlay != nil {
+		if _, err := os.Stat(zoneManifest.Overlay.Path); err != nil {
+			return fmt.Errorf("can't read the zone's Terraform overlay (use --overlay if it has moved): %v", err)
+		}
+	}
+
+	// switch to a new spec, or else reapply the one we have
+	if params.Spec != "" {
+		oldSpec := zoneManifest.ZoneSpec()
+		zoneManifest.Spec, err = ReadZoneSpec(params.Spec)
+		if err != nil {
+			return err
+		}
+		err = oldSpec.checkChange(zoneManifest.Spec)
+		if err != nil {
+			return fmt.Errorf("invalid zone spec %s: %v", params.Spec, err)
+		}
+		fmt.Printf("using zone spec %s\n", params.Spec)
+	}
+	err = zoneManifest.checkZoneSpec()
 	if err != nil {
-		return nil
+		return fmt.Errorf("the zone spec in the manifest is invalid (use --spec to replace it): %v", err)
+	}
+
+	var rolling *rollingUpdate
+	if params.Rolling {
+		if params.RollingBatchSize < 1 {
+			return fmt.Errorf("the rolling update batch size must be at least 1")
+		}
+		if params.RollingTimeout <= 0 {
+			return fmt.Errorf("the rolling update timeout must be more than 0")
+		}
+		rolling = &rollingUpdate{
+			BatchSize: params.RollingBatchSize,
+			Timeout:   params.RollingTimeout,
+			Prompt:    params.Prompt,
+		}
 	}
-	defer extractedAssets.Cleanup()
 
-	// extract the saved .tfstate from the manifest
-	stateJSON, err := json.MarshalIndent(zoneManifest.TerraformState, "", "    ")
+	return applyZoneChanges(store, zoneManifest, params.ManifestPath, params.Version, params.Prompt, "update", upgrade, rolling)
+}
+
+// checkUpdate explains whether (and how) `substrate zone update` would upgrade the zone in place
+func checkUpdate(params *UpdateInput) error {
+	zoneManifest, err := ReadManifest(params.ManifestPath)
 	if err != nil {
 		return err
 	}
 
-	// write the .tfstate
-	statePath := extractedAssets.Path("substrate.tfstate")
-	err = ioutil.WriteFile(statePath, stateJSON, 0600)
+	fmt.Printf("zone %s was last updated by Substrate %s, this is Substrate %s\n", zoneManifest.ZoneName(), zoneManifest.Version, params.Version)
+	if zoneManifest.UpgradingTo != "" {
+		fmt.Printf("an upgrade to Substrate %s didn't finish, and will be run again from the start\n", zoneManifest.UpgradingTo)
+	}
+	upgrade, err := planUpgrade(zoneManifest.Version, params.Version)
 	if err != nil {
-		return err
+		return fmt.Errorf("%v. You need to destroy and recreate the zone (or bypass this check with `substrate zone update --unsafe`, without any upgrade steps)", err)
 	}
+	upgrade.Print(os.Stdout)
+	return nil
+}
 
-	// write the .tfvars file to pass parameters into Terraform
-	varsPath := extractedAssets.Path("substrate.tfvars")
-	err = ioutil.WriteFile(varsPath, []byte(zoneManifest.TFVars()), 0600)
+// applyZoneChanges plans and (once confirmed) applies the zone's current
+// settings with Terraform, saving the resulting state to the manifest. The
+// command is what the run is recorded as in the transcript and history. Any
+// Terraform state moves in the upgrade path (which may be nil) are run before
+// planning, and its checks once the changes are applied. If rolling isn't
+// nil, the workers being replaced are replaced a batch at a time first.
+func applyZoneChanges(store ManifestStore, zoneManifest *SubstrateZoneManifest, manifestPath string, version string, prompt bool, command string, upgrade *UpgradePath, rolling *rollingUpdate) (err error) {
+	// extract all the Terraform binaries/config into a temp directory, along with the saved .tfstate and the .tfvars
+	workspace, err := newTerraformWorkspace(zoneManifest, os.Stdout)
 	if err != nil {
-		return nil
+		return err
 	}
+	defer workspace.Cleanup()
+
+	// release the lock even if we're interrupted
+	workspace.assets.OnInterrupt(func() { store.Unlock() })
+
+	// keep a transcript of everything Terraform does, for debugging later
+	transcript := workspace.startTranscript(zoneManifest, manifestPath, version, command)
+	defer func() { transcript.Finish(err) }()
 
 	// print terraform version
-	err = Terraform(extractedAssets, "version")
+	_, err = workspace.Runner.Version()
 	if err != nil {
 		return err
 	}
 
 	// run `terraform get` to install all our modules
-	err = Terraform(extractedAssets, "get", "-no-color", "-update", "./zone")
+	_, err = workspace.Runner.Get()
 	if err != nil {
 		return err
 	}
 
+	// rename anything the upgrade steps move, so Terraform doesn't replace it
+	if upgrade != nil {
+		err = upgrade.moveState(workspace)
+		if err != nil {
+			return err
+		}
+	}
+
 	// run `terraform plan` to generate an execution plan (.tfplan file)
-	planPath := extractedAssets.Path("substrate.tfplan")
-	err = Terraform(
-		extractedAssets,
-		"plan",
-		"-no-color",
-		"-input=false",
-		"-state", statePath,
-		"-out", planPath,
-		"-var-file", varsPath,
-		"./zone")
+	_, err = workspace.Runner.Plan(workspace.TerraformPaths)
 	if err != nil {
 		return err
 	}
 
-	// make sure the plan is legit before continuing
-	if params.Prompt {
-		err = util.Confirm("do you want to continue and apply this plan?")
+	// work out which workers to replace a batch at a time
+	if rolling != nil {
+		err = rolling.plan(workspace, zoneManifest, store)
 		if err != nil {
 			return err
 		}
 	}
 
-	// start watching logs and dumping them out in a goroutine
-	log := logwatcher.Start(
-		cloudwatchlogs.New(
-			session.New(),
-			&aws.Config{Region: aws.String(zoneManifest.AWSRegion())}),
-		zoneManifest.CloudWatchLogsGroupSystemLogs(),
-	)
-	// stream the log events to stdout in a background thread
-	go func() {
-		for event := range log.Events() {
-			// only output our AMI provisioning events at INFO or higher
-			if event.Record.Syslog.Identifier == "substrate-base-ami-provision" {
-				if event.Record.Priority != "DEBUG" {
-					fmt.Printf("base-ami-provision > %s\n", event.Record.Message)
-				}
-			}
-		}
-	}()
-	// close the logwatcher before we return, outputting any errors we hit
-	defer func() {
-		err := log.Stop()
+	// make sure the plan is legit before continuing
+	if prompt {
+		err = util.Confirm("do you want to continue and apply this plan?")
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error watching logs: %v\n", err)
+			return err
 		}
-	}()
+	}
 
-	// pass the plan into `terraform apply` to create all the zone resources and dump out the resulting .tfstate file
-	terraformApplyErr := Terraform(
-		extractedAssets,
-		"apply",
-		"-no-color",
-		"-refresh=false",
-		"-input=false",
-		"-state", statePath,
-		planPath)
+	// start watching logs and dumping them out in a goroutine, closing the
+	// logwatcher before we return
+	stopLogs := startProvisioningLogs(zoneManifest)
+	defer stopLogs()
+
+	// save the .tfstate as Terraform goes, so an interrupted run doesn't orphan anything
+	checkpoints := startStateCheckpoints(store, zoneManifest, workspace.assets, workspace.StatePath, version, command)
+
+	// replace the workers first if we're rolling, then pass the plan into
+	// `terraform apply` to create all the zone resources and dump out the resulting .tfstate file
+	var terraformApplyErr error
+	if rolling != nil {
+		terraformApplyErr = rolling.replaceWorkers(workspace)
+	}
+	if terraformApplyErr == nil {
+		_, terraformApplyErr = workspace.Runner.Apply(workspace.TerraformPaths, 0)
+	}
+	err = checkpoints.Stop()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error saving Terraform state checkpoint: %v\n", err)
+	}
 
 	// keep going and save the .tfstate even if `terraform apply` failed, so we don't orphan anything
 	// if anything goes wrong past this point, bail out with a prompt to the user but don't clean up the
 	// temp directory yet
 	bail := func(err error, msg string) error {
-		if params.Prompt {
-			fmt.Printf("%s: %v\n\nTemporary directory (may hold clues): %s\n", msg, err, extractedAssets.Path(""))
+		if prompt {
+			fmt.Printf("%s: %v\n\nTemporary directory (may hold clues): %s\n", msg, err, workspace.Path(""))
 			util.Confirm("I'll leave the temp directory around so you can clean up. Ready to delete it?")
 		}
 		return err
 	}
 
-	// read the .tfstate file that `terraform apply` should have generated
-	updatedStateJSON, err := ioutil.ReadFile(statePath)
+	// read the .tfstate file that `terraform apply` should have generated back into the manifest
+	err = workspace.ReadState(zoneManifest)
 	if err != nil {
 		return bail(err, "error reading .tfstate")
 	}
 
-	// parse it into the manifest
-	err = json.Unmarshal(updatedStateJSON, &zoneManifest.TerraformState)
+	err = backupManifest(store)
 	if err != nil {
-		return bail(err, "error parsing .tfstate")
+		return bail(err, "saving backup zone manifest")
 	}
 
-	// render the output manifest to (indented) JSON
-	updatedZoneManifestJSON, err := json.MarshalIndent(zoneManifest, "", "    ")
+	err = WriteManifestTo(store, zoneManifest)
 	if err != nil {
-		return bail(err, "error encoding zone manifest")
+		return bail(err, "saving updated zone manifest")
 	}
 
-	err = os.Rename(params.ManifestPath, params.ManifestPath+".bak")
+	err = recordManifestSnapshot(store, zoneManifest, version, command, terraformApplyErr)
 	if err != nil {
-		return bail(err, "saving backup zone manifest")
+		return bail(err, "saving manifest snapshot")
 	}
 
-	err = ioutil.WriteFile(params.ManifestPath, updatedZoneManifestJSON, 0600)
+	// the state is safely in the manifest now, so we don't need the checkpoint
+	err = checkpoints.Clear()
 	if err != nil {
-		return bail(err, "saving updated zone manifest")
+		return bail(err, "removing Terraform state checkpoint")
 	}
 
+	if terraformApplyErr == nil && upgrade != nil {
+		err = upgrade.finish(zoneManifest)
+		if err != nil {
+			return err
+		}
+		return finishUpgrade(store, zoneManifest)
+	}
 	return terraformApplyErr
 }
+
+// finishUpgrade records that the zone is now on the version it was being
+// upgraded to (if it was being upgraded), once the upgrade has been applied
+// and its checks have passed
+func finishUpgrade(store ManifestStore, zoneManifest *SubstrateZoneManifest) error {
+	if zoneManifest.UpgradingTo == "" {
+		return nil
+	}
+	fmt.Printf("upgraded zone %s from Substrate %s to %s\n", zoneManifest.ZoneName(), zoneManifest.Version, zoneManifest.UpgradingTo)
+	zoneManifest.Version = zoneManifest.UpgradingTo
+	zoneManifest.UpgradingTo = ""
+	return WriteManifestTo(store, zoneManifest)
+}
@@ -0,0 +1,173 @@
+package zone
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		applyErr error
+
+		wantErr       string
+		wantSnapshots []string
+	}{
+		{
+			name:          "apply succeeds",
+			wantSnapshots: []string{"create", "update"},
+		},
+		{
+			// the state is saved even though the apply failed, so nothing is orphaned
+			name:          "apply fails",
+			applyErr:      errors.New("aws_instance.border: timeout"),
+			wantErr:       "aws_instance.border: timeout",
+			wantSnapshots: []string{"create", "update: aws_instance.border: timeout"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, stop := startFakeZone(t)
+			defer stop()
+			f.create(t)
+			created, err := f.store(t).Read("")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// this time Terraform changes some things (the serial is bumped on every change)
+			updatedState := readTestState(t, "refreshed-drifted.tfstate")
+			f.runner.State = updatedState
+			f.runner.Errors = map[string]error{"apply": test.applyErr}
+
+			err = Update(&UpdateInput{Version: "v1.0.1", ManifestPath: f.manifestPath})
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("expected an error containing %q, got %v", test.wantErr, err)
+			}
+			wantCalls := []string{"version", "get", "plan", "apply"}
+			if !reflect.DeepEqual(f.runner.Calls, wantCalls) {
+				t.Errorf("expected Terraform calls %v, got %v", wantCalls, f.runner.Calls)
+			}
+			if !reflect.DeepEqual(f.snapshots(t), test.wantSnapshots) {
+				t.Errorf("expected history %v, got %v", test.wantSnapshots, f.snapshots(t))
+			}
+			if f.exists(t, manifestCheckpointSuffix) {
+				t.Errorf("the state checkpoint was left behind")
+			}
+
+			// the manifest has the new state, and the backup is the manifest from before
+			zoneManifest, err := ReadManifest(f.manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(zoneManifest.TerraformState, updatedState) {
+				t.Errorf("the applied state wasn't saved to the manifest")
+			}
+			backup, err := f.store(t).Read(".bak")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(backup) != string(created) {
+				t.Errorf("expected the backup to be the manifest from before the update")
+			}
+		})
+	}
+}
+
+func TestUpdateUpgrade(t *testing.T) {
+	tests := []struct {
+		name     string
+		applyErr error
+		checkErr error
+
+		wantErr         string
+		wantVersion     string
+		wantUpgradingTo string
+	}{
+		{
+			name:        "upgrade succeeds",
+			wantVersion: "v1.1.0",
+		},
+		{
+			// the upgrade is retried from the start by the next update
+			name:            "apply fails",
+			applyErr:        errors.New("aws_instance.border: timeout"),
+			wantErr:         "aws_instance.border: timeout",
+			wantVersion:     "v1.0.1",
+			wantUpgradingTo: "v1.1.0",
+		},
+		{
+			name:            "check after the upgrade fails",
+			checkErr:        errors.New("the nodes aren't ready"),
+			wantErr:         "the nodes aren't ready",
+			wantVersion:     "v1.0.1",
+			wantUpgradingTo: "v1.1.0",
+		},
+	}
+	defer func(previous []UpgradeStep) { upgradeSteps = previous }(upgradeSteps)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, stop := startFakeZone(t)
+			defer stop()
+			f.create(t)
+
+			checkErr := test.checkErr
+			upgradeSteps = nil
+			RegisterUpgradeStep(UpgradeStep{
+				Version:     "v1.1.0",
+				Description: "check the zone after upgrading",
+				After:       func(*SubstrateZoneManifest) error { return checkErr },
+			})
+			f.runner.Errors = map[string]error{"apply": test.applyErr}
+
+			err := Update(&UpdateInput{Version: "v1.1.0", ManifestPath: f.manifestPath})
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("expected an error containing %q, got %v", test.wantErr, err)
+			}
+			zoneManifest, err := ReadManifest(f.manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if zoneManifest.Version != test.wantVersion || zoneManifest.UpgradingTo != test.wantUpgradingTo {
+				t.Fatalf(
+					"expected version %q (upgrading to %q), got %q (upgrading to %q)",
+					test.wantVersion,
+					test.wantUpgradingTo,
+					zoneManifest.Version,
+					zoneManifest.UpgradingTo)
+			}
+			if test.wantUpgradingTo == "" {
+				return
+			}
+
+			// nothing else can change the zone until the upgrade is finished
+			err = checkNoUpgradeSteps(zoneManifest, "v1.1.0", "apply")
+			if err == nil || !strings.Contains(err.Error(), "unfinished upgrade") {
+				t.Errorf("expected an unfinished upgrade to block other commands, got %v", err)
+			}
+
+			// and running the update again finishes it
+			checkErr = nil
+			f.runner.Errors = nil
+			err = Update(&UpdateInput{Version: "v1.1.0", ManifestPath: f.manifestPath})
+			if err != nil {
+				t.Fatalf("error retrying the upgrade: %v", err)
+			}
+			zoneManifest, err = ReadManifest(f.manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if zoneManifest.Version != "v1.1.0" || zoneManifest.UpgradingTo != "" {
+				t.Errorf("expected the retried upgrade to finish, got version %q (upgrading to %q)", zoneManifest.Version, zoneManifest.UpgradingTo)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// substrateVersion is a parsed Substrate version number, e.g. "v1.0.2" or
+// "v1.0.2-snapshot" (the Makefile appends "-snapshot" to builds that aren't
+// from the release tag, before the release is cut)
+type substrateVersion struct {
+	Major int
+	Minor int
+	Patch int
+
+	// PreRelease is the part after the "-" (e.g., "snapshot"), if any
+	PreRelease string
+}
+
+var substrateVersionPattern = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)(?:-([0-9A-Za-z.-]+))?$`)
+
+// parseSubstrateVersion parses a semantic version number, with or without the leading "v"
+func parseSubstrateVersion(version string) (*substrateVersion, error) {
+	match := substrateVersionPattern.FindStringSubmatch(version)
+	if match == nil {
+		return nil, fmt.Errorf("%q is not a semantic version number", version)
+	}
+	result := &substrateVersion{PreRelease: match[4]}
+	for i, field := range []*int{&result.Major, &result.Minor, &result.Patch} {
+		number, err := strconv.Atoi(match[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a semantic version number: %v", version, err)
+		}
+		*field = number
+	}
+	return result, nil
+}
+
+// compareRelease compares the release v and other are (or are building
+// towards), ignoring any pre-release part, returning -1, 0 or 1
+func (v *substrateVersion) compareRelease(other *substrateVersion) int {
+	for _, pair := range [][2]int{
+		{v.Major, other.Major},
+		{v.Minor, other.Minor},
+		{v.Patch, other.Patch},
+	} {
+		switch {
+		case pair[0] < pair[1]:
+			return -1
+		case pair[0] > pair[1]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// TerraformStateMove is a `terraform state mv` from one resource (or module) address to another
+type TerraformStateMove struct {
+	From string
+	To   string
+}
+
+// UpgradeStep is something that has to happen to a zone when it's updated in
+// place to (or past) a particular Substrate release
+type UpgradeStep struct {
+	// Version is the release that introduced the step (e.g., "v1.1.0")
+	Version string
+
+	// Description is a short summary of what the step does
+	Description string
+
+	// Before checks that the zone can be upgraded, before anything is changed (optional)
+	Before func(zoneManifest *SubstrateZoneManifest) error
+
+	// Migrate modifies the manifest before the new Terraform config is planned (optional)
+	Migrate func(zoneManifest *SubstrateZoneManifest) error
+
+	// StateMoves rename resources in the Terraform state before it's planned,
+	// so Terraform doesn't replace resources whose names changed
+	StateMoves []TerraformStateMove
+
+	// After checks the zone once the upgrade has been applied (optional)
+	After func(zoneManifest *SubstrateZoneManifest) error
+}
+
+// upgradeSteps are the registered upgrade steps, in release order. They're run
+// in that order for every release after the zone's and up to this one.
+var upgradeSteps = []UpgradeStep{}
+
+// RegisterUpgradeStep adds an upgrade step, after any others for the same or earlier releases
+func RegisterUpgradeStep(step UpgradeStep) {
+	version, err := parseSubstrateVersion(step.Version)
+	if err != nil {
+		panic(fmt.Sprintf("invalid upgrade step %q: %v", step.Description, err))
+	}
+	i := len(upgradeSteps)
+	for i > 0 {
+		previous, _ := parseSubstrateVersion(upgradeSteps[i-1].Version)
+		if previous.compareRelease(version) <= 0 {
+			break
+		}
+		i--
+	}
+	upgradeSteps = append(upgradeSteps, UpgradeStep{})
+	copy(upgradeSteps[i+1:], upgradeSteps[i:])
+	upgradeSteps[i] = step
+}
+
+// kinds of in-place upgrade
+const (
+	upgradeSameVersion = "same version"
+	upgradePatch       = "patch upgrade"
+	upgradeMinor       = "minor upgrade"
+	upgradePreRelease  = "pre-release build of the same release"
+)
+
+// UpgradePath describes how a zone gets from one Substrate version to another
+type UpgradePath struct {
+	From string
+	To   string
+
+	// Kind is the kind of upgrade, e.g. "patch upgrade"
+	Kind string
+
+	// Steps are the upgrade steps to run, in order
+	Steps []UpgradeStep
+}
+
+// planUpgrade works out the in-place upgrade path between two Substrate
+// versions, or returns an error describing why there isn't one. Patch and
+// minor upgrades are allowed; major upgrades and downgrades aren't.
+//
+// A pre-release (snapshot) build counts as the release it's building towards,
+// so upgrade steps for a release have already run on zones updated by its
+// snapshot builds. Snapshot builds of the same release can't be ordered, so
+// switching between them (or to and from the release) is allowed either way.
+func planUpgrade(old string, new string) (*UpgradePath, error) {
+	result := &UpgradePath{From: old, To: new, Kind: upgradeSameVersion, Steps: []UpgradeStep{}}
+	if old == new {
+		return result, nil
+	}
+
+	oldVersion, err := parseSubstrateVersion(old)
+	if err != nil {
+		return nil, fmt.Errorf("in-place upgrade from Substrate %s to %s is not supported (%v)", old, new, err)
+	}
+	newVersion, err := parseSubstrateVersion(new)
+	if err != nil {
+		return nil, fmt.Errorf("in-place upgrade from Substrate %s to %s is not supported (%v)", old, new, err)
+	}
+
+	switch {
+	case oldVersion.Major != newVersion.Major:
+		return nil, fmt.Errorf("in-place upgrade from Substrate %s to %s is not supported (the major version is different)", old, new)
+	case oldVersion.compareRelease(newVersion) > 0:
+		return nil, fmt.Errorf("in-place downgrade from Substrate %s to %s is not supported", old, new)
+	case oldVersion.compareRelease(newVersion) == 0:
+		result.Kind = upgradePreRelease
+		if oldVersion.PreRelease == newVersion.PreRelease {
+			result.Kind = upgradeSameVersion
+		}
+		return result, nil
+	case oldVersion.Minor != newVersion.Minor:
+		result.Kind = upgradeMinor
+	default:
+		result.Kind = upgradePatch
+	}
+
+	for _, step := range upgradeSteps {
+		stepVersion, err := parseSubstrateVersion(step.Version)
+		if err != nil {
+			return nil, err
+		}
+		if oldVersion.compareRelease(stepVersion) < 0 && stepVersion.compareRelease(newVersion) <= 0 {
+			result.Steps = append(result.Steps, step)
+		}
+	}
+	return result, nil
+}
+
+// IsCompatibleUpgrade takes an old version number and a current version number
+// and returns nil if an in-place upgrade is possible, or else an error describing why not
+func IsCompatibleUpgrade(old string, new string) error {
+	_, err := planUpgrade(old, new)
+	return err
+}
+
+// Print describes the upgrade path and its steps
+func (p *UpgradePath) Print(out io.Writer) {
+	fmt.Fprintf(out, "the zone can be updated in place from Substrate %s to %s (%s)\n", p.From, p.To, p.Kind)
+	if len(p.Steps) == 0 {
+		fmt.Fprintf(out, "no upgrade steps to run\n")
+		return
+	}
+	fmt.Fprintf(out, "upgrade steps to run:\n")
+	for _, step := range p.Steps {
+		fmt.Fprintf(out, " - %s: %s\n", step.Version, step.Description)
+		for _, move := range step.StateMoves {
+			fmt.Fprintf(out, "     terraform state mv %s %s\n", move.From, move.To)
+		}
+	}
+}
+
+// checkNoUpgradeSteps returns an error if the zone needs upgrade steps run
+// (by `substrate zone update`) before the given command can apply this version's config
+func checkNoUpgradeSteps(zoneManifest *SubstrateZoneManifest, version string, command string) error {
+	if zoneManifest.UpgradingTo != "" {
+		return fmt.Errorf(
+			"zone %s has an unfinished upgrade from Substrate %s to %s, run `substrate zone update` again before `substrate zone %s`",
+			zoneManifest.ZoneName(),
+			zoneManifest.Version,
+			zoneManifest.UpgradingTo,
+			command)
+	}
+	upgrade, err := planUpgrade(zoneManifest.Version, version)
+	if err != nil {
+		return fmt.Errorf("%v, so `substrate zone %s` can't be run with this version", err, command)
+	}
+	if len(upgrade.Steps) > 0 {
+		return fmt.Errorf(
+			"zone %s needs %d upgrade step(s) to go from Substrate %s to %s, run `substrate zone update` before `substrate zone %s`",
+			zoneManifest.ZoneName(),
+			len(upgrade.Steps),
+			zoneManifest.Version,
+			version,
+			command)
+	}
+	return nil
+}
+
+// prepare runs each step's checks and manifest changes, before any of the zone's resources are touched
+func (p *UpgradePath) prepare(zoneManifest *SubstrateZoneManifest) error {
+	for _, step := range p.Steps {
+		if step.Before != nil {
+			err := step.Before(zoneManifest)
+			if err != nil {
+				return fmt.Errorf("upgrade step %s (%s) check failed: %v", step.Version, step.Description, err)
+			}
+		}
+	}
+	for _, step := range p.Steps {
+		if step.Migrate != nil {
+			fmt.Printf("upgrade step %s: %s\n", step.Version, step.Description)
+			err := step.Migrate(zoneManifest)
+			if err != nil {
+				return fmt.Errorf("upgrade step %s (%s) failed: %v", step.Version, step.Description, err)
+			}
+		}
+	}
+	return nil
+}
+
+// moveState runs each step's `terraform state mv` operations in the
+// workspace. Moves that have already happened (e.g., in an earlier run that
+// was interrupted) are skipped.
+func (p *UpgradePath) moveState(workspace *terraformWorkspace) error {
+	for _, step := range p.Steps {
+		for _, move := range step.StateMoves {
+			stateJSON, err := ioutil.ReadFile(workspace.StatePath)
+			if err != nil {
+				return err
+			}
+			var tfState interface{}
+			err = json.Unmarshal(stateJSON, &tfState)
+			if err != nil {
+				return err
+			}
+			resources, err := terraformStateResources(tfState)
+			if err != nil {
+				return err
+			}
+			if !hasStateAddress(resources, move.From) && hasStateAddress(resources, move.To) {
+				fmt.Printf("upgrade step %s: %s has already been moved to %s\n", step.Version, move.From, move.To)
+				continue
+			}
+			_, err = workspace.Runner.StateMove(workspace.TerraformPaths, move.From, move.To)
+			if err != nil {
+				return fmt.Errorf("upgrade step %s (%s) failed to move %s to %s: %v", step.Version, step.Description, move.From, move.To, err)
+			}
+		}
+	}
+	return nil
+}
+
+// hasStateAddress returns whether there's anything in the state at an
+// address, which may be a resource (with or without a count index) or module
+func hasStateAddress(resources map[string]*terraformStateResource, address string) bool {
+	for resourceAddress := range resources {
+		if resourceAddress == address || strings.HasPrefix(resourceAddress, address+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// finish runs each step's checks once the upgrade has been applied
+func (p *UpgradePath) finish(zoneManifest *SubstrateZoneManifest) error {
+	for _, step := range p.Steps {
+		if step.After != nil {
+			err := step.After(zoneManifest)
+			if err != nil {
+				return fmt.Errorf("upgrade step %s (%s) check failed after the upgrade: %v", step.Version, step.Description, err)
+			}
+		}
+	}
+	return nil
+}
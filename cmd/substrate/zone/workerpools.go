@@ -0,0 +1,96 @@
+package zone
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// workerPoolsFile is where the worker pools are rendered to in the workspace
+// (Terraform can't loop over modules, so each pool gets its own block)
+const workerPoolsFile = "zone/worker_pools.tf"
+
+// workerPoolsTemplateFile is the template worker_pools.tf is rendered from,
+// which is embedded (and signed) with the rest of the zone config
+const workerPoolsTemplateFile = "zone/worker_pools.tf.tmpl"
+
+// renderedWorkerPool is a worker pool plus the names it's rendered with
+type renderedWorkerPool struct {
+	ZoneSpecWorkerPool
+
+	// ResourceName names the pool's module and resources
+	ResourceName string
+
+	// OutputPrefix starts the names of the pool's Terraform outputs
+	OutputPrefix string
+
+	// ExtraUserData is a quoted HCL string of extra fields for the
+	// "substrate" section of the pool's EC2 user data
+	ExtraUserData string
+}
+
+// workerPoolOutputPrefix is the prefix of a worker pool's Terraform outputs
+// (e.g., "worker" for "worker_public_ips")
+func workerPoolOutputPrefix(name string) string {
+	return strings.Replace(name, "-", "_", -1)
+}
+
+// renderWorkerPoolsTF renders the zone's worker pools into Terraform config,
+// using the template extracted into dir
+func renderWorkerPoolsTF(dir string, spec *ZoneSpec) (string, error) {
+	pools := []renderedWorkerPool{}
+	for _, pool := range spec.WorkerPools {
+		resourceName := "workers"
+		if pool.Name != defaultWorkerPoolName {
+			resourceName = "workers_" + workerPoolOutputPrefix(pool.Name)
+		}
+		extraUserData, err := workerPoolExtraUserData(pool)
+		if err != nil {
+			return "", err
+		}
+		pools = append(pools, renderedWorkerPool{
+			ZoneSpecWorkerPool: pool,
+			ResourceName:       resourceName,
+			OutputPrefix:       workerPoolOutputPrefix(pool.Name),
+			ExtraUserData:      strconv.Quote(extraUserData),
+		})
+	}
+
+	return renderZoneTemplate(dir, workerPoolsTemplateFile, pools)
+}
+
+// workerPoolExtraUserData renders the JSON fields (with a leading comma) that
+// tell a worker which pool it's in and how to register with Kubernetes, read
+// by substrate-node-env.sh. It's empty for a default pool without labels or
+// taints, so its user data (and so its instances) stay the same as before.
+func workerPoolExtraUserData(pool ZoneSpecWorkerPool) (string, error) {
+	if pool.Name == defaultWorkerPoolName && len(pool.Labels) == 0 && len(pool.Taints) == 0 {
+		return "", nil
+	}
+
+	labels := []string{}
+	for key, value := range pool.Labels {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+
+	var result bytes.Buffer
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"pool", pool.Name},
+		{"node_labels", strings.Join(labels, ",")},
+		{"node_taints", strings.Join(pool.Taints, ",")},
+	} {
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&result, ",\n        %q: %s", field.name, value)
+	}
+	return result.String(), nil
+}
@@ -1,10 +1,20 @@
 #!/bin/bash
 # this needs to be run before kubeadm
 
+# add the worker pool's own labels and taints from the zone spec (if any)
+LABELS="substrate.zone/role=${ROLE},substrate.zone/pool=${POOL:-$ROLE},substrate.zone/version=${SUBSTRATE_VERSION},substrate.zone/zone=${SUBSTRATE_ZONE},substrate.zone/environment=${SUBSTRATE_ENVIRONMENT}"
+if [ -n "${NODE_LABELS}" ]; then
+  LABELS="${LABELS},${NODE_LABELS}"
+fi
+TAINTS=""
+if [ -n "${NODE_TAINTS}" ]; then
+  TAINTS=" --register-with-taints=${NODE_TAINTS}"
+fi
+
 mkdir -p /etc/systemd/system/kubelet.service.d
 cat >/etc/systemd/system/kubelet.service.d/11-node-labels.conf <<EOF
 [Service]
-Environment="KUBELET_EXTRA_ARGS=--v=2 --node-labels=\"substrate.zone/role=${ROLE},substrate.zone/version=${SUBSTRATE_VERSION},substrate.zone/zone=${SUBSTRATE_ZONE},substrate.zone/environment=${SUBSTRATE_ENVIRONMENT}\""
+Environment="KUBELET_EXTRA_ARGS=--v=2 --node-labels=\"${LABELS}\"${TAINTS}"
 EOF
 
 systemctl daemon-reload
@@ -13,6 +13,12 @@ ROLE=$(ec2metadata --user-data | jq -r .substrate.role)
 DIRECTOR=$(ec2metadata --user-data | jq -r .substrate.director)
 BORDER=$(ec2metadata --user-data | jq -r .substrate.border)
 
+# workers also get their pool and any extra Kubernetes node labels/taints
+# (the default "worker" pool doesn't set these)
+POOL=$(ec2metadata --user-data | jq -r '.substrate.pool // .substrate.role')
+NODE_LABELS=$(ec2metadata --user-data | jq -r '.substrate.node_labels // ""')
+NODE_TAINTS=$(ec2metadata --user-data | jq -r '.substrate.node_taints // ""')
+
 # choose the fully qualified domain name for this node
 FQDN="$INSTANCE_ID.$ROLE.zone.local"
 
@@ -31,4 +37,7 @@ INTERNAL_IP=$INTERNAL_IP
 DEFAULT_IPV4=$INTERNAL_IP
 PUBLIC_IP=$PUBLIC_IP
 BORDER=$BORDER
+POOL=$POOL
+NODE_LABELS=$NODE_LABELS
+NODE_TAINTS=$NODE_TAINTS
 EOF
@@ -34,6 +34,10 @@ variable "calico_etcd_port" {}
 
 variable "cloudwatch_logs_group_arn" {}
 
+variable "ssh_ingress_cidrs" {
+  type = "list"
+}
+
 resource "aws_security_group" "border" {
   name_prefix = "${var.zone_prefix}-${var.border_name}-security-group-"
   vpc_id      = "${var.vpc_id}"
@@ -84,16 +88,12 @@ resource "aws_security_group" "border" {
     cidr_blocks = ["0.0.0.0/0"]
   }
 
-  # Allow SSH ingress from known admin IPs
+  # Allow SSH ingress from known admin IPs (`ingress.ssh` in the zone spec)
   ingress {
-    from_port = 22
-    to_port   = 22
-    protocol  = "tcp"
-
-    cidr_blocks = [
-      # TODO: this was ported from a version that hardcoded some internal Simple ranges
-      "0.0.0.0/0",
-    ]
+    from_port   = 22
+    to_port     = 22
+    protocol    = "tcp"
+    cidr_blocks = ["${var.ssh_ingress_cidrs}"]
   }
 
   # Allow ingress from the rest of the environment
@@ -274,6 +274,12 @@ resource "aws_instance" "border" {
   }
 }
 EOF
+
+  # the admin SSH key is rotated on running instances by `substrate zone
+  # rotate-ssh-key`, so replacing the key pair shouldn't replace them
+  lifecycle {
+    ignore_changes = ["key_name"]
+  }
 }
 
 resource "aws_eip" "border" {
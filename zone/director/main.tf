@@ -30,6 +30,11 @@ variable "default_calico_pool" {}
 
 variable "border_internal_ip" {}
 
+# all the borders, which can SSH to the director
+variable "border_cidrs" {
+  type = "list"
+}
+
 variable "etcd_internal_port" {
   default     = "2380"
   description = "TCP port used for peer to peer etcd communication"
@@ -60,12 +65,12 @@ resource "aws_security_group" "director" {
     cidr_blocks = ["${var.substrate_zone_subnet}"]
   }
 
-  # ssh to border
+  # ssh from the borders
   ingress {
     from_port   = "22"
     to_port     = "22"
     protocol    = "tcp"
-    cidr_blocks = ["${var.border_internal_ip}/32"]
+    cidr_blocks = ["${var.border_cidrs}"]
   }
 
   # k8s discovery port
@@ -204,6 +209,11 @@ resource "aws_instance" "director" {
     }
 }
 EOF
+
+  # SSH keys are rotated in place (see the border instance)
+  lifecycle {
+    ignore_changes = ["key_name"]
+  }
 }
 
 output "internal_ip" {
@@ -16,7 +16,7 @@ resource "aws_vpc" "main" {
 # create some DHCP settings for everything spun up in the VPC
 resource "aws_vpc_dhcp_options" "main" {
   domain_name         = "zone.local"
-  domain_name_servers = ["${module.border-0.internal_ip}"]
+  domain_name_servers = ["${var.border_internal_ips}"]
 
   tags {
     "substrate:environment" = "${var.substrate_environment}"
@@ -72,10 +72,11 @@ resource "aws_main_route_table_association" "main" {
   route_table_id = "${aws_route_table.main.id}"
 }
 
-# create a single large subnet that takes up the entire VPC
+# create the subnet in the zone's own AZ, which takes up the entire VPC unless
+# the zone spans several AZs (the others are in control_plane.tf)
 resource "aws_subnet" "main" {
   vpc_id                  = "${aws_vpc.main.id}"
-  cidr_block              = "${aws_vpc.main.cidr_block}"
+  cidr_block              = "${var.main_subnet_cidr}"
   availability_zone       = "${var.aws_availability_zone}"
   map_public_ip_on_launch = false
 
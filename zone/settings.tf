@@ -42,6 +42,15 @@ variable "aws_availability_zone" {
   description = "AWS availability zone in which resources will be created"
 }
 
+variable "main_subnet_cidr" {
+  description = "the part of the zone subnet in aws_availability_zone"
+}
+
+variable "border_internal_ips" {
+  description = "the internal IPs of the zone's borders (its DNS servers)"
+  type        = "list"
+}
+
 # aws_account_id is a sanity check to make sure we're running in the AWS account we expect
 # (other AWS settings, e.g., AWS_ACCESS_KEY_ID, are read from env vars)
 variable "aws_account_id" {
@@ -72,11 +81,6 @@ variable "ssh_public_key" {
   description = "path to an SSH public key that will be given admin access (e.g., ~/.ssh/you.pub)"
 }
 
-variable "instance_type" {
-  description = "Type of worker instances to launch"
-  default     = "t2.medium"
-}
-
 variable "director_instance_type" {
   description = "Type of director instances to launch"
   default     = "t2.medium"
@@ -87,6 +91,18 @@ variable "border_instance_type" {
   default     = "t2.medium"
 }
 
+variable "border_ssh_ingress_cidrs" {
+  description = "CIDR blocks allowed to SSH to the border"
+  type        = "list"
+  default     = ["0.0.0.0/0"]
+}
+
+variable "worker_ingress_cidrs" {
+  description = "CIDR blocks allowed to reach the workers over HTTP and HTTPS"
+  type        = "list"
+  default     = ["0.0.0.0/0"]
+}
+
 variable "calico_etcd_port" {
   description = "Port for clients of calico etcd authority"
   default     = 4002
@@ -30,6 +30,12 @@ variable "default_calico_pool" {}
 
 variable "border_internal_ip" {}
 
+# extra fields for the "substrate" section of the user data (see
+# workerpools.go), e.g., the pool name and Kubernetes node labels/taints
+variable "extra_user_data" {
+  default = ""
+}
+
 resource "aws_security_group" "workers" {
   name_prefix = "${var.zone_prefix}-${var.worker_pool_name}-security-group-"
   vpc_id      = "${var.vpc_id}"
@@ -153,16 +159,18 @@ resource "aws_instance" "workers" {
   user_data = <<EOF
 {
     "substrate": {
-        "role": ${jsonencode(var.worker_pool_name)},
+        "role": "worker",
         "director": ${jsonencode(var.director_internal_ip)},
-        "border": ${jsonencode(var.border_internal_ip)}
+        "border": ${jsonencode(var.border_internal_ip)}${var.extra_user_data}
     }
 
 }
 EOF
 
+  # SSH keys are rotated in place (see the border instance)
   lifecycle {
     create_before_destroy = true
+    ignore_changes        = ["key_name"]
   }
 }
 
@@ -173,3 +181,7 @@ output "security_group_id" {
 output "public_ips" {
   value = ["${aws_instance.workers.*.public_ip}"]
 }
+
+output "private_ips" {
+  value = ["${aws_instance.workers.*.private_ip}"]
+}